@@ -0,0 +1,212 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/cmd/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var commandAudit = cli.Command{
+	Name:  "audit",
+	Usage: "Inspect the local audit log of signing and publishing actions",
+	Subcommands: []cli.Command{
+		{
+			Name:   "verify",
+			Usage:  "Verify the integrity of the audit log hash chain",
+			Flags:  []cli.Flag{auditLogFlag},
+			Action: utils.MigrateFlags(verifyAudit),
+		},
+	},
+}
+
+// auditEntry is a single record of the audit log. Every entry commits to the
+// hash of the previous one, so any modification of the log breaks the chain.
+type auditEntry struct {
+	Time       time.Time      `json:"time"`
+	Command    string         `json:"command"`
+	Index      uint64         `json:"index"`
+	Checkpoint common.Hash    `json:"checkpoint"`
+	Signer     common.Address `json:"signer"`
+	Signature  string         `json:"signature,omitempty"`
+	TxHash     string         `json:"tx,omitempty"`
+	RPC        string         `json:"rpc,omitempty"`
+	Outcome    string         `json:"outcome"`
+	Prev       common.Hash    `json:"prev"`
+	Hash       common.Hash    `json:"hash"`
+}
+
+// digest calculates the hash of the entry, covering every field but the hash.
+func (e auditEntry) digest() common.Hash {
+	e.Hash = common.Hash{}
+	blob, err := json.Marshal(e)
+	if err != nil {
+		panic(err) // can't happen, the entry only contains plain types
+	}
+	return crypto.Keccak256Hash(blob)
+}
+
+// auditLog is an append-only, hash chained log of the actions of the tool.
+type auditLog struct {
+	path string
+	last common.Hash // Hash of the last entry in the log
+}
+
+// openAuditLog opens the audit log at the given path, creating it if needed and
+// verifying the existing contents.
+func openAuditLog(path string) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	last, _, err := readAuditLog(path)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path, last: last}, nil
+}
+
+// append adds a new entry to the log, flushing it to disk before returning.
+func (l *auditLog) append(entry auditEntry) error {
+	entry.Time = time.Now().UTC()
+	entry.Prev = l.last
+	entry.Hash = entry.digest()
+
+	blob, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(blob, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	l.last = entry.Hash
+	return nil
+}
+
+// readAuditLog reads and verifies the entire audit log, returning the hash of
+// the last entry and the number of entries.
+func readAuditLog(path string) (common.Hash, int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return common.Hash{}, 0, nil
+	}
+	if err != nil {
+		return common.Hash{}, 0, err
+	}
+	defer f.Close()
+
+	var (
+		last    common.Hash
+		entries int
+		scanner = bufio.NewScanner(f)
+	)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return common.Hash{}, 0, fmt.Errorf("entry %d: %v", entries, err)
+		}
+		if entry.Prev != last {
+			return common.Hash{}, 0, fmt.Errorf("entry %d: chain broken, prev %x, want %x", entries, entry.Prev, last)
+		}
+		if hash := entry.digest(); entry.Hash != hash {
+			return common.Hash{}, 0, fmt.Errorf("entry %d: hash mismatch, have %x, want %x", entries, entry.Hash, hash)
+		}
+		last, entries = entry.Hash, entries+1
+	}
+	if err := scanner.Err(); err != nil {
+		return common.Hash{}, 0, err
+	}
+	return last, entries, nil
+}
+
+// newAuditLog opens the audit log configured on the command line, or returns
+// nil if auditing was disabled.
+func newAuditLog(ctx *cli.Context) *auditLog {
+	if ctx.Bool(noAuditFlag.Name) {
+		return nil
+	}
+	log, err := openAuditLog(expandHome(ctx.String(auditLogFlag.Name)))
+	if err != nil {
+		utils.Fatalf("Failed to open audit log: %v (use --%s to skip auditing)", err, noAuditFlag.Name)
+	}
+	return log
+}
+
+// record appends an entry into the audit log if auditing is enabled, aborting
+// the tool if the entry cannot be written.
+func (l *auditLog) record(entry auditEntry) {
+	if l == nil {
+		return
+	}
+	if err := l.append(entry); err != nil {
+		utils.Fatalf("Failed to write audit log: %v", err)
+	}
+}
+
+// attempt appends an attempt entry for an action about to be signed or sent into
+// the audit log if auditing is enabled, aborting the tool before the action if
+// the entry cannot be written. The outcome is recorded separately afterwards.
+func (l *auditLog) attempt(entry auditEntry) {
+	if l == nil {
+		return
+	}
+	entry.Outcome = "attempt"
+	if err := l.append(entry); err != nil {
+		utils.Fatalf("Failed to write audit log, refusing to %s: %v", entry.Command, err)
+	}
+}
+
+// verifyAudit checks the integrity of the audit log hash chain.
+func verifyAudit(ctx *cli.Context) error {
+	last, entries, err := readAuditLog(expandHome(ctx.String(auditLogFlag.Name)))
+	if err != nil {
+		utils.Fatalf("Audit log verification failed: %v", err)
+	}
+	fmt.Printf("Verified %d audit log entries, head %s\n", entries, last.Hex())
+	return nil
+}
+
+// expandHome replaces a leading tilde in the path with the user's home folder.
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
@@ -0,0 +1,240 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// newAuditContext creates a command line context with the audit flags set.
+func newAuditContext(path string, noAudit bool) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String(auditLogFlag.Name, path, "")
+	set.Bool(noAuditFlag.Name, noAudit, "")
+	return cli.NewContext(nil, set, nil)
+}
+
+// writeTestAuditLog creates an audit log with the given number of entries,
+// returning its path.
+func writeTestAuditLog(t *testing.T, dir string, entries int) string {
+	t.Helper()
+
+	path := filepath.Join(dir, "audit.log")
+	log, err := openAuditLog(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	for i := 0; i < entries; i++ {
+		entry := auditEntry{
+			Command:    "sign",
+			Index:      uint64(i),
+			Checkpoint: common.Hash{byte(i + 1)},
+			Outcome:    "signed",
+		}
+		if err := log.append(entry); err != nil {
+			t.Fatalf("Failed to append entry %d: %v", i, err)
+		}
+	}
+	return path
+}
+
+// Tests that the entries of the audit log form a hash chain which is verified
+// on reading, and continued across reopening the log.
+func TestAuditLogChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint-audit-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeTestAuditLog(t, dir, 3)
+	last, entries, err := readAuditLog(path)
+	if err != nil {
+		t.Fatalf("Failed to verify audit log: %v", err)
+	}
+	if entries != 3 {
+		t.Fatalf("Entry count mismatch: have %d, want %d", entries, 3)
+	}
+	// Reopen the log and extend it, the chain must continue from the old head
+	log, err := openAuditLog(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen audit log: %v", err)
+	}
+	if log.last != last {
+		t.Fatalf("Reopened head mismatch: have %x, want %x", log.last, last)
+	}
+	if err := log.append(auditEntry{Command: "publish", Index: 3, Outcome: "published"}); err != nil {
+		t.Fatalf("Failed to append entry: %v", err)
+	}
+	head, entries, err := readAuditLog(path)
+	if err != nil {
+		t.Fatalf("Failed to verify extended audit log: %v", err)
+	}
+	if entries != 4 || head != log.last {
+		t.Fatalf("Extended log mismatch: have %d entries, head %x, want %d, %x", entries, head, 4, log.last)
+	}
+	// A missing log is an empty one
+	if last, entries, err := readAuditLog(filepath.Join(dir, "missing.log")); err != nil || entries != 0 || last != (common.Hash{}) {
+		t.Fatalf("Missing log mismatch: have %x, %d, %v", last, entries, err)
+	}
+}
+
+// Tests that tampered, reordered or dropped entries are detected.
+func TestAuditLogTampering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint-audit-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	blob, err := ioutil.ReadFile(writeTestAuditLog(t, dir, 3))
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(blob, []byte{'\n'}), []byte{'\n'})
+
+	tests := []struct {
+		name  string
+		lines [][]byte
+		err   string
+	}{
+		{"modified", [][]byte{lines[0], bytes.Replace(lines[1], []byte(`"signed"`), []byte(`"failed"`), 1), lines[2]}, "entry 1: hash mismatch"},
+		{"reordered", [][]byte{lines[0], lines[2], lines[1]}, "entry 1: chain broken"},
+		{"dropped", [][]byte{lines[0], lines[2]}, "entry 1: chain broken"},
+		{"truncated head", [][]byte{lines[1], lines[2]}, "entry 0: chain broken"},
+		{"garbage", [][]byte{lines[0], []byte("not json")}, "entry 1:"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, strings.Replace(tt.name, " ", "-", -1)+".log")
+		if err := ioutil.WriteFile(path, append(bytes.Join(tt.lines, []byte{'\n'}), '\n'), 0600); err != nil {
+			t.Fatalf("%s: failed to write log: %v", tt.name, err)
+		}
+		if _, _, err := readAuditLog(path); err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("%s: verification error mismatch: have %v, want %q", tt.name, err, tt.err)
+		}
+		// Tampered logs must not be extended either
+		if _, err := openAuditLog(path); err == nil {
+			t.Errorf("%s: tampered log opened for appending", tt.name)
+		}
+	}
+}
+
+// Tests that the tool aborts if the audit log cannot be written, unless auditing
+// was explicitly disabled.
+func TestAuditLogUnwritable(t *testing.T) {
+	// Subprocess mode, open the audit log as the commands do and record into it
+	if path := os.Getenv("CHECKPOINT_ADMIN_AUDIT_TEST"); path != "" {
+		newAuditLog(newAuditContext(path, false)).record(auditEntry{Command: "sign", Outcome: "signed"})
+		os.Exit(0)
+	}
+	dir, err := ioutil.TempDir("", "checkpoint-audit-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Place the log below a regular file, so that it cannot be created even as root
+	blocker := filepath.Join(dir, "blocker")
+	if err := ioutil.WriteFile(blocker, nil, 0600); err != nil {
+		t.Fatalf("Failed to create blocker file: %v", err)
+	}
+	path := filepath.Join(blocker, "audit.log")
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAuditLogUnwritable$")
+	cmd.Env = append(os.Environ(), "CHECKPOINT_ADMIN_AUDIT_TEST="+path)
+	out, err := cmd.CombinedOutput()
+	if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 1 {
+		t.Fatalf("Command not aborted: err %v, output %s", err, out)
+	}
+	if !strings.Contains(string(out), "Failed to open audit log") {
+		t.Fatalf("Abort reason missing from output: %s", out)
+	}
+	// Disabling auditing must let the command proceed without a log
+	if log := newAuditLog(newAuditContext(path, true)); log != nil {
+		t.Fatalf("Audit log opened with auditing disabled")
+	}
+	var log *auditLog
+	log.record(auditEntry{Command: "sign", Outcome: "signed"})
+}
+
+// Tests that the tool aborts before the audited action if its attempt can't be
+// recorded, and that attempts are chained with their outcomes otherwise.
+func TestAuditLogAttempt(t *testing.T) {
+	// Subprocess mode, break the log after opening it and attempt an action
+	if path := os.Getenv("CHECKPOINT_ADMIN_ATTEMPT_TEST"); path != "" {
+		log := newAuditLog(newAuditContext(path, false))
+		if err := os.Remove(path); err != nil {
+			os.Exit(2)
+		}
+		if err := os.Mkdir(path, 0700); err != nil {
+			os.Exit(2)
+		}
+		log.attempt(auditEntry{Command: "sign"})
+		fmt.Println("action performed")
+		os.Exit(0)
+	}
+	dir, err := ioutil.TempDir("", "checkpoint-audit-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	broken := writeTestAuditLog(t, filepath.Join(dir, "broken"), 1)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAuditLogAttempt$")
+	cmd.Env = append(os.Environ(), "CHECKPOINT_ADMIN_ATTEMPT_TEST="+broken)
+	out, err := cmd.CombinedOutput()
+	if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 1 {
+		t.Fatalf("Command not aborted: err %v, output %s", err, out)
+	}
+	if strings.Contains(string(out), "action performed") {
+		t.Fatalf("Action performed without audit record: %s", out)
+	}
+	if !strings.Contains(string(out), "refusing to sign") {
+		t.Fatalf("Abort reason missing from output: %s", out)
+	}
+	// A working log should chain the attempt with the outcome
+	path := writeTestAuditLog(t, dir, 0)
+	log, err := openAuditLog(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	log.attempt(auditEntry{Command: "sign", Index: 1})
+	log.record(auditEntry{Command: "sign", Index: 1, Outcome: "signed"})
+
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(blob)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"outcome":"attempt"`) || !strings.Contains(lines[1], `"outcome":"signed"`) {
+		t.Fatalf("Audit entries mismatch: %v", lines)
+	}
+	if _, entries, err := readAuditLog(path); err != nil || entries != 2 {
+		t.Fatalf("Audit chain broken: %d entries, %v", entries, err)
+	}
+}
@@ -17,6 +17,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"strconv"
 
 	"github.com/ethereum/go-ethereum/accounts"
@@ -52,62 +54,93 @@ func newRPCClient(url string) *rpc.Client {
 // getContractAddr retrieves the register contract address through
 // rpc request.
 func getContractAddr(client *rpc.Client) common.Address {
+	addr, err := fetchContractAddr(client)
+	if err != nil {
+		utils.Fatalf("Failed to fetch checkpoint oracle address: %v", err)
+	}
+	return addr
+}
+
+// fetchContractAddr retrieves the register contract address through rpc request.
+func fetchContractAddr(client *rpc.Client) (common.Address, error) {
 	var addr string
 	if err := client.Call(&addr, "les_getCheckpointContractAddress"); err != nil {
-		utils.Fatalf("Failed to fetch checkpoint oracle address: %v", err)
+		return common.Address{}, err
 	}
-	return common.HexToAddress(addr)
+	return common.HexToAddress(addr), nil
 }
 
 // getCheckpoint retrieves the specified checkpoint or the latest one
 // through rpc request.
 func getCheckpoint(ctx *cli.Context, client *rpc.Client) *params.TrustedCheckpoint {
-	var checkpoint *params.TrustedCheckpoint
-
+	var index *uint64
 	if ctx.GlobalIsSet(indexFlag.Name) {
+		n := uint64(ctx.GlobalInt64(indexFlag.Name))
+		index = &n
+	}
+	checkpoint, err := fetchCheckpoint(client, index)
+	if err != nil {
+		utils.Fatalf("%v", err)
+	}
+	return checkpoint
+}
+
+// fetchCheckpoint retrieves the checkpoint with the given index, or the latest
+// one if no index is specified, through rpc request.
+func fetchCheckpoint(client *rpc.Client, index *uint64) (*params.TrustedCheckpoint, error) {
+	if index != nil {
 		var result [3]string
-		index := uint64(ctx.GlobalInt64(indexFlag.Name))
-		if err := client.Call(&result, "les_getCheckpoint", index); err != nil {
-			utils.Fatalf("Failed to get local checkpoint %v, please ensure the les API is exposed", err)
+		if err := client.Call(&result, "les_getCheckpoint", *index); err != nil {
+			return nil, fmt.Errorf("failed to get local checkpoint %v, please ensure the les API is exposed", err)
 		}
-		checkpoint = &params.TrustedCheckpoint{
-			SectionIndex: index,
+		return &params.TrustedCheckpoint{
+			SectionIndex: *index,
 			SectionHead:  common.HexToHash(result[0]),
 			CHTRoot:      common.HexToHash(result[1]),
 			BloomRoot:    common.HexToHash(result[2]),
-		}
-	} else {
-		var result [4]string
-		err := client.Call(&result, "les_latestCheckpoint")
-		if err != nil {
-			utils.Fatalf("Failed to get local checkpoint %v, please ensure the les API is exposed", err)
-		}
-		index, err := strconv.ParseUint(result[0], 0, 64)
-		if err != nil {
-			utils.Fatalf("Failed to parse checkpoint index %v", err)
-		}
-		checkpoint = &params.TrustedCheckpoint{
-			SectionIndex: index,
-			SectionHead:  common.HexToHash(result[1]),
-			CHTRoot:      common.HexToHash(result[2]),
-			BloomRoot:    common.HexToHash(result[3]),
-		}
+		}, nil
 	}
-	return checkpoint
+	var result [4]string
+	if err := client.Call(&result, "les_latestCheckpoint"); err != nil {
+		return nil, fmt.Errorf("failed to get local checkpoint %v, please ensure the les API is exposed", err)
+	}
+	n, err := strconv.ParseUint(result[0], 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint index %v", err)
+	}
+	return &params.TrustedCheckpoint{
+		SectionIndex: n,
+		SectionHead:  common.HexToHash(result[1]),
+		CHTRoot:      common.HexToHash(result[2]),
+		BloomRoot:    common.HexToHash(result[3]),
+	}, nil
 }
 
 // newContract creates a registrar contract instance with specified
 // contract address or the default contracts for mainnet or testnet.
 func newContract(client *rpc.Client) (common.Address, *checkpointoracle.CheckpointOracle) {
-	addr := getContractAddr(client)
+	addr, contract, err := bindContract(client)
+	if err != nil {
+		utils.Fatalf("%v", err)
+	}
+	return addr, contract
+}
+
+// bindContract creates a registrar contract instance with the contract address
+// reported by the connected node.
+func bindContract(client *rpc.Client) (common.Address, *checkpointoracle.CheckpointOracle, error) {
+	addr, err := fetchContractAddr(client)
+	if err != nil {
+		return common.Address{}, nil, fmt.Errorf("failed to fetch checkpoint oracle address: %v", err)
+	}
 	if addr == (common.Address{}) {
-		utils.Fatalf("No specified registrar contract address")
+		return common.Address{}, nil, errors.New("no specified registrar contract address")
 	}
 	contract, err := checkpointoracle.NewCheckpointOracle(addr, ethclient.NewClient(client))
 	if err != nil {
-		utils.Fatalf("Failed to setup registrar contract %s: %v", addr, err)
+		return common.Address{}, nil, fmt.Errorf("failed to setup registrar contract %s: %v", addr, err)
 	}
-	return addr, contract
+	return addr, contract, nil
 }
 
 // newClefSigner sets up a clef backend and returns a clef transaction signer.
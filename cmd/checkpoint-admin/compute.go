@@ -0,0 +1,399 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ethereum/go-ethereum/cmd/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/bitutil"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/bloombits"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/light"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var commandCompute = cli.Command{
+	Name:  "compute",
+	Usage: "Compute a checkpoint from the block headers served by any archive node",
+	Flags: []cli.Flag{
+		nodeURLFlag,
+		indexFlag,
+		computeDirFlag,
+		computeBatchFlag,
+	},
+	Action: utils.MigrateFlags(compute),
+}
+
+var (
+	// computeLastKey tracks the index of the last section computed.
+	computeLastKey = []byte("LastSection")
+
+	// computeSectionPrefix + section index (uint64 big endian) -> sectionRecord
+	computeSectionPrefix = []byte("section-")
+)
+
+// compute calculates the checkpoint of the specified section (the latest stable
+// one if not specified) without relying on the les API of the connected node.
+func compute(ctx *cli.Context) error {
+	checkpoint := computeCheckpoint(ctx, newRPCClient(ctx.GlobalString(nodeURLFlag.Name)))
+
+	fmt.Printf("Index      => %d\n", checkpoint.SectionIndex)
+	fmt.Printf("Head       => %s\n", checkpoint.SectionHead.Hex())
+	fmt.Printf("CHT root   => %s\n", checkpoint.CHTRoot.Hex())
+	fmt.Printf("Bloom root => %s\n", checkpoint.BloomRoot.Hex())
+	fmt.Printf("Checkpoint => %s\n", checkpoint.Hash().Hex())
+	return nil
+}
+
+// computeCheckpoint calculates the specified checkpoint, or the latest stable
+// one, from the headers served by the node, persisting the intermediate tries
+// so an interrupted computation can be resumed. If the node also exposes the
+// les API, the result is validated against the checkpoint of the node.
+func computeCheckpoint(ctx *cli.Context, client *rpc.Client) *params.TrustedCheckpoint {
+	genesis, err := fetchHeaders(client, 0, 1)
+	if err != nil {
+		utils.Fatalf("Failed to retrieve genesis block: %v", err)
+	}
+	var index uint64
+	if ctx.GlobalIsSet(indexFlag.Name) {
+		index = uint64(ctx.GlobalInt64(indexFlag.Name))
+	} else if index, err = latestStableSection(client, params.CheckpointFrequency); err != nil {
+		utils.Fatalf("%v", err)
+	}
+	dir := ctx.GlobalString(computeDirFlag.Name)
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "checkpoint-admin", genesis[0].Hash().Hex())
+	}
+	db, err := rawdb.NewLevelDBDatabase(dir, 16, 16, "")
+	if err != nil {
+		utils.Fatalf("Failed to open computation database: %v", err)
+	}
+	defer db.Close()
+
+	log.Info("Computing checkpoint", "index", index, "dir", dir)
+	computer := newCheckpointComputer(client, db, params.CheckpointFrequency, ctx.GlobalInt(computeBatchFlag.Name))
+	checkpoint, err := computer.compute(index)
+	if err != nil {
+		utils.Fatalf("Failed to compute checkpoint: %v", err)
+	}
+	if err := validateCheckpoint(client, checkpoint); err != nil {
+		utils.Fatalf("%v", err)
+	}
+	return checkpoint
+}
+
+// latestStableSection returns the index of the latest section which is final
+// enough to be signed.
+func latestStableSection(client *rpc.Client, size uint64) (uint64, error) {
+	var head *types.Header
+	if err := client.Call(&head, "eth_getBlockByNumber", "latest", false); err != nil {
+		return 0, fmt.Errorf("failed to retrieve chain head: %v", err)
+	}
+	if head == nil {
+		return 0, errors.New("chain head not available")
+	}
+	number := head.Number.Uint64()
+	if number < size+params.CheckpointProcessConfirmations {
+		return 0, fmt.Errorf("no stable section yet at block %d", number)
+	}
+	return (number-params.CheckpointProcessConfirmations)/size - 1, nil
+}
+
+// validateCheckpoint compares a computed checkpoint against the one reported by
+// the node, if the node serves it.
+func validateCheckpoint(client *rpc.Client, checkpoint *params.TrustedCheckpoint) error {
+	index := checkpoint.SectionIndex
+	remote, err := fetchCheckpoint(client, &index)
+	if err != nil {
+		log.Info("Node doesn't serve the checkpoint, skipping validation", "index", index, "err", err)
+		return nil
+	}
+	if remote.Hash() != checkpoint.Hash() {
+		return fmt.Errorf("computed checkpoint %d mismatches the node's: have %x (head %x, cht %x, bloom %x), want %x (head %x, cht %x, bloom %x)",
+			index, checkpoint.Hash(), checkpoint.SectionHead, checkpoint.CHTRoot, checkpoint.BloomRoot,
+			remote.Hash(), remote.SectionHead, remote.CHTRoot, remote.BloomRoot)
+	}
+	log.Info("Computed checkpoint matches the node's", "index", index, "hash", checkpoint.Hash())
+	return nil
+}
+
+// fetchHeaders retrieves a run of consecutive canonical headers from the node
+// in a single batch request.
+func fetchHeaders(client *rpc.Client, from uint64, count int) ([]*types.Header, error) {
+	var (
+		headers = make([]*types.Header, count)
+		reqs    = make([]rpc.BatchElem, count)
+	)
+	for i := range reqs {
+		reqs[i] = rpc.BatchElem{
+			Method: "eth_getBlockByNumber",
+			Args:   []interface{}{hexutil.EncodeUint64(from + uint64(i)), false},
+			Result: &headers[i],
+		}
+	}
+	if err := client.BatchCall(reqs); err != nil {
+		return nil, err
+	}
+	for i, req := range reqs {
+		number := from + uint64(i)
+		if req.Error != nil {
+			return nil, fmt.Errorf("failed to retrieve block %d: %v", number, req.Error)
+		}
+		if headers[i] == nil {
+			return nil, fmt.Errorf("block %d not available", number)
+		}
+		if headers[i].Number == nil || headers[i].Number.Uint64() != number {
+			return nil, fmt.Errorf("block number mismatch: have %v, want %d", headers[i].Number, number)
+		}
+	}
+	return headers, nil
+}
+
+// sectionRecord is the persisted state of the helper tries after a section was
+// fully processed.
+type sectionRecord struct {
+	Head      common.Hash // Hash of the last block of the section
+	Td        *big.Int    // Total difficulty of the last block of the section
+	ChtRoot   common.Hash // Root of the canonical hash trie including the section
+	BloomRoot common.Hash // Root of the bloom trie including the section
+}
+
+// checkpointComputer builds the canonical hash trie and the bloom trie from the
+// headers of a node section by section, the same way the les server indexers
+// do. The tries and the state after every section are persisted, so subsequent
+// computations only need to process the new sections.
+type checkpointComputer struct {
+	client *rpc.Client
+	db     ethdb.Database // Store of the computed tries and the section records
+	chtdb  *trie.Database // Trie database of the canonical hash trie
+	bltdb  *trie.Database // Trie database of the bloom trie
+	size   uint64         // Number of blocks in a section
+	batch  int            // Number of headers requested in one batch
+}
+
+// newCheckpointComputer creates a checkpoint computer persisting its progress
+// into the given database.
+func newCheckpointComputer(client *rpc.Client, db ethdb.Database, size uint64, batch int) *checkpointComputer {
+	if batch <= 0 {
+		batch = 1
+	}
+	return &checkpointComputer{
+		client: client,
+		db:     db,
+		chtdb:  trie.NewDatabase(rawdb.NewTable(db, light.ChtTablePrefix)),
+		bltdb:  trie.NewDatabase(rawdb.NewTable(db, light.BloomTrieTablePrefix)),
+		size:   size,
+		batch:  batch,
+	}
+}
+
+// compute returns the checkpoint of the given section, resuming from the last
+// section computed earlier if it's still part of the canonical chain.
+func (c *checkpointComputer) compute(index uint64) (*params.TrustedCheckpoint, error) {
+	var (
+		next uint64
+		prev *sectionRecord
+	)
+	if last, ok := c.lastSection(); ok {
+		if last > index {
+			last = index
+		}
+		record := c.readSection(last)
+		head, err := fetchHeaders(c.client, (last+1)*c.size-1, 1)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil && head[0].Hash() == record.Head {
+			next, prev = last+1, record
+			log.Info("Resuming checkpoint computation", "section", next)
+		} else {
+			log.Warn("Computed sections not on the canonical chain, restarting", "section", last)
+		}
+	}
+	for section := next; section <= index; section++ {
+		record, err := c.computeSection(section, prev, index)
+		if err != nil {
+			return nil, err
+		}
+		prev = record
+	}
+	return &params.TrustedCheckpoint{
+		SectionIndex: index,
+		SectionHead:  prev.Head,
+		CHTRoot:      prev.ChtRoot,
+		BloomRoot:    prev.BloomRoot,
+	}, nil
+}
+
+// computeSection adds a section to the helper tries built up to the previous one
+// and persists the result.
+func (c *checkpointComputer) computeSection(section uint64, prev *sectionRecord, target uint64) (*sectionRecord, error) {
+	var (
+		chtRoot   common.Hash
+		bloomRoot common.Hash
+		parent    common.Hash
+		td        = new(big.Int)
+	)
+	if prev != nil {
+		chtRoot, bloomRoot, parent = prev.ChtRoot, prev.BloomRoot, prev.Head
+		td.Set(prev.Td)
+	}
+	cht, err := trie.New(chtRoot, c.chtdb)
+	if err != nil {
+		return nil, fmt.Errorf("canonical hash trie of section %d unavailable: %v", section-1, err)
+	}
+	blt, err := trie.New(bloomRoot, c.bltdb)
+	if err != nil {
+		return nil, fmt.Errorf("bloom trie of section %d unavailable: %v", section-1, err)
+	}
+	gen, err := bloombits.NewGenerator(uint(c.size))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		first  = section * c.size
+		start  = time.Now()
+		logged = time.Now()
+	)
+	for number := first; number < first+c.size; {
+		count := c.batch
+		if remaining := first + c.size - number; uint64(count) > remaining {
+			count = int(remaining)
+		}
+		headers, err := fetchHeaders(c.client, number, count)
+		if err != nil {
+			return nil, err
+		}
+		for _, header := range headers {
+			if number > 0 && header.ParentHash != parent {
+				return nil, fmt.Errorf("block %d not a child of the previous block, chain reorged?", number)
+			}
+			hash := header.Hash()
+			td.Add(td, header.Difficulty)
+
+			var encNumber [8]byte
+			binary.BigEndian.PutUint64(encNumber[:], number)
+			data, _ := rlp.EncodeToBytes(light.ChtNode{Hash: hash, Td: td})
+			cht.Update(encNumber[:], data)
+
+			if err := gen.AddBloom(uint(number-first), header.Bloom); err != nil {
+				return nil, err
+			}
+			parent = hash
+			number++
+		}
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Computing checkpoint section", "section", section, "target", target, "block", number, "remaining", first+c.size-number,
+				"elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+	}
+	for i := uint(0); i < types.BloomBitLength; i++ {
+		bits, err := gen.Bitset(i)
+		if err != nil {
+			return nil, err
+		}
+		var encKey [10]byte
+		binary.BigEndian.PutUint16(encKey[0:2], uint16(i))
+		binary.BigEndian.PutUint64(encKey[2:10], section)
+		if comp := bitutil.CompressBytes(bits); len(comp) > 0 {
+			blt.Update(encKey[:], comp)
+		} else {
+			blt.Delete(encKey[:])
+		}
+	}
+	if chtRoot, err = cht.Commit(nil); err != nil {
+		return nil, err
+	}
+	if err := c.chtdb.Commit(chtRoot, false); err != nil {
+		return nil, err
+	}
+	if bloomRoot, err = blt.Commit(nil); err != nil {
+		return nil, err
+	}
+	if err := c.bltdb.Commit(bloomRoot, false); err != nil {
+		return nil, err
+	}
+	record := &sectionRecord{Head: parent, Td: td, ChtRoot: chtRoot, BloomRoot: bloomRoot}
+	if err := c.writeSection(section, record); err != nil {
+		return nil, err
+	}
+	log.Info("Computed checkpoint section", "section", section, "target", target, "head", parent, "cht", chtRoot, "bloom", bloomRoot,
+		"elapsed", common.PrettyDuration(time.Since(start)))
+	return record, nil
+}
+
+// lastSection returns the index of the last section computed, if any.
+func (c *checkpointComputer) lastSection() (uint64, bool) {
+	data, _ := c.db.Get(computeLastKey)
+	if len(data) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(data), true
+}
+
+// readSection retrieves the persisted record of a section, nil if not found.
+func (c *checkpointComputer) readSection(section uint64) *sectionRecord {
+	data, _ := c.db.Get(sectionKey(section))
+	if len(data) == 0 {
+		return nil
+	}
+	record := new(sectionRecord)
+	if err := rlp.DecodeBytes(data, record); err != nil {
+		log.Warn("Invalid computed section record", "section", section, "err", err)
+		return nil
+	}
+	return record
+}
+
+// writeSection persists the record of a section and marks it as the last one.
+func (c *checkpointComputer) writeSection(section uint64, record *sectionRecord) error {
+	data, err := rlp.EncodeToBytes(record)
+	if err != nil {
+		return err
+	}
+	var enc [8]byte
+	binary.BigEndian.PutUint64(enc[:], section)
+
+	batch := c.db.NewBatch()
+	batch.Put(sectionKey(section), data)
+	batch.Put(computeLastKey, enc[:])
+	return batch.Write()
+}
+
+// sectionKey = computeSectionPrefix + section index (uint64 big endian)
+func sectionKey(section uint64) []byte {
+	var enc [8]byte
+	binary.BigEndian.PutUint64(enc[:], section)
+	return append(append([]byte{}, computeSectionPrefix...), enc[:]...)
+}
@@ -0,0 +1,284 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"math/big"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/eth"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/light"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// computeSectionSize is the section size used by the tests, matching the test
+// indexer config of the les servers.
+const computeSectionSize = 128
+
+// mockArchive is a node serving block headers over the eth API.
+type mockArchive struct {
+	headers []*types.Header
+	served  uint64 // Number of headers served (atomic)
+}
+
+func (n *mockArchive) GetBlockByNumber(number rpc.BlockNumber, full bool) (*types.Header, error) {
+	if number == rpc.LatestBlockNumber {
+		number = rpc.BlockNumber(len(n.headers) - 1)
+	}
+	if number < 0 || int(number) >= len(n.headers) {
+		return nil, nil
+	}
+	atomic.AddUint64(&n.served, 1)
+	return n.headers[number], nil
+}
+
+// mockLightAPI is a node serving checkpoints over the les API.
+type mockLightAPI struct {
+	checkpoints map[uint64]*params.TrustedCheckpoint
+}
+
+func (api *mockLightAPI) GetCheckpoint(index uint64) ([3]string, error) {
+	cp, ok := api.checkpoints[index]
+	if !ok {
+		return [3]string{}, errors.New("checkpoint not found")
+	}
+	return [3]string{cp.SectionHead.Hex(), cp.CHTRoot.Hex(), cp.BloomRoot.Hex()}, nil
+}
+
+// makeHeaderChain creates a chain of headers with random difficulties and blooms.
+func makeHeaderChain(n int, seed int64) []*types.Header {
+	rand := rand.New(rand.NewSource(seed))
+
+	headers := make([]*types.Header, n)
+	for i := range headers {
+		header := &types.Header{
+			Number:     big.NewInt(int64(i)),
+			Difficulty: big.NewInt(rand.Int63n(1000) + 1),
+			Time:       uint64(i),
+		}
+		if i > 0 {
+			header.ParentHash = headers[i-1].Hash()
+		}
+		for j := 0; j < 3; j++ {
+			header.Bloom[rand.Intn(types.BloomByteLength)] |= 1 << uint(rand.Intn(8))
+		}
+		headers[i] = header
+	}
+	return headers
+}
+
+// headerChain is a chain of headers stored in a database, feeding the les
+// server indexers.
+type headerChain struct {
+	head *types.Header
+}
+
+func (c *headerChain) CurrentHeader() *types.Header { return c.head }
+
+func (c *headerChain) SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription {
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		<-quit
+		return nil
+	})
+}
+
+// indexCheckpoints runs the les server indexers over the given headers and
+// returns the checkpoints of the first sections.
+func indexCheckpoints(t *testing.T, headers []*types.Header, sections uint64) map[uint64]*params.TrustedCheckpoint {
+	db := rawdb.NewMemoryDatabase()
+
+	td := new(big.Int)
+	for _, header := range headers {
+		td.Add(td, header.Difficulty)
+		rawdb.WriteHeader(db, header)
+		rawdb.WriteTd(db, header.Hash(), header.Number.Uint64(), td)
+		rawdb.WriteCanonicalHash(db, header.Hash(), header.Number.Uint64())
+	}
+	var (
+		chain        = &headerChain{head: headers[len(headers)-1]}
+		chtIndexer   = light.NewChtIndexer(db, nil, computeSectionSize, 1)
+		bloomIndexer = eth.NewBloomIndexer(db, 16, 1)
+		bloomTrie    = light.NewBloomTrieIndexer(db, nil, 16, computeSectionSize)
+	)
+	bloomIndexer.AddChildIndexer(bloomTrie)
+	chtIndexer.Start(chain)
+	bloomIndexer.Start(chain)
+	defer chtIndexer.Close()
+	defer bloomIndexer.Close()
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		chts, _, _ := chtIndexer.Sections()
+		blooms, _, _ := bloomTrie.Sections()
+		if chts >= sections && blooms >= sections {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("indexers stuck at %d/%d sections, want %d", chts, blooms, sections)
+		}
+	}
+	checkpoints := make(map[uint64]*params.TrustedCheckpoint)
+	for section := uint64(0); section < sections; section++ {
+		head := headers[(section+1)*computeSectionSize-1].Hash()
+		checkpoints[section] = &params.TrustedCheckpoint{
+			SectionIndex: section,
+			SectionHead:  head,
+			CHTRoot:      light.GetChtRoot(db, section, head),
+			BloomRoot:    light.GetBloomTrieRoot(db, section, head),
+		}
+	}
+	return checkpoints
+}
+
+// newMockNode starts an in-process node serving the given headers and, if not
+// nil, checkpoints.
+func newMockNode(t *testing.T, archive *mockArchive, light *mockLightAPI) *rpc.Client {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", archive); err != nil {
+		t.Fatalf("failed to register eth API: %v", err)
+	}
+	if light != nil {
+		if err := server.RegisterName("les", light); err != nil {
+			t.Fatalf("failed to register les API: %v", err)
+		}
+	}
+	return rpc.DialInProc(server)
+}
+
+// Tests that the checkpoints computed from the headers match the ones produced
+// by the les server indexers, and that the computation resumes from the last
+// computed section.
+func TestComputeCheckpoint(t *testing.T) {
+	var (
+		headers  = makeHeaderChain(3*computeSectionSize+16, 1)
+		expected = indexCheckpoints(t, headers, 3)
+		archive  = &mockArchive{headers: headers}
+		client   = newMockNode(t, archive, nil)
+		db       = rawdb.NewMemoryDatabase()
+	)
+	compute := func(db ethdb.Database, index uint64) {
+		t.Helper()
+
+		have, err := newCheckpointComputer(client, db, computeSectionSize, 50).compute(index)
+		if err != nil {
+			t.Fatalf("failed to compute checkpoint %d: %v", index, err)
+		}
+		if want := expected[index]; *have != *want {
+			t.Fatalf("checkpoint %d mismatch: have %+v, want %+v", index, have, want)
+		}
+	}
+	compute(db, 1)
+	if served := atomic.LoadUint64(&archive.served); served != 2*computeSectionSize {
+		t.Errorf("headers served mismatch: have %d, want %d", served, 2*computeSectionSize)
+	}
+	// Computing the next section should only fetch the new headers
+	atomic.StoreUint64(&archive.served, 0)
+	compute(db, 2)
+	if served := atomic.LoadUint64(&archive.served); served != computeSectionSize+1 {
+		t.Errorf("headers served on resume mismatch: have %d, want %d", served, computeSectionSize+1)
+	}
+	// Older checkpoints should be served from the persisted sections
+	atomic.StoreUint64(&archive.served, 0)
+	compute(db, 0)
+	if served := atomic.LoadUint64(&archive.served); served != 1 {
+		t.Errorf("headers served for computed section mismatch: have %d, want 1", served)
+	}
+	// A fresh computation should yield the same results
+	compute(rawdb.NewMemoryDatabase(), 2)
+}
+
+// Tests that computed sections not matching the chain of the node any more are
+// discarded.
+func TestComputeCheckpointReorg(t *testing.T) {
+	var (
+		db      = rawdb.NewMemoryDatabase()
+		headers = makeHeaderChain(2*computeSectionSize+16, 1)
+		client  = newMockNode(t, &mockArchive{headers: headers}, nil)
+	)
+	if _, err := newCheckpointComputer(client, db, computeSectionSize, 50).compute(1); err != nil {
+		t.Fatalf("failed to compute checkpoint: %v", err)
+	}
+	headers = makeHeaderChain(2*computeSectionSize+16, 2)
+	client = newMockNode(t, &mockArchive{headers: headers}, nil)
+
+	have, err := newCheckpointComputer(client, db, computeSectionSize, 50).compute(1)
+	if err != nil {
+		t.Fatalf("failed to compute checkpoint after reorg: %v", err)
+	}
+	if want := indexCheckpoints(t, headers, 2)[1]; *have != *want {
+		t.Fatalf("checkpoint mismatch after reorg: have %+v, want %+v", have, want)
+	}
+}
+
+// Tests that computed checkpoints are validated against the ones served by the
+// node, if available.
+func TestValidateCheckpoint(t *testing.T) {
+	var (
+		headers  = makeHeaderChain(computeSectionSize+16, 1)
+		expected = indexCheckpoints(t, headers, 1)
+		archive  = &mockArchive{headers: headers}
+	)
+	checkpoint, err := newCheckpointComputer(newMockNode(t, archive, nil), rawdb.NewMemoryDatabase(), computeSectionSize, 50).compute(0)
+	if err != nil {
+		t.Fatalf("failed to compute checkpoint: %v", err)
+	}
+	// Nodes without the les API or without the checkpoint should be skipped
+	if err := validateCheckpoint(newMockNode(t, archive, nil), checkpoint); err != nil {
+		t.Errorf("validation failed without les API: %v", err)
+	}
+	if err := validateCheckpoint(newMockNode(t, archive, &mockLightAPI{}), checkpoint); err != nil {
+		t.Errorf("validation failed without remote checkpoint: %v", err)
+	}
+	// Matching checkpoints should be accepted, different ones rejected
+	if err := validateCheckpoint(newMockNode(t, archive, &mockLightAPI{checkpoints: expected}), checkpoint); err != nil {
+		t.Errorf("matching checkpoint rejected: %v", err)
+	}
+	bad := *expected[0]
+	bad.BloomRoot[0]++
+	if err := validateCheckpoint(newMockNode(t, archive, &mockLightAPI{checkpoints: map[uint64]*params.TrustedCheckpoint{0: &bad}}), checkpoint); err == nil {
+		t.Errorf("mismatching checkpoint accepted")
+	}
+}
+
+// Tests the selection of the latest stable section.
+func TestLatestStableSection(t *testing.T) {
+	size := uint64(computeSectionSize)
+
+	short := newMockNode(t, &mockArchive{headers: makeHeaderChain(int(size+params.CheckpointProcessConfirmations)-1, 1)}, nil)
+	if _, err := latestStableSection(short, size); err == nil {
+		t.Errorf("stable section reported on short chain")
+	}
+	for _, n := range []uint64{size + params.CheckpointProcessConfirmations, 3*size + params.CheckpointProcessConfirmations - 1} {
+		client := newMockNode(t, &mockArchive{headers: makeHeaderChain(int(n)+1, 1)}, nil)
+		index, err := latestStableSection(client, size)
+		if err != nil {
+			t.Fatalf("head %d: failed to find stable section: %v", n, err)
+		}
+		if want := (n-params.CheckpointProcessConfirmations)/size - 1; index != want {
+			t.Errorf("head %d: section mismatch: have %d, want %d", n, index, want)
+		}
+	}
+}
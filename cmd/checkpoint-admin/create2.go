@@ -0,0 +1,93 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/cmd/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var commandComputeAddress = cli.Command{
+	Name:  "compute-address",
+	Usage: "Derives the CREATE2 address of an oracle contract before deployment",
+	Flags: []cli.Flag{
+		deployerFlag,
+		saltFlag,
+		initcodeHashFlag,
+	},
+	Action: utils.MigrateFlags(computeAddress),
+}
+
+// computeAddress prints the CREATE2 address derived from the deployer, salt and
+// init code hash given on the command line.
+func computeAddress(ctx *cli.Context) error {
+	for _, flag := range []cli.StringFlag{deployerFlag, saltFlag, initcodeHashFlag} {
+		if !ctx.IsSet(flag.Name) {
+			utils.Fatalf("Please specify --%s", flag.Name)
+		}
+	}
+	deployer := ctx.String(deployerFlag.Name)
+	if !common.IsHexAddress(deployer) {
+		utils.Fatalf("Invalid deployer address %q", deployer)
+	}
+	salt, err := parseHash(ctx.String(saltFlag.Name))
+	if err != nil {
+		utils.Fatalf("Invalid salt: %v", err)
+	}
+	initHash, err := parseHash(ctx.String(initcodeHashFlag.Name))
+	if err != nil {
+		utils.Fatalf("Invalid init code hash: %v", err)
+	}
+	fmt.Printf("Oracle => %s\n", create2Address(common.HexToAddress(deployer), salt, initHash).Hex())
+	return nil
+}
+
+// create2Address derives the address of a contract deployed with CREATE2 as
+// keccak256(0xff ++ deployer ++ salt ++ keccak256(initcode))[12:].
+func create2Address(deployer common.Address, salt common.Hash, initHash common.Hash) common.Address {
+	return crypto.CreateAddress2(deployer, salt, initHash[:])
+}
+
+// parseHash parses a hex encoded 32 byte value, refusing shorter or longer ones
+// instead of silently padding or truncating them.
+func parseHash(s string) (common.Hash, error) {
+	var h common.Hash
+	if err := h.UnmarshalText([]byte(s)); err != nil {
+		return common.Hash{}, err
+	}
+	return h, nil
+}
+
+// isDeployed checks whether there is contract code at the given address.
+func isDeployed(node *rpc.Client, addr common.Address) (bool, error) {
+	reqCtx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+
+	code, err := ethclient.NewClient(node).CodeAt(reqCtx, addr, nil)
+	if err != nil {
+		return false, err
+	}
+	return len(code) > 0, nil
+}
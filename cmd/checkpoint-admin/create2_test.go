@@ -0,0 +1,95 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Tests the CREATE2 address derivation against the examples of EIP-1014.
+func TestCreate2Address(t *testing.T) {
+	tests := []struct {
+		deployer string
+		salt     string
+		initcode string
+		address  string
+	}{
+		{
+			"0x0000000000000000000000000000000000000000",
+			"0x0000000000000000000000000000000000000000000000000000000000000000",
+			"0x00",
+			"0x4D1A2e2bB4F88F0250f26Ffff098B0b30B26BF38",
+		},
+		{
+			"0xdeadbeef00000000000000000000000000000000",
+			"0x0000000000000000000000000000000000000000000000000000000000000000",
+			"0x00",
+			"0xB928f69Bb1D91Cd65274e3c79d8986362984fDA3",
+		},
+		{
+			"0xdeadbeef00000000000000000000000000000000",
+			"0x000000000000000000000000feed000000000000000000000000000000000000",
+			"0x00",
+			"0xD04116cDd17beBE565EB2422F2497E06cC1C9833",
+		},
+		{
+			"0x0000000000000000000000000000000000000000",
+			"0x0000000000000000000000000000000000000000000000000000000000000000",
+			"0xdeadbeef",
+			"0x70f2b2914A2a4b783FaEFb75f459A580616Fcb5e",
+		},
+		{
+			"0x00000000000000000000000000000000deadbeef",
+			"0x00000000000000000000000000000000000000000000000000000000cafebabe",
+			"0xdeadbeef",
+			"0x60f3f640a8508fC6a86d45DF051962668E1e8AC7",
+		},
+		{
+			"0x00000000000000000000000000000000deadbeef",
+			"0x00000000000000000000000000000000000000000000000000000000cafebabe",
+			"0xdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			"0x1d8bfDC5D46DC4f61D6b6115972536eBE6A8854C",
+		},
+		{
+			"0x0000000000000000000000000000000000000000",
+			"0x0000000000000000000000000000000000000000000000000000000000000000",
+			"0x",
+			"0xE33C0C7F7df4809055C3ebA6c09CFe4BaF1BD9e0",
+		},
+	}
+	for i, tt := range tests {
+		salt, err := parseHash(tt.salt)
+		if err != nil {
+			t.Fatalf("test %d: failed to parse salt: %v", i, err)
+		}
+		initHash := crypto.Keccak256Hash(common.FromHex(tt.initcode))
+		if have, want := create2Address(common.HexToAddress(tt.deployer), salt, initHash), common.HexToAddress(tt.address); have != want {
+			t.Errorf("test %d: address mismatch: have %s, want %s", i, have.Hex(), want.Hex())
+		}
+	}
+}
+
+func TestParseHashStrict(t *testing.T) {
+	for _, s := range []string{"", "0x", "0x00", "cafebabe", "0x" + common.Bytes2Hex(make([]byte, 33))} {
+		if _, err := parseHash(s); err == nil {
+			t.Errorf("Malformed hash %q accepted", s)
+		}
+	}
+}
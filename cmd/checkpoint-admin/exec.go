@@ -20,17 +20,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/big"
 	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/cmd/utils"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/contracts/checkpointoracle"
 	"github.com/ethereum/go-ethereum/contracts/checkpointoracle/contract"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/log"
@@ -48,6 +51,8 @@ var commandDeploy = cli.Command{
 		signerFlag,
 		signersFlag,
 		thresholdFlag,
+		auditLogFlag,
+		noAuditFlag,
 	},
 	Action: utils.MigrateFlags(deploy),
 }
@@ -62,10 +67,30 @@ var commandSign = cli.Command{
 		indexFlag,
 		hashFlag,
 		oracleFlag,
+		allowUndeployedFlag,
+		computeFlag,
+		computeDirFlag,
+		computeBatchFlag,
+		notBeforeFlag,
+		auditLogFlag,
+		noAuditFlag,
 	},
 	Action: utils.MigrateFlags(sign),
 }
 
+var commandVerify = cli.Command{
+	Name:  "verify",
+	Usage: "Verify checkpoint signatures and report their time locks",
+	Flags: []cli.Flag{
+		nodeURLFlag,
+		indexFlag,
+		hashFlag,
+		oracleFlag,
+		signaturesFlag,
+	},
+	Action: utils.MigrateFlags(verify),
+}
+
 var commandPublish = cli.Command{
 	Name:  "publish",
 	Usage: "Publish a checkpoint into the oracle",
@@ -75,6 +100,12 @@ var commandPublish = cli.Command{
 		signerFlag,
 		indexFlag,
 		signaturesFlag,
+		relayFlag,
+		relayMethodFlag,
+		relayBlocksFlag,
+		relayFallbackFlag,
+		auditLogFlag,
+		noAuditFlag,
 	},
 	Action: utils.MigrateFlags(publish),
 }
@@ -108,33 +139,47 @@ func deploy(ctx *cli.Context) error {
 	transactor, client := newClefSigner(ctx), newClient(ctx)
 
 	// Deploy the checkpoint oracle
+	audit := newAuditLog(ctx)
+	entry := auditEntry{
+		Command: "deploy",
+		Signer:  transactor.From,
+		RPC:     ctx.GlobalString(nodeURLFlag.Name),
+	}
+	audit.attempt(entry)
 	fmt.Println("Sending deploy request to Clef...")
-	oracle, tx, _, err := contract.DeployCheckpointOracle(transactor, client, addrs, big.NewInt(int64(params.CheckpointFrequency)),
-		big.NewInt(int64(params.CheckpointProcessConfirmations)), big.NewInt(int64(needed)))
+	oracle, tx, err := deployOracle(transactor, client, addrs, needed)
 	if err != nil {
+		entry.Outcome = fmt.Sprintf("failed: %v", err)
+		audit.record(entry)
 		utils.Fatalf("Failed to deploy checkpoint oracle %v", err)
 	}
+	entry.TxHash, entry.Outcome = tx.Hash().Hex(), fmt.Sprintf("deployed %s", oracle.Hex())
+	audit.record(entry)
 	log.Info("Deployed checkpoint oracle", "address", oracle, "tx", tx.Hash().Hex())
 
 	return nil
 }
 
+// deployOracle deploys a checkpoint oracle contract which accepts checkpoints
+// signed by at least threshold of the given admins.
+func deployOracle(opts *bind.TransactOpts, backend bind.ContractBackend, admins []common.Address, threshold int) (common.Address, *types.Transaction, error) {
+	oracle, tx, _, err := contract.DeployCheckpointOracle(opts, backend, admins, big.NewInt(int64(params.CheckpointFrequency)),
+		big.NewInt(int64(params.CheckpointProcessConfirmations)), big.NewInt(int64(threshold)))
+	return oracle, tx, err
+}
+
 // sign creates the signature for specific checkpoint
 // with local key. Only contract admins have the permission to
 // sign checkpoint.
 func sign(ctx *cli.Context) error {
 	var (
-		offline bool // The indicator whether we sign checkpoint by offline.
 		chash   common.Hash
 		cindex  uint64
 		address common.Address
-
-		node   *rpc.Client
-		oracle *checkpointoracle.CheckpointOracle
+		signer  = ctx.String(signerFlag.Name)
 	)
 	if !ctx.GlobalIsSet(nodeURLFlag.Name) {
 		// Offline mode signing
-		offline = true
 		if !ctx.IsSet(hashFlag.Name) {
 			utils.Fatalf("Please specify the checkpoint hash (--hash) to sign in offline mode")
 		}
@@ -151,80 +196,174 @@ func sign(ctx *cli.Context) error {
 		address = common.HexToAddress(ctx.String(oracleFlag.Name))
 	} else {
 		// Interactive mode signing, retrieve the data from the remote node
-		node = newRPCClient(ctx.GlobalString(nodeURLFlag.Name))
-
-		checkpoint := getCheckpoint(ctx, node)
-		chash, cindex, address = checkpoint.Hash(), checkpoint.SectionIndex, getContractAddr(node)
-
-		// Check the validity of checkpoint
-		reqCtx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancelFn()
-
-		head, err := ethclient.NewClient(node).HeaderByNumber(reqCtx, nil)
-		if err != nil {
-			return err
-		}
-		num := head.Number.Uint64()
-		if num < ((cindex+1)*params.CheckpointFrequency + params.CheckpointProcessConfirmations) {
-			utils.Fatalf("Invalid future checkpoint")
+		var index *uint64
+		if ctx.GlobalIsSet(indexFlag.Name) {
+			n := uint64(ctx.GlobalInt64(indexFlag.Name))
+			index = &n
 		}
-		_, oracle = newContract(node)
-		latest, _, h, err := oracle.Contract().GetLatestCheckpoint(nil)
-		if err != nil {
-			return err
+		var oracle *common.Address
+		if ctx.IsSet(oracleFlag.Name) {
+			addr := common.HexToAddress(ctx.String(oracleFlag.Name))
+			oracle = &addr
 		}
-		if cindex < latest {
-			utils.Fatalf("Checkpoint is too old")
-		}
-		if cindex == latest && (latest != 0 || h.Uint64() != 0) {
-			utils.Fatalf("Stale checkpoint, latest registered %d, given %d", latest, cindex)
+		var (
+			node       = newRPCClient(ctx.GlobalString(nodeURLFlag.Name))
+			checkpoint *params.TrustedCheckpoint
+			addr       common.Address
+			err        error
+		)
+		if ctx.Bool(computeFlag.Name) {
+			checkpoint, addr, err = prepareSignCheckpoint(node, computeCheckpoint(ctx, node), common.HexToAddress(signer), oracle, ctx.Bool(allowUndeployedFlag.Name))
+		} else {
+			checkpoint, addr, err = prepareSign(node, index, common.HexToAddress(signer), oracle, ctx.Bool(allowUndeployedFlag.Name))
 		}
-	}
-	var (
-		signature string
-		signer    string
-	)
-	// isAdmin checks whether the specified signer is admin.
-	isAdmin := func(addr common.Address) error {
-		signers, err := oracle.Contract().GetAllAdmin(nil)
 		if err != nil {
-			return err
+			utils.Fatalf("%v", err)
 		}
-		for _, s := range signers {
-			if s == addr {
-				return nil
-			}
-		}
-		return fmt.Errorf("signer %v is not the admin", addr.Hex())
+		chash, cindex, address = checkpoint.Hash(), checkpoint.SectionIndex, addr
 	}
 	// Print to the user the data thy are about to sign
 	fmt.Printf("Oracle     => %s\n", address.Hex())
 	fmt.Printf("Index %4d => %s\n", cindex, chash.Hex())
 
+	notBefore := ctx.Uint64(notBeforeFlag.Name)
+	if notBefore > 0 {
+		fmt.Printf("Not before => #%d\n", notBefore)
+	}
 	// Sign checkpoint in clef mode.
-	signer = ctx.String(signerFlag.Name)
-
-	if !offline {
-		if err := isAdmin(common.HexToAddress(signer)); err != nil {
-			return err
-		}
+	audit := newAuditLog(ctx)
+	entry := auditEntry{
+		Command:    "sign",
+		Index:      cindex,
+		Checkpoint: chash,
+		Signer:     common.HexToAddress(signer),
+		RPC:        ctx.String(clefURLFlag.Name),
 	}
-	clef := newRPCClient(ctx.String(clefURLFlag.Name))
-	p := make(map[string]string)
-	buf := make([]byte, 8)
-	binary.BigEndian.PutUint64(buf, cindex)
-	p["address"] = address.Hex()
-	p["message"] = hexutil.Encode(append(buf, chash.Bytes()...))
-
+	audit.attempt(entry)
 	fmt.Println("Sending signing request to Clef...")
-	if err := clef.Call(&signature, "account_signData", accounts.MimetypeDataWithValidator, signer, p); err != nil {
+	clef := newRPCClient(ctx.String(clefURLFlag.Name))
+	signature, err := signCheckpoint(clef, common.HexToAddress(signer), address, cindex, chash)
+	if err != nil {
+		entry.Outcome = fmt.Sprintf("failed: %v", err)
+		audit.record(entry)
 		utils.Fatalf("Failed to sign checkpoint, err %v", err)
 	}
+	entry.Outcome = "signed"
+	if notBefore > 0 {
+		// Time-locked signatures need a second signature over the lock
+		fmt.Println("Sending time lock signing request to Clef...")
+		if signature, err = signTimeLock(clef, common.HexToAddress(signer), address, cindex, chash, signature, notBefore); err != nil {
+			entry.Outcome = fmt.Sprintf("failed: %v", err)
+			audit.record(entry)
+			utils.Fatalf("Failed to sign time lock, err %v", err)
+		}
+		entry.Outcome = fmt.Sprintf("signed, not before #%d", notBefore)
+	}
+	entry.Signature = signature
+	audit.record(entry)
 	fmt.Printf("Signer     => %s\n", signer)
 	fmt.Printf("Signature  => %s\n", signature)
 	return nil
 }
 
+// prepareSign retrieves the checkpoint to sign (the latest one if no index is
+// given) and the oracle address (unless explicitly given) from the connected
+// node, and verifies that the checkpoint is signable by the given admin.
+//
+// If allowUndeployed is set, an oracle address without contract code is also
+// accepted, e.g. a CREATE2 address the oracle will be deployed to. The checks
+// requiring the contract are skipped in that case.
+func prepareSign(node *rpc.Client, index *uint64, signer common.Address, oracleAddr *common.Address, allowUndeployed bool) (*params.TrustedCheckpoint, common.Address, error) {
+	checkpoint, err := fetchCheckpoint(node, index)
+	if err != nil {
+		return nil, common.Address{}, err
+	}
+	return prepareSignCheckpoint(node, checkpoint, signer, oracleAddr, allowUndeployed)
+}
+
+// prepareSignCheckpoint retrieves the oracle address (unless explicitly given)
+// from the connected node and verifies that the given checkpoint is signable by
+// the given admin.
+func prepareSignCheckpoint(node *rpc.Client, checkpoint *params.TrustedCheckpoint, signer common.Address, oracleAddr *common.Address, allowUndeployed bool) (*params.TrustedCheckpoint, common.Address, error) {
+	var (
+		addr common.Address
+		err  error
+	)
+	if oracleAddr != nil {
+		addr = *oracleAddr
+	} else if addr, err = fetchContractAddr(node); err != nil {
+		return nil, common.Address{}, fmt.Errorf("failed to fetch checkpoint oracle address: %v", err)
+	}
+	if addr == (common.Address{}) {
+		return nil, common.Address{}, errors.New("no specified registrar contract address")
+	}
+	deployed, err := isDeployed(node, addr)
+	if err != nil {
+		return nil, common.Address{}, err
+	}
+	if !deployed && !allowUndeployed {
+		return nil, common.Address{}, fmt.Errorf("no oracle contract deployed at %s (use --%s to sign for a counterfactual address)", addr.Hex(), allowUndeployedFlag.Name)
+	}
+	// Check the validity of checkpoint
+	reqCtx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+
+	head, err := ethclient.NewClient(node).HeaderByNumber(reqCtx, nil)
+	if err != nil {
+		return nil, common.Address{}, err
+	}
+	num, cindex := head.Number.Uint64(), checkpoint.SectionIndex
+	if num < ((cindex+1)*params.CheckpointFrequency + params.CheckpointProcessConfirmations) {
+		return nil, common.Address{}, errors.New("invalid future checkpoint")
+	}
+	if !deployed {
+		log.Warn("Signing for undeployed oracle, skipping contract checks", "address", addr)
+		return checkpoint, addr, nil
+	}
+	oracle, err := checkpointoracle.NewCheckpointOracle(addr, ethclient.NewClient(node))
+	if err != nil {
+		return nil, common.Address{}, fmt.Errorf("failed to setup registrar contract %s: %v", addr.Hex(), err)
+	}
+	latest, _, h, err := oracle.Contract().GetLatestCheckpoint(nil)
+	if err != nil {
+		return nil, common.Address{}, err
+	}
+	if cindex < latest {
+		return nil, common.Address{}, errors.New("checkpoint is too old")
+	}
+	if cindex == latest && (latest != 0 || h.Uint64() != 0) {
+		return nil, common.Address{}, fmt.Errorf("stale checkpoint, latest registered %d, given %d", latest, cindex)
+	}
+	// Ensure the signer is permitted to sign
+	admins, err := oracle.Contract().GetAllAdmin(nil)
+	if err != nil {
+		return nil, common.Address{}, err
+	}
+	for _, admin := range admins {
+		if admin == signer {
+			return checkpoint, addr, nil
+		}
+	}
+	return nil, common.Address{}, fmt.Errorf("signer %v is not the admin", signer.Hex())
+}
+
+// signCheckpoint requests the signature of a checkpoint for the given oracle
+// from clef, returning it hex encoded.
+func signCheckpoint(clef *rpc.Client, signer common.Address, oracle common.Address, index uint64, hash common.Hash) (string, error) {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, index)
+
+	p := make(map[string]string)
+	p["address"] = oracle.Hex()
+	p["message"] = hexutil.Encode(append(buf, hash.Bytes()...))
+
+	var signature string
+	if err := clef.Call(&signature, "account_signData", accounts.MimetypeDataWithValidator, signer.Hex(), p); err != nil {
+		return "", err
+	}
+	return signature, nil
+}
+
 // sighash calculates the hash of the data to sign for the checkpoint oracle.
 func sighash(index uint64, oracle common.Address, hash common.Hash) []byte {
 	buf := make([]byte, 8)
@@ -235,47 +374,63 @@ func sighash(index uint64, oracle common.Address, hash common.Hash) []byte {
 }
 
 // ecrecover calculates the sender address from a sighash and signature combo.
-func ecrecover(sighash []byte, sig []byte) common.Address {
+func ecrecover(sighash []byte, sig []byte) (common.Address, error) {
 	sig[64] -= 27
 	defer func() { sig[64] += 27 }()
 
 	signer, err := crypto.SigToPub(sighash, sig)
 	if err != nil {
-		utils.Fatalf("Failed to recover sender from signature %x: %v", sig, err)
+		return common.Address{}, fmt.Errorf("failed to recover sender from signature %x: %v", sig, err)
 	}
-	return crypto.PubkeyToAddress(*signer)
+	return crypto.PubkeyToAddress(*signer), nil
 }
 
-// publish registers the specified checkpoint which generated by connected node
-// with a authorised private key.
-func publish(ctx *cli.Context) error {
-	// Print the checkpoint oracle's current status to make sure we're interacting
-	// with the correct network and contract.
-	status(ctx)
+// registration contains everything needed to register a checkpoint into the
+// oracle contract.
+type registration struct {
+	addr       common.Address                     // Address of the oracle contract
+	oracle     *checkpointoracle.CheckpointOracle // Oracle bound to the connected node
+	checkpoint *params.TrustedCheckpoint          // Checkpoint to register
+	sigs       [][]byte                           // Signatures, sorted by signer address
+	signers    []common.Address                   // Signers, in signature order
+	recent     *types.Header                      // Recent header protecting against replays
+}
 
-	// Gather the signatures from the CLI
-	var sigs [][]byte
-	for _, sig := range strings.Split(ctx.String(signaturesFlag.Name), ",") {
-		trimmed := strings.TrimPrefix(strings.TrimSpace(sig), "0x")
-		if len(trimmed) != 130 {
-			utils.Fatalf("Invalid signature in --signature: '%s'", trimmed)
-		} else {
-			sigs = append(sigs, common.Hex2Bytes(trimmed))
-		}
+// prepareRegistration retrieves the checkpoint to publish (the latest one if no
+// index is given) from the connected node, and sorts the signatures by signer
+// address as required by the oracle contract.
+func prepareRegistration(node *rpc.Client, index *uint64, sigs [][]byte) (*registration, error) {
+	addr, oracle, err := bindContract(node)
+	if err != nil {
+		return nil, err
+	}
+	// Signatures may be collected for a counterfactual oracle, but they can only
+	// be registered once the contract is deployed.
+	deployed, err := isDeployed(node, addr)
+	if err != nil {
+		return nil, err
+	}
+	if !deployed {
+		return nil, fmt.Errorf("no oracle contract deployed at %s", addr.Hex())
+	}
+	checkpoint, err := fetchCheckpoint(node, index)
+	if err != nil {
+		return nil, err
 	}
-	// Retrieve the checkpoint we want to sign to sort the signatures
 	var (
-		client       = newRPCClient(ctx.GlobalString(nodeURLFlag.Name))
-		addr, oracle = newContract(client)
-		checkpoint   = getCheckpoint(ctx, client)
-		sighash      = sighash(checkpoint.SectionIndex, addr, checkpoint.Hash())
+		hash    = sighash(checkpoint.SectionIndex, addr, checkpoint.Hash())
+		signers = make([]common.Address, len(sigs))
 	)
+	for i, sig := range sigs {
+		if signers[i], err = ecrecover(hash, sig); err != nil {
+			return nil, err
+		}
+	}
 	for i := 0; i < len(sigs); i++ {
 		for j := i + 1; j < len(sigs); j++ {
-			signerA := ecrecover(sighash, sigs[i])
-			signerB := ecrecover(sighash, sigs[j])
-			if bytes.Compare(signerA.Bytes(), signerB.Bytes()) > 0 {
+			if bytes.Compare(signers[i].Bytes(), signers[j].Bytes()) > 0 {
 				sigs[i], sigs[j] = sigs[j], sigs[i]
+				signers[i], signers[j] = signers[j], signers[i]
 			}
 		}
 	}
@@ -283,29 +438,213 @@ func publish(ctx *cli.Context) error {
 	reqCtx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancelFn()
 
-	head, err := ethclient.NewClient(client).HeaderByNumber(reqCtx, nil)
+	head, err := ethclient.NewClient(node).HeaderByNumber(reqCtx, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	num := head.Number.Uint64()
-	recent, err := ethclient.NewClient(client).HeaderByNumber(reqCtx, big.NewInt(int64(num-128)))
+	recent, err := ethclient.NewClient(node).HeaderByNumber(reqCtx, big.NewInt(int64(num-128)))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return &registration{
+		addr:       addr,
+		oracle:     oracle,
+		checkpoint: checkpoint,
+		sigs:       sigs,
+		signers:    signers,
+		recent:     recent,
+	}, nil
+}
+
+// register sends the checkpoint registration transaction through the oracle.
+func (r *registration) register(oracle *checkpointoracle.CheckpointOracle, opts *bind.TransactOpts) (*types.Transaction, error) {
+	return oracle.RegisterCheckpoint(opts, r.checkpoint.SectionIndex, r.checkpoint.Hash().Bytes(), r.recent.Number, r.recent.Hash(), r.sigs)
+}
+
+// publish registers the specified checkpoint which generated by connected node
+// with a authorised private key.
+func publish(ctx *cli.Context) error {
+	// Print the checkpoint oracle's current status to make sure we're interacting
+	// with the correct network and contract.
+	status(ctx)
+
+	// Gather the signatures from the CLI
+	locks, err := decodeSignatures(ctx.String(signaturesFlag.Name))
+	if err != nil {
+		utils.Fatalf("Invalid --%s: %v", signaturesFlag.Name, err)
+	}
+	sigs := make([][]byte, len(locks))
+	for i, sig := range locks {
+		sigs[i] = sig.sig
+	}
+	// Retrieve the checkpoint we want to sign to sort the signatures
+	var index *uint64
+	if ctx.GlobalIsSet(indexFlag.Name) {
+		n := uint64(ctx.GlobalInt64(indexFlag.Name))
+		index = &n
+	}
+	client := newRPCClient(ctx.GlobalString(nodeURLFlag.Name))
+	reg, err := prepareRegistration(client, index, sigs)
+	if err != nil {
+		utils.Fatalf("%v", err)
+	}
+	checkpoint := reg.checkpoint
+
+	// Refuse to register time-locked signatures before their time, the oracle
+	// contract can't enforce the locks itself
+	reqCtx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	head, err := ethclient.NewClient(client).HeaderByNumber(reqCtx, nil)
+	cancelFn()
+	if err != nil {
+		utils.Fatalf("Failed to retrieve chain head: %v", err)
+	}
+	if err := checkTimeLocks(locks, checkpoint.SectionIndex, reg.addr, checkpoint.Hash(), head.Number.Uint64()); err != nil {
+		utils.Fatalf("Refusing to publish: %v", err)
 	}
 	// Print a summary of the operation that's going to be performed
 	fmt.Printf("Publishing %d => %s:\n\n", checkpoint.SectionIndex, checkpoint.Hash().Hex())
-	for i, sig := range sigs {
-		fmt.Printf("Signer %d => %s\n", i+1, ecrecover(sighash, sig).Hex())
+	for i, signer := range reg.signers {
+		fmt.Printf("Signer %d => %s\n", i+1, signer.Hex())
 	}
 	fmt.Println()
-	fmt.Printf("Sentry number => %d\nSentry hash   => %s\n", recent.Number, recent.Hash().Hex())
+	fmt.Printf("Sentry number => %d\nSentry hash   => %s\n", reg.recent.Number, reg.recent.Hash().Hex())
 
 	// Publish the checkpoint into the oracle
+	var (
+		transactor = newClefSigner(ctx)
+		audit      = newAuditLog(ctx)
+		entry      = auditEntry{
+			Command:    "publish",
+			Index:      checkpoint.SectionIndex,
+			Checkpoint: checkpoint.Hash(),
+			Signer:     transactor.From,
+			RPC:        ctx.GlobalString(nodeURLFlag.Name),
+		}
+	)
+	audit.attempt(entry)
 	fmt.Println("Sending publish request to Clef...")
-	tx, err := oracle.RegisterCheckpoint(newClefSigner(ctx), checkpoint.SectionIndex, checkpoint.Hash().Bytes(), recent.Number, recent.Hash(), sigs)
+	if ctx.String(relayFlag.Name) == "" {
+		tx, err := reg.register(reg.oracle, transactor)
+		if err != nil {
+			entry.Outcome = fmt.Sprintf("failed: %v", err)
+			audit.record(entry)
+			utils.Fatalf("Register contract failed %v", err)
+		}
+		entry.TxHash, entry.Outcome = tx.Hash().Hex(), "registered"
+		audit.record(entry)
+		log.Info("Successfully registered checkpoint", "tx", tx.Hash().Hex())
+		return nil
+	}
+	// A private relay was requested, sign the transaction without sending it
+	var (
+		public   = ethclient.NewClient(client)
+		capturer = &txCapturer{ContractBackend: public}
+	)
+	signer, err := checkpointoracle.NewCheckpointOracle(reg.addr, capturer)
 	if err != nil {
+		return err
+	}
+	if _, err := reg.register(signer, transactor); err != nil {
+		entry.Outcome = fmt.Sprintf("failed: %v", err)
+		audit.record(entry)
+		utils.Fatalf("Register contract failed %v", err)
+	}
+	tx := capturer.tx
+	if err := checkReplayProtected(context.Background(), public, tx); err != nil {
+		entry.Outcome = fmt.Sprintf("failed: %v", err)
+		audit.record(entry)
+		utils.Fatalf("Refusing to relay transaction: %v", err)
+	}
+	fmt.Println("Sending publish request to relay...")
+	relayed, err := sendViaRelay(context.Background(), newRPCClient(ctx.String(relayFlag.Name)), ctx.String(relayMethodFlag.Name), public, tx, ctx.Uint64(relayBlocksFlag.Name), ctx.Bool(relayFallbackFlag.Name))
+	entry.TxHash = tx.Hash().Hex()
+	if err != nil {
+		entry.Outcome = fmt.Sprintf("failed: %v", err)
+		audit.record(entry)
 		utils.Fatalf("Register contract failed %v", err)
 	}
-	log.Info("Successfully registered checkpoint", "tx", tx.Hash().Hex())
+	if relayed {
+		entry.Outcome = "registered via relay"
+	} else {
+		entry.Outcome = "registered publicly after relay fallback"
+	}
+	audit.record(entry)
+	log.Info("Successfully registered checkpoint", "tx", tx.Hash().Hex(), "relayed", relayed)
+	return nil
+}
+
+// verify recovers the signers of the given checkpoint signatures and reports
+// their time locks. The checkpoint and the chain head are retrieved from the
+// connected node, or the checkpoint is specified by the command line flags in
+// offline mode.
+func verify(ctx *cli.Context) error {
+	sigs, err := decodeSignatures(ctx.String(signaturesFlag.Name))
+	if err != nil {
+		utils.Fatalf("Invalid --%s: %v", signaturesFlag.Name, err)
+	}
+	var (
+		chash   common.Hash
+		cindex  uint64
+		address common.Address
+		head    *uint64
+	)
+	if !ctx.GlobalIsSet(nodeURLFlag.Name) {
+		// Offline mode verification, time locks can't be checked against the chain
+		if !ctx.IsSet(hashFlag.Name) || !ctx.IsSet(indexFlag.Name) || !ctx.IsSet(oracleFlag.Name) {
+			utils.Fatalf("Please specify the checkpoint hash (--hash), index (--index) and oracle address (--oracle) to verify in offline mode")
+		}
+		chash = common.HexToHash(ctx.String(hashFlag.Name))
+		cindex = ctx.Uint64(indexFlag.Name)
+		address = common.HexToAddress(ctx.String(oracleFlag.Name))
+	} else {
+		var index *uint64
+		if ctx.GlobalIsSet(indexFlag.Name) {
+			n := uint64(ctx.GlobalInt64(indexFlag.Name))
+			index = &n
+		}
+		node := newRPCClient(ctx.GlobalString(nodeURLFlag.Name))
+		checkpoint, err := fetchCheckpoint(node, index)
+		if err != nil {
+			utils.Fatalf("%v", err)
+		}
+		if ctx.IsSet(oracleFlag.Name) {
+			address = common.HexToAddress(ctx.String(oracleFlag.Name))
+		} else {
+			address = getContractAddr(node)
+		}
+		reqCtx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancelFn()
+
+		header, err := ethclient.NewClient(node).HeaderByNumber(reqCtx, nil)
+		if err != nil {
+			utils.Fatalf("Failed to retrieve chain head: %v", err)
+		}
+		number := header.Number.Uint64()
+		chash, cindex, head = checkpoint.Hash(), checkpoint.SectionIndex, &number
+	}
+	fmt.Printf("Oracle     => %s\n", address.Hex())
+	fmt.Printf("Index %4d => %s\n", cindex, chash.Hex())
+	if head != nil {
+		fmt.Printf("Head       => #%d\n", *head)
+	}
+	fmt.Println()
+
+	for i, sig := range sigs {
+		signer, err := sig.verify(cindex, address, chash)
+		if err != nil {
+			utils.Fatalf("Invalid signature %d: %v", i+1, err)
+		}
+		switch {
+		case sig.lock == nil:
+			fmt.Printf("Signer %d => %s\n", i+1, signer.Hex())
+		case head == nil:
+			fmt.Printf("Signer %d => %s, not before #%d\n", i+1, signer.Hex(), sig.notBefore)
+		case sig.locked(*head):
+			fmt.Printf("Signer %d => %s, time-locked until #%d\n", i+1, signer.Hex(), sig.notBefore)
+		default:
+			fmt.Printf("Signer %d => %s, unlocked since #%d\n", i+1, signer.Hex(), sig.notBefore)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,254 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+// +build integration
+
+package main
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth"
+	"github.com/ethereum/go-ethereum/eth/downloader"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/les"
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// newIntegrationNode creates an in-process node running either a full node with
+// a les server, or a light client.
+func newIntegrationNode(t *testing.T, name string, config *eth.Config) *node.Node {
+	stack, err := node.New(&node.Config{
+		Name: name,
+		P2P: p2p.Config{
+			ListenAddr:  "127.0.0.1:0",
+			NoDiscovery: true,
+			MaxPeers:    10,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create %s node: %v", name, err)
+	}
+	err = stack.Register(func(ctx *node.ServiceContext) (node.Service, error) {
+		if config.SyncMode == downloader.LightSync {
+			return les.New(ctx, config)
+		}
+		fullNode, err := eth.New(ctx, config)
+		if fullNode != nil {
+			server, err := les.NewLesServer(fullNode, config)
+			if err != nil {
+				return nil, err
+			}
+			fullNode.AddLesServer(server)
+		}
+		return fullNode, err
+	})
+	if err != nil {
+		t.Fatalf("Failed to register %s service: %v", name, err)
+	}
+	if err := stack.Start(); err != nil {
+		t.Fatalf("Failed to start %s node: %v", name, err)
+	}
+	return stack
+}
+
+// generateBlocks extends the chain of the full node with empty blocks.
+func generateBlocks(t *testing.T, ethereum *eth.Ethereum, n int) {
+	chain := ethereum.BlockChain()
+	for n > 0 {
+		batch := n
+		if batch > 2048 {
+			batch = 2048
+		}
+		blocks, _ := core.GenerateChain(chain.Config(), chain.CurrentBlock(), ethash.NewFaker(), ethereum.ChainDb(), batch, nil)
+		if _, err := chain.InsertChain(blocks); err != nil {
+			t.Fatalf("Failed to insert blocks: %v", err)
+		}
+		n -= batch
+	}
+}
+
+// TestCheckpointRegistration runs the deploy, sign and publish steps of the tool
+// against an in-process les server and checks that a light client connecting to
+// the server syncs from the registered checkpoint.
+func TestCheckpointRegistration(t *testing.T) {
+	var (
+		key, _  = crypto.GenerateKey()
+		admin   = crypto.PubkeyToAddress(key.PublicKey)
+		genesis = &core.Genesis{
+			Config:     params.AllEthashProtocolChanges,
+			GasLimit:   8000000,
+			Difficulty: big.NewInt(1),
+			Alloc:      core.GenesisAlloc{admin: {Balance: new(big.Int).Mul(big.NewInt(1000), big.NewInt(params.Ether))}},
+		}
+		oracle = &params.CheckpointOracleConfig{
+			Address:   crypto.CreateAddress(admin, 0),
+			Signers:   []common.Address{admin},
+			Threshold: 1,
+		}
+	)
+	// Start a full node serving light clients, and generate enough blocks for
+	// a checkpoint to be signable
+	config := eth.DefaultConfig
+	config.Genesis = genesis
+	config.NetworkId = 1337
+	config.NoPruning = true
+	config.Ethash.PowMode = ethash.ModeFake
+	config.LightServ = 100
+	config.LightPeers = 5
+	config.CheckpointOracle = oracle
+	config.Miner.Etherbase = admin
+
+	server := newIntegrationNode(t, "server", &config)
+	defer server.Stop()
+
+	var ethereum *eth.Ethereum
+	if err := server.Service(&ethereum); err != nil {
+		t.Fatalf("Failed to retrieve ethereum service: %v", err)
+	}
+	node, err := server.Attach()
+	if err != nil {
+		t.Fatalf("Failed to attach to server: %v", err)
+	}
+	backend := ethclient.NewClient(node)
+	ethereum.SetContractBackend(backend)
+
+	generateBlocks(t, ethereum, int(params.CheckpointFrequency+params.CheckpointProcessConfirmations)+256)
+	ethereum.Miner().DisablePreseal() // Fake sealing always picks the empty block
+	if err := ethereum.StartMining(1); err != nil {
+		t.Fatalf("Failed to start mining: %v", err)
+	}
+	defer ethereum.StopMining()
+
+	// Deploy the oracle and wait for the checkpoint to be indexed
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	// Signing for the oracle address before deployment is only allowed explicitly,
+	// registration is refused until the contract exists
+	for {
+		if _, _, err = prepareSign(node, nil, admin, &oracle.Address, true); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Checkpoint not signable for undeployed oracle: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if _, _, err := prepareSign(node, nil, admin, &oracle.Address, false); err == nil {
+		t.Fatalf("Signing for undeployed oracle allowed implicitly")
+	}
+	if _, err := prepareRegistration(node, nil, nil); err == nil {
+		t.Fatalf("Registration allowed for undeployed oracle")
+	}
+	addr, tx, err := deployOracle(bind.NewKeyedTransactor(key), backend, []common.Address{admin}, 1)
+	if err != nil {
+		t.Fatalf("Failed to deploy oracle: %v", err)
+	}
+	if addr != oracle.Address {
+		t.Fatalf("Oracle address mismatch: have %x, want %x", addr, oracle.Address)
+	}
+	if _, err := bind.WaitDeployed(ctx, backend, tx); err != nil {
+		t.Fatalf("Failed to wait for oracle deployment: %v", err)
+	}
+	var checkpoint *params.TrustedCheckpoint
+	for {
+		if checkpoint, _, err = prepareSign(node, nil, admin, nil, false); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Checkpoint not signable: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if checkpoint.SectionIndex != 0 {
+		t.Fatalf("Checkpoint index mismatch: have %d, want 0", checkpoint.SectionIndex)
+	}
+	// Sign the checkpoint through a mock clef and publish it
+	clef := rpc.NewServer()
+	if err := clef.RegisterName("account", &mockClef{key: key}); err != nil {
+		t.Fatalf("Failed to register mock clef: %v", err)
+	}
+	defer clef.Stop()
+
+	signature, err := signCheckpoint(rpc.DialInProc(clef), admin, addr, checkpoint.SectionIndex, checkpoint.Hash())
+	if err != nil {
+		t.Fatalf("Failed to sign checkpoint: %v", err)
+	}
+	if signer, err := ecrecover(sighash(checkpoint.SectionIndex, addr, checkpoint.Hash()), common.FromHex(signature)); err != nil || signer != admin {
+		t.Fatalf("Signature recovery mismatch: have %x (%v), want %x", signer, err, admin)
+	}
+	reg, err := prepareRegistration(node, nil, [][]byte{common.FromHex(signature)})
+	if err != nil {
+		t.Fatalf("Failed to prepare registration: %v", err)
+	}
+	tx, err = reg.register(reg.oracle, bind.NewKeyedTransactor(key))
+	if err != nil {
+		t.Fatalf("Failed to register checkpoint: %v", err)
+	}
+	if receipt, err := bind.WaitMined(ctx, backend, tx); err != nil || receipt.Status != 1 {
+		t.Fatalf("Checkpoint registration failed: %v", err)
+	}
+	// Start a light client and ensure it syncs from the registered checkpoint
+	lconfig := eth.DefaultConfig
+	lconfig.Genesis = genesis
+	lconfig.NetworkId = 1337
+	lconfig.SyncMode = downloader.LightSync
+	lconfig.Ethash.PowMode = ethash.ModeFake
+	lconfig.CheckpointOracle = oracle
+
+	client := newIntegrationNode(t, "client", &lconfig)
+	defer client.Stop()
+
+	var lightEthereum *les.LightEthereum
+	if err := client.Service(&lightEthereum); err != nil {
+		t.Fatalf("Failed to retrieve light ethereum service: %v", err)
+	}
+	lnode, err := client.Attach()
+	if err != nil {
+		t.Fatalf("Failed to attach to client: %v", err)
+	}
+	lightEthereum.SetContractBackend(ethclient.NewClient(lnode))
+	client.Server().AddPeer(server.Server().Self())
+
+	for {
+		head := lightEthereum.BlockChain().CurrentHeader()
+		if head.Number.Uint64() >= params.CheckpointFrequency {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Light client did not sync, head #%d", head.Number)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if header := lightEthereum.BlockChain().GetHeaderByNumber(1); header != nil {
+		t.Errorf("Light client synced from genesis instead of the checkpoint")
+	}
+}
@@ -43,6 +43,11 @@ func init() {
 		commandDeploy,
 		commandSign,
 		commandPublish,
+		commandVerify,
+		commandServe,
+		commandAudit,
+		commandComputeAddress,
+		commandCompute,
 	}
 	app.Flags = []cli.Flag{
 		oracleFlag,
@@ -91,6 +96,84 @@ var (
 		Name:  "signatures",
 		Usage: "Comma separated checkpoint signatures to submit",
 	}
+	relayFlag = cli.StringFlag{
+		Name:  "relay",
+		Usage: "The rpc endpoint of a private transaction relay to publish through",
+	}
+	relayMethodFlag = cli.StringFlag{
+		Name:  "relay.method",
+		Value: "eth_sendPrivateTransaction",
+		Usage: "The rpc method of the relay accepting raw transactions",
+	}
+	relayBlocksFlag = cli.Uint64Flag{
+		Name:  "relay.blocks",
+		Value: 25,
+		Usage: "Number of blocks to wait for relayed inclusion before publishing publicly",
+	}
+	relayFallbackFlag = cli.BoolFlag{
+		Name:  "relay.fallback",
+		Usage: "Publish publicly right away if the relay rejects the transaction",
+	}
+	auditLogFlag = cli.StringFlag{
+		Name:  "audit",
+		Value: "~/.checkpoint-admin/audit.log",
+		Usage: "Path of the audit log recording all signing and publishing actions",
+	}
+	noAuditFlag = cli.BoolFlag{
+		Name:  "no-audit",
+		Usage: "Proceed even if the action cannot be recorded into the audit log",
+	}
+	allowUndeployedFlag = cli.BoolFlag{
+		Name:  "allow-undeployed",
+		Usage: "Sign for an oracle address without contract code (e.g. a CREATE2 address)",
+	}
+	notBeforeFlag = cli.Uint64Flag{
+		Name:  "not-before",
+		Usage: "Time-lock the signature until the given block number (enforced by this tool only)",
+	}
+	listenFlag = cli.StringFlag{
+		Name:  "listen",
+		Value: ":8787",
+		Usage: "Listening address of the signature collection server",
+	}
+	tokenFlag = cli.StringFlag{
+		Name:  "token",
+		Usage: "Shared bearer token authenticating the requests to the collection server",
+	}
+	stateFlag = cli.StringFlag{
+		Name:  "state",
+		Value: "~/.checkpoint-admin/signatures.json",
+		Usage: "Path of the file persisting the collected signatures",
+	}
+	autoRegisterFlag = cli.BoolFlag{
+		Name:  "auto-register",
+		Usage: "Register the checkpoint through clef as soon as the signature threshold is reached",
+	}
+	deployerFlag = cli.StringFlag{
+		Name:  "deployer",
+		Usage: "Address of the contract executing CREATE2",
+	}
+	saltFlag = cli.StringFlag{
+		Name:  "salt",
+		Usage: "32 byte hex salt of the CREATE2 deployment",
+	}
+	initcodeHashFlag = cli.StringFlag{
+		Name:  "initcode-hash",
+		Usage: "Keccak256 hash of the init code of the CREATE2 deployment",
+	}
+	computeFlag = cli.BoolFlag{
+		Name:  "compute",
+		Usage: "Compute the checkpoint from the block headers instead of querying the les API",
+	}
+	computeDirFlag = cli.StringFlag{
+		Name:  "compute.dir",
+		Usage: "Directory to persist the partially computed tries into (default: per chain temporary directory)",
+	}
+	computeBatchFlag = cli.IntFlag{
+		Name:  "compute.batch",
+		Value: 256,
+		Usage: "Number of block headers to request from the node in one batch",
+	}
 )
 
 func main() {
@@ -0,0 +1,161 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// relayPollInterval is the time between two inclusion checks of a relayed
+// transaction.
+var relayPollInterval = 3 * time.Second
+
+// txCapturer is a contract backend which captures signed transactions instead of
+// sending them into the network, allowing them to be submitted by other means.
+type txCapturer struct {
+	bind.ContractBackend
+	tx *types.Transaction
+}
+
+// SendTransaction implements bind.ContractTransactor, capturing the transaction.
+func (c *txCapturer) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	c.tx = tx
+	return nil
+}
+
+// relayChain is the subset of the public node's API needed to track and fall
+// back from a relayed transaction.
+type relayChain interface {
+	ChainID(ctx context.Context) (*big.Int, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error)
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+}
+
+// checkReplayProtected ensures that the transaction is EIP-155 signed for the
+// chain the public node is on, so the relay can't replay it elsewhere.
+func checkReplayProtected(ctx context.Context, chain relayChain, tx *types.Transaction) error {
+	chainID, err := chain.ChainID(ctx)
+	if err != nil {
+		return err
+	}
+	if !tx.Protected() {
+		return errors.New("transaction is not replay protected")
+	}
+	if tx.ChainId().Cmp(chainID) != 0 {
+		return fmt.Errorf("transaction chain id mismatch: have %v, want %v", tx.ChainId(), chainID)
+	}
+	return nil
+}
+
+// sendViaRelay submits a signed transaction through a private relay using the
+// given JSON-RPC method and waits for its inclusion. If it is not included within
+// the given number of blocks, the transaction is sent to the public endpoint
+// instead. If the relay rejects the transaction outright, it is only sent
+// publicly right away if fallback is set, otherwise the rejection is returned.
+// The returned flag reports whether the transaction was included through the
+// relay.
+func sendViaRelay(ctx context.Context, relay *rpc.Client, method string, chain relayChain, tx *types.Transaction, blocks uint64, fallback bool) (bool, error) {
+	head, err := chain.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	blob, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		return false, err
+	}
+	deadline := head.Number.Uint64() + blocks
+	req := map[string]interface{}{
+		"tx":             hexutil.Bytes(blob),
+		"maxBlockNumber": hexutil.Uint64(deadline),
+	}
+	if err := relay.CallContext(ctx, nil, method, req); err != nil {
+		if !fallback {
+			return false, fmt.Errorf("relay rejected transaction: %v", err)
+		}
+		log.Warn("Relay rejected transaction, sending publicly", "tx", tx.Hash(), "err", err)
+		return sendPublicly(ctx, chain, tx)
+	}
+	log.Info("Submitted transaction to relay", "tx", tx.Hash(), "deadline", deadline)
+
+	for {
+		if included, err := checkIncluded(ctx, chain, tx); included || err != nil {
+			return included, err
+		}
+		head, err := chain.HeaderByNumber(ctx, nil)
+		if err != nil {
+			return false, err
+		}
+		if head.Number.Uint64() > deadline {
+			log.Warn("Relayed transaction not included, sending publicly", "tx", tx.Hash(), "head", head.Number)
+			return sendPublicly(ctx, chain, tx)
+		}
+		select {
+		case <-time.After(relayPollInterval):
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// sendPublicly sends a previously relayed transaction to the public endpoint,
+// unless the relay got it included meanwhile. If the node refuses it as already
+// known or as reusing a spent nonce, the send is considered successful if the
+// transaction turns out to be included. The returned flag reports whether the
+// transaction was included through the relay.
+func sendPublicly(ctx context.Context, chain relayChain, tx *types.Transaction) (bool, error) {
+	if included, err := checkIncluded(ctx, chain, tx); included || err != nil {
+		return included, err
+	}
+	err := chain.SendTransaction(ctx, tx)
+	if err == nil {
+		return false, nil
+	}
+	if msg := err.Error(); strings.Contains(msg, core.ErrAlreadyKnown.Error()) || strings.Contains(msg, core.ErrNonceTooLow.Error()) {
+		if included, cerr := checkIncluded(ctx, chain, tx); included || cerr != nil {
+			return included, cerr
+		}
+	}
+	return false, err
+}
+
+// checkIncluded reports whether the transaction has a receipt on the public node.
+func checkIncluded(ctx context.Context, chain relayChain, tx *types.Transaction) (bool, error) {
+	receipt, err := chain.TransactionReceipt(ctx, tx.Hash())
+	if err == nil && receipt != nil {
+		return true, nil
+	}
+	if err != nil && err != ethereum.NotFound {
+		return false, err
+	}
+	return false, nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// mockRelay is a private transaction relay accepting or rejecting transactions.
+type mockRelay struct {
+	reject bool
+	txs    []*types.Transaction
+}
+
+func (r *mockRelay) SendPrivateTransaction(req struct {
+	Tx             hexutil.Bytes  `json:"tx"`
+	MaxBlockNumber hexutil.Uint64 `json:"maxBlockNumber"`
+}) error {
+	if r.reject {
+		return errors.New("rejected")
+	}
+	tx := new(types.Transaction)
+	if err := rlp.DecodeBytes(req.Tx, tx); err != nil {
+		return err
+	}
+	r.txs = append(r.txs, tx)
+	return nil
+}
+
+// mockChain is a public node whose head advances on every poll, including the
+// transaction once a given block is reached.
+type mockChain struct {
+	lock      sync.Mutex
+	head      uint64
+	includeAt uint64 // Block at which relayed transactions get included, 0 = never
+	relayed   bool   // Whether the relay accepted the transaction
+	sendErr   error  // Error to return from public sends
+	sendMined bool   // Whether a failing public send finds the transaction mined
+	mined     bool   // Whether the transaction got mined outside the relay
+	sent      []*types.Transaction
+}
+
+func (c *mockChain) ChainID(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(1), nil
+}
+
+func (c *mockChain) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.head++
+	return &types.Header{Number: new(big.Int).SetUint64(c.head)}, nil
+}
+
+func (c *mockChain) TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.mined || (c.relayed && c.includeAt != 0 && c.head >= c.includeAt) {
+		return &types.Receipt{TxHash: hash}, nil
+	}
+	return nil, ethereum.NotFound
+}
+
+func (c *mockChain) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.sendErr != nil {
+		c.mined = c.sendMined
+		return c.sendErr
+	}
+	c.sent = append(c.sent, tx)
+	return nil
+}
+
+// startRelay serves the mock relay over HTTP and dials it.
+func startRelay(t *testing.T, relay *mockRelay) (*rpc.Client, func()) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", relay); err != nil {
+		t.Fatalf("Failed to register relay: %v", err)
+	}
+	httpsrv := httptest.NewServer(server)
+	client, err := rpc.Dial(httpsrv.URL)
+	if err != nil {
+		t.Fatalf("Failed to dial relay: %v", err)
+	}
+	return client, func() {
+		client.Close()
+		httpsrv.Close()
+		server.Stop()
+	}
+}
+
+func signedTestTx(t *testing.T, signer types.Signer) *types.Transaction {
+	key, _ := crypto.GenerateKey()
+	tx, err := types.SignTx(types.NewTransaction(0, common.Address{0x01}, big.NewInt(0), 100000, big.NewInt(1), nil), signer, key)
+	if err != nil {
+		t.Fatalf("Failed to sign transaction: %v", err)
+	}
+	return tx
+}
+
+func TestRelayReplayProtection(t *testing.T) {
+	chain := new(mockChain)
+	if err := checkReplayProtected(context.Background(), chain, signedTestTx(t, types.NewEIP155Signer(big.NewInt(1)))); err != nil {
+		t.Errorf("EIP-155 transaction rejected: %v", err)
+	}
+	if err := checkReplayProtected(context.Background(), chain, signedTestTx(t, types.NewEIP155Signer(big.NewInt(5)))); err == nil {
+		t.Errorf("Transaction for other chain accepted")
+	}
+	if err := checkReplayProtected(context.Background(), chain, signedTestTx(t, types.HomesteadSigner{})); err == nil {
+		t.Errorf("Unprotected transaction accepted")
+	}
+}
+
+func TestRelaySubmission(t *testing.T) {
+	defer func(interval time.Duration) { relayPollInterval = interval }(relayPollInterval)
+	relayPollInterval = time.Millisecond
+
+	tests := []struct {
+		name      string
+		reject    bool
+		fallback  bool
+		includeAt uint64
+		sendErr   error
+		sendMined bool
+		relayed   bool
+		sent      bool
+		fail      bool
+	}{
+		{name: "success", includeAt: 5, relayed: true},
+		{name: "rejection", reject: true, fail: true},
+		{name: "rejection fallback", reject: true, fallback: true, sent: true},
+		{name: "deadline", sent: true},
+		{name: "included at deadline", includeAt: 12, relayed: true},
+		{name: "already known", sendErr: core.ErrAlreadyKnown, sendMined: true, relayed: true},
+		{name: "nonce too low", sendErr: core.ErrNonceTooLow, sendMined: true, relayed: true},
+		{name: "nonce too low unmined", sendErr: core.ErrNonceTooLow, fail: true},
+	}
+	for _, tt := range tests {
+		relay := &mockRelay{reject: tt.reject}
+		client, stop := startRelay(t, relay)
+
+		chain := &mockChain{includeAt: tt.includeAt, relayed: !tt.reject, sendErr: tt.sendErr, sendMined: tt.sendMined}
+		tx := signedTestTx(t, types.NewEIP155Signer(big.NewInt(1)))
+
+		relayed, err := sendViaRelay(context.Background(), client, "eth_sendPrivateTransaction", chain, tx, 10, tt.fallback)
+		stop()
+		if tt.fail != (err != nil) {
+			t.Fatalf("%s: relay submission error mismatch: have %v, want failure %v", tt.name, err, tt.fail)
+		}
+		if relayed != tt.relayed {
+			t.Errorf("%s: relayed mismatch: have %v, want %v", tt.name, relayed, tt.relayed)
+		}
+		if !tt.reject && (len(relay.txs) != 1 || relay.txs[0].Hash() != tx.Hash()) {
+			t.Errorf("%s: relay did not receive the transaction", tt.name)
+		}
+		if !tt.sent && len(chain.sent) != 0 {
+			t.Errorf("%s: transaction sent publicly", tt.name)
+		}
+		if tt.sent && (len(chain.sent) != 1 || chain.sent[0].Hash() != tx.Hash()) {
+			t.Errorf("%s: transaction not sent publicly", tt.name)
+		}
+	}
+}
@@ -0,0 +1,504 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/cmd/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var commandServe = cli.Command{
+	Name:  "serve",
+	Usage: "Run a signature collection server for a checkpoint",
+	Description: `
+The serve command runs an HTTP service collecting the signatures of the admins
+for a single checkpoint. The endpoints are:
+
+  POST /signatures  submit a signature as {"signature": "0x..."}
+  GET  /progress    show the collected signatures and the missing admins
+  POST /register    register the checkpoint if the threshold is reached
+
+Every request needs to carry the shared token as "Authorization: Bearer <token>".
+Submitted signatures are verified against the admin list of the oracle and the
+expected checkpoint immediately. The collected signatures are persisted into the
+state file, so the server can be restarted without losing them.
+
+With --auto-register, the checkpoint is registered through clef as soon as the
+threshold is reached. Otherwise the progress lists the collected signatures in
+the format expected by the publish command.`,
+	Flags: []cli.Flag{
+		nodeURLFlag,
+		clefURLFlag,
+		signerFlag,
+		indexFlag,
+		oracleFlag,
+		thresholdFlag,
+		listenFlag,
+		tokenFlag,
+		stateFlag,
+		autoRegisterFlag,
+		auditLogFlag,
+		noAuditFlag,
+	},
+	Action: utils.MigrateFlags(serve),
+}
+
+// registerFunc submits the registration of the collected checkpoint with the
+// given signatures, returning the hash of the registration transaction.
+type registerFunc func(sigs []*checkpointSig) (common.Hash, error)
+
+// collectorState is the persisted state of a signature collector.
+type collectorState struct {
+	Oracle     common.Address `json:"oracle"`
+	Index      uint64         `json:"index"`
+	Checkpoint common.Hash    `json:"checkpoint"`
+	Signatures []string       `json:"signatures"`
+	TxHash     *common.Hash   `json:"tx,omitempty"`
+}
+
+// collectedSig is a verified signature held by the collector.
+type collectedSig struct {
+	Signer    common.Address `json:"signer"`
+	NotBefore uint64         `json:"notBefore,omitempty"`
+
+	sig *checkpointSig
+}
+
+// collectionProgress is the progress of the signature collection, as reported
+// by the progress endpoint.
+type collectionProgress struct {
+	Oracle     common.Address   `json:"oracle"`
+	Index      uint64           `json:"index"`
+	Checkpoint common.Hash      `json:"checkpoint"`
+	Threshold  int              `json:"threshold"`
+	Signed     []collectedSig   `json:"signed"`
+	Missing    []common.Address `json:"missing"`
+	Signatures string           `json:"signatures"`      // Comma separated, as accepted by publish
+	TxHash     *common.Hash     `json:"tx,omitempty"`    // Registration transaction, if registered
+	Error      string           `json:"error,omitempty"` // Last registration failure
+}
+
+// collector gathers the signatures of the admins for a single checkpoint.
+type collector struct {
+	oracle    common.Address
+	index     uint64
+	hash      common.Hash
+	admins    []common.Address
+	threshold int
+
+	path     string       // Path of the state file
+	audit    *auditLog    // Audit log of the mutations, nil if disabled
+	register registerFunc // Automatic registration, nil if disabled
+
+	lock   sync.Mutex
+	sigs   map[common.Address]*collectedSig
+	tx     *common.Hash // Registration transaction, nil if not registered yet
+	regErr error        // Last registration failure
+}
+
+// newCollector creates a signature collector for the given checkpoint, loading
+// the signatures collected earlier from the state file if it exists.
+func newCollector(oracle common.Address, index uint64, hash common.Hash, admins []common.Address, threshold int, path string, audit *auditLog, register registerFunc) (*collector, error) {
+	if threshold <= 0 || threshold > len(admins) {
+		return nil, fmt.Errorf("invalid threshold %d for %d admins", threshold, len(admins))
+	}
+	c := &collector{
+		oracle:    oracle,
+		index:     index,
+		hash:      hash,
+		admins:    admins,
+		threshold: threshold,
+		path:      path,
+		audit:     audit,
+		register:  register,
+		sigs:      make(map[common.Address]*collectedSig),
+	}
+	blob, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state collectorState
+	if err := json.Unmarshal(blob, &state); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+	if state.Oracle != oracle || state.Index != index || state.Checkpoint != hash {
+		return nil, fmt.Errorf("state file %s belongs to checkpoint %d => %s of oracle %s", path, state.Index, state.Checkpoint.Hex(), state.Oracle.Hex())
+	}
+	for _, s := range state.Signatures {
+		sig, err := c.check(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+		}
+		c.sigs[sig.Signer] = sig
+	}
+	c.tx = state.TxHash
+	return c, nil
+}
+
+// check decodes the signature and verifies that it's made by an admin for the
+// expected checkpoint.
+func (c *collector) check(s string) (*collectedSig, error) {
+	sig, err := decodeSignature(s)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := sig.verify(c.index, c.oracle, c.hash)
+	if err != nil {
+		return nil, err
+	}
+	var admin bool
+	for _, addr := range c.admins {
+		if addr == signer {
+			admin = true
+			break
+		}
+	}
+	if !admin {
+		return nil, fmt.Errorf("signer %s is not an admin", signer.Hex())
+	}
+	return &collectedSig{Signer: signer, NotBefore: sig.notBefore, sig: sig}, nil
+}
+
+// submit verifies and stores a signature, then registers the checkpoint if the
+// threshold is reached and automatic registration is enabled. A resubmission by
+// the same admin replaces the previous signature.
+func (c *collector) submit(s string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.tx != nil {
+		return errors.New("checkpoint already registered")
+	}
+	collected, err := c.check(s)
+	if err != nil {
+		return err
+	}
+	prev := c.sigs[collected.Signer]
+	c.sigs[collected.Signer] = collected
+	if err := c.save(); err != nil {
+		// Keep the collected set in sync with the state file
+		if prev != nil {
+			c.sigs[collected.Signer] = prev
+		} else {
+			delete(c.sigs, collected.Signer)
+		}
+		return err
+	}
+	if err := c.record(auditEntry{Signer: collected.Signer, Signature: s, Outcome: "collected"}); err != nil {
+		return err
+	}
+	log.Info("Collected checkpoint signature", "signer", collected.Signer, "notBefore", collected.NotBefore, "signed", len(c.sigs), "threshold", c.threshold)
+
+	if c.register != nil && len(c.sigs) >= c.threshold {
+		c.tryRegister() // Failures are reported through the progress
+	}
+	return nil
+}
+
+// registerNow registers the checkpoint with the collected signatures.
+func (c *collector) registerNow() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.tx != nil {
+		return errors.New("checkpoint already registered")
+	}
+	if c.register == nil {
+		return errors.New("automatic registration disabled")
+	}
+	if len(c.sigs) < c.threshold {
+		return fmt.Errorf("%d of %d signatures collected", len(c.sigs), c.threshold)
+	}
+	return c.tryRegister()
+}
+
+// tryRegister submits the registration, recording the attempt before and the
+// outcome after it.
+//
+// Note, this function assumes the lock is held.
+func (c *collector) tryRegister() error {
+	sorted := c.sorted()
+	sigs := make([]*checkpointSig, len(sorted))
+	for i, sig := range sorted {
+		sigs[i] = sig.sig
+	}
+	if err := c.record(auditEntry{Outcome: "attempt"}); err != nil {
+		return err
+	}
+	tx, err := c.register(sigs)
+	if err != nil {
+		c.regErr = err
+		log.Warn("Failed to register checkpoint", "index", c.index, "hash", c.hash, "err", err)
+		if aerr := c.record(auditEntry{Outcome: fmt.Sprintf("failed: %v", err)}); aerr != nil {
+			return aerr
+		}
+		return err
+	}
+	c.tx, c.regErr = &tx, nil
+	if err := c.save(); err != nil {
+		return err
+	}
+	log.Info("Registered checkpoint", "index", c.index, "hash", c.hash, "tx", tx.Hex())
+	return c.record(auditEntry{TxHash: tx.Hex(), Outcome: "registered"})
+}
+
+// sorted returns the collected signatures sorted by signer address, the order
+// required by the oracle contract.
+//
+// Note, this function assumes the lock is held.
+func (c *collector) sorted() []*collectedSig {
+	sigs := make([]*collectedSig, 0, len(c.sigs))
+	for _, sig := range c.sigs {
+		sigs = append(sigs, sig)
+	}
+	sort.Slice(sigs, func(i, j int) bool {
+		return bytes.Compare(sigs[i].Signer[:], sigs[j].Signer[:]) < 0
+	})
+	return sigs
+}
+
+// progress returns the current state of the collection.
+func (c *collector) progress() *collectionProgress {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	res := &collectionProgress{
+		Oracle:     c.oracle,
+		Index:      c.index,
+		Checkpoint: c.hash,
+		Threshold:  c.threshold,
+		Signed:     []collectedSig{},
+		Missing:    []common.Address{},
+		TxHash:     c.tx,
+	}
+	var encoded []string
+	for _, sig := range c.sorted() {
+		res.Signed = append(res.Signed, *sig)
+		encoded = append(encoded, sig.sig.String())
+	}
+	res.Signatures = strings.Join(encoded, ",")
+	for _, admin := range c.admins {
+		if _, ok := c.sigs[admin]; !ok {
+			res.Missing = append(res.Missing, admin)
+		}
+	}
+	if c.regErr != nil {
+		res.Error = c.regErr.Error()
+	}
+	return res
+}
+
+// save persists the collected signatures into the state file.
+//
+// Note, this function assumes the lock is held.
+func (c *collector) save() error {
+	state := collectorState{
+		Oracle:     c.oracle,
+		Index:      c.index,
+		Checkpoint: c.hash,
+		Signatures: []string{},
+		TxHash:     c.tx,
+	}
+	for _, sig := range c.sorted() {
+		state.Signatures = append(state.Signatures, sig.sig.String())
+	}
+	blob, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+	// Write into a temporary file first, a crash must not lose the collected set
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, blob, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// record appends an entry of the collected checkpoint to the audit log, if
+// auditing is enabled.
+//
+// Note, this function assumes the lock is held.
+func (c *collector) record(entry auditEntry) error {
+	if c.audit == nil {
+		return nil
+	}
+	entry.Command, entry.Index, entry.Checkpoint = "serve", c.index, c.hash
+	return c.audit.append(entry)
+}
+
+// collectorHandler returns the HTTP handler of the collector, accepting only
+// requests authenticated with the given bearer token.
+func collectorHandler(c *collector, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/signatures", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Signature string `json:"signature"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := c.submit(req.Signature); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, c.progress())
+	})
+	mux.HandleFunc("/progress", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, c.progress())
+	})
+	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := c.registerNow(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, c.progress())
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON sends the given value as a JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debug("Failed to send response", "err", err)
+	}
+}
+
+// nodeRegistrar returns a registration function submitting the checkpoint into
+// the oracle through the connected node, refusing time-locked signatures and
+// checkpoints not matching the collected one.
+func nodeRegistrar(node *rpc.Client, index uint64, hash common.Hash, opts *bind.TransactOpts) registerFunc {
+	return func(sigs []*checkpointSig) (common.Hash, error) {
+		plain := make([][]byte, len(sigs))
+		for i, sig := range sigs {
+			plain[i] = sig.sig
+		}
+		reg, err := prepareRegistration(node, &index, plain)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		if reg.checkpoint.Hash() != hash {
+			return common.Hash{}, fmt.Errorf("checkpoint mismatch: node has %s, collected %s", reg.checkpoint.Hash().Hex(), hash.Hex())
+		}
+		reqCtx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+		head, err := ethclient.NewClient(node).HeaderByNumber(reqCtx, nil)
+		cancelFn()
+		if err != nil {
+			return common.Hash{}, err
+		}
+		if err := checkTimeLocks(sigs, index, reg.addr, hash, head.Number.Uint64()); err != nil {
+			return common.Hash{}, err
+		}
+		tx, err := reg.register(reg.oracle, opts)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		return tx.Hash(), nil
+	}
+}
+
+// serve runs the signature collection server for the checkpoint retrieved from
+// the connected node (the latest one if no index is given).
+func serve(ctx *cli.Context) error {
+	token := ctx.String(tokenFlag.Name)
+	if token == "" {
+		utils.Fatalf("Please specify the shared access token (--%s)", tokenFlag.Name)
+	}
+	if !ctx.IsSet(thresholdFlag.Name) {
+		utils.Fatalf("Please specify the signature threshold of the oracle (--%s)", thresholdFlag.Name)
+	}
+	var index *uint64
+	if ctx.GlobalIsSet(indexFlag.Name) {
+		n := uint64(ctx.GlobalInt64(indexFlag.Name))
+		index = &n
+	}
+	node := newRPCClient(ctx.GlobalString(nodeURLFlag.Name))
+	checkpoint, err := fetchCheckpoint(node, index)
+	if err != nil {
+		utils.Fatalf("%v", err)
+	}
+	addr, oracle := newContract(node)
+	if ctx.IsSet(oracleFlag.Name) && common.HexToAddress(ctx.String(oracleFlag.Name)) != addr {
+		utils.Fatalf("Oracle mismatch: node uses %s, requested %s", addr.Hex(), ctx.String(oracleFlag.Name))
+	}
+	admins, err := oracle.Contract().GetAllAdmin(nil)
+	if err != nil {
+		utils.Fatalf("Failed to retrieve oracle admins: %v", err)
+	}
+	var register registerFunc
+	if ctx.Bool(autoRegisterFlag.Name) {
+		register = nodeRegistrar(node, checkpoint.SectionIndex, checkpoint.Hash(), newClefSigner(ctx))
+	}
+	c, err := newCollector(addr, checkpoint.SectionIndex, checkpoint.Hash(), admins, int(ctx.Int64(thresholdFlag.Name)), expandHome(ctx.String(stateFlag.Name)), newAuditLog(ctx), register)
+	if err != nil {
+		utils.Fatalf("Failed to create signature collector: %v", err)
+	}
+	progress := c.progress()
+	fmt.Printf("Oracle     => %s\n", addr.Hex())
+	fmt.Printf("Index %4d => %s\n", checkpoint.SectionIndex, checkpoint.Hash().Hex())
+	fmt.Printf("Collected  => %d of %d\n", len(progress.Signed), progress.Threshold)
+	fmt.Println()
+
+	log.Info("Serving signature collection", "listen", ctx.String(listenFlag.Name))
+	return http.ListenAndServe(ctx.String(listenFlag.Name), collectorHandler(c, token))
+}
@@ -0,0 +1,325 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/contracts/checkpointoracle"
+	"github.com/ethereum/go-ethereum/contracts/checkpointoracle/contract"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// collectorClient sends authenticated requests to a collection server.
+type collectorClient struct {
+	t     *testing.T
+	url   string
+	token string
+}
+
+// do sends a request to the given endpoint, returning the status code and the
+// decoded progress if the request succeeded.
+func (c *collectorClient) do(method, path string, body interface{}) (int, *collectionProgress) {
+	c.t.Helper()
+
+	var reader *bytes.Reader
+	switch body := body.(type) {
+	case nil:
+		reader = bytes.NewReader(nil)
+	case string:
+		reader = bytes.NewReader([]byte(body))
+	default:
+		blob, _ := json.Marshal(body)
+		reader = bytes.NewReader(blob)
+	}
+	req, err := http.NewRequest(method, c.url+path, reader)
+	if err != nil {
+		c.t.Fatalf("Failed to create request: %v", err)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("Failed to send request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return res.StatusCode, nil
+	}
+	var progress collectionProgress
+	if err := json.NewDecoder(res.Body).Decode(&progress); err != nil {
+		c.t.Fatalf("Failed to decode progress: %v", err)
+	}
+	return res.StatusCode, &progress
+}
+
+// submit posts a signature to the collection server.
+func (c *collectorClient) submit(sig string) (int, *collectionProgress) {
+	c.t.Helper()
+	return c.do(http.MethodPost, "/signatures", map[string]string{"signature": sig})
+}
+
+// newTestAdmins creates the given number of admin keys.
+func newTestAdmins(n int) ([]*ecdsa.PrivateKey, []common.Address) {
+	var (
+		keys   []*ecdsa.PrivateKey
+		admins []common.Address
+	)
+	for i := 0; i < n; i++ {
+		key, _ := crypto.GenerateKey()
+		keys = append(keys, key)
+		admins = append(admins, crypto.PubkeyToAddress(key.PublicKey))
+	}
+	return keys, admins
+}
+
+// Tests that the collection server authenticates the requests, only accepts the
+// signatures of the admins for the expected checkpoint, persists them across
+// restarts and registers the checkpoint once the threshold is reached.
+func TestCollectorHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint-admin-serve-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		keys, admins = newTestAdmins(3)
+		outsider, _  = crypto.GenerateKey()
+		oracle       = common.HexToAddress("0xcafebabe")
+		hash         = common.HexToHash("0xdeadbeef")
+		state        = filepath.Join(dir, "signatures.json")
+		txHash       = common.HexToHash("0x01")
+
+		registered [][]*checkpointSig
+		failure    error
+	)
+	audit, err := openAuditLog(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	register := func(sigs []*checkpointSig) (common.Hash, error) {
+		if failure != nil {
+			return common.Hash{}, failure
+		}
+		registered = append(registered, sigs)
+		return txHash, nil
+	}
+	start := func() (*collectorClient, func()) {
+		c, err := newCollector(oracle, 5, hash, admins, 2, state, audit, register)
+		if err != nil {
+			t.Fatalf("Failed to create collector: %v", err)
+		}
+		server := httptest.NewServer(collectorHandler(c, "secret"))
+		return &collectorClient{t: t, url: server.URL, token: "secret"}, server.Close
+	}
+	client, stop := start()
+
+	// Unauthenticated requests need to be rejected
+	for _, token := range []string{"", "wrong", "Secret"} {
+		anon := &collectorClient{t: t, url: client.url, token: token}
+		if code, _ := anon.do(http.MethodGet, "/progress", nil); code != http.StatusUnauthorized {
+			t.Errorf("token %q: status mismatch: have %d, want %d", token, code, http.StatusUnauthorized)
+		}
+		if code, _ := anon.submit(signTimeLocked(t, keys[0], oracle, 5, hash, 0)); code != http.StatusUnauthorized {
+			t.Errorf("token %q: submission status mismatch: have %d, want %d", token, code, http.StatusUnauthorized)
+		}
+	}
+	req, _ := http.NewRequest(http.MethodGet, client.url+"/progress", nil)
+	req.Header.Set("Authorization", "secret")
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token without bearer scheme accepted: %v", err)
+	} else {
+		res.Body.Close()
+	}
+	// Invalid signatures need to be rejected
+	invalid := []string{
+		"0xzz",
+		signTimeLocked(t, outsider, oracle, 5, hash, 0),
+		signTimeLocked(t, keys[0], oracle, 6, hash, 0),
+		signTimeLocked(t, keys[0], common.HexToAddress("0xbabecafe"), 5, hash, 0),
+	}
+	for i, sig := range invalid {
+		if code, _ := client.submit(sig); code != http.StatusBadRequest {
+			t.Errorf("invalid signature %d: status mismatch: have %d, want %d", i, code, http.StatusBadRequest)
+		}
+	}
+	if code, _ := client.do(http.MethodPost, "/signatures", "{"); code != http.StatusBadRequest {
+		t.Errorf("malformed request status mismatch: have %d, want %d", code, http.StatusBadRequest)
+	}
+	if code, _ := client.do(http.MethodPost, "/progress", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("wrong method status mismatch: have %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+	// Collect a signature and check that it survives a restart
+	first := signTimeLocked(t, keys[0], oracle, 5, hash, 0)
+	code, progress := client.submit(first)
+	if code != http.StatusOK {
+		t.Fatalf("submission status mismatch: have %d, want %d", code, http.StatusOK)
+	}
+	if len(progress.Signed) != 1 || progress.Signed[0].Signer != admins[0] || len(progress.Missing) != 2 || progress.Signatures != first {
+		t.Fatalf("progress mismatch: %+v", progress)
+	}
+	if code, _ := client.do(http.MethodPost, "/register", nil); code != http.StatusConflict {
+		t.Errorf("premature registration status mismatch: have %d, want %d", code, http.StatusConflict)
+	}
+	stop()
+
+	client, stop = start()
+	defer stop()
+
+	if _, progress := client.do(http.MethodGet, "/progress", nil); progress == nil || len(progress.Signed) != 1 || progress.Signed[0].Signer != admins[0] {
+		t.Fatalf("collected signature lost on restart: %+v", progress)
+	}
+	if _, err := newCollector(oracle, 6, hash, admins, 2, state, nil, nil); err == nil {
+		t.Fatalf("state of another checkpoint accepted")
+	}
+	// Reach the threshold with a failing registration, then retry manually
+	failure = errors.New("node unavailable")
+	second := signTimeLocked(t, keys[1], oracle, 5, hash, 100)
+	code, progress = client.submit(second)
+	if code != http.StatusOK {
+		t.Fatalf("submission status mismatch: have %d, want %d", code, http.StatusOK)
+	}
+	if progress.TxHash != nil || !strings.Contains(progress.Error, failure.Error()) {
+		t.Fatalf("registration failure not reported: %+v", progress)
+	}
+	if progress.Signed[1].NotBefore != 100 && progress.Signed[0].NotBefore != 100 {
+		t.Fatalf("time lock not reported: %+v", progress)
+	}
+	failure = nil
+	code, progress = client.do(http.MethodPost, "/register", nil)
+	if code != http.StatusOK || progress.TxHash == nil || *progress.TxHash != txHash || progress.Error != "" {
+		t.Fatalf("registration mismatch: status %d, progress %+v", code, progress)
+	}
+	if len(registered) != 1 || len(registered[0]) != 2 {
+		t.Fatalf("registered signatures mismatch: %v", registered)
+	}
+	if sigs := registered[0]; bytes.Compare(mustVerify(t, sigs[0], oracle, hash).Bytes(), mustVerify(t, sigs[1], oracle, hash).Bytes()) >= 0 {
+		t.Fatalf("registered signatures not sorted by signer")
+	}
+	// Nothing is accepted after the registration
+	if code, _ := client.submit(signTimeLocked(t, keys[2], oracle, 5, hash, 0)); code != http.StatusBadRequest {
+		t.Errorf("submission after registration status mismatch: have %d, want %d", code, http.StatusBadRequest)
+	}
+	if code, _ := client.do(http.MethodPost, "/register", nil); code != http.StatusConflict {
+		t.Errorf("repeated registration status mismatch: have %d, want %d", code, http.StatusConflict)
+	}
+	// Every mutation needs to be audited: two collections, and an attempt before
+	// both the failure and the registration
+	if _, entries, err := readAuditLog(audit.path); err != nil || entries != 6 {
+		t.Fatalf("audit log mismatch: have %d entries (%v), want 6", entries, err)
+	}
+}
+
+// mustVerify recovers the signer of a checkpoint signature.
+func mustVerify(t *testing.T, sig *checkpointSig, oracle common.Address, hash common.Hash) common.Address {
+	t.Helper()
+
+	signer, err := sig.verify(5, oracle, hash)
+	if err != nil {
+		t.Fatalf("Failed to verify signature: %v", err)
+	}
+	return signer
+}
+
+// Tests that the signatures collected over HTTP are accepted by the oracle
+// contract when registered automatically.
+func TestCollectorRegistration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint-admin-serve-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys, admins := newTestAdmins(3)
+	backend := backends.NewSimulatedBackend(core.GenesisAlloc{admins[0]: {Balance: big.NewInt(1000000000)}}, 10000000)
+	defer backend.Close()
+
+	opts := bind.NewKeyedTransactor(keys[0])
+	addr, _, _, err := contract.DeployCheckpointOracle(opts, backend, admins, big.NewInt(4), big.NewInt(1), big.NewInt(2))
+	if err != nil {
+		t.Fatalf("Failed to deploy oracle: %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		backend.Commit()
+	}
+	oracle, err := checkpointoracle.NewCheckpointOracle(addr, backend)
+	if err != nil {
+		t.Fatalf("Failed to bind oracle: %v", err)
+	}
+	hash := common.HexToHash("0xdeadbeef")
+	register := func(sigs []*checkpointSig) (common.Hash, error) {
+		plain := make([][]byte, len(sigs))
+		for i, sig := range sigs {
+			plain[i] = sig.sig
+		}
+		head := backend.Blockchain().CurrentHeader()
+		recent := backend.Blockchain().GetHeaderByHash(head.ParentHash)
+
+		tx, err := oracle.RegisterCheckpoint(opts, 0, hash[:], recent.Number, recent.Hash(), plain)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		backend.Commit()
+		return tx.Hash(), nil
+	}
+	c, err := newCollector(addr, 0, hash, admins, 2, filepath.Join(dir, "signatures.json"), nil, register)
+	if err != nil {
+		t.Fatalf("Failed to create collector: %v", err)
+	}
+	server := httptest.NewServer(collectorHandler(c, "secret"))
+	defer server.Close()
+
+	client := &collectorClient{t: t, url: server.URL, token: "secret"}
+	for _, key := range keys[1:] {
+		if code, _ := client.submit(signTimeLocked(t, key, addr, 0, hash, 0)); code != http.StatusOK {
+			t.Fatalf("submission status mismatch: have %d, want %d", code, http.StatusOK)
+		}
+	}
+	_, progress := client.do(http.MethodGet, "/progress", nil)
+	if progress.TxHash == nil {
+		t.Fatalf("checkpoint not registered: %+v", progress)
+	}
+	receipt, err := backend.TransactionReceipt(nil, *progress.TxHash)
+	if err != nil || receipt.Status != 1 {
+		t.Fatalf("registration transaction failed: %v", err)
+	}
+	index, registered, _, err := oracle.Contract().GetLatestCheckpoint(nil)
+	if err != nil {
+		t.Fatalf("Failed to retrieve latest checkpoint: %v", err)
+	}
+	if index != 0 || common.Hash(registered) != hash {
+		t.Fatalf("registered checkpoint mismatch: have %d => %x, want 0 => %x", index, registered, hash)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	signatureLength           = crypto.SignatureLength       // Length of a plain checkpoint signature
+	timeLockedSignatureLength = 2*crypto.SignatureLength + 8 // Length of a time-locked signature envelope
+)
+
+// checkpointSig is a checkpoint signature as exchanged between the admins. It
+// is either a plain signature accepted by the oracle contract, or a time-locked
+// one which may only be registered from a given block number on.
+//
+// A time-locked signature is encoded as the concatenation of
+//
+//	sig       [65]byte // Plain signature of the checkpoint, as accepted by the contract
+//	notBefore uint64   // Big endian block number from which the signature may be used
+//	lock      [65]byte // Signature of the same admin over the extended payload
+//
+// where the extended payload is 0x19 0x00 || oracle || index || hash || notBefore,
+// i.e. the plain payload with the block number appended. The current contract
+// only verifies the plain signature, so the time lock is enforced by this tool
+// alone; a future contract can verify the lock signature and enforce it on-chain.
+type checkpointSig struct {
+	sig       []byte // Plain signature, accepted by the oracle contract
+	notBefore uint64 // First block the signature may be registered at, 0 if not locked
+	lock      []byte // Signature over the extended payload, nil if not locked
+}
+
+// decodeSignature parses a hex encoded plain or time-locked checkpoint signature.
+func decodeSignature(s string) (*checkpointSig, error) {
+	blob, err := hexutil.Decode("0x" + strings.TrimPrefix(strings.TrimSpace(s), "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature '%s': %v", s, err)
+	}
+	switch len(blob) {
+	case signatureLength:
+		return &checkpointSig{sig: blob}, nil
+	case timeLockedSignatureLength:
+		sig := &checkpointSig{
+			sig:       blob[:signatureLength],
+			notBefore: binary.BigEndian.Uint64(blob[signatureLength:]),
+			lock:      blob[signatureLength+8:],
+		}
+		if sig.notBefore == 0 {
+			return nil, fmt.Errorf("invalid signature '%s': zero time lock", s)
+		}
+		return sig, nil
+	default:
+		return nil, fmt.Errorf("invalid signature '%s': length %d, want %d or %d", s, len(blob), signatureLength, timeLockedSignatureLength)
+	}
+}
+
+// decodeSignatures parses a comma separated list of checkpoint signatures.
+func decodeSignatures(list string) ([]*checkpointSig, error) {
+	var sigs []*checkpointSig
+	for _, s := range strings.Split(list, ",") {
+		sig, err := decodeSignature(s)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// String returns the hex encoding of the signature.
+func (s *checkpointSig) String() string {
+	if s.lock == nil {
+		return hexutil.Encode(s.sig)
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, s.notBefore)
+	return hexutil.Encode(append(append(append([]byte{}, s.sig...), buf...), s.lock...))
+}
+
+// locked reports whether the signature is time-locked at the given head.
+func (s *checkpointSig) locked(head uint64) bool {
+	return s.lock != nil && head < s.notBefore
+}
+
+// verify recovers the signer of the checkpoint signature. The lock signature of
+// time-locked signatures needs to be made by the same admin, otherwise the time
+// lock could be stripped off or replaced by anyone.
+func (s *checkpointSig) verify(index uint64, oracle common.Address, hash common.Hash) (common.Address, error) {
+	signer, err := ecrecover(sighash(index, oracle, hash), s.sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+	if s.lock == nil {
+		return signer, nil
+	}
+	locker, err := ecrecover(timeLockHash(index, oracle, hash, s.notBefore), s.lock)
+	if err != nil {
+		return common.Address{}, err
+	}
+	if locker != signer {
+		return common.Address{}, fmt.Errorf("time lock of %s signed by %s", signer.Hex(), locker.Hex())
+	}
+	return signer, nil
+}
+
+// timeLockHash calculates the hash of the extended payload of a time-locked
+// checkpoint signature.
+func timeLockHash(index uint64, oracle common.Address, hash common.Hash, notBefore uint64) []byte {
+	msg := make([]byte, 48)
+	binary.BigEndian.PutUint64(msg, index)
+	copy(msg[8:], hash[:])
+	binary.BigEndian.PutUint64(msg[40:], notBefore)
+
+	return crypto.Keccak256(append([]byte{0x19, 0x00}, oracle[:]...), msg)
+}
+
+// signTimeLock requests the lock signature of a time-locked checkpoint signature
+// from clef, returning the complete signature envelope.
+func signTimeLock(clef *rpc.Client, signer common.Address, oracle common.Address, index uint64, hash common.Hash, plain string, notBefore uint64) (string, error) {
+	sig, err := decodeSignature(plain)
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 48)
+	binary.BigEndian.PutUint64(msg, index)
+	copy(msg[8:], hash[:])
+	binary.BigEndian.PutUint64(msg[40:], notBefore)
+
+	p := make(map[string]string)
+	p["address"] = oracle.Hex()
+	p["message"] = hexutil.Encode(msg)
+
+	var lock hexutil.Bytes
+	if err := clef.Call(&lock, "account_signData", accounts.MimetypeDataWithValidator, signer.Hex(), p); err != nil {
+		return "", err
+	}
+	if len(lock) != signatureLength {
+		return "", fmt.Errorf("invalid lock signature length %d", len(lock))
+	}
+	sig.notBefore, sig.lock = notBefore, lock
+	return sig.String(), nil
+}
+
+// checkTimeLocks verifies the given checkpoint signatures and ensures none of
+// them is time-locked at the given chain head, listing the locked ones if any.
+func checkTimeLocks(sigs []*checkpointSig, index uint64, oracle common.Address, hash common.Hash, head uint64) error {
+	var locked []string
+	for _, sig := range sigs {
+		signer, err := sig.verify(index, oracle, hash)
+		if err != nil {
+			return err
+		}
+		if sig.locked(head) {
+			locked = append(locked, fmt.Sprintf("%s until #%d", signer.Hex(), sig.notBefore))
+		}
+	}
+	if len(locked) > 0 {
+		return fmt.Errorf("%d signature(s) time-locked at head #%d: %s", len(locked), head, strings.Join(locked, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// mockClef is a clef instance signing checkpoints with a single key.
+type mockClef struct {
+	key *ecdsa.PrivateKey
+}
+
+func (c *mockClef) SignData(contentType string, addr common.Address, data map[string]string) (hexutil.Bytes, error) {
+	validator := common.HexToAddress(data["address"])
+	msg, err := hexutil.Decode(data["message"])
+	if err != nil {
+		return nil, err
+	}
+	blob := append([]byte{0x19, 0x00}, append(validator.Bytes(), msg...)...)
+	sig, err := crypto.Sign(crypto.Keccak256(blob), c.key)
+	if err != nil {
+		return nil, err
+	}
+	sig[64] += 27 // Transform V from 0/1 to 27/28 like clef does
+	return sig, nil
+}
+
+// signTimeLocked signs a checkpoint through a mock clef, time-locking the
+// signature if notBefore is non-zero.
+func signTimeLocked(t *testing.T, key *ecdsa.PrivateKey, oracle common.Address, index uint64, hash common.Hash, notBefore uint64) string {
+	t.Helper()
+
+	clef := rpc.NewServer()
+	if err := clef.RegisterName("account", &mockClef{key: key}); err != nil {
+		t.Fatalf("Failed to register mock clef: %v", err)
+	}
+	defer clef.Stop()
+
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+	sig, err := signCheckpoint(rpc.DialInProc(clef), signer, oracle, index, hash)
+	if err != nil {
+		t.Fatalf("Failed to sign checkpoint: %v", err)
+	}
+	if notBefore == 0 {
+		return sig
+	}
+	if sig, err = signTimeLock(rpc.DialInProc(clef), signer, oracle, index, hash, sig, notBefore); err != nil {
+		t.Fatalf("Failed to sign time lock: %v", err)
+	}
+	return sig
+}
+
+// Tests that time-locked signatures round trip through their encoding, and that
+// the plain part of them is accepted the same way as the contract would.
+func TestTimeLockedSignatureEncoding(t *testing.T) {
+	var (
+		key, _ = crypto.GenerateKey()
+		signer = crypto.PubkeyToAddress(key.PublicKey)
+		oracle = common.HexToAddress("0xcafebabe")
+		hash   = common.HexToHash("0xdeadbeef")
+	)
+	plain := signTimeLocked(t, key, oracle, 3, hash, 0)
+	locked := signTimeLocked(t, key, oracle, 3, hash, 1000)
+
+	if have, want := len(plain), 2+2*signatureLength; have != want {
+		t.Fatalf("plain signature length mismatch: have %d, want %d", have, want)
+	}
+	if have, want := len(locked), 2+2*timeLockedSignatureLength; have != want {
+		t.Fatalf("time-locked signature length mismatch: have %d, want %d", have, want)
+	}
+	sigs, err := decodeSignatures(plain + ", " + strings.TrimPrefix(locked, "0x"))
+	if err != nil {
+		t.Fatalf("failed to decode signatures: %v", err)
+	}
+	if sigs[0].String() != plain || sigs[1].String() != locked {
+		t.Fatalf("signature encoding mismatch")
+	}
+	if sigs[1].notBefore != 1000 {
+		t.Fatalf("time lock mismatch: have #%d, want #1000", sigs[1].notBefore)
+	}
+	// The plain part of both signatures needs to be valid for the contract
+	for i, sig := range sigs {
+		if addr, err := ecrecover(sighash(3, oracle, hash), sig.sig); err != nil || addr != signer {
+			t.Errorf("signature %d: plain signer mismatch: have %x (%v), want %x", i, addr, err, signer)
+		}
+		if addr, err := sig.verify(3, oracle, hash); err != nil || addr != signer {
+			t.Errorf("signature %d: signer mismatch: have %x (%v), want %x", i, addr, err, signer)
+		}
+	}
+	// Malformed signatures need to be rejected
+	for _, sig := range []string{plain[:len(plain)-2], locked + "00", "0xzz", plain[:2+2*signatureLength] + strings.Repeat("0", 16) + plain[2:]} {
+		if _, err := decodeSignature(sig); err == nil {
+			t.Errorf("malformed signature %s accepted", sig)
+		}
+	}
+}
+
+// Tests that time locks are only accepted if signed by the checkpoint signer,
+// and that locked signatures are refused until the head reaches the lock.
+func TestTimeLockedSignatureCheck(t *testing.T) {
+	var (
+		key1, _ = crypto.GenerateKey()
+		key2, _ = crypto.GenerateKey()
+		key3, _ = crypto.GenerateKey()
+		oracle  = common.HexToAddress("0xcafebabe")
+		hash    = common.HexToHash("0xdeadbeef")
+	)
+	sigs, err := decodeSignatures(strings.Join([]string{
+		signTimeLocked(t, key1, oracle, 5, hash, 0),
+		signTimeLocked(t, key2, oracle, 5, hash, 100),
+		signTimeLocked(t, key3, oracle, 5, hash, 200),
+	}, ","))
+	if err != nil {
+		t.Fatalf("failed to decode signatures: %v", err)
+	}
+	tests := []struct {
+		head   uint64
+		locked []common.Address
+	}{
+		{0, []common.Address{crypto.PubkeyToAddress(key2.PublicKey), crypto.PubkeyToAddress(key3.PublicKey)}},
+		{99, []common.Address{crypto.PubkeyToAddress(key2.PublicKey), crypto.PubkeyToAddress(key3.PublicKey)}},
+		{100, []common.Address{crypto.PubkeyToAddress(key3.PublicKey)}},
+		{199, []common.Address{crypto.PubkeyToAddress(key3.PublicKey)}},
+		{200, nil},
+	}
+	for i, tt := range tests {
+		err := checkTimeLocks(sigs, 5, oracle, hash, tt.head)
+		if len(tt.locked) == 0 {
+			if err != nil {
+				t.Errorf("test %d: unexpected refusal: %v", i, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("test %d: time-locked signatures accepted at head #%d", i, tt.head)
+			continue
+		}
+		for _, signer := range tt.locked {
+			if !strings.Contains(err.Error(), signer.Hex()) {
+				t.Errorf("test %d: locked signer %x not reported: %v", i, signer, err)
+			}
+		}
+	}
+	// A signature for a different checkpoint needs to be rejected
+	if err := checkTimeLocks(sigs, 6, oracle, hash, 1000); err == nil {
+		t.Errorf("signatures of another checkpoint accepted")
+	}
+	// Replacing the time lock needs to be detected, even if signed by another admin
+	forged := *sigs[2]
+	forged.notBefore = 1
+	if _, err := forged.verify(5, oracle, hash); err == nil {
+		t.Errorf("modified time lock accepted")
+	}
+	other, _ := decodeSignature(signTimeLocked(t, key1, oracle, 5, hash, 1))
+	forged.lock = other.lock
+	if _, err := forged.verify(5, oracle, hash); err == nil {
+		t.Errorf("time lock of another admin accepted")
+	}
+}
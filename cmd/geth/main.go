@@ -99,15 +99,27 @@ var (
 		utils.LightEgressFlag,
 		utils.LightMaxPeersFlag,
 		utils.LegacyLightPeersFlag,
+		utils.LightPoolRecordFlag,
+		utils.LightPoolImportFlag,
+		utils.LightFreePerAddrFlag,
+		utils.LightPruneHeadersFlag,
+		utils.LightDeepReorgFlag,
 		utils.LightKDFFlag,
 		utils.UltraLightServersFlag,
 		utils.UltraLightFractionFlag,
 		utils.UltraLightOnlyAnnounceFlag,
+		utils.UltraLightUnattestedCheckpointFlag,
 		utils.WhitelistFlag,
 		utils.CacheFlag,
 		utils.CacheDatabaseFlag,
 		utils.CacheTrieFlag,
+		utils.CacheTrieJournalFlag,
+		utils.CacheTrieRejournalFlag,
+		utils.CacheTrieShareFlag,
+		utils.CacheTrieSharedFlag,
 		utils.CacheGCFlag,
+		utils.CacheGCJournalFlag,
+		utils.CacheGCBackgroundFlag,
 		utils.CacheSnapshotFlag,
 		utils.CacheNoPrefetchFlag,
 		utils.ListenPortFlag,
@@ -92,9 +92,15 @@ var AppHelpFlagGroups = []flagGroup{
 			utils.LightIngressFlag,
 			utils.LightEgressFlag,
 			utils.LightMaxPeersFlag,
+			utils.LightPoolRecordFlag,
+			utils.LightPoolImportFlag,
+			utils.LightFreePerAddrFlag,
+			utils.LightPruneHeadersFlag,
+			utils.LightDeepReorgFlag,
 			utils.UltraLightServersFlag,
 			utils.UltraLightFractionFlag,
 			utils.UltraLightOnlyAnnounceFlag,
+			utils.UltraLightUnattestedCheckpointFlag,
 		},
 	},
 	{
@@ -139,7 +145,13 @@ var AppHelpFlagGroups = []flagGroup{
 			utils.CacheFlag,
 			utils.CacheDatabaseFlag,
 			utils.CacheTrieFlag,
+			utils.CacheTrieJournalFlag,
+			utils.CacheTrieRejournalFlag,
+			utils.CacheTrieShareFlag,
+			utils.CacheTrieSharedFlag,
 			utils.CacheGCFlag,
+			utils.CacheGCJournalFlag,
+			utils.CacheGCBackgroundFlag,
 			utils.CacheSnapshotFlag,
 			utils.CacheNoPrefetchFlag,
 		},
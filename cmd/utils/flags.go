@@ -263,6 +263,26 @@ var (
 		Usage: "Maximum number of light clients to serve, or light servers to attach to",
 		Value: eth.DefaultConfig.LightPeers,
 	}
+	LightPoolRecordFlag = cli.StringFlag{
+		Name:  "light.poolrecord",
+		Usage: "File to record the light client pool events into for debugging (off by default)",
+	}
+	LightPoolImportFlag = cli.StringFlag{
+		Name:  "light.poolimport",
+		Usage: "File with a light client pool state exported by les.exportPoolState to import on startup",
+	}
+	LightFreePerAddrFlag = cli.IntFlag{
+		Name:  "light.freeperaddr",
+		Usage: "Maximum number of free light clients per IP address, identifying them by node ID too (0 = by address only)",
+	}
+	LightPruneHeadersFlag = cli.BoolFlag{
+		Name:  "light.pruneheaders",
+		Usage: "Delete old headers covered by the trusted checkpoint, retrieving them on demand (light client)",
+	}
+	LightDeepReorgFlag = cli.Uint64Flag{
+		Name:  "light.deepreorg",
+		Usage: "Reorg depth above which light clients are told to resync instead of following the announcement (0 = disabled)",
+	}
 	UltraLightServersFlag = cli.StringFlag{
 		Name:  "ulc.servers",
 		Usage: "List of trusted ultra-light servers",
@@ -277,6 +297,10 @@ var (
 		Name:  "ulc.onlyannounce",
 		Usage: "Ultra light server sends announcements only",
 	}
+	UltraLightUnattestedCheckpointFlag = cli.BoolFlag{
+		Name:  "ulc.unattested",
+		Usage: "Advertise the local checkpoint to ultra light clients before it is registered in the oracle",
+	}
 	// Ethash settings
 	EthashCacheDirFlag = DirectoryFlag{
 		Name:  "ethash.cachedir",
@@ -385,11 +409,36 @@ var (
 		Usage: "Percentage of cache memory allowance to use for trie caching (default = 15% full mode, 30% archive mode)",
 		Value: 15,
 	}
+	CacheTrieJournalFlag = cli.StringFlag{
+		Name:  "cache.trie.journal",
+		Usage: "Disk journal directory for the trie cache to survive node restarts (empty = disabled)",
+	}
+	CacheTrieRejournalFlag = cli.DurationFlag{
+		Name:  "cache.trie.rejournal",
+		Usage: "Time interval to regenerate the trie cache journal",
+		Value: eth.DefaultConfig.TrieCleanRejournal,
+	}
+	CacheTrieShareFlag = cli.BoolFlag{
+		Name:  "cache.trie.share",
+		Usage: "Save a copy of the trie cache along with its journal for read-only processes to use",
+	}
+	CacheTrieSharedFlag = cli.StringFlag{
+		Name:  "cache.trie.shared",
+		Usage: "Trie cache journal directory of another process sharing its cache, used instead of an own trie cache",
+	}
 	CacheGCFlag = cli.IntFlag{
 		Name:  "cache.gc",
 		Usage: "Percentage of cache memory allowance to use for trie pruning (default = 25% full mode, 0% archive mode)",
 		Value: 25,
 	}
+	CacheGCJournalFlag = cli.StringFlag{
+		Name:  "cache.gc.journal",
+		Usage: "Disk journal for the trie pruning cache to survive node restarts (empty = disabled)",
+	}
+	CacheGCBackgroundFlag = cli.BoolFlag{
+		Name:  "cache.gc.background",
+		Usage: "Flush the trie pruning cache to disk in the background instead of during block import",
+	}
 	CacheSnapshotFlag = cli.IntFlag{
 		Name:  "cache.snapshot",
 		Usage: "Percentage of cache memory allowance to use for snapshot caching (default = 10% full mode, 20% archive mode)",
@@ -1021,6 +1070,21 @@ func setLes(ctx *cli.Context, cfg *eth.Config) {
 	if ctx.GlobalIsSet(LightMaxPeersFlag.Name) {
 		cfg.LightPeers = ctx.GlobalInt(LightMaxPeersFlag.Name)
 	}
+	if ctx.GlobalIsSet(LightPoolRecordFlag.Name) {
+		cfg.LightPoolRecord = ctx.GlobalString(LightPoolRecordFlag.Name)
+	}
+	if ctx.GlobalIsSet(LightPoolImportFlag.Name) {
+		cfg.LightPoolImport = ctx.GlobalString(LightPoolImportFlag.Name)
+	}
+	if ctx.GlobalIsSet(LightFreePerAddrFlag.Name) {
+		cfg.LightFreePerAddr = ctx.GlobalInt(LightFreePerAddrFlag.Name)
+	}
+	if ctx.GlobalIsSet(LightPruneHeadersFlag.Name) {
+		cfg.LightPruneHeaders = ctx.GlobalBool(LightPruneHeadersFlag.Name)
+	}
+	if ctx.GlobalIsSet(LightDeepReorgFlag.Name) {
+		cfg.LightDeepReorg = ctx.GlobalUint64(LightDeepReorgFlag.Name)
+	}
 	if ctx.GlobalIsSet(UltraLightServersFlag.Name) {
 		cfg.UltraLightServers = strings.Split(ctx.GlobalString(UltraLightServersFlag.Name), ",")
 	}
@@ -1034,6 +1098,9 @@ func setLes(ctx *cli.Context, cfg *eth.Config) {
 	if ctx.GlobalIsSet(UltraLightOnlyAnnounceFlag.Name) {
 		cfg.UltraLightOnlyAnnounce = ctx.GlobalBool(UltraLightOnlyAnnounceFlag.Name)
 	}
+	if ctx.GlobalIsSet(UltraLightUnattestedCheckpointFlag.Name) {
+		cfg.UltraLightUnattestedCheckpoint = ctx.GlobalBool(UltraLightUnattestedCheckpointFlag.Name)
+	}
 }
 
 // makeDatabaseHandles raises out the number of allowed file handles per process
@@ -1523,6 +1590,24 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *eth.Config) {
 	if ctx.GlobalIsSet(CacheFlag.Name) || ctx.GlobalIsSet(CacheGCFlag.Name) {
 		cfg.TrieDirtyCache = ctx.GlobalInt(CacheFlag.Name) * ctx.GlobalInt(CacheGCFlag.Name) / 100
 	}
+	if ctx.GlobalIsSet(CacheTrieJournalFlag.Name) {
+		cfg.TrieCleanJournal = ctx.GlobalString(CacheTrieJournalFlag.Name)
+	}
+	if ctx.GlobalIsSet(CacheTrieRejournalFlag.Name) {
+		cfg.TrieCleanRejournal = ctx.GlobalDuration(CacheTrieRejournalFlag.Name)
+	}
+	if ctx.GlobalIsSet(CacheTrieShareFlag.Name) {
+		cfg.TrieCleanShare = ctx.GlobalBool(CacheTrieShareFlag.Name)
+	}
+	if ctx.GlobalIsSet(CacheTrieSharedFlag.Name) {
+		cfg.TrieCleanShared = ctx.GlobalString(CacheTrieSharedFlag.Name)
+	}
+	if ctx.GlobalIsSet(CacheGCJournalFlag.Name) {
+		cfg.TrieDirtyJournal = ctx.GlobalString(CacheGCJournalFlag.Name)
+	}
+	if ctx.GlobalIsSet(CacheGCBackgroundFlag.Name) {
+		cfg.TrieBackgroundFlush = ctx.GlobalBool(CacheGCBackgroundFlag.Name)
+	}
 	if ctx.GlobalIsSet(CacheFlag.Name) || ctx.GlobalIsSet(CacheSnapshotFlag.Name) {
 		cfg.SnapshotCache = ctx.GlobalInt(CacheFlag.Name) * ctx.GlobalInt(CacheSnapshotFlag.Name) / 100
 	}
@@ -1810,6 +1895,9 @@ func MakeChain(ctx *cli.Context, stack *node.Node, readOnly bool) (chain *core.B
 	if ctx.GlobalIsSet(CacheFlag.Name) || ctx.GlobalIsSet(CacheGCFlag.Name) {
 		cache.TrieDirtyLimit = ctx.GlobalInt(CacheFlag.Name) * ctx.GlobalInt(CacheGCFlag.Name) / 100
 	}
+	if readOnly && ctx.GlobalIsSet(CacheTrieSharedFlag.Name) {
+		cache.TrieCleanShared = stack.ResolvePath(ctx.GlobalString(CacheTrieSharedFlag.Name))
+	}
 	vmcfg := vm.Config{EnablePreimageRecording: ctx.GlobalBool(VMEnableDebugFlag.Name)}
 	var limit *uint64
 	if ctx.GlobalIsSet(TxLookupLimitFlag.Name) && !readOnly {
@@ -23,6 +23,7 @@ import (
 	"io"
 	"math/big"
 	mrand "math/rand"
+	"os"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -89,6 +90,14 @@ const (
 	badBlockLimit       = 10
 	TriesInMemory       = 128
 
+	// minCleanRejournal is the shortest interval the clean trie cache is saved
+	// into its journal with, saving it takes a while for large caches.
+	minCleanRejournal = time.Minute
+
+	// sharedCacheRefresh is the interval a clean trie cache shared by another
+	// process is checked for new saves with.
+	sharedCacheRefresh = time.Minute
+
 	// BlockChainVersion ensures that an incompatible database forces a resync from scratch.
 	//
 	// Changelog:
@@ -117,9 +126,15 @@ const (
 type CacheConfig struct {
 	TrieCleanLimit      int           // Memory allowance (MB) to use for caching trie nodes in memory
 	TrieCleanNoPrefetch bool          // Whether to disable heuristic state prefetching for followup blocks
+	TrieCleanJournal    string        // Disk journal for saving the clean trie cache across restarts (empty = disabled)
+	TrieCleanRejournal  time.Duration // Time interval to periodically save the clean trie cache to its journal
+	TrieCleanShare      bool          // Whether to save a copy of the clean trie cache for other processes to map
+	TrieCleanShared     string        // Clean trie cache journal of another process to serve clean reads from (empty = own cache)
 	TrieDirtyLimit      int           // Memory limit (MB) at which to start flushing dirty trie nodes to disk
 	TrieDirtyDisabled   bool          // Whether to disable trie write caching and GC altogether (archive node)
 	TrieTimeLimit       time.Duration // Time limit after which to flush the current in-memory trie to disk
+	TrieDirtyJournal    string        // Disk journal for saving the dirty trie cache across restarts (empty = disabled)
+	TrieBackgroundFlush bool          // Whether to flush dirty trie nodes in the background instead of during block import
 	SnapshotLimit       int           // Memory allowance (MB) to use for caching snapshot entries in memory
 
 	SnapshotWait bool // Wait for snapshot construction on startup. TODO(karalabe): This is a dirty hack for testing, nuke it
@@ -220,7 +235,7 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 		cacheConfig:    cacheConfig,
 		db:             db,
 		triegc:         prque.New(nil),
-		stateCache:     state.NewDatabaseWithCache(db, cacheConfig.TrieCleanLimit),
+		stateCache:     newStateCache(db, cacheConfig),
 		quit:           make(chan struct{}),
 		shouldPreserve: shouldPreserve,
 		bodyCache:      bodyCache,
@@ -264,6 +279,10 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 		}
 	}
 
+	// Restore the recent tries journalled on the last shutdown before loading
+	// the head, its state may only be available from the journal.
+	restored := bc.loadDirtyTries()
+
 	if err := bc.loadLastState(); err != nil {
 		return nil, err
 	}
@@ -318,6 +337,18 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 			}
 		}
 	}
+	// Track the restored tries for garbage collection now that the head is final
+	bc.trackDirtyTries(restored)
+
+	// Start flushing the dirty trie nodes in the background if requested
+	if bc.cacheConfig.TrieBackgroundFlush && !bc.cacheConfig.TrieDirtyDisabled {
+		limit := common.StorageSize(bc.cacheConfig.TrieDirtyLimit) * 1024 * 1024
+		bc.stateCache.TrieDB().StartBackgroundCap(limit-ethdb.IdealBatchSize, limit)
+	}
+
+	// Keep the clean trie cache journal up to date, or follow the one of another process
+	bc.maintainCleanCache()
+
 	// Load any existing snapshot, regenerating it if loading failed
 	if bc.cacheConfig.SnapshotLimit > 0 {
 		bc.snaps = snapshot.New(bc.db, bc.stateCache.TrieDB(), bc.cacheConfig.SnapshotLimit, bc.CurrentBlock().Root(), !bc.cacheConfig.SnapshotWait)
@@ -569,6 +600,12 @@ func (bc *BlockChain) StateAt(root common.Hash) (*state.StateDB, error) {
 	return state.New(root, bc.stateCache, bc.snaps)
 }
 
+// StateAtWithTag returns a new mutable state based on a particular point in time,
+// accounting its trie reads to the given caller tag.
+func (bc *BlockChain) StateAtWithTag(root common.Hash, tag trie.ReadTag) (*state.StateDB, error) {
+	return state.New(root, state.WithReadTag(bc.stateCache, tag), bc.snaps)
+}
+
 // StateCache returns the caching database underpinning the blockchain instance.
 func (bc *BlockChain) StateCache() state.Database {
 	return bc.stateCache
@@ -895,6 +932,7 @@ func (bc *BlockChain) Stop() {
 	//  - HEAD-127: So we have a hard limit on the number of blocks reexecuted
 	if !bc.cacheConfig.TrieDirtyDisabled {
 		triedb := bc.stateCache.TrieDB()
+		triedb.StopBackgroundCap()
 
 		for _, offset := range []uint64{0, 1, TriesInMemory - 1} {
 			if number := bc.CurrentBlock().NumberU64(); number > offset {
@@ -912,16 +950,117 @@ func (bc *BlockChain) Stop() {
 				log.Error("Failed to commit recent state trie", "err", err)
 			}
 		}
+		if bc.cacheConfig.TrieDirtyJournal != "" {
+			if err := triedb.Journal(bc.cacheConfig.TrieDirtyJournal); err != nil {
+				log.Error("Failed to journal dirty trie cache", "err", err)
+			}
+		}
+		roots := make([]common.Hash, 0, bc.triegc.Size())
 		for !bc.triegc.Empty() {
-			triedb.Dereference(bc.triegc.PopItem().(common.Hash))
+			roots = append(roots, bc.triegc.PopItem().(common.Hash))
 		}
+		triedb.DereferenceBatch(roots)
 		if size, _ := triedb.Size(); size != 0 {
 			log.Error("Dangling trie nodes after full cleanup")
 		}
 	}
+	// Save the clean trie cache last, it holds the nodes flushed above too
+	if bc.cacheConfig.TrieCleanJournal != "" && bc.cacheConfig.TrieCleanShared == "" {
+		bc.stateCache.TrieDB().SaveCache(bc.cacheConfig.TrieCleanJournal)
+	}
 	log.Info("Blockchain stopped")
 }
 
+// newStateCache creates the state database of the blockchain. Its clean trie cache
+// is loaded from the clean cache journal if configured, or replaced by the clean
+// cache shared by another process using the same database.
+func newStateCache(db ethdb.Database, cacheConfig *CacheConfig) state.Database {
+	switch {
+	case cacheConfig.TrieCleanShared != "":
+		return state.NewDatabaseWithSharedCache(db, cacheConfig.TrieCleanShared)
+	case cacheConfig.TrieCleanJournal != "":
+		return state.NewDatabaseWithJournal(db, cacheConfig.TrieCleanLimit, cacheConfig.TrieCleanJournal)
+	default:
+		return state.NewDatabaseWithCache(db, cacheConfig.TrieCleanLimit)
+	}
+}
+
+// maintainCleanCache starts saving the clean trie cache into its journal, sharing
+// it with other processes if requested, or if the clean cache of another process
+// is used, starts picking up its new saves.
+func (bc *BlockChain) maintainCleanCache() {
+	triedb := bc.stateCache.TrieDB()
+	switch {
+	case bc.cacheConfig.TrieCleanShared != "":
+		bc.wg.Add(1)
+		go func() {
+			defer bc.wg.Done()
+			triedb.RefreshSharedCachePeriodically(sharedCacheRefresh, bc.quit)
+		}()
+	case bc.cacheConfig.TrieCleanJournal != "":
+		if bc.cacheConfig.TrieCleanShare {
+			triedb.ShareCleanCache()
+		}
+		rejournal := bc.cacheConfig.TrieCleanRejournal
+		if rejournal < minCleanRejournal {
+			log.Warn("Sanitizing clean trie cache journal interval", "provided", rejournal, "updated", minCleanRejournal)
+			rejournal = minCleanRejournal
+		}
+		bc.wg.Add(1)
+		go func() {
+			defer bc.wg.Done()
+			triedb.SaveCachePeriodically(bc.cacheConfig.TrieCleanJournal, rejournal, bc.quit)
+		}()
+	}
+}
+
+// loadDirtyTries restores the dirty trie cache from the journal written on the
+// last shutdown, if enabled, returning the restored roots and their reference
+// counts. They need to be passed to trackDirtyTries once the head is final.
+func (bc *BlockChain) loadDirtyTries() map[common.Hash]int {
+	path := bc.cacheConfig.TrieDirtyJournal
+	if path == "" || bc.cacheConfig.TrieDirtyDisabled {
+		return nil
+	}
+	roots, err := bc.stateCache.TrieDB().LoadJournal(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn("Failed to load dirty trie cache journal", "path", path, "err", err)
+		}
+		return nil
+	}
+	return roots
+}
+
+// trackDirtyTries takes over the references of the tries restored from the
+// journal. The roots of the recent canonical blocks are tracked for garbage
+// collection again, the same way as when they were imported. The rest (e.g.
+// side chains or blocks rewound since) are released.
+func (bc *BlockChain) trackDirtyTries(roots map[common.Hash]int) {
+	if len(roots) == 0 {
+		return
+	}
+	head := bc.CurrentBlock().NumberU64()
+	for number := head; number > 0 && head-number < TriesInMemory; number-- {
+		header := bc.GetHeaderByNumber(number)
+		if header == nil {
+			break
+		}
+		if roots[header.Root] > 0 {
+			roots[header.Root]--
+			bc.triegc.Push(header.Root, -int64(number))
+		}
+	}
+	var stale []common.Hash
+	for root, refs := range roots {
+		for ; refs > 0; refs-- {
+			stale = append(stale, root)
+		}
+	}
+	bc.stateCache.TrieDB().DereferenceBatch(stale)
+	log.Info("Restored recent tries from journal", "tries", bc.triegc.Size(), "released", len(stale))
+}
+
 // StopInsert interrupts all insertion methods, causing them to return
 // errInsertionInterrupted as soon as possible. Insertion is permanently disabled after
 // calling this method.
@@ -1456,7 +1595,13 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 				nodes, imgs = triedb.Size()
 				limit       = common.StorageSize(bc.cacheConfig.TrieDirtyLimit) * 1024 * 1024
 			)
-			if nodes > limit || imgs > 4*1024*1024 {
+			// With background flushing enabled, only step in if the flusher can't
+			// keep up with the import, or to flush the preimages it doesn't handle
+			capLimit := limit
+			if bc.cacheConfig.TrieBackgroundFlush {
+				capLimit = 2 * limit
+			}
+			if nodes > capLimit || imgs > 4*1024*1024 {
 				triedb.Cap(limit - ethdb.IdealBatchSize)
 			}
 			// Find the next state trie we need to commit
@@ -1482,13 +1627,17 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 				}
 			}
 			// Garbage collect anything below our required write retention
+			var roots []common.Hash
 			for !bc.triegc.Empty() {
 				root, number := bc.triegc.Pop()
 				if uint64(-number) > chosen {
 					bc.triegc.Push(root, number)
 					break
 				}
-				triedb.Dereference(root.(common.Hash))
+				roots = append(roots, root.(common.Hash))
+			}
+			if len(roots) > 0 {
+				triedb.DereferenceBatch(roots)
 			}
 		}
 	}
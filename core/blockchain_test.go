@@ -22,6 +22,7 @@ import (
 	"math/big"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -1796,6 +1797,186 @@ func testSideImport(t *testing.T, numCanonBlocksInSidechain, blocksBetweenCommon
 	}
 }
 
+// Tests that the clean trie cache is saved into its journal on shutdown, along
+// with a shared copy if requested, which chains opened read-only on the same
+// database can read through.
+func TestCleanTrieCacheShare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clean-trie-journal-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		engine  = ethash.NewFaker()
+		diskdb  = rawdb.NewMemoryDatabase()
+		genesis = new(Genesis).MustCommit(diskdb)
+		journal = filepath.Join(dir, "triecache")
+		config  = &CacheConfig{
+			TrieCleanLimit:     16,
+			TrieCleanJournal:   journal,
+			TrieCleanRejournal: time.Hour,
+			TrieCleanShare:     true,
+			TrieDirtyLimit:     256,
+			TrieTimeLimit:      5 * time.Minute,
+		}
+	)
+	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, rawdb.NewMemoryDatabase(), 10, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{byte(i + 1)})
+	})
+	chain, err := NewBlockChain(diskdb, config, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to import chain: %v", err)
+	}
+	chain.Stop()
+
+	if _, err := os.Stat(filepath.Join(journal, "shared.bin")); err != nil {
+		t.Fatalf("shared clean cache not saved: %v", err)
+	}
+	// Open the chain again using the shared cache instead of an own one
+	chain, err = NewBlockChain(diskdb, &CacheConfig{
+		TrieCleanShared: journal,
+		TrieDirtyLimit:  256,
+		TrieTimeLimit:   5 * time.Minute,
+	}, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to recreate tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	state, err := chain.State()
+	if err != nil {
+		t.Fatalf("failed to open head state: %v", err)
+	}
+	if balance := state.GetBalance(common.Address{10}); balance.Sign() == 0 {
+		t.Fatalf("coinbase balance missing from head state")
+	}
+}
+
+// Tests that block import and shutdown work the same with the dirty trie cache
+// flushed in the background.
+func TestBackgroundTrieFlush(t *testing.T) {
+	var (
+		engine  = ethash.NewFaker()
+		diskdb  = rawdb.NewMemoryDatabase()
+		genesis = new(Genesis).MustCommit(diskdb)
+		config  = &CacheConfig{
+			TrieCleanLimit:      256,
+			TrieDirtyLimit:      1,
+			TrieTimeLimit:       5 * time.Minute,
+			TrieBackgroundFlush: true,
+		}
+	)
+	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, rawdb.NewMemoryDatabase(), 2*TriesInMemory, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{byte(i), byte(i >> 8)})
+	})
+	chain, err := NewBlockChain(diskdb, config, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to import chain: %v", err)
+	}
+	chain.Stop()
+
+	if size, _ := chain.stateCache.TrieDB().Size(); size != 0 {
+		t.Fatalf("dangling trie nodes after shutdown: %v", size)
+	}
+	chain, err = NewBlockChain(diskdb, config, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to recreate tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if head := chain.CurrentBlock(); head.Hash() != blocks[len(blocks)-1].Hash() || !chain.HasState(head.Root()) {
+		t.Fatalf("head state lost across restart: head %d", head.NumberU64())
+	}
+}
+
+// Tests that the dirty trie cache is journalled on shutdown if enabled and the
+// recent tries are tracked for garbage collection again after a restart, with
+// the ones not belonging to the chain anymore released.
+func TestDirtyTrieJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirty-trie-journal-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		engine  = ethash.NewFaker()
+		diskdb  = rawdb.NewMemoryDatabase()
+		genesis = new(Genesis).MustCommit(diskdb)
+		config  = &CacheConfig{
+			TrieCleanLimit:   256,
+			TrieDirtyLimit:   256,
+			TrieTimeLimit:    5 * time.Minute,
+			TrieDirtyJournal: filepath.Join(dir, "triedirty"),
+		}
+	)
+	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, rawdb.NewMemoryDatabase(), 20, func(i int, b *BlockGen) {
+		b.SetCoinbase(common.Address{byte(i + 1)})
+	})
+	chain, err := NewBlockChain(diskdb, config, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to import chain: %v", err)
+	}
+	chain.Stop()
+
+	// Only the two most recent states are persisted on shutdown, the rest should
+	// be restored from the journal and tracked for garbage collection
+	chain, err = NewBlockChain(diskdb, config, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to recreate tester chain: %v", err)
+	}
+	for _, block := range blocks[:len(blocks)-2] {
+		if !chain.HasState(block.Root()) {
+			t.Fatalf("block %d: state not restored", block.NumberU64())
+		}
+	}
+	if size := chain.triegc.Size(); size != len(blocks)-2 {
+		t.Fatalf("tracked tries mismatch: have %d, want %d", size, len(blocks)-2)
+	}
+	chain.Stop()
+
+	// Rewind the head and restart, the tries above the head should be released
+	rawdb.WriteHeadBlockHash(diskdb, blocks[9].Hash())
+	rawdb.WriteHeadFastBlockHash(diskdb, blocks[9].Hash())
+	rawdb.WriteHeadHeaderHash(diskdb, blocks[9].Hash())
+
+	chain, err = NewBlockChain(diskdb, config, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to recreate tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if head := chain.CurrentBlock().NumberU64(); head != 10 {
+		t.Fatalf("head mismatch after rewind: have %d, want 10", head)
+	}
+	if size := chain.triegc.Size(); size != 10 {
+		t.Fatalf("tracked tries mismatch after rewind: have %d, want 10", size)
+	}
+	for _, block := range blocks[10 : len(blocks)-2] {
+		if chain.HasState(block.Root()) {
+			t.Fatalf("block %d: rewound state not released", block.NumberU64())
+		}
+	}
+	// Releasing the tracked tries should empty the dirty cache
+	triedb := chain.stateCache.TrieDB()
+	for !chain.triegc.Empty() {
+		triedb.Dereference(chain.triegc.PopItem().(common.Hash))
+	}
+	if size, _ := triedb.Size(); size != 0 {
+		t.Fatalf("dangling trie nodes after releasing all tries: %v", size)
+	}
+}
+
 // Tests that importing a sidechain (S), where
 // - S is sidechain, containing blocks [Sn...Sm]
 // - C is canon chain, containing blocks [G..Cn..Cm]
@@ -437,6 +437,40 @@ func (c *ChainIndexer) Sections() (uint64, uint64, common.Hash) {
 	return c.storedSections, c.storedSections*c.sectionSize - 1, c.SectionHead(c.storedSections - 1)
 }
 
+// Rollback discards all the processed sections starting with the given one,
+// scheduling them for reprocessing from the chain data still in the database.
+// Child indexers are rolled back to the same block as during a reorg.
+//
+// Sections covered by a checkpoint can't be reprocessed since their chain data
+// is not expected to be available.
+func (c *ChainIndexer) Rollback(section uint64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if section < c.checkpointSections {
+		return fmt.Errorf("section %d covered by checkpoint (%d sections)", section, c.checkpointSections)
+	}
+	if section >= c.storedSections {
+		return fmt.Errorf("section %d not processed yet (%d sections)", section, c.storedSections)
+	}
+	c.log.Info("Rolling back chain index", "section", section, "stored", c.storedSections)
+	c.setValidSections(section)
+
+	// Roll back the children too if they already consumed the discarded sections
+	if head := section * c.sectionSize; head < c.cascadedHead {
+		c.cascadedHead = head
+		for _, child := range c.children {
+			child.newHead(c.cascadedHead, true)
+		}
+	}
+	// Sections are still known to be complete, kick off reprocessing
+	select {
+	case c.update <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
 // AddChildIndexer adds a child ChainIndexer that can use the output of this one
 func (c *ChainIndexer) AddChildIndexer(indexer *ChainIndexer) {
 	if indexer == c {
@@ -111,22 +111,61 @@ func NewDatabaseWithCache(db ethdb.Database, cache int) Database {
 	return &cachingDB{
 		db:            trie.NewDatabaseWithCache(db, cache),
 		codeSizeCache: csc,
+		tag:           trie.ReadTagState,
 	}
 }
 
+// NewDatabaseWithJournal creates a backing store for state, like NewDatabaseWithCache,
+// but loads the contents of the trie node cache from the given journal directory
+// if it was saved earlier.
+func NewDatabaseWithJournal(db ethdb.Database, cache int, journal string) Database {
+	csc, _ := lru.New(codeSizeCacheSize)
+	return &cachingDB{
+		db:            trie.NewDatabaseWithJournal(db, cache, journal),
+		codeSizeCache: csc,
+		tag:           trie.ReadTagState,
+	}
+}
+
+// NewDatabaseWithSharedCache creates a backing store for state without a trie node
+// cache of its own. Cached nodes are read from the clean cache shared into the
+// given journal directory by another process using the same database instead.
+func NewDatabaseWithSharedCache(db ethdb.Database, journal string) Database {
+	csc, _ := lru.New(codeSizeCacheSize)
+	return &cachingDB{
+		db:            trie.NewDatabaseWithSharedCache(db, journal),
+		codeSizeCache: csc,
+		tag:           trie.ReadTagState,
+	}
+}
+
+// WithReadTag returns a view of the state database which accounts all the trie
+// node and code reads to the given caller tag in the read statistics of the
+// underlying trie database. The view shares all caches with db. Databases not
+// created by this package are returned as is.
+func WithReadTag(db Database, tag trie.ReadTag) Database {
+	if c, ok := db.(*cachingDB); ok {
+		view := *c
+		view.tag = tag
+		return &view
+	}
+	return db
+}
+
 type cachingDB struct {
 	db            *trie.Database
 	codeSizeCache *lru.Cache
+	tag           trie.ReadTag // Caller tag the reads are accounted to
 }
 
 // OpenTrie opens the main account trie at a specific root hash.
 func (db *cachingDB) OpenTrie(root common.Hash) (Trie, error) {
-	return trie.NewSecure(root, db.db)
+	return trie.NewSecureTagged(db.tag, common.Hash{}, root, db.db)
 }
 
 // OpenStorageTrie opens the storage trie of an account.
 func (db *cachingDB) OpenStorageTrie(addrHash, root common.Hash) (Trie, error) {
-	return trie.NewSecure(root, db.db)
+	return trie.NewSecureTagged(db.tag, addrHash, root, db.db)
 }
 
 // CopyTrie returns an independent copy of the given trie.
@@ -141,7 +180,7 @@ func (db *cachingDB) CopyTrie(t Trie) Trie {
 
 // ContractCode retrieves a particular contract's code.
 func (db *cachingDB) ContractCode(addrHash, codeHash common.Hash) ([]byte, error) {
-	code, err := db.db.Node(codeHash)
+	code, err := db.db.NodeWithTag(db.tag, codeHash)
 	if err == nil {
 		db.codeSizeCache.Add(codeHash, len(code))
 	}
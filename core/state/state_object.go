@@ -27,6 +27,7 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
 )
 
 var emptyCodeHash = crypto.Keccak256(nil)
@@ -161,7 +162,10 @@ func (s *stateObject) getTrie(db Database) Trie {
 		s.trie, err = db.OpenStorageTrie(s.addrHash, s.data.Root)
 		if err != nil {
 			s.trie, _ = db.OpenStorageTrie(s.addrHash, common.Hash{})
-			s.setError(fmt.Errorf("can't create storage trie: %v", err))
+			if _, ok := err.(*trie.MissingNodeError); !ok {
+				err = fmt.Errorf("can't create storage trie: %v", err)
+			}
+			s.setError(err)
 		}
 	}
 	return s.trie
@@ -534,7 +534,11 @@ func (s *StateDB) getDeletedStateObject(addr common.Address) *stateObject {
 		}
 		enc, err := s.trie.TryGet(addr[:])
 		if err != nil {
-			s.setError(fmt.Errorf("getDeleteStateObject (%x) error: %v", addr[:], err))
+			// Missing node errors carry their own context, keep them intact
+			if _, ok := err.(*trie.MissingNodeError); !ok {
+				err = fmt.Errorf("getDeleteStateObject (%x) error: %v", addr[:], err)
+			}
+			s.setError(err)
 			return nil
 		}
 		if len(enc) == 0 {
@@ -32,6 +32,8 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/trie"
 )
 
 // Tests that updating a state trie does not leak any database writes prior to
@@ -727,3 +729,57 @@ func TestMissingTrieNodes(t *testing.T) {
 		t.Fatalf("expected error, got root :%x", root)
 	}
 }
+
+// Tests that a missing storage trie node hit by the state reads surfaces from the
+// commit as a trie.MissingNodeError carrying the owner account, path and hash.
+func TestMissingStorageNodeError(t *testing.T) {
+	memDb := rawdb.NewMemoryDatabase()
+	db := NewDatabase(memDb)
+	state, _ := New(common.Hash{}, db, nil)
+
+	addr := toAddr([]byte("storage"))
+	for i := byte(0); i < 64; i++ {
+		state.SetState(addr, common.Hash{i}, common.Hash{i + 1})
+	}
+	root, _ := state.Commit(false)
+	if err := db.TrieDB().Commit(root, false); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	// Delete an inner node of the storage trie from the disk
+	state, _ = New(root, db, nil)
+	var (
+		it   = state.StorageTrie(addr).NodeIterator(nil)
+		hash common.Hash
+		path []byte
+	)
+	for it.Next(true) {
+		if it.Hash() != (common.Hash{}) && len(it.Path()) > 0 {
+			hash, path = it.Hash(), common.CopyBytes(it.Path())
+			break
+		}
+	}
+	if hash == (common.Hash{}) {
+		t.Fatalf("no inner storage node found")
+	}
+	memDb.Delete(hash[:])
+
+	state, _ = New(root, db, nil)
+	for i := byte(0); i < 64; i++ {
+		state.GetState(addr, common.Hash{i})
+	}
+	state.SetState(addr, common.Hash{0xff}, common.Hash{0xff})
+	_, err := state.Commit(false)
+	missing, ok := err.(*trie.MissingNodeError)
+	if !ok {
+		t.Fatalf("error type mismatch: have %T (%v), want *trie.MissingNodeError", err, err)
+	}
+	if owner := crypto.Keccak256Hash(addr[:]); missing.Owner != owner {
+		t.Errorf("owner mismatch: have %x, want %x", missing.Owner, owner)
+	}
+	if missing.NodeHash != hash || !bytes.Equal(missing.Path, path) {
+		t.Errorf("missing node mismatch: have %x at %x, want %x at %x", missing.NodeHash, missing.Path, hash, path)
+	}
+	if have := trie.FormatNodeError(missing); !strings.Contains(have, fmt.Sprintf("owner=%x", missing.Owner)) {
+		t.Errorf("formatted error lacks the owner: %s", have)
+	}
+}
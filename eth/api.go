@@ -294,7 +294,7 @@ func (api *PublicDebugAPI) DumpBlock(blockNr rpc.BlockNumber) (state.Dump, error
 	if block == nil {
 		return state.Dump{}, fmt.Errorf("block #%d not found", blockNr)
 	}
-	stateDb, err := api.eth.BlockChain().StateAt(block.Root())
+	stateDb, err := api.eth.BlockChain().StateAtWithTag(block.Root(), trie.ReadTagRPC)
 	if err != nil {
 		return state.Dump{}, err
 	}
@@ -321,6 +321,24 @@ func (api *PrivateDebugAPI) Preimage(ctx context.Context, hash common.Hash) (hex
 	return nil, errors.New("unknown preimage")
 }
 
+// CheckTrieConsistency audits the reference counts, flush-list and tracked sizes
+// of the in-memory trie node cache, returning every discrepancy found.
+func (api *PrivateDebugAPI) CheckTrieConsistency() error {
+	return api.eth.BlockChain().StateCache().TrieDB().CheckConsistency()
+}
+
+// TrieSharingReport measures how many of the in-memory trie nodes reachable from
+// two state roots are shared between them, and how many are unique to either.
+func (api *PrivateDebugAPI) TrieSharingReport(rootA, rootB common.Hash) trie.SharingReport {
+	return api.eth.BlockChain().StateCache().TrieDB().SharingReport(rootA, rootB)
+}
+
+// TrieSizeByOwner returns the tries holding the most in-memory trie nodes, the
+// account trie being reported as the zero owner. Zero count returns all of them.
+func (api *PrivateDebugAPI) TrieSizeByOwner(count int) []trie.OwnerSize {
+	return api.eth.BlockChain().StateCache().TrieDB().SizeByOwner(count)
+}
+
 // BadBlockArgs represents the entries in the list returned when bad blocks are queried.
 type BadBlockArgs struct {
 	Hash  common.Hash            `json:"hash"`
@@ -375,7 +393,7 @@ func (api *PublicDebugAPI) AccountRange(blockNrOrHash rpc.BlockNumberOrHash, sta
 			if block == nil {
 				return state.IteratorDump{}, fmt.Errorf("block #%d not found", number)
 			}
-			stateDb, err = api.eth.BlockChain().StateAt(block.Root())
+			stateDb, err = api.eth.BlockChain().StateAtWithTag(block.Root(), trie.ReadTagRPC)
 			if err != nil {
 				return state.IteratorDump{}, err
 			}
@@ -385,7 +403,7 @@ func (api *PublicDebugAPI) AccountRange(blockNrOrHash rpc.BlockNumberOrHash, sta
 		if block == nil {
 			return state.IteratorDump{}, fmt.Errorf("block %s not found", hash.Hex())
 		}
-		stateDb, err = api.eth.BlockChain().StateAt(block.Root())
+		stateDb, err = api.eth.BlockChain().StateAtWithTag(block.Root(), trie.ReadTagRPC)
 		if err != nil {
 			return state.IteratorDump{}, err
 		}
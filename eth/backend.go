@@ -184,12 +184,24 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 		cacheConfig = &core.CacheConfig{
 			TrieCleanLimit:      config.TrieCleanCache,
 			TrieCleanNoPrefetch: config.NoPrefetch,
+			TrieCleanRejournal:  config.TrieCleanRejournal,
+			TrieCleanShare:      config.TrieCleanShare,
 			TrieDirtyLimit:      config.TrieDirtyCache,
 			TrieDirtyDisabled:   config.NoPruning,
 			TrieTimeLimit:       config.TrieTimeout,
+			TrieBackgroundFlush: config.TrieBackgroundFlush,
 			SnapshotLimit:       config.SnapshotCache,
 		}
 	)
+	if config.TrieCleanJournal != "" {
+		cacheConfig.TrieCleanJournal = ctx.ResolvePath(config.TrieCleanJournal)
+	}
+	if config.TrieCleanShared != "" {
+		cacheConfig.TrieCleanShared = ctx.ResolvePath(config.TrieCleanShared)
+	}
+	if config.TrieDirtyJournal != "" {
+		cacheConfig.TrieDirtyJournal = ctx.ResolvePath(config.TrieDirtyJournal)
+	}
 	eth.blockchain, err = core.NewBlockChain(chainDb, cacheConfig, chainConfig, eth.engine, vmConfig, eth.shouldPreserve, &config.TxLookupLimit)
 	if err != nil {
 		return nil, err
@@ -50,6 +50,7 @@ var DefaultConfig = Config{
 	UltraLightFraction: 75,
 	DatabaseCache:      512,
 	TrieCleanCache:     256,
+	TrieCleanRejournal: 60 * time.Minute,
 	TrieDirtyCache:     256,
 	TrieTimeout:        60 * time.Minute,
 	SnapshotCache:      256,
@@ -116,21 +117,49 @@ type Config struct {
 	LightEgress  int `toml:",omitempty"` // Outgoing bandwidth limit for light servers
 	LightPeers   int `toml:",omitempty"` // Maximum number of LES client peers
 
+	// Light server client pool event log, used to replay capacity incidents
+	LightPoolRecord string `toml:",omitempty"`
+
+	// Light server client pool state to import on startup, exported from another
+	// server with les_exportPoolState
+	LightPoolImport string `toml:",omitempty"`
+
+	// Maximum number of free light clients per address. If set, free clients are
+	// identified by both their address and node ID, otherwise by address only.
+	LightFreePerAddr int `toml:",omitempty"`
+
+	// Light client header pruning, deleting headers retrievable via CHT proofs
+	LightPruneHeaders bool `toml:",omitempty"`
+
+	// Reorg depth above which light servers flag their announcements as deep
+	// reorgs, making the clients resync instead of following them (0 = disabled)
+	LightDeepReorg uint64 `toml:",omitempty"`
+
 	// Ultra Light client options
 	UltraLightServers      []string `toml:",omitempty"` // List of trusted ultra light servers
 	UltraLightFraction     int      `toml:",omitempty"` // Percentage of trusted servers to accept an announcement
 	UltraLightOnlyAnnounce bool     `toml:",omitempty"` // Whether to only announce headers, or also serve them
 
+	// Whether to advertise the locally computed checkpoint to ultra light clients
+	// before it is registered in the checkpoint oracle
+	UltraLightUnattestedCheckpoint bool `toml:",omitempty"`
+
 	// Database options
 	SkipBcVersionCheck bool `toml:"-"`
 	DatabaseHandles    int  `toml:"-"`
 	DatabaseCache      int
 	DatabaseFreezer    string
 
-	TrieCleanCache int
-	TrieDirtyCache int
-	TrieTimeout    time.Duration
-	SnapshotCache  int
+	TrieCleanCache      int
+	TrieCleanJournal    string        `toml:",omitempty"` // Disk journal for the clean trie cache to survive node restarts
+	TrieCleanRejournal  time.Duration `toml:",omitempty"` // Time interval to regenerate the clean trie cache journal
+	TrieCleanShare      bool          `toml:",omitempty"` // Save a copy of the clean trie cache for read-only processes to map
+	TrieCleanShared     string        `toml:",omitempty"` // Clean trie cache journal of another process to read through instead of an own cache
+	TrieDirtyCache      int
+	TrieTimeout         time.Duration
+	TrieDirtyJournal    string `toml:",omitempty"` // Disk journal for the dirty trie cache to survive node restarts
+	TrieBackgroundFlush bool   `toml:",omitempty"` // Flush the dirty trie cache in the background instead of during import
+	SnapshotCache       int
 
 	// Mining options
 	Miner miner.Config
@@ -18,41 +18,53 @@ import (
 // MarshalTOML marshals as TOML.
 func (c Config) MarshalTOML() (interface{}, error) {
 	type Config struct {
-		Genesis                 *core.Genesis `toml:",omitempty"`
-		NetworkId               uint64
-		SyncMode                downloader.SyncMode
-		DiscoveryURLs           []string
-		NoPruning               bool
-		NoPrefetch              bool
-		TxLookupLimit           uint64                 `toml:",omitempty"`
-		Whitelist               map[uint64]common.Hash `toml:"-"`
-		LightServ               int                    `toml:",omitempty"`
-		LightIngress            int                    `toml:",omitempty"`
-		LightEgress             int                    `toml:",omitempty"`
-		LightPeers              int                    `toml:",omitempty"`
-		UltraLightServers       []string               `toml:",omitempty"`
-		UltraLightFraction      int                    `toml:",omitempty"`
-		UltraLightOnlyAnnounce  bool                   `toml:",omitempty"`
-		SkipBcVersionCheck      bool                   `toml:"-"`
-		DatabaseHandles         int                    `toml:"-"`
-		DatabaseCache           int
-		DatabaseFreezer         string
-		TrieCleanCache          int
-		TrieDirtyCache          int
-		TrieTimeout             time.Duration
-		Miner                   miner.Config
-		Ethash                  ethash.Config
-		TxPool                  core.TxPoolConfig
-		GPO                     gasprice.Config
-		EnablePreimageRecording bool
-		DocRoot                 string `toml:"-"`
-		EWASMInterpreter        string
-		EVMInterpreter          string
-		RPCGasCap               *big.Int                       `toml:",omitempty"`
-		Checkpoint              *params.TrustedCheckpoint      `toml:",omitempty"`
-		CheckpointOracle        *params.CheckpointOracleConfig `toml:",omitempty"`
-		OverrideIstanbul        *big.Int                       `toml:",omitempty"`
-		OverrideMuirGlacier     *big.Int                       `toml:",omitempty"`
+		Genesis                        *core.Genesis `toml:",omitempty"`
+		NetworkId                      uint64
+		SyncMode                       downloader.SyncMode
+		DiscoveryURLs                  []string
+		NoPruning                      bool
+		NoPrefetch                     bool
+		TxLookupLimit                  uint64                 `toml:",omitempty"`
+		Whitelist                      map[uint64]common.Hash `toml:"-"`
+		LightServ                      int                    `toml:",omitempty"`
+		LightIngress                   int                    `toml:",omitempty"`
+		LightEgress                    int                    `toml:",omitempty"`
+		LightPeers                     int                    `toml:",omitempty"`
+		LightPoolRecord                string                 `toml:",omitempty"`
+		LightPoolImport                string                 `toml:",omitempty"`
+		LightFreePerAddr               int                    `toml:",omitempty"`
+		LightPruneHeaders              bool                   `toml:",omitempty"`
+		LightDeepReorg                 uint64                 `toml:",omitempty"`
+		UltraLightServers              []string               `toml:",omitempty"`
+		UltraLightFraction             int                    `toml:",omitempty"`
+		UltraLightOnlyAnnounce         bool                   `toml:",omitempty"`
+		UltraLightUnattestedCheckpoint bool                   `toml:",omitempty"`
+		SkipBcVersionCheck             bool                   `toml:"-"`
+		DatabaseHandles                int                    `toml:"-"`
+		DatabaseCache                  int
+		DatabaseFreezer                string
+		TrieCleanCache                 int
+		TrieCleanJournal               string        `toml:",omitempty"`
+		TrieCleanRejournal             time.Duration `toml:",omitempty"`
+		TrieCleanShare                 bool          `toml:",omitempty"`
+		TrieCleanShared                string        `toml:",omitempty"`
+		TrieDirtyCache                 int
+		TrieTimeout                    time.Duration
+		TrieDirtyJournal               string
+		TrieBackgroundFlush            bool
+		Miner                          miner.Config
+		Ethash                         ethash.Config
+		TxPool                         core.TxPoolConfig
+		GPO                            gasprice.Config
+		EnablePreimageRecording        bool
+		DocRoot                        string `toml:"-"`
+		EWASMInterpreter               string
+		EVMInterpreter                 string
+		RPCGasCap                      *big.Int                       `toml:",omitempty"`
+		Checkpoint                     *params.TrustedCheckpoint      `toml:",omitempty"`
+		CheckpointOracle               *params.CheckpointOracleConfig `toml:",omitempty"`
+		OverrideIstanbul               *big.Int                       `toml:",omitempty"`
+		OverrideMuirGlacier            *big.Int                       `toml:",omitempty"`
 	}
 	var enc Config
 	enc.Genesis = c.Genesis
@@ -67,16 +79,28 @@ func (c Config) MarshalTOML() (interface{}, error) {
 	enc.LightIngress = c.LightIngress
 	enc.LightEgress = c.LightEgress
 	enc.LightPeers = c.LightPeers
+	enc.LightPoolRecord = c.LightPoolRecord
+	enc.LightPoolImport = c.LightPoolImport
+	enc.LightFreePerAddr = c.LightFreePerAddr
+	enc.LightPruneHeaders = c.LightPruneHeaders
+	enc.LightDeepReorg = c.LightDeepReorg
 	enc.UltraLightServers = c.UltraLightServers
 	enc.UltraLightFraction = c.UltraLightFraction
 	enc.UltraLightOnlyAnnounce = c.UltraLightOnlyAnnounce
+	enc.UltraLightUnattestedCheckpoint = c.UltraLightUnattestedCheckpoint
 	enc.SkipBcVersionCheck = c.SkipBcVersionCheck
 	enc.DatabaseHandles = c.DatabaseHandles
 	enc.DatabaseCache = c.DatabaseCache
 	enc.DatabaseFreezer = c.DatabaseFreezer
 	enc.TrieCleanCache = c.TrieCleanCache
+	enc.TrieCleanJournal = c.TrieCleanJournal
+	enc.TrieCleanRejournal = c.TrieCleanRejournal
+	enc.TrieCleanShare = c.TrieCleanShare
+	enc.TrieCleanShared = c.TrieCleanShared
 	enc.TrieDirtyCache = c.TrieDirtyCache
 	enc.TrieTimeout = c.TrieTimeout
+	enc.TrieDirtyJournal = c.TrieDirtyJournal
+	enc.TrieBackgroundFlush = c.TrieBackgroundFlush
 	enc.Miner = c.Miner
 	enc.Ethash = c.Ethash
 	enc.TxPool = c.TxPool
@@ -94,41 +118,53 @@ func (c Config) MarshalTOML() (interface{}, error) {
 // UnmarshalTOML unmarshals from TOML.
 func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	type Config struct {
-		Genesis                 *core.Genesis `toml:",omitempty"`
-		NetworkId               *uint64
-		SyncMode                *downloader.SyncMode
-		DiscoveryURLs           []string
-		NoPruning               *bool
-		NoPrefetch              *bool
-		TxLookupLimit           *uint64                `toml:",omitempty"`
-		Whitelist               map[uint64]common.Hash `toml:"-"`
-		LightServ               *int                   `toml:",omitempty"`
-		LightIngress            *int                   `toml:",omitempty"`
-		LightEgress             *int                   `toml:",omitempty"`
-		LightPeers              *int                   `toml:",omitempty"`
-		UltraLightServers       []string               `toml:",omitempty"`
-		UltraLightFraction      *int                   `toml:",omitempty"`
-		UltraLightOnlyAnnounce  *bool                  `toml:",omitempty"`
-		SkipBcVersionCheck      *bool                  `toml:"-"`
-		DatabaseHandles         *int                   `toml:"-"`
-		DatabaseCache           *int
-		DatabaseFreezer         *string
-		TrieCleanCache          *int
-		TrieDirtyCache          *int
-		TrieTimeout             *time.Duration
-		Miner                   *miner.Config
-		Ethash                  *ethash.Config
-		TxPool                  *core.TxPoolConfig
-		GPO                     *gasprice.Config
-		EnablePreimageRecording *bool
-		DocRoot                 *string `toml:"-"`
-		EWASMInterpreter        *string
-		EVMInterpreter          *string
-		RPCGasCap               *big.Int                       `toml:",omitempty"`
-		Checkpoint              *params.TrustedCheckpoint      `toml:",omitempty"`
-		CheckpointOracle        *params.CheckpointOracleConfig `toml:",omitempty"`
-		OverrideIstanbul        *big.Int                       `toml:",omitempty"`
-		OverrideMuirGlacier     *big.Int                       `toml:",omitempty"`
+		Genesis                        *core.Genesis `toml:",omitempty"`
+		NetworkId                      *uint64
+		SyncMode                       *downloader.SyncMode
+		DiscoveryURLs                  []string
+		NoPruning                      *bool
+		NoPrefetch                     *bool
+		TxLookupLimit                  *uint64                `toml:",omitempty"`
+		Whitelist                      map[uint64]common.Hash `toml:"-"`
+		LightServ                      *int                   `toml:",omitempty"`
+		LightIngress                   *int                   `toml:",omitempty"`
+		LightEgress                    *int                   `toml:",omitempty"`
+		LightPeers                     *int                   `toml:",omitempty"`
+		LightPoolRecord                *string                `toml:",omitempty"`
+		LightPoolImport                *string                `toml:",omitempty"`
+		LightFreePerAddr               *int                   `toml:",omitempty"`
+		LightPruneHeaders              *bool                  `toml:",omitempty"`
+		LightDeepReorg                 *uint64                `toml:",omitempty"`
+		UltraLightServers              []string               `toml:",omitempty"`
+		UltraLightFraction             *int                   `toml:",omitempty"`
+		UltraLightOnlyAnnounce         *bool                  `toml:",omitempty"`
+		UltraLightUnattestedCheckpoint *bool                  `toml:",omitempty"`
+		SkipBcVersionCheck             *bool                  `toml:"-"`
+		DatabaseHandles                *int                   `toml:"-"`
+		DatabaseCache                  *int
+		DatabaseFreezer                *string
+		TrieCleanCache                 *int
+		TrieCleanJournal               *string        `toml:",omitempty"`
+		TrieCleanRejournal             *time.Duration `toml:",omitempty"`
+		TrieCleanShare                 *bool          `toml:",omitempty"`
+		TrieCleanShared                *string        `toml:",omitempty"`
+		TrieDirtyCache                 *int
+		TrieTimeout                    *time.Duration
+		TrieDirtyJournal               *string
+		TrieBackgroundFlush            *bool
+		Miner                          *miner.Config
+		Ethash                         *ethash.Config
+		TxPool                         *core.TxPoolConfig
+		GPO                            *gasprice.Config
+		EnablePreimageRecording        *bool
+		DocRoot                        *string `toml:"-"`
+		EWASMInterpreter               *string
+		EVMInterpreter                 *string
+		RPCGasCap                      *big.Int                       `toml:",omitempty"`
+		Checkpoint                     *params.TrustedCheckpoint      `toml:",omitempty"`
+		CheckpointOracle               *params.CheckpointOracleConfig `toml:",omitempty"`
+		OverrideIstanbul               *big.Int                       `toml:",omitempty"`
+		OverrideMuirGlacier            *big.Int                       `toml:",omitempty"`
 	}
 	var dec Config
 	if err := unmarshal(&dec); err != nil {
@@ -170,6 +206,21 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.LightPeers != nil {
 		c.LightPeers = *dec.LightPeers
 	}
+	if dec.LightPoolRecord != nil {
+		c.LightPoolRecord = *dec.LightPoolRecord
+	}
+	if dec.LightPoolImport != nil {
+		c.LightPoolImport = *dec.LightPoolImport
+	}
+	if dec.LightFreePerAddr != nil {
+		c.LightFreePerAddr = *dec.LightFreePerAddr
+	}
+	if dec.LightPruneHeaders != nil {
+		c.LightPruneHeaders = *dec.LightPruneHeaders
+	}
+	if dec.LightDeepReorg != nil {
+		c.LightDeepReorg = *dec.LightDeepReorg
+	}
 	if dec.UltraLightServers != nil {
 		c.UltraLightServers = dec.UltraLightServers
 	}
@@ -179,6 +230,9 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.UltraLightOnlyAnnounce != nil {
 		c.UltraLightOnlyAnnounce = *dec.UltraLightOnlyAnnounce
 	}
+	if dec.UltraLightUnattestedCheckpoint != nil {
+		c.UltraLightUnattestedCheckpoint = *dec.UltraLightUnattestedCheckpoint
+	}
 	if dec.SkipBcVersionCheck != nil {
 		c.SkipBcVersionCheck = *dec.SkipBcVersionCheck
 	}
@@ -194,12 +248,30 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.TrieCleanCache != nil {
 		c.TrieCleanCache = *dec.TrieCleanCache
 	}
+	if dec.TrieCleanJournal != nil {
+		c.TrieCleanJournal = *dec.TrieCleanJournal
+	}
+	if dec.TrieCleanRejournal != nil {
+		c.TrieCleanRejournal = *dec.TrieCleanRejournal
+	}
+	if dec.TrieCleanShare != nil {
+		c.TrieCleanShare = *dec.TrieCleanShare
+	}
+	if dec.TrieCleanShared != nil {
+		c.TrieCleanShared = *dec.TrieCleanShared
+	}
 	if dec.TrieDirtyCache != nil {
 		c.TrieDirtyCache = *dec.TrieDirtyCache
 	}
 	if dec.TrieTimeout != nil {
 		c.TrieTimeout = *dec.TrieTimeout
 	}
+	if dec.TrieDirtyJournal != nil {
+		c.TrieDirtyJournal = *dec.TrieDirtyJournal
+	}
+	if dec.TrieBackgroundFlush != nil {
+		c.TrieBackgroundFlush = *dec.TrieBackgroundFlush
+	}
 	if dec.Miner != nil {
 		c.Miner = *dec.Miner
 	}
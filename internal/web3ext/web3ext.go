@@ -434,6 +434,21 @@ web3._extend({
 			params: 1,
 			inputFormatter: [null]
 		}),
+		new web3._extend.Method({
+			name: 'checkTrieConsistency',
+			call: 'debug_checkTrieConsistency',
+			params: 0,
+		}),
+		new web3._extend.Method({
+			name: 'trieSharingReport',
+			call: 'debug_trieSharingReport',
+			params: 2,
+		}),
+		new web3._extend.Method({
+			name: 'trieSizeByOwner',
+			call: 'debug_trieSizeByOwner',
+			params: 1,
+		}),
 		new web3._extend.Method({
 			name: 'getBadBlocks',
 			call: 'debug_getBadBlocks',
@@ -839,6 +854,11 @@ web3._extend({
 			call: 'les_addBalance',
 			params: 3
 		}),
+		new web3._extend.Method({
+			name: 'exportPoolState',
+			call: 'les_exportPoolState',
+			params: 1
+		}),
 	],
 	properties:
 	[
@@ -0,0 +1,131 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// announcePrefTTL is the time after which the announcement type negotiated by
+// a client is forgotten if the client doesn't connect again.
+const announcePrefTTL = 30 * 24 * time.Hour
+
+var announcePrefPrefix = []byte("announcePref:") // announcePrefPrefix + id -> announcePref
+
+// announcePref is the announcement type a client negotiated in its last session.
+type announcePref struct {
+	Type uint64 // Negotiated announcement type
+	Time uint64 // Unix time of the last negotiation
+}
+
+// announcePrefs persists the announcement types negotiated by the clients, so
+// that a returning client which doesn't repeat its request in the handshake is
+// served with the type it asked for from the first announced head, even after
+// a server restart.
+//
+// The entries are timestamped with the wall clock, as they need to be aged out
+// across restarts.
+type announcePrefs struct {
+	db  ethdb.KeyValueStore
+	ttl time.Duration
+	now func() time.Time // Wall clock, replaceable in tests
+}
+
+// newAnnouncePrefs creates the announcement preference store on top of the
+// given database, dropping the expired entries.
+func newAnnouncePrefs(db ethdb.KeyValueStore) *announcePrefs {
+	prefs := &announcePrefs{db: db, ttl: announcePrefTTL, now: time.Now}
+	prefs.expire()
+	return prefs
+}
+
+// key returns the database key of the preference of the given client.
+func (prefs *announcePrefs) key(id enode.ID) []byte {
+	return append(append([]byte{}, announcePrefPrefix...), id[:]...)
+}
+
+// expired reports whether the preference is too old to be used.
+func (prefs *announcePrefs) expired(pref announcePref) bool {
+	return prefs.now().Sub(time.Unix(int64(pref.Time), 0)) >= prefs.ttl
+}
+
+// get retrieves the announcement type last negotiated by the given client, if
+// it's known and not expired.
+func (prefs *announcePrefs) get(id enode.ID) (uint64, bool) {
+	if prefs == nil {
+		return 0, false
+	}
+	enc, err := prefs.db.Get(prefs.key(id))
+	if err != nil || len(enc) == 0 {
+		return 0, false
+	}
+	var pref announcePref
+	if err := rlp.DecodeBytes(enc, &pref); err != nil {
+		log.Error("Failed to decode announcement preference", "id", id, "err", err)
+		return 0, false
+	}
+	if prefs.expired(pref) {
+		prefs.db.Delete(prefs.key(id))
+		return 0, false
+	}
+	return pref.Type, true
+}
+
+// set stores the announcement type negotiated by the given client.
+func (prefs *announcePrefs) set(id enode.ID, announceType uint64) {
+	if prefs == nil {
+		return
+	}
+	enc, err := rlp.EncodeToBytes(announcePref{Type: announceType, Time: uint64(prefs.now().Unix())})
+	if err != nil {
+		log.Error("Failed to encode announcement preference", "err", err)
+		return
+	}
+	if err := prefs.db.Put(prefs.key(id), enc); err != nil {
+		log.Error("Failed to store announcement preference", "id", id, "err", err)
+	}
+}
+
+// expire deletes the expired and undecodable preferences.
+func (prefs *announcePrefs) expire() {
+	var (
+		visited, deleted int
+		batch            = prefs.db.NewBatch()
+	)
+	it := prefs.db.NewIterator(announcePrefPrefix, nil)
+	for it.Next() {
+		visited++
+
+		var pref announcePref
+		if err := rlp.DecodeBytes(it.Value(), &pref); err != nil || prefs.expired(pref) {
+			batch.Delete(it.Key())
+			deleted++
+		}
+	}
+	it.Release()
+
+	if err := batch.Write(); err != nil {
+		log.Error("Failed to expire announcement preferences", "err", err)
+		return
+	}
+	log.Debug("Expired announcement preferences", "visited", visited, "deleted", deleted)
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// Tests that the announcement type negotiated by a client is remembered across
+// server restarts, so a returning client is sent signed announcements from the
+// first head on, even without repeating its request.
+func TestAnnouncePrefRestart(t *testing.T) {
+	var (
+		db     = rawdb.NewMemoryDatabase()
+		clock  = &mclock.Simulated{}
+		key, _ = crypto.GenerateKey()
+		id     = enode.ID{0x01}
+	)
+	start := func() (*serverHandler, *backends.SimulatedBackend) {
+		handler, backend := newTestServerHandler(0, nil, db, newClientPeerSet(), clock)
+		handler.server.privateKey = key
+		return handler, backend
+	}
+	// connect runs the handshake of the client, requesting the given announcement
+	// type if any, and waits until it's registered.
+	connect := func(handler *serverHandler, announceType *uint64) (*p2p.MsgPipeRW, *clientPeer) {
+		app, net := p2p.MsgPipe()
+		peer := newClientPeer(lpv3, NetworkId, p2p.NewPeer(id, "client", nil), net)
+		go handler.handle(peer)
+
+		msg, err := app.ReadMsg()
+		if err != nil || msg.Code != StatusMsg {
+			t.Fatalf("Failed to read status: code %d, err %v", msg.Code, err)
+		}
+		msg.Discard()
+
+		var (
+			genesis = handler.blockchain.Genesis()
+			head    = handler.blockchain.CurrentHeader()
+			td      = handler.blockchain.GetTd(head.Hash(), head.Number.Uint64())
+		)
+		var send keyValueList
+		send = send.add("protocolVersion", uint64(lpv3))
+		send = send.add("networkId", uint64(NetworkId))
+		send = send.add("headTd", td)
+		send = send.add("headHash", head.Hash())
+		send = send.add("headNum", head.Number.Uint64())
+		send = send.add("genesisHash", genesis.Hash())
+		if announceType != nil {
+			send = send.add("announceType", *announceType)
+		}
+		if err := p2p.Send(app, StatusMsg, send); err != nil {
+			t.Fatalf("Failed to send status: %v", err)
+		}
+		for i := 0; handler.server.peers.peer(peerIdToString(id)) == nil; i++ {
+			if i == 500 {
+				t.Fatalf("Client not registered")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return app, peer
+	}
+	// Negotiate signed announcements in the first session, then restart
+	signed := uint64(announceTypeSigned)
+	handler, backend := start()
+	app, peer := connect(handler, &signed)
+	app.Close()
+	peer.close()
+	handler.stop()
+	backend.Close()
+
+	// Reconnect without requesting any announcement type and check that the
+	// first announced head is signed
+	handler, backend = start()
+	defer backend.Close()
+	defer handler.stop()
+
+	app, peer = connect(handler, nil)
+	defer peer.close()
+	defer app.Close()
+
+	if peer.announceType != announceTypeSigned {
+		t.Fatalf("Announcement type mismatch: have %s, want %s", announceTypeName(peer.announceType), announceTypeName(announceTypeSigned))
+	}
+	backend.Commit()
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("Failed to read announcement: %v", err)
+	}
+	if msg.Code != AnnounceMsg {
+		t.Fatalf("Message code mismatch: have %d, want %d", msg.Code, AnnounceMsg)
+	}
+	var announce announceData
+	if err := msg.Decode(&announce); err != nil {
+		t.Fatalf("Failed to decode announcement: %v", err)
+	}
+	update, _ := announce.Update.decode()
+	if err := announce.checkSignature(enode.PubkeyToIDV4(&key.PublicKey), update); err != nil {
+		t.Fatalf("First announcement not signed: %v", err)
+	}
+}
+
+// Tests that the negotiated announcement types are forgotten after the TTL.
+func TestAnnouncePrefExpiry(t *testing.T) {
+	var (
+		db  = rawdb.NewMemoryDatabase()
+		now = time.Unix(1600000000, 0)
+	)
+	prefs := newAnnouncePrefs(db)
+	prefs.now = func() time.Time { return now }
+
+	prefs.set(enode.ID{0x01}, announceTypeSigned)
+	now = now.Add(announcePrefTTL / 2)
+	prefs.set(enode.ID{0x02}, announceTypeNone)
+
+	if typ, ok := prefs.get(enode.ID{0x01}); !ok || typ != announceTypeSigned {
+		t.Fatalf("Preference mismatch: have %d/%v, want %d/true", typ, ok, announceTypeSigned)
+	}
+	if _, ok := prefs.get(enode.ID{0x03}); ok {
+		t.Fatalf("Unknown client has a preference")
+	}
+	// Age out the first entry and check that a restart drops it from the database
+	now = now.Add(announcePrefTTL / 2)
+	if _, ok := prefs.get(enode.ID{0x01}); ok {
+		t.Fatalf("Expired preference returned")
+	}
+	prefs.set(enode.ID{0x01}, announceTypeSigned)
+	now = now.Add(announcePrefTTL / 2)
+
+	prefs = &announcePrefs{db: db, ttl: announcePrefTTL, now: func() time.Time { return now }}
+	prefs.expire()
+	if has, _ := db.Has(prefs.key(enode.ID{0x02})); has {
+		t.Fatalf("Expired preference not deleted")
+	}
+	if typ, ok := prefs.get(enode.ID{0x01}); !ok || typ != announceTypeSigned {
+		t.Fatalf("Refreshed preference mismatch: have %d/%v, want %d/true", typ, ok, announceTypeSigned)
+	}
+}
@@ -17,14 +17,29 @@
 package les
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
+	"net"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	lpc "github.com/ethereum/go-ethereum/les/lespay/client"
+	"github.com/ethereum/go-ethereum/light"
 	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
+	"golang.org/x/time/rate"
 )
 
 var (
@@ -33,6 +48,9 @@ var (
 	errUnknownBenchmarkType = errors.New("unknown benchmark type")
 	errBalanceOverflow      = errors.New("balance overflow")
 	errNoPriority           = errors.New("priority too low to raise capacity")
+	errNoBalance            = errors.New("source client has no positive balance")
+	errInsufficientBalance  = errors.New("insufficient balance for transfer")
+	errTransferToSelf       = errors.New("balance transfer to the same client")
 )
 
 const maxBalance = math.MaxInt64
@@ -59,9 +77,96 @@ func (api *PrivateLightServerAPI) ServerInfo() map[string]interface{} {
 	res["maximumCapacity"] = api.server.maxCapacity
 	res["freeClientCapacity"] = api.server.freeCapacity
 	res["totalCapacity"], res["totalConnectedCapacity"], res["priorityConnectedCapacity"] = api.server.clientPool.capacityInfo()
+	res["freeClientsPaused"] = api.server.clientPool.freeClientsPaused()
 	return res
 }
 
+// SetFreeClientsPaused pauses or resumes serving free clients without affecting
+// priority ones. Pausing disconnects all currently connected free clients.
+func (api *PrivateLightServerAPI) SetFreeClientsPaused(paused bool) {
+	api.server.clientPool.setFreeClientsPaused(paused)
+}
+
+// SetBudgetAlert sets the ratio of the total stored positive balance to the
+// balance the pool can serve during an expected session length of the given
+// number of seconds, above which an alert is raised. Zero disables the alert.
+func (api *PrivateLightServerAPI) SetBudgetAlert(threshold float64, session uint64) {
+	api.server.clientPool.setBudgetAlert(threshold, time.Duration(session)*time.Second, nil)
+}
+
+// SetServiceQualityTarget sets the share of time the priority clients should be
+// served at their requested capacity, below which an alert is raised. Zero
+// disables the alert.
+func (api *PrivateLightServerAPI) SetServiceQualityTarget(target float64) {
+	api.server.clientPool.setServiceQualityTarget(target)
+}
+
+// ServiceQuality returns the share of time the connected clients of each class
+// spent at their requested capacity, at a reduced capacity or inactive over the
+// rolling windows.
+func (api *PrivateLightServerAPI) ServiceQuality() []ServiceQuality {
+	return api.server.clientPool.serviceQuality()
+}
+
+// Peers returns the negotiated capabilities of all connected client peers.
+func (api *PrivateLightServerAPI) Peers() []LightPeerInfo {
+	return api.server.peers.lightInfos()
+}
+
+// PoolMetrics returns a snapshot of the client pool metrics
+func (api *PrivateLightServerAPI) PoolMetrics() ClientPoolMetrics {
+	return api.server.clientPool.metricsSnapshot()
+}
+
+// ActivationThreshold returns the highest priority a new free client may have in
+// order to be accepted by the client pool right now (lower is better).
+func (api *PrivateLightServerAPI) ActivationThreshold() int64 {
+	return api.server.clientPool.activationThreshold()
+}
+
+// IndexerStatus is the processing progress of a helper trie indexer.
+type IndexerStatus struct {
+	Sections    uint64      `json:"sections"`    // Number of processed sections
+	Head        uint64      `json:"head"`        // Number of the last indexed block
+	SectionHead common.Hash `json:"sectionHead"` // Hash of the last indexed block
+	Root        common.Hash `json:"root"`        // Root of the last generated helper trie
+}
+
+// IndexerStatus returns the processing progress of the CHT and bloom trie indexers.
+func (api *PrivateLightServerAPI) IndexerStatus() map[string]IndexerStatus {
+	status := func(indexer *core.ChainIndexer, root func(ethdb.Database, uint64, common.Hash) common.Hash) IndexerStatus {
+		sections, head, sectionHead := indexer.Sections()
+		if sections == 0 {
+			return IndexerStatus{}
+		}
+		return IndexerStatus{
+			Sections:    sections,
+			Head:        head,
+			SectionHead: sectionHead,
+			Root:        root(api.server.chainDb, sections-1, sectionHead),
+		}
+	}
+	return map[string]IndexerStatus{
+		"cht":       status(api.server.chtIndexer, light.GetChtRoot),
+		"bloomtrie": status(api.server.bloomTrieIndexer, light.GetBloomTrieRoot),
+	}
+}
+
+// ReprocessSection rolls the CHT ("cht") or bloom trie ("bloomtrie") indexer back
+// to before the given section, letting it regenerate the discarded helper tries.
+// Local checkpoints are not served for the affected sections until both indexers
+// have caught up again.
+func (api *PrivateLightServerAPI) ReprocessSection(kind string, index uint64) error {
+	switch kind {
+	case "cht":
+		return api.server.chtIndexer.Rollback(index)
+	case "bloomtrie":
+		return api.server.bloomTrieIndexer.Rollback(index)
+	default:
+		return fmt.Errorf("unknown indexer %q", kind)
+	}
+}
+
 // ClientInfo returns information about clients listed in the ids list or matching the given tags
 func (api *PrivateLightServerAPI) ClientInfo(ids []enode.ID) map[enode.ID]map[string]interface{} {
 	res := make(map[enode.ID]map[string]interface{})
@@ -177,6 +282,37 @@ func (api *PrivateLightServerAPI) AddBalance(id enode.ID, value int64, meta stri
 	return [2]uint64{oldBalance, newBalance}, err
 }
 
+// TransferBalance moves positive balance from one client to another, e.g. after
+// a node key rotation. If value is zero the entire balance is moved. The amount
+// transferred is returned.
+func (api *PrivateLightServerAPI) TransferBalance(from, to enode.ID, value uint64) (uint64, error) {
+	return api.server.clientPool.transferBalance(from, to, value)
+}
+
+// ExportPoolState writes the full client pool state, the balances and the set of
+// connected clients, into the given file. A server migrated to new hardware can
+// import it on startup with --light.pool.import before serving any clients.
+func (api *PrivateLightServerAPI) ExportPoolState(file string) (bool, error) {
+	if _, err := os.Stat(file); err == nil {
+		// File already exists. Allowing overwrite could be a DoS vector,
+		// since the 'file' may point to arbitrary paths on the drive
+		return false, errors.New("location would overwrite an existing file")
+	}
+	out, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return false, err
+	}
+	if err := api.server.clientPool.exportState(out); err != nil {
+		out.Close()
+		os.Remove(file)
+		return false, err
+	}
+	if err := out.Close(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // SetClientParams sets client parameters for all clients listed in the ids list
 // or all connected clients if the list is empty
 func (api *PrivateLightServerAPI) SetClientParams(ids []enode.ID, params map[string]interface{}) error {
@@ -301,6 +437,85 @@ func (api *PrivateDebugAPI) FreezeClient(id enode.ID) error {
 	})
 }
 
+// PrivateLightClientAPI provides an API to access the LES light client.
+type PrivateLightClientAPI struct {
+	client *LightEthereum
+}
+
+// NewPrivateLightClientAPI creates a new LES light client API.
+func NewPrivateLightClientAPI(client *LightEthereum) *PrivateLightClientAPI {
+	return &PrivateLightClientAPI{client: client}
+}
+
+// ServerPeers returns the negotiated capabilities of all connected server peers.
+func (api *PrivateLightClientAPI) ServerPeers() []LightPeerInfo {
+	return api.client.peers.lightInfos()
+}
+
+// RequestTimeouts returns the soft timeouts currently applied to the requests sent
+// to each connected server, per request type, in seconds. They are derived from the
+// response times of the individual servers once enough responses are collected.
+func (api *PrivateLightClientAPI) RequestTimeouts() map[enode.ID]map[string]float64 {
+	res := make(map[enode.ID]map[string]float64)
+	for _, p := range api.client.peers.allPeers() {
+		timeouts := make(map[string]float64)
+		for name, timeout := range api.client.serverPool.serverTimeouts(p) {
+			timeouts[name] = float64(timeout) / float64(time.Second)
+		}
+		res[p.ID()] = timeouts
+	}
+	return res
+}
+
+// dialEventBuffer is the number of dial events buffered for a subscriber before
+// further events are dropped.
+const dialEventBuffer = 256
+
+// PrivateLightDebugAPI provides debugging facilities of the LES light client.
+type PrivateLightDebugAPI struct {
+	client *LightEthereum
+}
+
+// NewPrivateLightDebugAPI creates a new LES light client debug API.
+func NewPrivateLightDebugAPI(client *LightEthereum) *PrivateLightDebugAPI {
+	return &PrivateLightDebugAPI{client: client}
+}
+
+// LesDialEvents subscribes to the decisions made while selecting servers to dial:
+// weighted random selections, pre-negotiation queries and their results. Events
+// are dropped if the subscriber can't keep up, see LesDialEventsDropped.
+func (api *PrivateLightDebugAPI) LesDialEvents(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	rpcSub := notifier.CreateSubscription()
+
+	go func() {
+		events := make(chan lpc.DialEvent, dialEventBuffer)
+		sub := api.client.serverPool.dialEvents.Subscribe(events)
+		defer sub.Unsubscribe()
+
+		for {
+			select {
+			case ev := <-events:
+				notifier.Notify(rpcSub.ID, ev)
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+	return rpcSub, nil
+}
+
+// LesDialEventsDropped returns the number of dial events dropped because of slow
+// subscribers.
+func (api *PrivateLightDebugAPI) LesDialEventsDropped() uint64 {
+	return api.client.serverPool.dialEvents.Dropped()
+}
+
 // PrivateLightAPI provides an API to access the LES light server or light client.
 type PrivateLightAPI struct {
 	backend *lesCommons
@@ -352,3 +567,191 @@ func (api *PrivateLightAPI) GetCheckpointContractAddress() (string, error) {
 	}
 	return api.backend.oracle.Contract().ContractAddr().Hex(), nil
 }
+
+const (
+	checkpointAPIRate      = 10        // Maximum number of proof queries served per second per caller
+	checkpointAPIBurst     = 20        // Maximum number of proof queries served in a burst per caller
+	checkpointAPICallers   = 1024      // Maximum number of callers rate limited individually
+	checkpointAPIProofSize = 64 * 1024 // Maximum size of a single proof response
+)
+
+var (
+	errRateLimited       = errors.New("request rate limit exceeded")
+	errHelperTrieMissing = errors.New("helper trie not available")
+	errProofTooLarge     = errors.New("proof exceeds the response size limit")
+)
+
+// HelperTrieProof is a merkle proof of a single key in one of the helper tries
+// (CHT or bloom trie) of a LES server, along with the root it belongs to.
+type HelperTrieProof struct {
+	Section uint64          `json:"section"` // Index of the helper trie
+	Root    common.Hash     `json:"root"`    // Root hash of the helper trie
+	Key     hexutil.Bytes   `json:"key"`     // Key proven in the helper trie
+	Proof   []hexutil.Bytes `json:"proof"`   // RLP encoded trie nodes of the proof
+}
+
+// callerLimiter rate limits the queries of every RPC caller separately, so that
+// a single busy caller can't starve the others. Websocket and IPC callers are
+// limited per connection, HTTP ones per remote host as plain HTTP requests are
+// not tied to a connection. Above checkpointAPICallers concurrently active
+// callers, the newcomers share a single limit.
+type callerLimiter struct {
+	lock     sync.Mutex
+	callers  map[interface{}]*callerRate
+	overflow *rate.Limiter
+}
+
+// callerRate is the rate limit of a single caller.
+type callerRate struct {
+	limiter *rate.Limiter
+	used    time.Time // Time of the last query, to drop the limits of idle callers
+}
+
+// newCallerLimiter creates a per-caller rate limiter.
+func newCallerLimiter() *callerLimiter {
+	return &callerLimiter{
+		callers:  make(map[interface{}]*callerRate),
+		overflow: rate.NewLimiter(checkpointAPIRate, checkpointAPIBurst),
+	}
+}
+
+// allow reports whether the caller of the RPC request with the given context may
+// be served now.
+func (l *callerLimiter) allow(ctx context.Context) bool {
+	key := rpcCaller(ctx)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	caller, ok := l.callers[key]
+	if !ok {
+		if len(l.callers) >= checkpointAPICallers {
+			l.prune(now)
+		}
+		if len(l.callers) >= checkpointAPICallers {
+			return l.overflow.AllowN(now, 1)
+		}
+		caller = &callerRate{limiter: rate.NewLimiter(checkpointAPIRate, checkpointAPIBurst)}
+		l.callers[key] = caller
+	}
+	caller.used = now
+	return caller.limiter.AllowN(now, 1)
+}
+
+// prune drops the limits of the callers idle long enough for their burst
+// allowance to be fully recharged, forgetting them loses nothing.
+//
+// Note, this function assumes the lock is held.
+func (l *callerLimiter) prune(now time.Time) {
+	idle := time.Duration(checkpointAPIBurst) * time.Second / checkpointAPIRate
+	for key, caller := range l.callers {
+		if now.Sub(caller.used) >= idle {
+			delete(l.callers, key)
+		}
+	}
+}
+
+// rpcCaller returns the key identifying the caller of an RPC request: the
+// connection for persistent transports or the remote host for HTTP. In-process
+// calls all share the nil key.
+func rpcCaller(ctx context.Context) interface{} {
+	if client, ok := rpc.ClientFromContext(ctx); ok {
+		return client
+	}
+	if remote, ok := ctx.Value("remote").(string); ok {
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			return host
+		}
+		return remote
+	}
+	return nil
+}
+
+// PublicCheckpointAPI provides access to the checkpoint and helper trie data of a
+// LES server for consumers not speaking the LES protocol (e.g. block explorers).
+// It lives in its own namespace, so that it can be exposed without the admin
+// methods of the les one.
+//
+// Proof generation is expensive, so the queries are rate limited per caller.
+type PublicCheckpointAPI struct {
+	server  *LesServer
+	limiter *callerLimiter
+}
+
+// NewPublicCheckpointAPI creates a new LES checkpoint data API.
+func NewPublicCheckpointAPI(server *LesServer) *PublicCheckpointAPI {
+	return &PublicCheckpointAPI{
+		server:  server,
+		limiter: newCallerLimiter(),
+	}
+}
+
+// GetCheckpoint returns the specific local checkpoint package, in the same format
+// as les_getCheckpoint.
+func (api *PublicCheckpointAPI) GetCheckpoint(index uint64) ([3]string, error) {
+	var res [3]string
+	cp := api.server.localCheckpoint(index)
+	if cp.Empty() {
+		return res, errNoCheckpoint
+	}
+	res[0], res[1], res[2] = cp.SectionHead.Hex(), cp.CHTRoot.Hex(), cp.BloomRoot.Hex()
+	return res, nil
+}
+
+// GetChtProof returns the proof of the given block in the canonical hash trie
+// covering it.
+func (api *PublicCheckpointAPI) GetChtProof(ctx context.Context, number uint64) (*HelperTrieProof, error) {
+	var (
+		section = number / api.server.iConfig.ChtSize
+		head    = rawdb.ReadCanonicalHash(api.server.chainDb, (section+1)*api.server.iConfig.ChtSize-1)
+		root    = light.GetChtRoot(api.server.chainDb, section, head)
+	)
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, number)
+	return api.prove(ctx, section, root, light.ChtTablePrefix, key)
+}
+
+// GetBloomTrieProof returns the proof of the given bloom bit vector of a bloom
+// bits section in the bloom trie covering it.
+func (api *PublicCheckpointAPI) GetBloomTrieProof(ctx context.Context, section uint64, bit uint) (*HelperTrieProof, error) {
+	if bit >= types.BloomBitLength {
+		return nil, fmt.Errorf("bloom bit index %d out of range", bit)
+	}
+	var (
+		index = section * api.server.iConfig.BloomSize / api.server.iConfig.BloomTrieSize
+		head  = rawdb.ReadCanonicalHash(api.server.chainDb, (index+1)*api.server.iConfig.BloomTrieSize-1)
+		root  = light.GetBloomTrieRoot(api.server.chainDb, index, head)
+	)
+	key := make([]byte, 10)
+	binary.BigEndian.PutUint16(key[:2], uint16(bit))
+	binary.BigEndian.PutUint64(key[2:], section)
+	return api.prove(ctx, index, root, light.BloomTrieTablePrefix, key)
+}
+
+// prove assembles the merkle proof of a key in the helper trie with the given
+// root, enforcing the rate and size limits of the API.
+func (api *PublicCheckpointAPI) prove(ctx context.Context, section uint64, root common.Hash, prefix string, key []byte) (*HelperTrieProof, error) {
+	if !api.limiter.allow(ctx) {
+		return nil, errRateLimited
+	}
+	if root == (common.Hash{}) {
+		return nil, errHelperTrieMissing
+	}
+	tr, err := trie.New(root, trie.NewDatabase(rawdb.NewTable(api.server.chainDb, prefix)))
+	if err != nil {
+		return nil, err
+	}
+	nodes := light.NewNodeSet()
+	if err := tr.Prove(key, 0, nodes); err != nil {
+		return nil, err
+	}
+	if nodes.DataSize() > checkpointAPIProofSize {
+		return nil, errProofTooLarge
+	}
+	result := &HelperTrieProof{Section: section, Root: root, Key: key}
+	for _, node := range nodes.NodeList() {
+		result.Proof = append(result.Proof, hexutil.Bytes(node))
+	}
+	return result, nil
+}
@@ -122,7 +122,7 @@ func (h *clientHandler) handle(p *serverPeer) error {
 		serverConnectionGauge.Update(int64(h.backend.peers.len()))
 	}()
 
-	h.fetcher.announce(p, &announceData{Hash: p.headInfo.Hash, Number: p.headInfo.Number, Td: p.headInfo.Td})
+	h.fetcher.announce(p, &announceData{Hash: p.headInfo.Hash, Number: p.headInfo.Number, Td: p.headInfo.Td}, false)
 
 	// Mark the peer starts to be served.
 	atomic.StoreUint32(&p.serving, 1)
@@ -166,6 +166,10 @@ func (h *clientHandler) handleMsg(p *serverPeer) error {
 		if err := req.sanityCheck(); err != nil {
 			return err
 		}
+		p.lock.Lock()
+		p.announceTime = time.Now()
+		p.lock.Unlock()
+
 		update, size := req.Update.decode()
 		if p.rejectUpdate(size) {
 			return errResp(ErrRequestRejected, "")
@@ -185,7 +189,7 @@ func (h *clientHandler) handleMsg(p *serverPeer) error {
 				p.Log().Trace("Valid announcement signature")
 			}
 			p.Log().Trace("Announce message content", "number", req.Number, "hash", req.Hash, "td", req.Td, "reorg", req.ReorgDepth)
-			h.fetcher.announce(p, &req)
+			h.fetcher.announce(p, &req, update.get("deepReorg", nil) == nil)
 		}
 	case BlockHeadersMsg:
 		p.Log().Trace("Received block header response message")
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sort"
 	"sync"
 	"time"
 
@@ -51,6 +52,31 @@ const (
 	// todo(rjl493456442) make it configurable. It can be the option of
 	// free trial time!
 	connectedBias = time.Minute * 3
+
+	// defaultWarmUp is the period after the server start in which the previously
+	// connected clients reconnect. During this period the connected bias is
+	// multiplied by warmUpBiasFactor and clients are kicked out at most once per
+	// warmUpKickInterval, so that the priorities can settle without heavy churn.
+	defaultWarmUp      = time.Minute * 2
+	warmUpBiasFactor   = 3
+	warmUpKickInterval = time.Second * 10
+)
+
+// freeIDMode is the strategy of identifying free clients for negative balance
+// tracking.
+type freeIDMode int
+
+const (
+	// freeIDAddress tracks the negative balance of free clients by their network
+	// address only. Clients behind a shared address (e.g. CGNAT) share a single
+	// balance, while a client hopping addresses gets a fresh one every time.
+	freeIDAddress freeIDMode = iota
+
+	// freeIDDual tracks the negative balance by both the address and the node ID
+	// and uses the worse one for priority. The address record accumulates the
+	// usage of all clients behind the address but is shared by the number of
+	// free clients an address may connect simultaneously.
+	freeIDDual
 )
 
 // clientPool implements a client database that assigns a priority to each client
@@ -79,7 +105,9 @@ type clientPool struct {
 	lock       sync.Mutex
 	clock      mclock.Clock
 	stopCh     chan struct{}
+	persist    mclock.Timer // Timer of the next running time persistence
 	closed     bool
+	serving    bool // Whether a client attempted to connect, state imports are refused afterwards
 	removePeer func(enode.ID)
 
 	connectedMap   map[enode.ID]*clientInfo
@@ -95,6 +123,18 @@ type clientPool struct {
 	startTime         mclock.AbsTime // The timestamp at which the clientpool started running
 	cumulativeTime    int64          // The cumulative running time of clientpool at the start point.
 	disableBias       bool           // Disable connection bias(used in testing)
+	freePaused        bool           // Whether free clients are refused service
+	warmUp            time.Duration  // Length of the warm-up period after the start
+	lastWarmUpKick    mclock.AbsTime // The timestamp at which clients were last kicked during warm-up
+	freeIDMode        freeIDMode     // Strategy of identifying free clients
+	addrLimit         int            // Maximum number of free clients per address in dual mode, zero if unlimited
+	addrConns         map[string]int // Number of connected free clients per address
+
+	rates    clientPoolRates  // Rates of the recent connection events
+	snapshot *snapshotTracker // Persistence of the connected set across restarts
+	recorder *poolRecorder    // Recorder of the external inputs, nil if not recording
+	budget   budgetAlert      // Alert configuration for oversold positive balances
+	quality  *serviceQuality  // Service quality statistics of the connected clients
 }
 
 // clientPoolPeer represents a client peer in the pool.
@@ -105,16 +145,41 @@ type clientPool struct {
 type clientPoolPeer interface {
 	ID() enode.ID
 	freeClientId() string
-	updateCapacity(uint64)
+	updateCapacity(uint64, capacityReason)
 	freezeClient()
 }
 
+// capacityReason tells a client why its capacity was changed.
+type capacityReason uint64
+
+const (
+	capReasonInitial          capacityReason = iota // Non-default capacity assigned on connection
+	capReasonOperator                               // Capacity set by the operator through the API
+	capReasonBalanceExhausted                       // Positive balance used up, reduced to the free capacity
+)
+
+// String returns the name of the capacity change reason.
+func (r capacityReason) String() string {
+	switch r {
+	case capReasonInitial:
+		return "initial"
+	case capReasonOperator:
+		return "operator"
+	case capReasonBalanceExhausted:
+		return "balanceExhausted"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint64(r))
+	}
+}
+
 // clientInfo represents a connected client
 type clientInfo struct {
 	address                string
 	id                     enode.ID
 	connectedAt            mclock.AbsTime
 	capacity               uint64
+	requested              uint64 // Capacity last requested for the client
+	quality                int    // Service quality slot the client is accounted in, -1 if none
 	priority               bool
 	pool                   *clientPool
 	peer                   clientPoolPeer
@@ -122,6 +187,7 @@ type clientInfo struct {
 	balanceTracker         balanceTracker
 	posFactors, negFactors priceFactors
 	balanceMetaInfo        string
+	negStart               uint64 // Negative balance the client connected with
 }
 
 // connSetIndex callback updates clientInfo item index in connectedQueue
@@ -171,6 +237,9 @@ func newClientPool(db ethdb.Database, freeClientCap uint64, clock mclock.Clock,
 		startTime:      clock.Now(),
 		cumulativeTime: ndb.getCumulativeTime(),
 		stopCh:         make(chan struct{}),
+		snapshot:       newSnapshotTracker(ndb, clock.Now()),
+		addrConns:      make(map[string]int),
+		quality:        newServiceQuality(clock.Now()),
 	}
 	// If the negative balance of free client is even lower than 1,
 	// delete this entry.
@@ -178,15 +247,21 @@ func newClientPool(db ethdb.Database, freeClientCap uint64, clock mclock.Clock,
 		balance := math.Exp(float64(b.logValue-pool.logOffset(now)) / fixedPointMultiplier)
 		return balance <= 1
 	}
+	// The running time is persisted from a self-rescheduling timer, the refresh
+	// timer of the loop below would always fire first otherwise
+	pool.persist = clock.AfterFunc(persistCumulativeTimeRefresh, pool.persistCumulativeTime)
+
 	go func() {
 		for {
 			select {
 			case <-clock.After(lazyQueueRefresh):
 				pool.lock.Lock()
 				pool.connectedQueue.Refresh()
+				pool.snapshot.refresh(clock.Now(), pool.activeClients())
+				pool.recordCheckpoint()
+				pool.qualityReport(clock.Now())
+				pool.checkQuality(clock.Now())
 				pool.lock.Unlock()
-			case <-clock.After(persistCumulativeTimeRefresh):
-				pool.ndb.setCumulativeTime(pool.logOffset(clock.Now()))
 			case <-pool.stopCh:
 				return
 			}
@@ -200,11 +275,26 @@ func (f *clientPool) stop() {
 	close(f.stopCh)
 	f.lock.Lock()
 	f.closed = true
+	f.persist.Stop()
+	f.recorder.flush()
 	f.lock.Unlock()
 	f.ndb.setCumulativeTime(f.logOffset(f.clock.Now()))
 	f.ndb.close()
 }
 
+// persistCumulativeTime saves the running time of the pool, so that negative
+// balances keep decaying across an unclean shutdown, and schedules the next save.
+func (f *clientPool) persistCumulativeTime() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return
+	}
+	f.ndb.setCumulativeTime(f.logOffset(f.clock.Now()))
+	f.persist = f.clock.AfterFunc(persistCumulativeTimeRefresh, f.persistCumulativeTime)
+}
+
 // connect should be called after a successful handshake. If the connection was
 // rejected, there is no need to call disconnect.
 func (f *clientPool) connect(peer clientPoolPeer, capacity uint64) bool {
@@ -215,10 +305,13 @@ func (f *clientPool) connect(peer clientPoolPeer, capacity uint64) bool {
 	if f.closed {
 		return false
 	}
-	// Dedup connected peers.
+	f.serving = true
 	id, freeID := peer.ID(), peer.freeClientId()
+	f.recorder.record(f.clock.Now(), poolEventConnect, &poolConnectEvent{ID: id, FreeID: freeID, Capacity: capacity})
+	// Dedup connected peers.
 	if _, ok := f.connectedMap[id]; ok {
 		clientRejectedMeter.Mark(1)
+		f.rates.rejected.add(f.clock.Now())
 		log.Debug("Client already connected", "address", freeID, "id", peerIdToString(id))
 		return false
 	}
@@ -230,29 +323,47 @@ func (f *clientPool) connect(peer clientPoolPeer, capacity uint64) bool {
 	)
 	pb := f.ndb.getOrNewPB(id)
 	posBalance = pb.value
+	negBalance = f.freeNegBalance(id, freeID, now)
 
-	nb := f.ndb.getOrNewNB(freeID)
-	if nb.logValue != 0 {
-		negBalance = uint64(math.Exp(float64(nb.logValue-f.logOffset(now))/fixedPointMultiplier) * float64(time.Second))
-	}
 	e := &clientInfo{
 		pool:            f,
 		peer:            peer,
 		address:         freeID,
 		queueIndex:      -1,
+		quality:         -1,
 		id:              id,
 		connectedAt:     now,
 		priority:        posBalance != 0,
 		posFactors:      f.defaultPosFactors,
 		negFactors:      f.defaultNegFactors,
 		balanceMetaInfo: pb.meta,
+		negStart:        negBalance,
+	}
+	// Refuse free clients while their service is paused
+	if f.freePaused && !e.priority {
+		clientRejectedMeter.Mark(1)
+		f.rates.rejected.add(now)
+		log.Debug("Free client rejected, free service paused", "address", freeID, "id", peerIdToString(id))
+		return false
+	}
+	// Refuse free clients exceeding the per-address limit
+	if f.freeIDMode == freeIDDual && f.addrLimit > 0 && !e.priority && f.addrConns[freeID] >= f.addrLimit {
+		clientRejectedMeter.Mark(1)
+		f.rates.rejected.add(now)
+		log.Debug("Free client rejected, too many from address", "address", freeID, "id", peerIdToString(id))
+		return false
+	}
+	// If a priority client reconnects shortly after a restart without asking for
+	// a specific capacity, reassign the capacity it had before the restart.
+	if restored, ok := f.snapshot.take(id, now); ok && e.priority && capacity == 0 {
+		capacity = restored
 	}
 	// If the client is a free client, assign with a low free capacity,
 	// Otherwise assign with the given value(priority client)
 	if !e.priority || capacity == 0 {
 		capacity = f.freeClientCap
 	}
-	e.capacity = capacity
+	e.capacity, e.requested = capacity, capacity
 
 	// Starts a balance tracker
 	e.balanceTracker.init(f.clock, capacity)
@@ -280,14 +391,21 @@ func (f *clientPool) connect(peer clientPoolPeer, capacity uint64) bool {
 			return newCapacity > f.capLimit || newCount > f.connLimit
 		})
 		bias := connectedBias
+		warmUp := f.inWarmUp(now)
+		if warmUp {
+			bias *= warmUpBiasFactor
+		}
 		if f.disableBias {
 			bias = 0
 		}
-		if newCapacity > f.capLimit || newCount > f.connLimit || (e.balanceTracker.estimatedPriority(now+mclock.AbsTime(bias), false)-kickPriority) > 0 {
+		// During warm-up, also limit the rate of kicking out clients
+		throttled := warmUp && f.lastWarmUpKick != 0 && time.Duration(now-f.lastWarmUpKick) < warmUpKickInterval
+		if newCapacity > f.capLimit || newCount > f.connLimit || throttled || (e.balanceTracker.estimatedPriority(now+mclock.AbsTime(bias), false)-kickPriority) > 0 {
 			for _, c := range kickList {
 				f.connectedQueue.Push(c)
 			}
 			clientRejectedMeter.Mark(1)
+			f.rates.rejected.add(now)
 			log.Debug("Client rejected", "address", freeID, "id", peerIdToString(id))
 			return false
 		}
@@ -295,12 +413,18 @@ func (f *clientPool) connect(peer clientPoolPeer, capacity uint64) bool {
 		for _, c := range kickList {
 			f.dropClient(c, now, true)
 		}
+		if warmUp {
+			f.lastWarmUpKick = now
+		}
 	}
 
 	// Register new client to connection queue.
 	f.connectedMap[id] = e
 	f.connectedQueue.Push(e)
 	f.connectedCap += e.capacity
+	if !e.priority {
+		f.addrConns[freeID]++
+	}
 
 	// If the current client is a paid client, monitor the status of client,
 	// downgrade it to normal client if positive balance is used up.
@@ -311,10 +435,12 @@ func (f *clientPool) connect(peer clientPoolPeer, capacity uint64) bool {
 	// If the capacity of client is not the default value(free capacity), notify
 	// it to update capacity.
 	if e.capacity != f.freeClientCap {
-		e.peer.updateCapacity(e.capacity)
+		e.peer.updateCapacity(e.capacity, capReasonInitial)
 	}
+	f.updateQuality(e, now, true)
 	totalConnectedGauge.Update(int64(f.connectedCap))
 	clientConnectedMeter.Mark(1)
+	f.rates.connected.add(now)
 	log.Debug("Client accepted", "address", freeID)
 	return true
 }
@@ -330,6 +456,7 @@ func (f *clientPool) disconnect(p clientPoolPeer) {
 	if f.closed {
 		return
 	}
+	f.recorder.record(f.clock.Now(), poolEventDisconnect, &poolClientEvent{ID: p.ID()})
 	// Short circuit if the peer hasn't been registered.
 	e := f.connectedMap[p.ID()]
 	if e == nil {
@@ -369,6 +496,8 @@ func (f *clientPool) setDefaultFactors(posFactors, negFactors priceFactors) {
 
 	f.defaultPosFactors = posFactors
 	f.defaultNegFactors = negFactors
+	f.recorder.record(f.clock.Now(), poolEventSetFactors, &poolFactorsEvent{Pos: encodeFactors(posFactors), Neg: encodeFactors(negFactors)})
+	f.checkBudget()
 }
 
 // dropClient removes a client from the connected queue and finalizes its balance.
@@ -383,14 +512,19 @@ func (f *clientPool) dropClient(e *clientInfo, now mclock.AbsTime, kick bool) {
 	f.connectedCap -= e.capacity
 	if e.priority {
 		f.priorityConnected -= e.capacity
+	} else {
+		f.releaseAddress(e.address)
 	}
+	f.updateQuality(e, now, false)
 	totalConnectedGauge.Update(int64(f.connectedCap))
 	if kick {
 		clientKickedMeter.Mark(1)
+		f.rates.kicked.add(now)
 		log.Debug("Client kicked out", "address", e.address)
 		f.removePeer(e.id)
 	} else {
 		clientDisconnectedMeter.Mark(1)
+		f.rates.disconnected.add(now)
 		log.Debug("Client disconnected", "address", e.address)
 	}
 }
@@ -404,25 +538,151 @@ func (f *clientPool) capacityInfo() (uint64, uint64, uint64) {
 	return f.capLimit, f.connectedCap, f.priorityConnected
 }
 
+// activationThreshold returns the highest priority a new client connecting with
+// the free client capacity may have in order to be accepted right now. As higher
+// priority means first to disconnect, a client is accepted if its priority, as
+// estimated by connect (including the connection bias), does not exceed the
+// threshold. If the client fits without evicting anyone, math.MaxInt64 is returned,
+// if it cannot be accepted at all, math.MinInt64.
+//
+// The connected queue is not modified, the eviction performed by connect is
+// simulated on the current priorities of the connected clients instead.
+func (f *clientPool) activationThreshold() int64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.freeClientCap > f.capLimit || f.connLimit < 1 {
+		return math.MinInt64
+	}
+	newCapacity := f.connectedCap + f.freeClientCap
+	newCount := len(f.connectedMap) + 1
+	if newCapacity <= f.capLimit && newCount <= f.connLimit {
+		return math.MaxInt64
+	}
+	type candidate struct {
+		capacity uint64
+		priority int64
+	}
+	var (
+		now        = f.clock.Now()
+		candidates = make([]candidate, 0, len(f.connectedMap))
+	)
+	for _, c := range f.connectedMap {
+		candidates = append(candidates, candidate{c.capacity, c.balanceTracker.getPriority(now)})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].priority > candidates[j].priority
+	})
+	threshold := int64(math.MinInt64)
+	for _, c := range candidates {
+		if newCapacity <= f.capLimit && newCount <= f.connLimit {
+			break
+		}
+		newCapacity -= c.capacity
+		newCount--
+		threshold = c.priority
+	}
+	return threshold
+}
+
 // finalizeBalance stops the balance tracker, retrieves the final balances and
 // stores them in posBalanceQueue and negBalanceQueue
 func (f *clientPool) finalizeBalance(c *clientInfo, now mclock.AbsTime) {
 	c.balanceTracker.stop(now)
 	pos, neg := c.balanceTracker.getBalance(now)
 
-	pb, nb := f.ndb.getOrNewPB(c.id), f.ndb.getOrNewNB(c.address)
+	pb := f.ndb.getOrNewPB(c.id)
 	pb.value = pos
 	f.ndb.setPB(c.id, pb)
+	f.checkBudget()
 
-	neg /= uint64(time.Second) // Convert the expanse to second level.
-	if neg > 1 {
-		nb.logValue = int64(math.Log(float64(neg))*fixedPointMultiplier) + f.logOffset(now)
+	if f.freeIDMode != freeIDDual {
+		if nb, ok := f.encodeNegBalance(neg, now); ok {
+			f.ndb.setNB(c.address, nb)
+		} else {
+			f.ndb.delNB(c.address) // Negative balance is small enough, drop it directly.
+		}
+		return
+	}
+	// In dual mode the node ID record follows the client while the address
+	// record accumulates the usage of every client behind the address.
+	if nb, ok := f.encodeNegBalance(neg, now); ok {
+		f.ndb.setIDNB(c.id, nb)
+	} else {
+		f.ndb.delIDNB(c.id)
+	}
+	addrNeg := f.decodeNegBalance(f.ndb.getOrNewNB(c.address), now)
+	if neg > c.negStart {
+		addrNeg += neg - c.negStart
+	}
+	if nb, ok := f.encodeNegBalance(addrNeg, now); ok {
 		f.ndb.setNB(c.address, nb)
 	} else {
-		f.ndb.delNB(c.address) // Negative balance is small enough, drop it directly.
+		f.ndb.delNB(c.address)
+	}
+}
+
+// freeNegBalance returns the negative balance a connecting client starts with.
+// In dual mode it is the worse of the node ID record and the share of a single
+// client from the address record.
+//
+// Note, this function assumes the lock is held.
+func (f *clientPool) freeNegBalance(id enode.ID, address string, now mclock.AbsTime) uint64 {
+	neg := f.decodeNegBalance(f.ndb.getOrNewNB(address), now)
+	if f.freeIDMode != freeIDDual {
+		return neg
+	}
+	if f.addrLimit > 1 {
+		neg /= uint64(f.addrLimit)
+	}
+	if idNeg := f.decodeNegBalance(f.ndb.getOrNewIDNB(id), now); idNeg > neg {
+		neg = idNeg
+	}
+	return neg
+}
+
+// decodeNegBalance converts a stored logarithmic negative balance into its
+// current value.
+func (f *clientPool) decodeNegBalance(nb negBalance, now mclock.AbsTime) uint64 {
+	if nb.logValue == 0 {
+		return 0
+	}
+	return uint64(math.Exp(float64(nb.logValue-f.logOffset(now))/fixedPointMultiplier) * float64(time.Second))
+}
+
+// encodeNegBalance converts a negative balance into its logarithmic form for
+// storage. False is returned if the balance is small enough to be dropped.
+func (f *clientPool) encodeNegBalance(neg uint64, now mclock.AbsTime) (negBalance, bool) {
+	neg /= uint64(time.Second) // Convert the expanse to second level.
+	if neg <= 1 {
+		return negBalance{}, false
+	}
+	return negBalance{logValue: int64(math.Log(float64(neg))*fixedPointMultiplier) + f.logOffset(now)}, true
+}
+
+// releaseAddress decrements the number of free clients connected from the
+// given address.
+//
+// Note, this function assumes the lock is held.
+func (f *clientPool) releaseAddress(address string) {
+	if f.addrConns[address] <= 1 {
+		delete(f.addrConns, address)
+	} else {
+		f.addrConns[address]--
 	}
 }
 
+// setFreeIDMode sets the strategy of identifying free clients. In dual mode the
+// addrLimit, if non-zero, is the maximum number of free clients connected from
+// a single address. Address records stored earlier stay valid in both modes.
+func (f *clientPool) setFreeIDMode(mode freeIDMode, addrLimit int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.freeIDMode, f.addrLimit = mode, addrLimit
+	f.recorder.record(f.clock.Now(), poolEventSetFreeID, &poolFreeIDEvent{Mode: uint64(mode), AddrLimit: uint64(addrLimit)})
+}
+
 // balanceExhausted callback is called by balanceTracker when positive balance is exhausted.
 // It revokes priority status and also reduces the client capacity if necessary.
 func (f *clientPool) balanceExhausted(id enode.ID) {
@@ -437,16 +697,86 @@ func (f *clientPool) balanceExhausted(id enode.ID) {
 		f.priorityConnected -= c.capacity
 	}
 	c.priority = false
+	overLimit := f.freeIDMode == freeIDDual && f.addrLimit > 0 && f.addrConns[c.address] >= f.addrLimit
+	f.addrConns[c.address]++
 	if c.capacity != f.freeClientCap {
 		f.connectedCap += f.freeClientCap - c.capacity
 		totalConnectedGauge.Update(int64(f.connectedCap))
 		c.capacity = f.freeClientCap
 		c.balanceTracker.setCapacity(c.capacity)
-		c.peer.updateCapacity(c.capacity)
+		c.peer.updateCapacity(c.capacity, capReasonBalanceExhausted)
 	}
+	c.requested = c.capacity
+	f.updateQuality(c, f.clock.Now(), true)
+
 	pb := f.ndb.getOrNewPB(id)
 	pb.value = 0
 	f.ndb.setPB(id, pb)
+
+	// The client became a free one, drop it if free service is paused or its
+	// address already has as many free clients as allowed
+	if f.freePaused || overLimit {
+		if overLimit {
+			log.Debug("Exhausted client kicked out, too many from address", "address", c.address, "id", peerIdToString(id))
+		}
+		f.dropClient(c, f.clock.Now(), true)
+	}
+}
+
+// setFreeClientsPaused pauses or resumes serving free clients. While paused, new
+// free clients are rejected and the connected ones are kicked out, including the
+// priority clients running out of balance. Priority clients are not affected.
+func (f *clientPool) setFreeClientsPaused(paused bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.recorder.record(f.clock.Now(), poolEventSetPaused, &poolPausedEvent{Paused: paused})
+	if f.freePaused == paused {
+		return
+	}
+	f.freePaused = paused
+	if !paused {
+		log.Info("Resumed serving free clients")
+		return
+	}
+	var (
+		now  = f.clock.Now()
+		drop []*clientInfo
+	)
+	for _, c := range f.connectedMap {
+		if !c.priority {
+			drop = append(drop, c)
+		}
+	}
+	for _, c := range drop {
+		f.dropClient(c, now, true)
+	}
+	log.Info("Paused serving free clients", "dropped", len(drop))
+}
+
+// freeClientsPaused returns whether serving free clients is currently paused.
+func (f *clientPool) freeClientsPaused() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.freePaused
+}
+
+// setWarmUp sets the length of the warm-up period measured from the start of
+// the pool. Zero disables the warm-up.
+func (f *clientPool) setWarmUp(period time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.warmUp = period
+	f.recorder.record(f.clock.Now(), poolEventSetWarmUp, &poolWarmUpEvent{Period: uint64(period)})
+}
+
+// inWarmUp returns whether the pool is in its warm-up period.
+//
+// Note, this function assumes the lock is held.
+func (f *clientPool) inWarmUp(now mclock.AbsTime) bool {
+	return time.Duration(now-f.startTime) < f.warmUp
 }
 
 // setConnLimit sets the maximum number and total capacity of connected clients,
@@ -457,12 +787,14 @@ func (f *clientPool) setLimits(totalConn int, totalCap uint64) {
 
 	f.connLimit = totalConn
 	f.capLimit = totalCap
+	f.recorder.record(f.clock.Now(), poolEventSetLimits, &poolLimitsEvent{Conns: uint64(totalConn), Capacity: totalCap})
 	if f.connectedCap > f.capLimit || f.connectedQueue.Size() > f.connLimit {
 		f.connectedQueue.MultiPop(func(data interface{}, priority int64) bool {
-			f.dropClient(data.(*clientInfo), mclock.Now(), true)
+			f.dropClient(data.(*clientInfo), f.clock.Now(), true)
 			return f.connectedCap > f.capLimit || f.connectedQueue.Size() > f.connLimit
 		})
 	}
+	f.checkBudget()
 }
 
 // setCapacity sets the assigned capacity of a connected client
@@ -470,12 +802,18 @@ func (f *clientPool) setCapacity(c *clientInfo, capacity uint64) error {
 	if f.connectedMap[c.id] != c {
 		return fmt.Errorf("client %064x is not connected", c.id[:])
 	}
+	f.recorder.record(f.clock.Now(), poolEventSetCapacity, &poolClientEvent{ID: c.id, Value: capacity})
+	if c.capacity != capacity && !c.priority {
+		return errNoPriority
+	}
+	// Record the requested capacity even if it can't be granted, the time spent
+	// below it is accounted as reduced service
+	c.requested = capacity
+	defer f.updateQuality(c, f.clock.Now(), true)
+
 	if c.capacity == capacity {
 		return nil
 	}
-	if !c.priority {
-		return errNoPriority
-	}
 	oldCapacity := c.capacity
 	c.capacity = capacity
 	f.connectedCap += capacity - oldCapacity
@@ -494,7 +832,7 @@ func (f *clientPool) setCapacity(c *clientInfo, capacity uint64) error {
 			return kick && (f.connectedCap > f.capLimit)
 		})
 		if kick {
-			now := mclock.Now()
+			now := f.clock.Now()
 			for _, c := range kickList {
 				f.dropClient(c, now, true)
 			}
@@ -511,17 +849,36 @@ func (f *clientPool) setCapacity(c *clientInfo, capacity uint64) error {
 	totalConnectedGauge.Update(int64(f.connectedCap))
 	f.priorityConnected += capacity - oldCapacity
 	c.updatePriceFactors()
-	c.peer.updateCapacity(c.capacity)
+	c.peer.updateCapacity(c.capacity, capReasonOperator)
 	return nil
 }
 
+// saveSnapshot persists the list of currently connected clients. It should be
+// called before the connected peers are torn down at shutdown.
+func (f *clientPool) saveSnapshot() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return
+	}
+	f.snapshot.save(f.clock.Now(), f.activeClients())
+}
+
 // requestCost feeds request cost after serving a request from the given peer.
-func (f *clientPool) requestCost(p *clientPeer, cost uint64) {
+func (f *clientPool) requestCost(p clientPoolPeer, cost uint64) {
 	f.lock.Lock()
 	defer f.lock.Unlock()
 
+	if f.closed {
+		return
+	}
+	// Requests are served on the hot path, don't allocate the event if not recording
+	if f.recorder != nil {
+		f.recorder.record(f.clock.Now(), poolEventRequestCost, &poolClientEvent{ID: p.ID(), Value: cost})
+	}
 	info, exist := f.connectedMap[p.ID()]
-	if !exist || f.closed {
+	if !exist {
 		return
 	}
 	info.balanceTracker.requestCost(cost)
@@ -559,12 +916,12 @@ func (f *clientPool) addBalance(id enode.ID, amount int64, meta string) (uint64,
 	f.lock.Lock()
 	defer f.lock.Unlock()
 
-	pb := f.ndb.getOrNewPB(id)
-	var negBalance uint64
-	c := f.connectedMap[id]
-	if c != nil {
-		pb.value, negBalance = c.balanceTracker.getBalance(f.clock.Now())
+	ev := &poolBalanceEvent{ID: id, Amount: uint64(amount), Meta: meta}
+	if amount < 0 {
+		ev.Amount, ev.Neg = uint64(-amount), true
 	}
+	f.recorder.record(f.clock.Now(), poolEventAddBalance, ev)
+	pb, negBalance := f.currentPosBalance(id)
 	oldBalance := pb.value
 	if amount > 0 {
 		if amount > maxBalance || pb.value > maxBalance-uint64(amount) {
@@ -579,8 +936,67 @@ func (f *clientPool) addBalance(id enode.ID, amount int64, meta string) (uint64,
 		}
 	}
 	pb.meta = meta
+	f.setPosBalance(id, pb, negBalance)
+	return oldBalance, pb.value, nil
+}
+
+// transferBalance moves the given amount of positive balance from one client to
+// another, or the entire balance if the amount is zero. Negative balances stay
+// where they are. Both records are updated without releasing the pool lock, so
+// no request cost can be charged in between. The moved amount is returned.
+func (f *clientPool) transferBalance(from, to enode.ID, amount uint64) (uint64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.recorder.record(f.clock.Now(), poolEventTransfer, &poolTransferEvent{From: from, To: to, Amount: amount})
+	if from == to {
+		return 0, errTransferToSelf
+	}
+	src, srcNeg := f.currentPosBalance(from)
+	if src.value == 0 {
+		return 0, errNoBalance
+	}
+	if amount == 0 {
+		amount = src.value
+	}
+	if amount > src.value {
+		return 0, errInsufficientBalance
+	}
+	dst, dstNeg := f.currentPosBalance(to)
+	if dst.value > maxBalance-amount {
+		return 0, errBalanceOverflow
+	}
+	// Debit the source first, a crash in between may lose but never mint balance
+	src.value -= amount
+	f.setPosBalance(from, src, srcNeg)
+	dst.value += amount
+	f.setPosBalance(to, dst, dstNeg)
+
+	log.Info("Transferred client balance", "from", peerIdToString(from), "to", peerIdToString(to), "amount", amount)
+	return amount, nil
+}
+
+// currentPosBalance returns the up-to-date positive balance of a client, along
+// with its negative balance if it is connected.
+//
+// Note, this function assumes the lock is held.
+func (f *clientPool) currentPosBalance(id enode.ID) (posBalance, uint64) {
+	pb := f.ndb.getOrNewPB(id)
+	var negBalance uint64
+	if c := f.connectedMap[id]; c != nil {
+		pb.value, negBalance = c.balanceTracker.getBalance(f.clock.Now())
+	}
+	return pb, negBalance
+}
+
+// setPosBalance stores the positive balance of a client, also updating the
+// balance tracker and priority status if the client is connected.
+//
+// Note, this function assumes the lock is held.
+func (f *clientPool) setPosBalance(id enode.ID, pb posBalance, negBalance uint64) {
 	f.ndb.setPB(id, pb)
-	if c != nil {
+	f.checkBudget()
+	if c := f.connectedMap[id]; c != nil {
 		c.balanceTracker.setBalance(pb.value, negBalance)
 		if !c.priority && pb.value > 0 {
 			// The capacity should be adjusted based on the requirement,
@@ -588,13 +1004,13 @@ func (f *clientPool) addBalance(id enode.ID, amount int64, meta string) (uint64,
 			// call to update it.
 			c.priority = true
 			f.priorityConnected += c.capacity
+			f.releaseAddress(c.address)
 			c.balanceTracker.addCallback(balanceCallbackZero, 0, func() { f.balanceExhausted(id) })
 		}
 		// if balance is set to zero then reverting to non-priority status
 		// is handled by the balanceExhausted callback
-		c.balanceMetaInfo = meta
+		c.balanceMetaInfo = pb.meta
 	}
-	return oldBalance, pb.value, nil
 }
 
 // posBalance represents a recently accessed positive balance entry
@@ -656,7 +1072,9 @@ const (
 var (
 	positiveBalancePrefix    = []byte("pb:")             // dbVersion(uint16 big endian) + positiveBalancePrefix + id -> balance
 	negativeBalancePrefix    = []byte("nb:")             // dbVersion(uint16 big endian) + negativeBalancePrefix + ip -> balance
+	negativeIDBalancePrefix  = []byte("ni:")             // dbVersion(uint16 big endian) + negativeIDBalancePrefix + id -> balance
 	cumulativeRunningTimeKey = []byte("cumulativeTime:") // dbVersion(uint16 big endian) + cumulativeRunningTimeKey -> cumulativeTime
+	activeSnapshotKey        = []byte("activeSnapshot:") // activeSnapshotKey + dbVersion(uint16 big endian) -> activeSnapshot
 )
 
 type nodeDB struct {
@@ -669,6 +1087,7 @@ type nodeDB struct {
 	clock           mclock.Clock
 	closeCh         chan struct{}
 	cleanupHook     func() // Test hook used for testing
+	posTotal        uint64 // Sum of all stored positive balances
 }
 
 func newNodeDB(db ethdb.Database, clock mclock.Clock) *nodeDB {
@@ -683,6 +1102,7 @@ func newNodeDB(db ethdb.Database, clock mclock.Clock) *nodeDB {
 		closeCh: make(chan struct{}),
 	}
 	binary.BigEndian.PutUint16(ndb.verbuf[:], uint16(nodeDBVersion))
+	ndb.posTotal = ndb.sumPosBalances()
 	go ndb.expirer()
 	return ndb
 }
@@ -704,6 +1124,10 @@ func (db *nodeDB) key(id []byte, neg bool) []byte {
 	if neg {
 		prefix = negativeBalancePrefix
 	}
+	return db.prefixedKey(prefix, id)
+}
+
+func (db *nodeDB) prefixedKey(prefix []byte, id []byte) []byte {
 	if len(prefix)+len(db.verbuf)+len(id) > len(db.auxbuf) {
 		db.auxbuf = append(db.auxbuf, make([]byte, len(prefix)+len(db.verbuf)+len(id)-len(db.auxbuf))...)
 	}
@@ -747,6 +1171,7 @@ func (db *nodeDB) setPB(id enode.ID, b posBalance) {
 		db.delPB(id)
 		return
 	}
+	old := db.getOrNewPB(id).value
 	key := db.key(id.Bytes(), false)
 	enc, err := rlp.EncodeToBytes(&(b))
 	if err != nil {
@@ -755,12 +1180,34 @@ func (db *nodeDB) setPB(id enode.ID, b posBalance) {
 	}
 	db.db.Put(key, enc)
 	db.pcache.Add(string(key), b)
+	db.posTotal += b.value - old
 }
 
 func (db *nodeDB) delPB(id enode.ID) {
+	old := db.getOrNewPB(id).value
 	key := db.key(id.Bytes(), false)
 	db.db.Delete(key)
 	db.pcache.Remove(string(key))
+	db.posTotal -= old
+}
+
+// sumPosBalances iterates the stored positive balances and returns their sum.
+// It's used to initialize the running total which is updated incrementally
+// afterwards.
+func (db *nodeDB) sumPosBalances() uint64 {
+	var total uint64
+	iter := db.db.NewIterator(db.getPrefix(false), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		var balance posBalance
+		if err := rlp.DecodeBytes(iter.Value(), &balance); err != nil {
+			log.Error("Failed to decode positive balance", "err", err)
+			continue
+		}
+		total += balance.value
+	}
+	return total
 }
 
 // getPosBalanceIDs returns a lexicographically ordered list of IDs of accounts
@@ -796,7 +1243,33 @@ func (db *nodeDB) getPosBalanceIDs(start, stop enode.ID, maxCount int) (result [
 }
 
 func (db *nodeDB) getOrNewNB(id string) negBalance {
-	key := db.key([]byte(id), true)
+	return db.getOrNewNBByKey(db.key([]byte(id), true))
+}
+
+func (db *nodeDB) setNB(id string, b negBalance) {
+	db.setNBByKey(db.key([]byte(id), true), b)
+}
+
+func (db *nodeDB) delNB(id string) {
+	db.delNBByKey(db.key([]byte(id), true))
+}
+
+// getOrNewIDNB retrieves the negative balance tracked by node ID.
+func (db *nodeDB) getOrNewIDNB(id enode.ID) negBalance {
+	return db.getOrNewNBByKey(db.prefixedKey(negativeIDBalancePrefix, id.Bytes()))
+}
+
+// setIDNB stores the negative balance tracked by node ID.
+func (db *nodeDB) setIDNB(id enode.ID, b negBalance) {
+	db.setNBByKey(db.prefixedKey(negativeIDBalancePrefix, id.Bytes()), b)
+}
+
+// delIDNB deletes the negative balance tracked by node ID.
+func (db *nodeDB) delIDNB(id enode.ID) {
+	db.delNBByKey(db.prefixedKey(negativeIDBalancePrefix, id.Bytes()))
+}
+
+func (db *nodeDB) getOrNewNBByKey(key []byte) negBalance {
 	item, exist := db.ncache.Get(string(key))
 	if exist {
 		return item.(negBalance)
@@ -811,8 +1284,7 @@ func (db *nodeDB) getOrNewNB(id string) negBalance {
 	return balance
 }
 
-func (db *nodeDB) setNB(id string, b negBalance) {
-	key := db.key([]byte(id), true)
+func (db *nodeDB) setNBByKey(key []byte, b negBalance) {
 	enc, err := rlp.EncodeToBytes(&(b))
 	if err != nil {
 		log.Error("Failed to encode negative balance", "err", err)
@@ -822,8 +1294,7 @@ func (db *nodeDB) setNB(id string, b negBalance) {
 	db.ncache.Add(string(key), b)
 }
 
-func (db *nodeDB) delNB(id string) {
-	key := db.key([]byte(id), true)
+func (db *nodeDB) delNBByKey(key []byte) {
 	db.db.Delete(key)
 	db.ncache.Remove(string(key))
 }
@@ -849,20 +1320,22 @@ func (db *nodeDB) expireNodes() {
 		visited int
 		deleted int
 		start   = time.Now()
-		prefix  = db.getPrefix(true)
 	)
-	iter := db.db.NewIterator(prefix, nil)
-	for iter.Next() {
-		visited += 1
-		var balance negBalance
-		if err := rlp.DecodeBytes(iter.Value(), &balance); err != nil {
-			log.Error("Failed to decode negative balance", "err", err)
-			continue
-		}
-		if db.nbEvictCallBack != nil && db.nbEvictCallBack(db.clock.Now(), balance) {
-			deleted += 1
-			db.db.Delete(iter.Key())
+	for _, prefix := range [][]byte{negativeBalancePrefix, negativeIDBalancePrefix} {
+		iter := db.db.NewIterator(append(db.verbuf[:], prefix...), nil)
+		for iter.Next() {
+			visited += 1
+			var balance negBalance
+			if err := rlp.DecodeBytes(iter.Value(), &balance); err != nil {
+				log.Error("Failed to decode negative balance", "err", err)
+				continue
+			}
+			if db.nbEvictCallBack != nil && db.nbEvictCallBack(db.clock.Now(), balance) {
+				deleted += 1
+				db.db.Delete(iter.Key())
+			}
 		}
+		iter.Release()
 	}
 	// Invoke testing hook if it's not nil.
 	if db.cleanupHook != nil {
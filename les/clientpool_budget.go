@@ -0,0 +1,103 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// budgetAlert is the configuration and state of the alert firing when the total
+// positive balance sold to the clients outstrips what the pool can serve.
+type budgetAlert struct {
+	threshold float64               // Alert threshold of the balance/budget ratio, zero if disabled
+	session   time.Duration         // Expected session length the serving budget is calculated for
+	callback  func(uint64, float64) // Optional callback invoked with the total balance and the ratio
+	alerted   bool                  // Whether the ratio is currently above the threshold
+}
+
+// setBudgetAlert enables the alert fired when the total stored positive balance
+// exceeds the given ratio of the serving budget. The serving budget is the
+// amount of balance the clients could spend using up the whole capacity of the
+// pool for the expected session length, at the default positive price factors.
+// The callback, if not nil, is invoked on a separate goroutine every time the
+// threshold is crossed. A zero threshold disables the alert.
+func (f *clientPool) setBudgetAlert(threshold float64, session time.Duration, callback func(total uint64, ratio float64)) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.budget = budgetAlert{threshold: threshold, session: session, callback: callback}
+	f.checkBudget()
+}
+
+// servingBudget returns the amount of positive balance the clients are able to
+// spend with the given limits and price factors during the expected session
+// length.
+func (b *budgetAlert) servingBudget(connLimit int, capLimit uint64, factors priceFactors) float64 {
+	perNano := float64(connLimit)*factors.timeFactor + float64(capLimit)*factors.capacityFactor/1000000
+	return perNano * float64(b.session)
+}
+
+// ratio returns the ratio of the total stored positive balance to the serving
+// budget, or zero if the budget is unknown.
+func (b *budgetAlert) ratio(total uint64, budget float64) float64 {
+	if budget <= 0 {
+		return 0
+	}
+	return float64(total) / budget
+}
+
+// update fires the alert if the ratio of the total stored positive balance to
+// the serving budget has just crossed the threshold.
+func (b *budgetAlert) update(total uint64, budget float64) {
+	if b.threshold <= 0 {
+		return
+	}
+	ratio := b.ratio(total, budget)
+	if ratio < b.threshold {
+		b.alerted = false
+		return
+	}
+	if b.alerted {
+		return
+	}
+	b.alerted = true
+	budgetAlertMeter.Mark(1)
+	log.Warn("Client balances exceed serving capacity", "total", total, "ratio", ratio, "threshold", b.threshold, "session", common.PrettyDuration(b.session))
+	if b.callback != nil {
+		go b.callback(total, ratio)
+	}
+}
+
+// budgetRatio returns the ratio of the total stored positive balance to the
+// serving budget of the pool.
+//
+// Note, this function assumes the lock is held.
+func (f *clientPool) budgetRatio() float64 {
+	return f.budget.ratio(f.ndb.posTotal, f.budget.servingBudget(f.connLimit, f.capLimit, f.defaultPosFactors))
+}
+
+// checkBudget updates the total balance metric and fires the budget alert if
+// the threshold has just been crossed.
+//
+// Note, this function assumes the lock is held.
+func (f *clientPool) checkBudget() {
+	totalPosBalanceGauge.Update(int64(f.ndb.posTotal))
+	f.budget.update(f.ndb.posTotal, f.budget.servingBudget(f.connLimit, f.capLimit, f.defaultPosFactors))
+}
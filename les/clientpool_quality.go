@@ -0,0 +1,284 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Service states of a connected client, compared to the capacity it requested.
+const (
+	qualityFull     = iota // Client is served at its requested capacity
+	qualityReduced         // Client is served below its requested capacity
+	qualityInactive        // Client is connected without any capacity
+	qualityStates
+)
+
+// Client classes the service quality is tracked for.
+const (
+	qualityPriority = iota // Clients with a positive balance
+	qualityFree            // Clients without a positive balance
+	qualityClasses
+)
+
+var (
+	qualityClassNames = [qualityClasses]string{"priority", "free"}
+
+	// qualityWindows are the lengths of the rolling windows the service quality
+	// is aggregated over, qualitySLOWindow is the one the priority SLO is
+	// checked against.
+	qualityWindows     = [...]time.Duration{5 * time.Minute, time.Hour, 24 * time.Hour}
+	qualityWindowNames = [len(qualityWindows)]string{"5m", "1h", "24h"}
+	qualitySLOWindow   = 1
+)
+
+// qualityBuckets is the number of buckets a rolling window is divided into. The
+// ring buffer holds an extra bucket for the current, partially elapsed one.
+const qualityBuckets = 60
+
+// qualityWindow accumulates the client time spent in each service state over a
+// rolling window, using a ring buffer of fixed length buckets. The window covers
+// the last qualityBuckets full buckets and the current one, i.e. its length is
+// up to a bucket longer than nominal.
+type qualityWindow struct {
+	width   time.Duration // Length of a single bucket
+	buckets [qualityBuckets + 1][qualityStates]time.Duration
+	last    int64 // Index of the most recently touched bucket
+}
+
+// advance clears the buckets that fell out of the window before the given one.
+func (w *qualityWindow) advance(idx int64) {
+	if idx <= w.last {
+		return
+	}
+	if idx-w.last > qualityBuckets {
+		w.buckets = [qualityBuckets + 1][qualityStates]time.Duration{}
+	} else {
+		for i := w.last + 1; i <= idx; i++ {
+			w.buckets[i%(qualityBuckets+1)] = [qualityStates]time.Duration{}
+		}
+	}
+	w.last = idx
+}
+
+// add accounts the given number of clients in each state for the time between
+// from and to, splitting it between the buckets the interval overlaps.
+func (w *qualityWindow) add(from, to mclock.AbsTime, clients [qualityStates]int) {
+	if clients == [qualityStates]int{} {
+		w.advance(int64(to) / int64(w.width))
+		return
+	}
+	for from < to {
+		idx := int64(from) / int64(w.width)
+		end := mclock.AbsTime((idx + 1) * int64(w.width))
+		if end > to {
+			end = to
+		}
+		w.advance(idx)
+		for state, n := range clients {
+			w.buckets[idx%(qualityBuckets+1)][state] += time.Duration(end-from) * time.Duration(n)
+		}
+		from = end
+	}
+}
+
+// sum returns the client time spent in each state within the window.
+func (w *qualityWindow) sum(now mclock.AbsTime) (sum [qualityStates]time.Duration) {
+	w.advance(int64(now) / int64(w.width))
+	for _, bucket := range w.buckets {
+		for state, t := range bucket {
+			sum[state] += t
+		}
+	}
+	return sum
+}
+
+// serviceQuality tracks the share of time the connected clients of each class
+// spend at their requested capacity, at a reduced capacity or without capacity.
+// It is driven by the capacity updates of the clients and the pool clock.
+type serviceQuality struct {
+	last    mclock.AbsTime                                     // Time the windows are accounted until
+	clients [qualityClasses][qualityStates]int                 // Number of connected clients per class and state
+	windows [qualityClasses][len(qualityWindows)]qualityWindow // Rolling windows per class
+	target  float64                                            // Priority SLO target of the full service share, zero if disabled
+	alerted bool                                               // Whether the priority SLO is currently violated
+}
+
+// newServiceQuality creates an empty service quality tracker.
+func newServiceQuality(now mclock.AbsTime) *serviceQuality {
+	q := &serviceQuality{last: now}
+	for class := range q.windows {
+		for i, length := range qualityWindows {
+			w := &q.windows[class][i]
+			w.width = length / qualityBuckets
+			w.last = int64(now) / int64(w.width)
+		}
+	}
+	return q
+}
+
+// advance accounts the time elapsed since the last update.
+func (q *serviceQuality) advance(now mclock.AbsTime) {
+	if now <= q.last {
+		return
+	}
+	for class := range q.windows {
+		for i := range q.windows[class] {
+			q.windows[class][i].add(q.last, now, q.clients[class])
+		}
+	}
+	q.last = now
+}
+
+// move reaccounts a client from one slot to another, where a slot is the class
+// and state index pair flattened into a single number, -1 meaning untracked.
+func (q *serviceQuality) move(now mclock.AbsTime, from, to int) {
+	q.advance(now)
+	if from >= 0 {
+		q.clients[from/qualityStates][from%qualityStates]--
+	}
+	if to >= 0 {
+		q.clients[to/qualityStates][to%qualityStates]++
+	}
+}
+
+// ServiceQuality is the share of the connection time of a client class spent
+// in each service state over a rolling window.
+type ServiceQuality struct {
+	Class      string  `json:"class"`      // Client class, either "priority" or "free"
+	Window     string  `json:"window"`     // Length of the rolling window
+	Full       float64 `json:"full"`       // Share of the time spent at the requested capacity
+	Reduced    float64 `json:"reduced"`    // Share of the time spent below the requested capacity
+	Inactive   float64 `json:"inactive"`   // Share of the time spent without capacity
+	ClientTime float64 `json:"clientTime"` // Total connection time of the class within the window, in seconds
+}
+
+// report computes the service quality of the given class over a window.
+func (q *serviceQuality) report(now mclock.AbsTime, class, window int) ServiceQuality {
+	q.advance(now)
+
+	sum := q.windows[class][window].sum(now)
+	res := ServiceQuality{
+		Class:  qualityClassNames[class],
+		Window: qualityWindowNames[window],
+	}
+	total := sum[qualityFull] + sum[qualityReduced] + sum[qualityInactive]
+	if total > 0 {
+		res.Full = float64(sum[qualityFull]) / float64(total)
+		res.Reduced = float64(sum[qualityReduced]) / float64(total)
+		res.Inactive = float64(sum[qualityInactive]) / float64(total)
+		res.ClientTime = total.Seconds()
+	} else {
+		res.Full = 1 // No clients, nothing promised
+	}
+	return res
+}
+
+// qualitySlot returns the class and state a connected client is accounted in.
+func (c *clientInfo) qualitySlot() int {
+	class := qualityFree
+	if c.priority {
+		class = qualityPriority
+	}
+	state := qualityFull
+	switch {
+	case c.capacity == 0:
+		state = qualityInactive
+	case c.capacity < c.requested:
+		state = qualityReduced
+	}
+	return class*qualityStates + state
+}
+
+// updateQuality reaccounts a client in the service quality statistics after a
+// change of its class or its assigned or requested capacity.
+//
+// Note, this function assumes the lock is held.
+func (f *clientPool) updateQuality(c *clientInfo, now mclock.AbsTime, connected bool) {
+	slot := -1
+	if connected {
+		slot = c.qualitySlot()
+	}
+	if slot == c.quality {
+		return
+	}
+	f.quality.move(now, c.quality, slot)
+	c.quality = slot
+	f.checkQuality(now)
+}
+
+// serviceQuality returns the service quality of every client class over every
+// rolling window.
+func (f *clientPool) serviceQuality() []ServiceQuality {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.qualityReport(f.clock.Now())
+}
+
+// qualityReport computes the service quality of every client class over every
+// rolling window and updates the service quality gauges.
+//
+// Note, this function assumes the lock is held.
+func (f *clientPool) qualityReport(now mclock.AbsTime) []ServiceQuality {
+	var res []ServiceQuality
+	for class := 0; class < qualityClasses; class++ {
+		for window := range qualityWindows {
+			report := f.quality.report(now, class, window)
+			serviceQualityGauges[class][window].Update(report.Full)
+			res = append(res, report)
+		}
+	}
+	return res
+}
+
+// setServiceQualityTarget sets the share of time the priority clients should be
+// served at their requested capacity over the SLO window. The SLO alert fires
+// whenever the share drops below the target. A zero target disables the alert.
+func (f *clientPool) setServiceQualityTarget(target float64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.quality.target, f.quality.alerted = target, false
+	f.checkQuality(f.clock.Now())
+}
+
+// checkQuality fires the SLO alert if the full service share of the priority
+// clients has just dropped below the target.
+//
+// Note, this function assumes the lock is held.
+func (f *clientPool) checkQuality(now mclock.AbsTime) {
+	if f.quality.target <= 0 {
+		return
+	}
+	report := f.quality.report(now, qualityPriority, qualitySLOWindow)
+	if report.Full >= f.quality.target {
+		f.quality.alerted = false
+		serviceQualityAlertGauge.Update(0)
+		return
+	}
+	if f.quality.alerted {
+		return
+	}
+	f.quality.alerted = true
+	serviceQualityAlertGauge.Update(1)
+	serviceQualityAlertMeter.Mark(1)
+	log.Warn("Priority client service quality below target", "full", report.Full, "reduced", report.Reduced, "inactive", report.Inactive, "target", f.quality.target, "window", report.Window)
+}
@@ -0,0 +1,217 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Client pool event kinds stored in a recorded log.
+const (
+	poolEventStart       = iota // Recording started, poolStartEvent
+	poolEventConnect            // Client connected, poolConnectEvent
+	poolEventDisconnect         // Client disconnected, poolClientEvent
+	poolEventRequestCost        // Request served, poolClientEvent
+	poolEventAddBalance         // Balance updated, poolBalanceEvent
+	poolEventTransfer           // Balance transferred, poolTransferEvent
+	poolEventSetCapacity        // Client capacity changed, poolClientEvent
+	poolEventSetLimits          // Pool limits changed, poolLimitsEvent
+	poolEventSetFactors         // Default price factors changed, poolFactorsEvent
+	poolEventSetPaused          // Free service paused or resumed, poolPausedEvent
+	poolEventCheckpoint         // Snapshot of the connected set, poolCheckpointEvent
+	poolEventSetWarmUp          // Warm-up period changed, poolWarmUpEvent
+	poolEventSetFreeID          // Free client identification changed, poolFreeIDEvent
+)
+
+// poolEvent is a single entry of a recorded client pool log. Time is measured
+// in nanoseconds since the recording was started, Data is the RLP encoding of
+// the kind specific payload.
+type poolEvent struct {
+	Kind uint8
+	Time uint64
+	Data rlp.RawValue
+}
+
+type poolStartEvent struct {
+	FreeClientCap uint64
+	DisableBias   bool
+}
+
+type poolConnectEvent struct {
+	ID       enode.ID
+	FreeID   string
+	Capacity uint64
+}
+
+// poolClientEvent is the payload of the events concerning a single client.
+// Value is the request cost or the new capacity, depending on the event kind.
+type poolClientEvent struct {
+	ID    enode.ID
+	Value uint64
+}
+
+type poolBalanceEvent struct {
+	ID     enode.ID
+	Amount uint64
+	Neg    bool // Whether the amount is subtracted
+	Meta   string
+}
+
+type poolTransferEvent struct {
+	From, To enode.ID
+	Amount   uint64
+}
+
+type poolLimitsEvent struct {
+	Conns    uint64
+	Capacity uint64
+}
+
+// poolFactorsEvent stores the price factors as IEEE 754 bit patterns, in the
+// order of time, capacity and request factor.
+type poolFactorsEvent struct {
+	Pos, Neg [3]uint64
+}
+
+type poolPausedEvent struct {
+	Paused bool
+}
+
+// poolWarmUpEvent stores the length of the warm-up period in nanoseconds.
+type poolWarmUpEvent struct {
+	Period uint64
+}
+
+// poolFreeIDEvent stores the free client identification mode and the maximum
+// number of free clients per address.
+type poolFreeIDEvent struct {
+	Mode, AddrLimit uint64
+}
+
+// poolCheckpointEvent lists the connected clients sorted by ID.
+type poolCheckpointEvent struct {
+	Clients []activeSnapshotEntry
+}
+
+// poolRecorder serializes every external input of a client pool into a compact
+// binary log, allowing the exact sequence of events to be replayed later.
+//
+// A nil recorder ignores all events, so the pool needn't check whether it is
+// recording.
+//
+// Note, the recorder is protected by the pool's lock.
+type poolRecorder struct {
+	w     *bufio.Writer
+	start mclock.AbsTime
+	buf   bytes.Buffer
+	err   error
+}
+
+// record appends an event with the given payload to the log. Recording stops at
+// the first write error.
+func (r *poolRecorder) record(now mclock.AbsTime, kind uint8, data interface{}) {
+	if r == nil || r.err != nil {
+		return
+	}
+	r.buf.Reset()
+	err := rlp.Encode(&r.buf, data)
+	if err == nil {
+		err = rlp.Encode(r.w, &poolEvent{Kind: kind, Time: uint64(now - r.start), Data: r.buf.Bytes()})
+	}
+	if err != nil {
+		r.err = err
+		log.Warn("Client pool recording failed", "err", err)
+	}
+}
+
+// flush writes the buffered events into the underlying writer.
+func (r *poolRecorder) flush() {
+	if r == nil || r.err != nil {
+		return
+	}
+	if err := r.w.Flush(); err != nil {
+		r.err = err
+		log.Warn("Client pool recording failed", "err", err)
+	}
+}
+
+// encodeFactors converts price factors into their recorded format.
+func encodeFactors(f priceFactors) [3]uint64 {
+	return [3]uint64{math.Float64bits(f.timeFactor), math.Float64bits(f.capacityFactor), math.Float64bits(f.requestFactor)}
+}
+
+// decodeFactors converts recorded price factors back into their original form.
+func decodeFactors(f [3]uint64) priceFactors {
+	return priceFactors{math.Float64frombits(f[0]), math.Float64frombits(f[1]), math.Float64frombits(f[2])}
+}
+
+// setRecorder starts recording every external input of the pool into the given
+// writer, or stops recording if it is nil. Recording is off by default. To be
+// replayable, the recording should be started right after the pool is created
+// and the log should be replayed against a copy of the database at that time.
+func (f *clientPool) setRecorder(w io.Writer) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.recorder.flush()
+	f.recorder = nil
+	if w == nil {
+		return
+	}
+	now := f.clock.Now()
+	f.recorder = &poolRecorder{w: bufio.NewWriter(w), start: now}
+	f.recorder.record(now, poolEventStart, &poolStartEvent{FreeClientCap: f.freeClientCap, DisableBias: f.disableBias})
+	f.recorder.record(now, poolEventSetLimits, &poolLimitsEvent{Conns: uint64(f.connLimit), Capacity: f.capLimit})
+	f.recorder.record(now, poolEventSetFactors, &poolFactorsEvent{Pos: encodeFactors(f.defaultPosFactors), Neg: encodeFactors(f.defaultNegFactors)})
+	f.recorder.record(now, poolEventSetWarmUp, &poolWarmUpEvent{Period: uint64(f.warmUp)})
+	f.recorder.record(now, poolEventSetFreeID, &poolFreeIDEvent{Mode: uint64(f.freeIDMode), AddrLimit: uint64(f.addrLimit)})
+}
+
+// activeClients returns the connected clients and their capacities sorted by ID.
+//
+// Note, this function assumes the lock is held.
+func (f *clientPool) activeClients() []activeSnapshotEntry {
+	clients := make([]activeSnapshotEntry, 0, len(f.connectedMap))
+	for id, c := range f.connectedMap {
+		clients = append(clients, activeSnapshotEntry{ID: id, Capacity: c.capacity})
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return bytes.Compare(clients[i].ID[:], clients[j].ID[:]) < 0
+	})
+	return clients
+}
+
+// recordCheckpoint stores a snapshot of the connected set into the recorded log
+// for the replay to compare against, and flushes the log.
+//
+// Note, this function assumes the lock is held.
+func (f *clientPool) recordCheckpoint() {
+	if f.recorder == nil {
+		return
+	}
+	f.recorder.record(f.clock.Now(), poolEventCheckpoint, &poolCheckpointEvent{Clients: f.activeClients()})
+	f.recorder.flush()
+}
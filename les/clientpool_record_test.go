@@ -0,0 +1,271 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// replayPeer is a client peer recreated from a recorded client pool log.
+type replayPeer struct {
+	id     enode.ID
+	freeID string
+}
+
+func (p *replayPeer) ID() enode.ID                          { return p.id }
+func (p *replayPeer) freeClientId() string                  { return p.freeID }
+func (p *replayPeer) updateCapacity(uint64, capacityReason) {}
+func (p *replayPeer) freezeClient()                         {}
+
+// replayClientPool feeds a recorded client pool log into a fresh pool running on
+// a simulated clock, comparing the connected set with the recorded one at every
+// checkpoint. The database should be a copy of the recorded pool's database at
+// the time the recording was started. It returns the number of checkpoints
+// verified.
+//
+// To replay a log recorded in production, call it from a local test with the
+// recorded file and a copy of the server's database.
+func replayClientPool(r io.Reader, db ethdb.Database) (int, error) {
+	var (
+		stream      = rlp.NewStream(r, 0)
+		clock       = &mclock.Simulated{}
+		pool        *clientPool
+		peers       = make(map[enode.ID]*replayPeer)
+		checkpoints int
+	)
+	for index := 0; ; index++ {
+		var ev poolEvent
+		if err := stream.Decode(&ev); err == io.EOF {
+			break
+		} else if err != nil {
+			return checkpoints, fmt.Errorf("event %d: %v", index, err)
+		}
+		if pool == nil {
+			if ev.Kind != poolEventStart {
+				return 0, fmt.Errorf("event %d: log does not begin with a start event", index)
+			}
+			var start poolStartEvent
+			if err := rlp.DecodeBytes(ev.Data, &start); err != nil {
+				return 0, fmt.Errorf("event %d: %v", index, err)
+			}
+			pool = newClientPool(db, start.FreeClientCap, clock, func(enode.ID) {})
+			pool.disableBias = start.DisableBias
+			defer pool.stop()
+			continue
+		}
+		if elapsed := time.Duration(clock.Now()); time.Duration(ev.Time) > elapsed {
+			clock.Run(time.Duration(ev.Time) - elapsed)
+		}
+		var err error
+		switch ev.Kind {
+		case poolEventConnect:
+			var data poolConnectEvent
+			if err = rlp.DecodeBytes(ev.Data, &data); err == nil {
+				peers[data.ID] = &replayPeer{id: data.ID, freeID: data.FreeID}
+				pool.connect(peers[data.ID], data.Capacity)
+			}
+		case poolEventDisconnect, poolEventRequestCost, poolEventSetCapacity:
+			var data poolClientEvent
+			if err = rlp.DecodeBytes(ev.Data, &data); err != nil {
+				break
+			}
+			peer := peers[data.ID]
+			if peer == nil {
+				peer = &replayPeer{id: data.ID}
+			}
+			switch ev.Kind {
+			case poolEventDisconnect:
+				pool.disconnect(peer)
+			case poolEventRequestCost:
+				pool.requestCost(peer, data.Value)
+			case poolEventSetCapacity:
+				pool.forClients([]enode.ID{data.ID}, func(c *clientInfo, id enode.ID) error {
+					if c != nil {
+						pool.setCapacity(c, data.Value)
+					}
+					return nil
+				})
+			}
+		case poolEventAddBalance:
+			var data poolBalanceEvent
+			if err = rlp.DecodeBytes(ev.Data, &data); err == nil {
+				amount := int64(data.Amount)
+				if data.Neg {
+					amount = -amount
+				}
+				pool.addBalance(data.ID, amount, data.Meta)
+			}
+		case poolEventTransfer:
+			var data poolTransferEvent
+			if err = rlp.DecodeBytes(ev.Data, &data); err == nil {
+				pool.transferBalance(data.From, data.To, data.Amount)
+			}
+		case poolEventSetLimits:
+			var data poolLimitsEvent
+			if err = rlp.DecodeBytes(ev.Data, &data); err == nil {
+				pool.setLimits(int(data.Conns), data.Capacity)
+			}
+		case poolEventSetFactors:
+			var data poolFactorsEvent
+			if err = rlp.DecodeBytes(ev.Data, &data); err == nil {
+				pool.setDefaultFactors(decodeFactors(data.Pos), decodeFactors(data.Neg))
+			}
+		case poolEventSetPaused:
+			var data poolPausedEvent
+			if err = rlp.DecodeBytes(ev.Data, &data); err == nil {
+				pool.setFreeClientsPaused(data.Paused)
+			}
+		case poolEventSetWarmUp:
+			var data poolWarmUpEvent
+			if err = rlp.DecodeBytes(ev.Data, &data); err == nil {
+				pool.setWarmUp(time.Duration(data.Period))
+			}
+		case poolEventSetFreeID:
+			var data poolFreeIDEvent
+			if err = rlp.DecodeBytes(ev.Data, &data); err == nil {
+				pool.setFreeIDMode(freeIDMode(data.Mode), int(data.AddrLimit))
+			}
+		case poolEventCheckpoint:
+			var data poolCheckpointEvent
+			if err = rlp.DecodeBytes(ev.Data, &data); err != nil {
+				break
+			}
+			pool.lock.Lock()
+			have := pool.activeClients()
+			pool.lock.Unlock()
+
+			if len(have) != len(data.Clients) || (len(have) > 0 && !reflect.DeepEqual(have, data.Clients)) {
+				return checkpoints, fmt.Errorf("event %d: connected set mismatch at %v: have %v, want %v", index, time.Duration(ev.Time), have, data.Clients)
+			}
+			checkpoints++
+		default:
+			err = fmt.Errorf("unknown event kind %d", ev.Kind)
+		}
+		if err != nil {
+			return checkpoints, fmt.Errorf("event %d: %v", index, err)
+		}
+	}
+	return checkpoints, nil
+}
+
+func TestClientPoolRecordReplay(t *testing.T) {
+	const (
+		connLimit   = 10
+		clientCount = 30
+		paidCount   = 5
+		ticks       = 2000
+	)
+	var (
+		clock  mclock.Simulated
+		db     = rawdb.NewMemoryDatabase()
+		kicked []enode.ID
+		pool   = newClientPool(db, 1, &clock, func(id enode.ID) { kicked = append(kicked, id) })
+		record bytes.Buffer
+		rng    = rand.New(rand.NewSource(1))
+	)
+	pool.disableBias = true
+	pool.setRecorder(&record)
+	pool.setLimits(connLimit, uint64(connLimit))
+	pool.setDefaultFactors(priceFactors{1, 0, 1}, priceFactors{1, 0, 1})
+
+	checkpoint := func() {
+		pool.lock.Lock()
+		pool.recordCheckpoint()
+		pool.lock.Unlock()
+	}
+	for tick := 0; tick < ticks; tick++ {
+		clock.Run(time.Second)
+
+		switch {
+		case tick == ticks/4:
+			for i := 0; i < paidCount; i++ {
+				pool.addBalance(poolTestPeer(i).ID(), int64(ticks/2*time.Second), "")
+			}
+		case tick == ticks/2:
+			pool.transferBalance(poolTestPeer(0).ID(), poolTestPeer(paidCount).ID(), 0)
+			pool.setLimits(connLimit/2, uint64(connLimit/2))
+		case tick == ticks*3/4:
+			pool.setLimits(connLimit, uint64(connLimit))
+			pool.setFreeClientsPaused(true)
+		case tick == ticks*7/8:
+			pool.setFreeClientsPaused(false)
+		}
+		i := poolTestPeer(rng.Intn(clientCount))
+		if rng.Intn(2) == 0 {
+			pool.connect(i, 0)
+		} else {
+			pool.disconnect(i)
+		}
+		pool.requestCost(poolTestPeer(rng.Intn(clientCount)), uint64(rng.Intn(1000)))
+
+		// Disconnect the kicked out clients like the server does
+		for _, id := range kicked {
+			pool.disconnect(poolTestPeer(int(id[0]) + int(id[1])<<8))
+		}
+		kicked = kicked[:0]
+
+		if tick%100 == 0 {
+			checkpoint()
+		}
+	}
+	checkpoint()
+	pool.stop()
+
+	// Replay the log against the initial, empty database
+	checkpoints, err := replayClientPool(bytes.NewReader(record.Bytes()), rawdb.NewMemoryDatabase())
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if checkpoints < ticks/100 {
+		t.Fatalf("Checkpoint count mismatch: have %d, want at least %d", checkpoints, ticks/100)
+	}
+}
+
+func TestClientPoolRecordingDisabled(t *testing.T) {
+	var clock mclock.Simulated
+	pool := newClientPool(rawdb.NewMemoryDatabase(), 1, &clock, func(id enode.ID) {})
+	defer pool.stop()
+
+	if pool.recorder != nil {
+		t.Fatal("Recording enabled by default")
+	}
+	var record bytes.Buffer
+	pool.setRecorder(&record)
+	pool.setLimits(1, 1)
+	pool.setRecorder(nil)
+	size := record.Len()
+	if size == 0 {
+		t.Fatal("Nothing recorded")
+	}
+	pool.setLimits(2, 2)
+	pool.connect(poolTestPeer(0), 0)
+	if record.Len() != size {
+		t.Fatalf("Events recorded after stopping: have %d bytes, want %d", record.Len(), size)
+	}
+}
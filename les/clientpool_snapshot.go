@@ -0,0 +1,148 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+const (
+	activeSnapshotRefresh = time.Minute      // refresh period of the persisted connected client snapshot
+	activeSnapshotTTL     = time.Minute * 10 // the maximum age of a persisted snapshot still used at startup
+	activeSnapshotGrace   = time.Minute * 5  // the period after startup in which the snapshot is honoured
+)
+
+// activeSnapshot is the persisted list of connected clients along with their
+// assigned capacities.
+type activeSnapshot struct {
+	Time    uint64 // Unix timestamp of the snapshot creation
+	Clients []activeSnapshotEntry
+}
+
+// activeSnapshotEntry is a single connected client in an activeSnapshot.
+type activeSnapshotEntry struct {
+	ID       enode.ID
+	Capacity uint64
+}
+
+// snapshotTracker persists the connected set of a client pool periodically and
+// remembers the capacities of the clients connected before the last shutdown,
+// so that a restarted server can quickly restore the allocation.
+//
+// Note, the tracker is protected by the pool's lock.
+type snapshotTracker struct {
+	ndb       *nodeDB
+	startTime mclock.AbsTime      // The pool clock time at which the tracker was created
+	startWall time.Time           // The wall clock time at which the tracker was created
+	last      mclock.AbsTime      // The timestamp at which the connected set was last persisted
+	restored  map[enode.ID]uint64 // Capacities of the clients connected before the last shutdown
+}
+
+// newSnapshotTracker creates a snapshot tracker and loads the connected set of
+// the previous run, ignoring stale snapshots. The snapshot age is the only wall
+// clock measurement of the pool, if the clock was set back since the snapshot
+// was taken, consider it fresh.
+func newSnapshotTracker(ndb *nodeDB, now mclock.AbsTime) *snapshotTracker {
+	s := &snapshotTracker{
+		ndb:       ndb,
+		startTime: now,
+		startWall: time.Now(),
+		last:      now,
+		restored:  make(map[enode.ID]uint64),
+	}
+	if snap := ndb.getActiveSnapshot(); snap != nil {
+		age := s.startWall.Sub(time.Unix(int64(snap.Time), 0))
+		if age < 0 {
+			log.Warn("Connected client snapshot from the future, wall clock moved backward", "skew", common.PrettyDuration(-age))
+			age = 0
+		}
+		if age < activeSnapshotTTL {
+			s.restore(snap.Clients)
+			log.Debug("Loaded connected client snapshot", "clients", len(snap.Clients), "age", common.PrettyDuration(age))
+		}
+	}
+	return s
+}
+
+// restore replaces the remembered capacities with the given connected set.
+func (s *snapshotTracker) restore(clients []activeSnapshotEntry) {
+	s.restored = make(map[enode.ID]uint64, len(clients))
+	for _, entry := range clients {
+		s.restored[entry.ID] = entry.Capacity
+	}
+}
+
+// take returns the capacity the client had before the restart if it reconnects
+// within the grace period, and forgets it either way.
+func (s *snapshotTracker) take(id enode.ID, now mclock.AbsTime) (uint64, bool) {
+	capacity, ok := s.restored[id]
+	if !ok {
+		return 0, false
+	}
+	delete(s.restored, id)
+	return capacity, time.Duration(now-s.startTime) < activeSnapshotGrace
+}
+
+// refresh persists the given connected set if the last snapshot is older than
+// the refresh period.
+func (s *snapshotTracker) refresh(now mclock.AbsTime, clients []activeSnapshotEntry) {
+	if time.Duration(now-s.last) < activeSnapshotRefresh {
+		return
+	}
+	s.save(now, clients)
+}
+
+// save persists the given connected set, dated by the wall clock time matching
+// the given pool clock time.
+func (s *snapshotTracker) save(now mclock.AbsTime, clients []activeSnapshotEntry) {
+	s.ndb.setActiveSnapshot(&activeSnapshot{Time: uint64(s.wallTime(now).Unix()), Clients: clients})
+	s.last = now
+}
+
+// wallTime converts a timestamp of the pool clock into wall clock time, anchored
+// at the creation of the tracker.
+func (s *snapshotTracker) wallTime(now mclock.AbsTime) time.Time {
+	return s.startWall.Add(time.Duration(now - s.startTime))
+}
+
+func (db *nodeDB) getActiveSnapshot() *activeSnapshot {
+	blob, err := db.db.Get(append(activeSnapshotKey, db.verbuf[:]...))
+	if err != nil || len(blob) == 0 {
+		return nil
+	}
+	var snap activeSnapshot
+	if err := rlp.DecodeBytes(blob, &snap); err != nil {
+		log.Error("Failed to decode connected client snapshot", "err", err)
+		return nil
+	}
+	return &snap
+}
+
+func (db *nodeDB) setActiveSnapshot(snap *activeSnapshot) {
+	enc, err := rlp.EncodeToBytes(snap)
+	if err != nil {
+		log.Error("Failed to encode connected client snapshot", "err", err)
+		return
+	}
+	db.db.Put(append(activeSnapshotKey, db.verbuf[:]...), enc)
+}
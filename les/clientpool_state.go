@@ -0,0 +1,337 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// poolStateVersion is the version of the exported client pool state container.
+// It is only bumped by incompatible changes of the container itself, new kinds
+// of sections are added without bumping it, older importers skip them.
+const poolStateVersion = 1
+
+// Client pool state section kinds.
+const (
+	poolSectionPosBalances   = iota // Positive balances, []poolStatePosBalance
+	poolSectionNegBalances          // Negative balances by address, []poolStateNegBalance
+	poolSectionIDNegBalances        // Negative balances by node ID, []poolStateIDNegBalance
+	poolSectionActive               // Connected clients, []activeSnapshotEntry
+)
+
+var (
+	errPoolClosed          = errors.New("client pool closed")
+	errPoolServing         = errors.New("client pool already serving")
+	errPoolStateVersion    = errors.New("unsupported client pool state version")
+	errPoolStateDuplicated = errors.New("duplicate client pool state section")
+)
+
+// poolState is the container of an exported client pool state.
+type poolState struct {
+	Version  uint
+	Sections []poolStateSection
+}
+
+// poolStateSection is a single typed section of the pool state. The content is
+// kept raw so that sections of unknown kinds can be skipped.
+type poolStateSection struct {
+	Kind uint
+	Data rlp.RawValue
+}
+
+// poolStatePosBalance is the exported positive balance of a client.
+type poolStatePosBalance struct {
+	ID    enode.ID
+	Value uint64
+	Meta  string
+}
+
+// poolStateNegBalance is the exported negative balance of an address. Balances
+// are exported as their current linear value, the logarithmic form stored in
+// the database is relative to the running time of the exporting pool.
+type poolStateNegBalance struct {
+	Address string
+	Value   uint64
+}
+
+// poolStateIDNegBalance is the exported negative balance of a node ID.
+type poolStateIDNegBalance struct {
+	ID    enode.ID
+	Value uint64
+}
+
+// exportState writes the full state of the client pool into w. The balances of
+// the connected clients are exported as if they disconnected right now, the
+// connected set is exported so that the importing pool can restore the
+// capacities of the priority clients reconnecting to it.
+func (f *clientPool) exportState(w io.Writer) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return errPoolClosed
+	}
+	var (
+		now  = f.clock.Now()
+		pos  = f.ndb.posBalances()
+		neg  = make(map[string]uint64)
+		idn  = make(map[enode.ID]uint64)
+		dual = f.freeIDMode == freeIDDual
+	)
+	for address, nb := range f.ndb.negBalances() {
+		neg[address] = f.decodeNegBalance(nb, now)
+	}
+	for id, nb := range f.ndb.idNegBalances() {
+		idn[id] = f.decodeNegBalance(nb, now)
+	}
+	// Fold the live balances of the connected clients in, the same way
+	// finalizeBalance would on disconnection.
+	for id, c := range f.connectedMap {
+		p, n := c.balanceTracker.getBalance(now)
+		if p != 0 || pos[id].meta != "" {
+			pos[id] = posBalance{value: p, meta: pos[id].meta}
+		} else {
+			delete(pos, id)
+		}
+		if !dual {
+			neg[c.address] = n
+			continue
+		}
+		idn[id] = n
+		if n > c.negStart {
+			neg[c.address] += n - c.negStart
+		}
+	}
+	var state poolState
+	state.Version = poolStateVersion
+
+	posList := make([]poolStatePosBalance, 0, len(pos))
+	for id, pb := range pos {
+		posList = append(posList, poolStatePosBalance{ID: id, Value: pb.value, Meta: pb.meta})
+	}
+	sort.Slice(posList, func(i, j int) bool { return bytes.Compare(posList[i].ID[:], posList[j].ID[:]) < 0 })
+
+	negList := make([]poolStateNegBalance, 0, len(neg))
+	for address, value := range neg {
+		negList = append(negList, poolStateNegBalance{Address: address, Value: value})
+	}
+	sort.Slice(negList, func(i, j int) bool { return negList[i].Address < negList[j].Address })
+
+	idnList := make([]poolStateIDNegBalance, 0, len(idn))
+	for id, value := range idn {
+		idnList = append(idnList, poolStateIDNegBalance{ID: id, Value: value})
+	}
+	sort.Slice(idnList, func(i, j int) bool { return bytes.Compare(idnList[i].ID[:], idnList[j].ID[:]) < 0 })
+
+	for _, section := range []struct {
+		kind uint
+		data interface{}
+	}{
+		{poolSectionPosBalances, posList},
+		{poolSectionNegBalances, negList},
+		{poolSectionIDNegBalances, idnList},
+		{poolSectionActive, f.activeClients()},
+	} {
+		enc, err := rlp.EncodeToBytes(section.data)
+		if err != nil {
+			return err
+		}
+		state.Sections = append(state.Sections, poolStateSection{Kind: section.kind, Data: enc})
+	}
+	log.Info("Exported client pool state", "posbalances", len(posList), "negbalances", len(negList)+len(idnList), "connected", len(f.connectedMap))
+	return rlp.Encode(w, &state)
+}
+
+// importState loads a client pool state exported by exportState into the pool.
+// Imported balances overwrite the stored ones of the same clients, the imported
+// connected set replaces the one loaded from the database. The state can only
+// be imported before the pool starts serving clients. Sections of unknown kinds
+// are skipped.
+func (f *clientPool) importState(r io.Reader) error {
+	var state poolState
+	if err := rlp.Decode(r, &state); err != nil {
+		return err
+	}
+	if state.Version != poolStateVersion {
+		return fmt.Errorf("%w: %d", errPoolStateVersion, state.Version)
+	}
+	var (
+		posList []poolStatePosBalance
+		negList []poolStateNegBalance
+		idnList []poolStateIDNegBalance
+		active  []activeSnapshotEntry
+		seen    = make(map[uint]bool)
+		skipped int
+	)
+	for _, section := range state.Sections {
+		if seen[section.Kind] {
+			return fmt.Errorf("%w: kind %d", errPoolStateDuplicated, section.Kind)
+		}
+		seen[section.Kind] = true
+
+		var (
+			err   error
+			known = true
+		)
+		switch section.Kind {
+		case poolSectionPosBalances:
+			err = rlp.DecodeBytes(section.Data, &posList)
+		case poolSectionNegBalances:
+			err = rlp.DecodeBytes(section.Data, &negList)
+		case poolSectionIDNegBalances:
+			err = rlp.DecodeBytes(section.Data, &idnList)
+		case poolSectionActive:
+			err = rlp.DecodeBytes(section.Data, &active)
+		default:
+			known = false
+		}
+		if err != nil {
+			return fmt.Errorf("invalid client pool state section %d: %v", section.Kind, err)
+		}
+		if !known {
+			log.Debug("Skipping unknown client pool state section", "kind", section.Kind, "size", len(section.Data))
+			skipped++
+		}
+	}
+	// Everything decoded fine, apply the state
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return errPoolClosed
+	}
+	if f.serving {
+		return errPoolServing
+	}
+	now := f.clock.Now()
+	for _, entry := range posList {
+		f.ndb.setPB(entry.ID, posBalance{value: entry.Value, meta: entry.Meta})
+	}
+	f.checkBudget()
+	for _, entry := range negList {
+		f.importNegBalance(now, entry.Value, func(nb negBalance) { f.ndb.setNB(entry.Address, nb) }, func() { f.ndb.delNB(entry.Address) })
+	}
+	for _, entry := range idnList {
+		f.importNegBalance(now, entry.Value, func(nb negBalance) { f.ndb.setIDNB(entry.ID, nb) }, func() { f.ndb.delIDNB(entry.ID) })
+	}
+	if seen[poolSectionActive] {
+		f.snapshot.restore(active)
+
+		// Persist the imported connected set too, in case the node restarts
+		// before the clients reconnect.
+		f.snapshot.save(now, active)
+	}
+	log.Info("Imported client pool state", "posbalances", len(posList), "negbalances", len(negList)+len(idnList), "connected", len(active), "skipped", skipped)
+	return nil
+}
+
+// importStateFile loads a client pool state exported into a file.
+func (f *clientPool) importStateFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return f.importState(bufio.NewReader(file))
+}
+
+// importNegBalance re-encodes an imported linear negative balance relative to
+// the running time of the pool and stores it, or deletes the record if the
+// balance is small enough to be dropped.
+//
+// Note, this function assumes the lock is held.
+func (f *clientPool) importNegBalance(now mclock.AbsTime, value uint64, set func(negBalance), del func()) {
+	if nb, ok := f.encodeNegBalance(value, now); ok {
+		set(nb)
+	} else {
+		del()
+	}
+}
+
+// posBalances returns all the stored positive balances.
+func (db *nodeDB) posBalances() map[enode.ID]posBalance {
+	prefix := db.getPrefix(false)
+	iter := db.db.NewIterator(prefix, nil)
+	defer iter.Release()
+
+	balances := make(map[enode.ID]posBalance)
+	for iter.Next() {
+		var id enode.ID
+		if len(iter.Key()) != len(prefix)+len(id) {
+			continue
+		}
+		var balance posBalance
+		if err := rlp.DecodeBytes(iter.Value(), &balance); err != nil {
+			log.Error("Failed to decode positive balance", "err", err)
+			continue
+		}
+		copy(id[:], iter.Key()[len(prefix):])
+		balances[id] = balance
+	}
+	return balances
+}
+
+// negBalances returns all the stored negative balances tracked by address.
+func (db *nodeDB) negBalances() map[string]negBalance {
+	balances := make(map[string]negBalance)
+	db.iterateNegBalances(negativeBalancePrefix, func(key []byte, balance negBalance) {
+		balances[string(key)] = balance
+	})
+	return balances
+}
+
+// idNegBalances returns all the stored negative balances tracked by node ID.
+func (db *nodeDB) idNegBalances() map[enode.ID]negBalance {
+	balances := make(map[enode.ID]negBalance)
+	db.iterateNegBalances(negativeIDBalancePrefix, func(key []byte, balance negBalance) {
+		var id enode.ID
+		if len(key) == len(id) {
+			copy(id[:], key)
+			balances[id] = balance
+		}
+	})
+	return balances
+}
+
+// iterateNegBalances calls fn for every stored negative balance under the given
+// prefix with the key stripped of the prefix.
+func (db *nodeDB) iterateNegBalances(prefix []byte, fn func(key []byte, balance negBalance)) {
+	prefix = append(db.verbuf[:], prefix...)
+	iter := db.db.NewIterator(prefix, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		var balance negBalance
+		if err := rlp.DecodeBytes(iter.Value(), &balance); err != nil {
+			log.Error("Failed to decode negative balance", "err", err)
+			continue
+		}
+		fn(iter.Key()[len(prefix):], balance)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func newStateTestPool(clock mclock.Clock) *clientPool {
+	pool := newClientPool(rawdb.NewMemoryDatabase(), 1, clock, func(id enode.ID) {})
+	pool.setLimits(10, uint64(10))
+	pool.setDefaultFactors(priceFactors{1, 0, 1}, priceFactors{1, 0, 1})
+	return pool
+}
+
+// negBalanceClose reports whether two negative balances match within the loss
+// of the logarithmic storage format.
+func negBalanceClose(have, want uint64) bool {
+	diff := int64(have) - int64(want)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= int64(time.Second)+int64(want/100)
+}
+
+func TestClientPoolStateRoundTrip(t *testing.T) {
+	var clock mclock.Simulated
+	pool := newStateTestPool(&clock)
+	defer pool.stop()
+
+	// Build some history: a disconnected free client, a connected free client
+	// and a connected priority client.
+	pool.addBalance(poolTestPeer(0).ID(), int64(time.Hour), "meta")
+	pool.connect(poolTestPeer(0), 5)
+	pool.connect(poolTestPeer(1), 0)
+	pool.connect(poolTestPeer(2), 0)
+	clock.Run(time.Minute)
+	pool.disconnect(poolTestPeer(2))
+	clock.Run(time.Minute)
+
+	now := clock.Now()
+	wantPos, _ := pool.connectedMap[poolTestPeer(0).ID()].balanceTracker.getBalance(now)
+	_, wantNeg1 := pool.connectedMap[poolTestPeer(1).ID()].balanceTracker.getBalance(now)
+	wantNeg2 := pool.decodeNegBalance(pool.ndb.getOrNewNB(poolTestPeer(2).freeClientId()), now)
+	if wantPos == 0 || wantNeg1 == 0 || wantNeg2 == 0 {
+		t.Fatalf("Missing balances to export: pos %d, neg %d/%d", wantPos, wantNeg1, wantNeg2)
+	}
+	var buf bytes.Buffer
+	if err := pool.exportState(&buf); err != nil {
+		t.Fatalf("Failed to export state: %v", err)
+	}
+	// Restore the state into a fresh pool and reconnect the clients
+	var clock2 mclock.Simulated
+	clock2.Run(time.Hour) // Different running time, negative balances must be re-encoded
+	restored := newStateTestPool(&clock2)
+	defer restored.stop()
+
+	if err := restored.importState(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Failed to import state: %v", err)
+	}
+	if pb := restored.ndb.getOrNewPB(poolTestPeer(0).ID()); pb.value != wantPos || pb.meta != "meta" {
+		t.Fatalf("Positive balance mismatch: have %d/%q, want %d/%q", pb.value, pb.meta, wantPos, "meta")
+	}
+	peers := make([]*poolTestPeerWithCap, 3)
+	for i := range peers {
+		peers[i] = &poolTestPeerWithCap{poolTestPeer: poolTestPeer(i)}
+		if !restored.connect(peers[i], 0) {
+			t.Fatalf("Failed to reconnect client %d", i)
+		}
+	}
+	if peers[0].cap != 5 {
+		t.Fatalf("Priority client capacity mismatch: have %d, want %d", peers[0].cap, 5)
+	}
+	now = clock2.Now()
+	if pos, _ := restored.connectedMap[poolTestPeer(0).ID()].balanceTracker.getBalance(now); pos != wantPos {
+		t.Fatalf("Priority client balance mismatch: have %d, want %d", pos, wantPos)
+	}
+	for i, want := range []uint64{wantNeg1, wantNeg2} {
+		_, have := restored.connectedMap[poolTestPeer(i+1).ID()].balanceTracker.getBalance(now)
+		if !negBalanceClose(have, want) {
+			t.Fatalf("Free client %d negative balance mismatch: have %d, want %d", i+1, have, want)
+		}
+	}
+	// The pool is serving now, further imports must be refused
+	if err := restored.importState(bytes.NewReader(buf.Bytes())); err != errPoolServing {
+		t.Fatalf("Import into serving pool: have %v, want %v", err, errPoolServing)
+	}
+}
+
+func TestClientPoolStateUnknownSection(t *testing.T) {
+	var clock mclock.Simulated
+	pool := newStateTestPool(&clock)
+	defer pool.stop()
+
+	pool.addBalance(poolTestPeer(0).ID(), int64(time.Hour), "")
+	var buf bytes.Buffer
+	if err := pool.exportState(&buf); err != nil {
+		t.Fatalf("Failed to export state: %v", err)
+	}
+	// Append a section of a kind introduced by a future version
+	var state poolState
+	if err := rlp.DecodeBytes(buf.Bytes(), &state); err != nil {
+		t.Fatalf("Failed to decode state: %v", err)
+	}
+	future, _ := rlp.EncodeToBytes([]interface{}{"future", uint(1)})
+	state.Sections = append(state.Sections, poolStateSection{Kind: 100, Data: future})
+	enc, _ := rlp.EncodeToBytes(&state)
+
+	restored := newStateTestPool(&clock)
+	defer restored.stop()
+	if err := restored.importState(bytes.NewReader(enc)); err != nil {
+		t.Fatalf("Failed to import state with unknown section: %v", err)
+	}
+	if pb := restored.ndb.getOrNewPB(poolTestPeer(0).ID()); pb.value != uint64(time.Hour) {
+		t.Fatalf("Positive balance mismatch: have %d, want %d", pb.value, uint64(time.Hour))
+	}
+	// Unknown container versions are rejected
+	state.Version = poolStateVersion + 1
+	enc, _ = rlp.EncodeToBytes(&state)
+	if err := restored.importState(bytes.NewReader(enc)); !errors.Is(err, errPoolStateVersion) {
+		t.Fatalf("Import of future version: have %v, want %v", err, errPoolStateVersion)
+	}
+}
+
+// Tests that the pool state exported through the admin API can be imported from
+// the written file, and that existing files are not overwritten.
+func TestClientPoolStateExportFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "les-pool-state-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var clock mclock.Simulated
+	pool := newStateTestPool(&clock)
+	defer pool.stop()
+
+	pool.addBalance(poolTestPeer(0).ID(), int64(time.Hour), "meta")
+
+	api := &PrivateLightServerAPI{server: &LesServer{clientPool: pool}}
+	path := filepath.Join(dir, "pool.rlp")
+	if ok, err := api.ExportPoolState(path); !ok || err != nil {
+		t.Fatalf("Failed to export state: %v", err)
+	}
+	if ok, err := api.ExportPoolState(path); ok || err == nil {
+		t.Fatalf("Existing export file overwritten")
+	}
+	restored := newStateTestPool(&clock)
+	defer restored.stop()
+
+	if err := restored.importStateFile(path); err != nil {
+		t.Fatalf("Failed to import state file: %v", err)
+	}
+	if pb := restored.ndb.getOrNewPB(poolTestPeer(0).ID()); pb.value != uint64(time.Hour) || pb.meta != "meta" {
+		t.Fatalf("Positive balance mismatch: have %d/%q, want %d/%q", pb.value, pb.meta, uint64(time.Hour), "meta")
+	}
+	if err := restored.importStateFile(filepath.Join(dir, "missing.rlp")); !os.IsNotExist(err) {
+		t.Fatalf("Missing state file import: have %v, want not exist error", err)
+	}
+}
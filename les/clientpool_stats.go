@@ -0,0 +1,124 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/mclock"
+)
+
+// eventRateWindow is the number of seconds event rates are measured over.
+const eventRateWindow = 60
+
+// eventRate counts events over a sliding window using a ring buffer of per
+// second buckets.
+type eventRate struct {
+	buckets [eventRateWindow]uint64
+	last    int64 // Second of the most recently touched bucket
+}
+
+// advance clears the buckets that fell out of the window since the last update.
+func (r *eventRate) advance(now mclock.AbsTime) {
+	sec := int64(time.Duration(now) / time.Second)
+	if sec <= r.last {
+		return
+	}
+	if sec-r.last >= eventRateWindow {
+		r.buckets = [eventRateWindow]uint64{}
+	} else {
+		for s := r.last + 1; s <= sec; s++ {
+			r.buckets[s%eventRateWindow] = 0
+		}
+	}
+	r.last = sec
+}
+
+// add records a single event.
+func (r *eventRate) add(now mclock.AbsTime) {
+	r.advance(now)
+	r.buckets[r.last%eventRateWindow]++
+}
+
+// count returns the number of events recorded within the window.
+func (r *eventRate) count(now mclock.AbsTime) uint64 {
+	r.advance(now)
+
+	var sum uint64
+	for _, n := range r.buckets {
+		sum += n
+	}
+	return sum
+}
+
+// clientPoolRates tracks the rates of the client pool events.
+type clientPoolRates struct {
+	connected, disconnected, kicked, rejected eventRate
+}
+
+// ClientPoolMetrics is a point-in-time snapshot of the client pool state. Event
+// counters cover the last minute.
+type ClientPoolMetrics struct {
+	ConnectedCount    int    `json:"connectedCount"`    // Number of connected clients
+	ConnectedCapacity uint64 `json:"connectedCapacity"` // Total capacity of the connected clients
+	PriorityCapacity  uint64 `json:"priorityCapacity"`  // Total capacity of the connected priority clients
+	MaxCount          int    `json:"maxCount"`          // Maximum number of connected clients
+	MaxCapacity       uint64 `json:"maxCapacity"`       // Maximum total capacity of connected clients
+	WarmUp            bool   `json:"warmUp"`            // Whether the pool is in its warm-up period
+
+	PositiveBalance uint64 `json:"positiveBalance"` // Total positive balance of the connected clients
+	NegativeBalance uint64 `json:"negativeBalance"` // Total negative balance of the connected clients
+
+	StoredBalance uint64  `json:"storedBalance"` // Total positive balance of all stored clients
+	BudgetRatio   float64 `json:"budgetRatio"`   // Ratio of the stored balance to the serving budget
+
+	Connects    uint64 `json:"connects"`    // Number of accepted connections
+	Disconnects uint64 `json:"disconnects"` // Number of client initiated disconnections
+	Kicks       uint64 `json:"kicks"`       // Number of clients kicked out by the pool
+	Rejects     uint64 `json:"rejects"`     // Number of rejected connections
+
+	Quality []ServiceQuality `json:"quality"` // Service quality per client class and window
+}
+
+// metricsSnapshot computes the current metrics of the client pool.
+func (f *clientPool) metricsSnapshot() ClientPoolMetrics {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := f.clock.Now()
+	m := ClientPoolMetrics{
+		ConnectedCount:    len(f.connectedMap),
+		ConnectedCapacity: f.connectedCap,
+		PriorityCapacity:  f.priorityConnected,
+		MaxCount:          f.connLimit,
+		MaxCapacity:       f.capLimit,
+		WarmUp:            f.inWarmUp(now),
+		Connects:          f.rates.connected.count(now),
+		Disconnects:       f.rates.disconnected.count(now),
+		Kicks:             f.rates.kicked.count(now),
+		Rejects:           f.rates.rejected.count(now),
+		StoredBalance:     f.ndb.posTotal,
+		BudgetRatio:       f.budgetRatio(),
+		Quality:           f.qualityReport(now),
+	}
+	for _, c := range f.connectedMap {
+		pos, neg := c.balanceTracker.getBalance(now)
+		m.PositiveBalance += pos
+		m.NegativeBalance += neg
+	}
+	return m
+}
@@ -22,6 +22,7 @@ import (
 	"math"
 	"math/rand"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -66,15 +67,18 @@ func (i poolTestPeer) freeClientId() string {
 	return fmt.Sprintf("addr #%d", i)
 }
 
-func (i poolTestPeer) updateCapacity(uint64) {}
+func (i poolTestPeer) updateCapacity(uint64, capacityReason) {}
 
 type poolTestPeerWithCap struct {
 	poolTestPeer
 
-	cap uint64
+	cap    uint64
+	reason capacityReason
 }
 
-func (i *poolTestPeerWithCap) updateCapacity(cap uint64) { i.cap = cap }
+func (i *poolTestPeerWithCap) updateCapacity(cap uint64, reason capacityReason) {
+	i.cap, i.reason = cap, reason
+}
 
 func (i poolTestPeer) freezeClient() {}
 
@@ -541,3 +545,748 @@ func TestNodeDBExpiration(t *testing.T) {
 		t.Fatalf("Failed to evict useless negative balances, want %v, got %d", 4, iterated)
 	}
 }
+
+func TestConnectedSnapshotRestore(t *testing.T) {
+	var (
+		clock mclock.Simulated
+		db    = rawdb.NewMemoryDatabase()
+	)
+	pool := newClientPool(db, 1, &clock, func(id enode.ID) {})
+	pool.setLimits(10, uint64(10))
+	pool.setDefaultFactors(priceFactors{1, 0, 1}, priceFactors{1, 0, 1})
+
+	pool.addBalance(poolTestPeer(0).ID(), int64(time.Hour), "")
+	pool.connect(poolTestPeer(0), 5)
+	pool.connect(poolTestPeer(1), 0)
+	pool.saveSnapshot()
+	pool.disconnect(poolTestPeer(0))
+	pool.disconnect(poolTestPeer(1))
+	pool.stop()
+
+	// Restart the pool, the priority client should get its capacity back
+	pool = newClientPool(db, 1, &clock, func(id enode.ID) {})
+	pool.setLimits(10, uint64(10))
+	pool.setDefaultFactors(priceFactors{1, 0, 1}, priceFactors{1, 0, 1})
+
+	p0 := &poolTestPeerWithCap{poolTestPeer: poolTestPeer(0)}
+	p1 := &poolTestPeerWithCap{poolTestPeer: poolTestPeer(1)}
+	if !pool.connect(p0, 0) || !pool.connect(p1, 0) {
+		t.Fatalf("Failed to reconnect clients")
+	}
+	if p0.cap != 5 {
+		t.Fatalf("Priority client capacity mismatch: have %d, want %d", p0.cap, 5)
+	}
+	if p1.cap != 0 {
+		t.Fatalf("Free client capacity changed: have %d", p1.cap)
+	}
+	pool.disconnect(p0)
+	pool.stop()
+
+	// Make the snapshot stale, it should be ignored by the next restart
+	snap := pool.ndb.getActiveSnapshot()
+	snap.Time -= uint64(activeSnapshotTTL / time.Second)
+	pool.ndb.setActiveSnapshot(snap)
+
+	pool = newClientPool(db, 1, &clock, func(id enode.ID) {})
+	defer pool.stop()
+	pool.setLimits(10, uint64(10))
+
+	p0 = &poolTestPeerWithCap{poolTestPeer: poolTestPeer(0)}
+	if !pool.connect(p0, 0) {
+		t.Fatalf("Failed to reconnect client")
+	}
+	if p0.cap != 0 {
+		t.Fatalf("Capacity restored from stale snapshot: have %d", p0.cap)
+	}
+}
+
+func TestClientPoolMetricsSnapshot(t *testing.T) {
+	var (
+		clock mclock.Simulated
+		db    = rawdb.NewMemoryDatabase()
+	)
+	pool := newClientPool(db, 1, &clock, func(id enode.ID) {})
+	defer pool.stop()
+	pool.setLimits(2, uint64(4))
+	pool.setDefaultFactors(priceFactors{1, 0, 1}, priceFactors{1, 0, 1})
+
+	pool.addBalance(poolTestPeer(0).ID(), int64(time.Hour), "")
+	pool.connect(poolTestPeer(0), 2)
+	pool.connect(poolTestPeer(1), 0)
+	clock.Run(time.Second * 30)
+	pool.connect(poolTestPeer(2), 0) // rejected, pool is full
+	pool.disconnect(poolTestPeer(1))
+
+	m := pool.metricsSnapshot()
+	if m.ConnectedCount != 1 || m.ConnectedCapacity != 2 || m.PriorityCapacity != 2 {
+		t.Fatalf("Connected state mismatch: %+v", m)
+	}
+	if m.MaxCount != 2 || m.MaxCapacity != 4 {
+		t.Fatalf("Limits mismatch: %+v", m)
+	}
+	if m.Connects != 2 || m.Disconnects != 1 || m.Rejects != 1 || m.Kicks != 0 {
+		t.Fatalf("Event counters mismatch: %+v", m)
+	}
+	if m.PositiveBalance != uint64(time.Hour-time.Second*30) {
+		t.Fatalf("Positive balance mismatch: have %d, want %d", m.PositiveBalance, uint64(time.Hour-time.Second*30))
+	}
+	// Events older than a minute should fall out of the window
+	clock.Run(time.Second * 45)
+	m = pool.metricsSnapshot()
+	if m.Connects != 0 || m.Disconnects != 1 || m.Rejects != 1 {
+		t.Fatalf("Event counters mismatch after 75s: %+v", m)
+	}
+	clock.Run(time.Minute)
+	m = pool.metricsSnapshot()
+	if m.Connects != 0 || m.Disconnects != 0 || m.Rejects != 0 {
+		t.Fatalf("Event counters mismatch after 135s: %+v", m)
+	}
+}
+
+func TestActivationThreshold(t *testing.T) {
+	var (
+		clock mclock.Simulated
+		db    = rawdb.NewMemoryDatabase()
+	)
+	pool := newClientPool(db, 1, &clock, func(id enode.ID) {})
+	defer pool.stop()
+	pool.disableBias = true
+	pool.setLimits(2, uint64(2))
+	pool.setDefaultFactors(priceFactors{1, 0, 1}, priceFactors{1, 0, 1})
+
+	if threshold := pool.activationThreshold(); threshold != math.MaxInt64 {
+		t.Fatalf("Empty pool threshold mismatch: have %d, want %d", threshold, int64(math.MaxInt64))
+	}
+	pool.addBalance(poolTestPeer(0).ID(), int64(time.Minute), "")
+	pool.addBalance(poolTestPeer(1).ID(), int64(time.Minute*2), "")
+	pool.connect(poolTestPeer(0), 0)
+	pool.connect(poolTestPeer(1), 0)
+
+	// The worst connected client has a minute of balance, a newcomer needs at least as much
+	want := ^int64(time.Minute)
+	if threshold := pool.activationThreshold(); threshold != want {
+		t.Fatalf("Full pool threshold mismatch: have %d, want %d", threshold, want)
+	}
+	pool.addBalance(poolTestPeer(2).ID(), int64(time.Minute-1), "")
+	if pool.connect(poolTestPeer(2), 0) {
+		t.Fatalf("Client below the threshold accepted")
+	}
+	if threshold := pool.activationThreshold(); threshold != want {
+		t.Fatalf("Threshold changed by rejected client: have %d, want %d", threshold, want)
+	}
+	pool.addBalance(poolTestPeer(3).ID(), int64(time.Minute), "")
+	if !pool.connect(poolTestPeer(3), 0) {
+		t.Fatalf("Client at the threshold rejected")
+	}
+	if _, ok := pool.connectedMap[poolTestPeer(0).ID()]; ok {
+		t.Fatalf("Worst client not evicted")
+	}
+}
+
+func TestTransferBalance(t *testing.T) {
+	var (
+		clock mclock.Simulated
+		db    = rawdb.NewMemoryDatabase()
+	)
+	pool := newClientPool(db, 1, &clock, func(id enode.ID) {})
+	defer pool.stop()
+	pool.setLimits(10, uint64(10))
+	pool.setDefaultFactors(priceFactors{0, 0, 1}, priceFactors{0, 0, 1})
+
+	// Transfers from clients without balance should fail
+	if _, err := pool.transferBalance(poolTestPeer(0).ID(), poolTestPeer(1).ID(), 0); err != errNoBalance {
+		t.Fatalf("Empty source error mismatch: have %v, want %v", err, errNoBalance)
+	}
+	// Partial and full transfers between disconnected clients
+	pool.addBalance(poolTestPeer(0).ID(), 1000, "")
+	if _, err := pool.transferBalance(poolTestPeer(0).ID(), poolTestPeer(1).ID(), 1001); err != errInsufficientBalance {
+		t.Fatalf("Overdraft error mismatch: have %v, want %v", err, errInsufficientBalance)
+	}
+	if moved, err := pool.transferBalance(poolTestPeer(0).ID(), poolTestPeer(1).ID(), 400); err != nil || moved != 400 {
+		t.Fatalf("Partial transfer failed: moved %d, err %v", moved, err)
+	}
+	if moved, err := pool.transferBalance(poolTestPeer(0).ID(), poolTestPeer(1).ID(), 0); err != nil || moved != 600 {
+		t.Fatalf("Full transfer failed: moved %d, err %v", moved, err)
+	}
+	if pb := pool.getPosBalance(poolTestPeer(0).ID()); pb.value != 0 {
+		t.Fatalf("Source balance mismatch: have %d, want 0", pb.value)
+	}
+	if pb := pool.getPosBalance(poolTestPeer(1).ID()); pb.value != 1000 {
+		t.Fatalf("Destination balance mismatch: have %d, want 1000", pb.value)
+	}
+	// Transferring to a connected free client should upgrade it
+	pool.connect(poolTestPeer(2), 0)
+	if _, err := pool.transferBalance(poolTestPeer(1).ID(), poolTestPeer(2).ID(), 500); err != nil {
+		t.Fatalf("Transfer to connected client failed: %v", err)
+	}
+	if c := pool.connectedMap[poolTestPeer(2).ID()]; !c.priority {
+		t.Fatalf("Connected destination not prioritized")
+	}
+}
+
+func TestTransferBalanceConcurrentCharges(t *testing.T) {
+	var (
+		clock mclock.Simulated
+		db    = rawdb.NewMemoryDatabase()
+	)
+	pool := newClientPool(db, 1, &clock, func(id enode.ID) {})
+	defer pool.stop()
+	pool.setLimits(10, uint64(10))
+	pool.setDefaultFactors(priceFactors{0, 0, 1}, priceFactors{0, 0, 1})
+
+	pool.addBalance(poolTestPeer(0).ID(), 1000000, "")
+	pool.connect(poolTestPeer(0), 0)
+	source := pool.connectedMap[poolTestPeer(0).ID()]
+
+	// Charge the connected source while moving its balance away piecemeal
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			source.balanceTracker.requestCost(10)
+		}
+		close(done)
+	}()
+	for i := 0; i < 50; i++ {
+		if _, err := pool.transferBalance(poolTestPeer(0).ID(), poolTestPeer(1).ID(), 100); err != nil {
+			t.Fatalf("Transfer %d failed: %v", i, err)
+		}
+	}
+	<-done
+
+	pool.disconnect(poolTestPeer(0))
+	src, dst := pool.getPosBalance(poolTestPeer(0).ID()), pool.getPosBalance(poolTestPeer(1).ID())
+	if dst.value != 5000 {
+		t.Fatalf("Destination balance mismatch: have %d, want 5000", dst.value)
+	}
+	if src.value != 1000000-5000-1000 {
+		t.Fatalf("Source balance mismatch: have %d, want %d", src.value, 1000000-5000-1000)
+	}
+}
+
+func TestFreeClientsPaused(t *testing.T) {
+	var (
+		clock  mclock.Simulated
+		db     = rawdb.NewMemoryDatabase()
+		lock   sync.Mutex
+		kicked = make(map[enode.ID]bool)
+	)
+	pool := newClientPool(db, 1, &clock, func(id enode.ID) {
+		lock.Lock()
+		kicked[id] = true
+		lock.Unlock()
+	})
+	isKicked := func(p poolTestPeer) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return kicked[p.ID()]
+	}
+	defer pool.stop()
+	pool.setLimits(10, uint64(10))
+	pool.setDefaultFactors(priceFactors{1, 0, 1}, priceFactors{1, 0, 1})
+
+	pool.addBalance(poolTestPeer(0).ID(), int64(time.Minute), "")
+	pool.connect(poolTestPeer(0), 4)
+	pool.connect(poolTestPeer(1), 0)
+	pool.connect(poolTestPeer(2), 0)
+
+	checkPriority := func() {
+		t.Helper()
+		c := pool.connectedMap[poolTestPeer(0).ID()]
+		if c == nil || c.capacity != 4 {
+			t.Fatalf("Priority client affected: %+v", c)
+		}
+	}
+	// Pausing should kick out all the free clients, but no priority ones
+	pool.setFreeClientsPaused(true)
+	if !pool.freeClientsPaused() {
+		t.Fatalf("Pause not reported")
+	}
+	if !isKicked(poolTestPeer(1)) || !isKicked(poolTestPeer(2)) || isKicked(poolTestPeer(0)) {
+		t.Fatalf("Kicked clients mismatch")
+	}
+	checkPriority()
+
+	// New free clients should be rejected, priority ones accepted
+	if pool.connect(poolTestPeer(3), 0) {
+		t.Fatalf("Free client accepted while paused")
+	}
+	pool.addBalance(poolTestPeer(4).ID(), int64(time.Second), "")
+	if !pool.connect(poolTestPeer(4), 2) {
+		t.Fatalf("Priority client rejected while paused")
+	}
+	checkPriority()
+
+	// Priority clients running out of balance should be dropped too
+	clock.Run(time.Second * 2)
+	time.Sleep(300 * time.Millisecond) // Ensure the callback is called
+	if !isKicked(poolTestPeer(4)) {
+		t.Fatalf("Exhausted priority client not dropped while paused")
+	}
+	checkPriority()
+
+	// Resuming should admit free clients again
+	pool.setFreeClientsPaused(false)
+	if !pool.connect(poolTestPeer(3), 0) {
+		t.Fatalf("Free client rejected after resume")
+	}
+	checkPriority()
+}
+
+func TestClientPoolBudgetAlert(t *testing.T) {
+	var (
+		clock  mclock.Simulated
+		db     = rawdb.NewMemoryDatabase()
+		alerts = make(chan float64, 10)
+	)
+	pool := newClientPool(db, 1, &clock, func(id enode.ID) {})
+	pool.setLimits(10, uint64(10))
+	pool.setDefaultFactors(priceFactors{1, 0, 1}, priceFactors{1, 0, 1})
+
+	// The pool can serve 10 clients for a minute, alert at half of it
+	pool.setBudgetAlert(0.5, time.Minute, func(total uint64, ratio float64) { alerts <- ratio })
+	expectAlert := func(expect bool) {
+		select {
+		case ratio := <-alerts:
+			if !expect {
+				t.Fatalf("Unexpected budget alert (ratio %f)", ratio)
+			}
+			if ratio < 0.5 {
+				t.Fatalf("Budget alert below threshold (ratio %f)", ratio)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if expect {
+				t.Fatalf("Budget alert not fired")
+			}
+		}
+	}
+	for i := 0; i < 4; i++ {
+		pool.addBalance(poolTestPeer(i).ID(), int64(time.Minute), "")
+	}
+	expectAlert(false)
+	if m := pool.metricsSnapshot(); m.StoredBalance != uint64(4*time.Minute) || m.BudgetRatio != 0.4 {
+		t.Fatalf("Budget metrics mismatch: have %d/%f, want %d/%f", m.StoredBalance, m.BudgetRatio, uint64(4*time.Minute), 0.4)
+	}
+	// Crossing the threshold should alert only once
+	pool.addBalance(poolTestPeer(4).ID(), int64(time.Minute), "")
+	expectAlert(true)
+	pool.addBalance(poolTestPeer(5).ID(), int64(time.Minute), "")
+	expectAlert(false)
+
+	// Transfers should not change the total, spending should rearm the alert
+	pool.transferBalance(poolTestPeer(5).ID(), poolTestPeer(6).ID(), 0)
+	expectAlert(false)
+	pool.addBalance(poolTestPeer(4).ID(), -int64(time.Minute), "")
+	pool.addBalance(poolTestPeer(6).ID(), -int64(time.Minute), "")
+	expectAlert(false)
+	if m := pool.metricsSnapshot(); m.StoredBalance != uint64(4*time.Minute) {
+		t.Fatalf("Stored balance mismatch: have %d, want %d", m.StoredBalance, uint64(4*time.Minute))
+	}
+	pool.connect(poolTestPeer(0), 1)
+	clock.Run(time.Minute / 2)
+	pool.disconnect(poolTestPeer(0))
+	pool.addBalance(poolTestPeer(7).ID(), int64(time.Minute), "")
+	expectAlert(false)
+	pool.addBalance(poolTestPeer(8).ID(), int64(time.Minute), "")
+	expectAlert(true)
+	pool.stop()
+
+	// The total should be restored after a restart
+	pool = newClientPool(db, 1, &clock, func(id enode.ID) {})
+	defer pool.stop()
+	if m := pool.metricsSnapshot(); m.StoredBalance != uint64(11*time.Minute/2) {
+		t.Fatalf("Restored balance mismatch: have %d, want %d", m.StoredBalance, uint64(11*time.Minute/2))
+	}
+}
+
+func TestClientPoolWarmUp(t *testing.T) {
+	// stormChurn simulates the clients reconnecting after a server restart and
+	// returns the number of activations and kicks during the first two minutes.
+	stormChurn := func(warmUp time.Duration) int {
+		var (
+			clock     mclock.Simulated
+			rnd       = rand.New(rand.NewSource(1))
+			db        = rawdb.NewMemoryDatabase()
+			kicked    = make(chan int, 100)
+			connected = make(map[int]bool)
+			churn     int
+		)
+		pool := newClientPool(db, 1, &clock, func(id enode.ID) { kicked <- int(id[0]) + int(id[1])<<8 })
+		defer pool.stop()
+		pool.setLimits(10, uint64(10))
+		pool.setDefaultFactors(priceFactors{1, 0, 1}, priceFactors{1, 0, 1})
+		pool.setWarmUp(warmUp)
+
+		for i := 0; i < 20; i++ {
+			pool.addBalance(poolTestPeer(i).ID(), int64(time.Minute)+rnd.Int63n(int64(time.Minute*10)), "")
+		}
+		for clock.Now() < mclock.AbsTime(time.Minute*2) {
+			if warm := pool.metricsSnapshot().WarmUp; warm != (warmUp != 0) {
+				t.Fatalf("Warm-up flag mismatch at %v: have %v, want %v", time.Duration(clock.Now()), warm, warmUp != 0)
+			}
+			for _, i := range rnd.Perm(30) {
+				if !connected[i] && pool.connect(poolTestPeer(i), 1) {
+					connected[i] = true
+					churn++
+				}
+			drain:
+				for {
+					select {
+					case k := <-kicked:
+						pool.disconnect(poolTestPeer(k))
+						delete(connected, k)
+						churn++
+					default:
+						break drain
+					}
+				}
+			}
+			clock.Run(time.Second * 5)
+		}
+		if pool.metricsSnapshot().WarmUp {
+			t.Fatalf("Warm-up still active after its period")
+		}
+		return churn
+	}
+	plain, warm := stormChurn(0), stormChurn(defaultWarmUp)
+	if warm >= plain {
+		t.Fatalf("Warm-up did not reduce churn: have %d, without warm-up %d", warm, plain)
+	}
+}
+
+type addrTestPeer struct {
+	poolTestPeer
+
+	addr string
+}
+
+func (p addrTestPeer) freeClientId() string { return p.addr }
+
+func TestClientPoolDualIdentification(t *testing.T) {
+	var (
+		clock mclock.Simulated
+		db    = rawdb.NewMemoryDatabase()
+	)
+	newPool := func(mode freeIDMode) *clientPool {
+		pool := newClientPool(db, 1, &clock, func(id enode.ID) {})
+		pool.setLimits(20, uint64(20))
+		pool.setDefaultFactors(priceFactors{1, 0, 1}, priceFactors{1, 0, 1})
+		pool.setFreeIDMode(mode, 8)
+		return pool
+	}
+	// startNeg connects the peer and returns the negative balance it starts with
+	startNeg := func(pool *clientPool, p addrTestPeer) time.Duration {
+		if !pool.connect(p, 0) {
+			t.Fatalf("Peer %v rejected", p)
+		}
+		_, neg := pool.connectedMap[p.ID()].balanceTracker.getBalance(clock.Now())
+		return time.Duration(neg)
+	}
+	near := func(have, want time.Duration) bool {
+		return have > want-want/100 && have < want+want/100
+	}
+	// Accumulate an hour of negative balance behind an address in legacy mode
+	pool := newPool(freeIDAddress)
+	pool.connect(addrTestPeer{0, "cgnat"}, 0)
+	clock.Run(time.Hour)
+	pool.disconnect(addrTestPeer{0, "cgnat"})
+
+	// CGNAT: another client behind the same address inherits the whole balance
+	if neg := startNeg(pool, addrTestPeer{1, "cgnat"}); !near(neg, time.Hour) {
+		t.Fatalf("Address mode balance mismatch: have %v, want %v", neg, time.Hour)
+	}
+	pool.disconnect(addrTestPeer{1, "cgnat"})
+
+	// Sybil: the same client from a new address starts from scratch
+	if neg := startNeg(pool, addrTestPeer{0, "fresh"}); neg != 0 {
+		t.Fatalf("Address mode balance on new address: have %v, want 0", neg)
+	}
+	pool.disconnect(addrTestPeer{0, "fresh"})
+	pool.stop()
+
+	// Restart in dual mode, the legacy address record should be honoured but
+	// only a share of it is charged to an innocent client behind the address
+	pool = newPool(freeIDDual)
+	defer pool.stop()
+	if neg := startNeg(pool, addrTestPeer{2, "cgnat"}); !near(neg, time.Hour/8) {
+		t.Fatalf("Dual mode share mismatch: have %v, want %v", neg, time.Hour/8)
+	}
+	pool.disconnect(addrTestPeer{2, "cgnat"})
+
+	// Accumulate an hour of balance on a node ID, then hop addresses
+	pool.connect(addrTestPeer{3, "first"}, 0)
+	clock.Run(time.Hour)
+	pool.disconnect(addrTestPeer{3, "first"})
+	if neg := startNeg(pool, addrTestPeer{3, "second"}); !near(neg, time.Hour) {
+		t.Fatalf("Dual mode balance after address change: have %v, want %v", neg, time.Hour)
+	}
+	pool.disconnect(addrTestPeer{3, "second"})
+
+	// The address record accumulates the usage of all clients behind it
+	for i := 4; i < 8; i++ {
+		pool.connect(addrTestPeer{poolTestPeer(i), "busy"}, 0)
+	}
+	clock.Run(time.Hour)
+	for i := 4; i < 8; i++ {
+		pool.disconnect(addrTestPeer{poolTestPeer(i), "busy"})
+	}
+	if neg := startNeg(pool, addrTestPeer{8, "busy"}); !near(neg, time.Hour/2) {
+		t.Fatalf("Dual mode accumulated share mismatch: have %v, want %v", neg, time.Hour/2)
+	}
+	pool.disconnect(addrTestPeer{8, "busy"})
+}
+
+func TestClientPoolAddressLimit(t *testing.T) {
+	var clock mclock.Simulated
+	pool := newClientPool(rawdb.NewMemoryDatabase(), 1, &clock, func(id enode.ID) {})
+	defer pool.stop()
+	pool.setLimits(20, uint64(20))
+	pool.setDefaultFactors(priceFactors{1, 0, 1}, priceFactors{1, 0, 1})
+	pool.setFreeIDMode(freeIDDual, 4)
+
+	for i := 0; i < 4; i++ {
+		if !pool.connect(addrTestPeer{poolTestPeer(i), "shared"}, 0) {
+			t.Fatalf("Peer %d rejected below the address limit", i)
+		}
+	}
+	if pool.connect(addrTestPeer{4, "shared"}, 0) {
+		t.Fatalf("Peer accepted above the address limit")
+	}
+	if !pool.connect(addrTestPeer{5, "other"}, 0) {
+		t.Fatalf("Peer from another address rejected")
+	}
+	// Priority clients are not limited and don't occupy free slots
+	pool.addBalance(poolTestPeer(6).ID(), int64(time.Hour), "")
+	if !pool.connect(addrTestPeer{6, "shared"}, 0) {
+		t.Fatalf("Priority peer rejected by the address limit")
+	}
+	pool.disconnect(addrTestPeer{0, "shared"})
+	if !pool.connect(addrTestPeer{4, "shared"}, 0) {
+		t.Fatalf("Peer rejected after a slot was freed")
+	}
+	if n := pool.addrConns["shared"]; n != 4 {
+		t.Fatalf("Free client count mismatch: have %d, want 4", n)
+	}
+	// A priority client running out of balance mustn't exceed the limit either
+	var kicked []enode.ID
+	pool.removePeer = func(id enode.ID) { kicked = append(kicked, id) }
+	pool.balanceExhausted(poolTestPeer(6).ID())
+	if len(kicked) != 1 || kicked[0] != poolTestPeer(6).ID() {
+		t.Fatalf("Exhausted client over the address limit not kicked: %v", kicked)
+	}
+	if n := pool.addrConns["shared"]; n != 4 {
+		t.Fatalf("Free client count mismatch after exhaustion: have %d, want 4", n)
+	}
+}
+
+func TestNegativeBalanceDecayAcrossCrash(t *testing.T) {
+	var (
+		clock mclock.Simulated
+		db    = rawdb.NewMemoryDatabase()
+		addr  = poolTestPeer(0).freeClientId()
+	)
+	pool := newClientPool(db, 1, &clock, func(id enode.ID) {})
+	pool.setLimits(10, uint64(10))
+	pool.setDefaultFactors(priceFactors{1, 0, 1}, priceFactors{1, 0, 1})
+
+	pool.connect(poolTestPeer(0), 0)
+	clock.Run(time.Hour)
+	pool.disconnect(poolTestPeer(0))
+
+	// The balance of the disconnected client should keep decaying
+	balance := func(pool *clientPool, now mclock.AbsTime) uint64 {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		return pool.decodeNegBalance(pool.ndb.getOrNewNB(addr), now)
+	}
+	last := balance(pool, clock.Now())
+	for i := 0; i < 6; i++ {
+		// The persistence timer fires synchronously on the simulated clock
+		clock.Run(persistCumulativeTimeRefresh)
+		if have, want := pool.ndb.getCumulativeTime(), pool.logOffset(clock.Now()); have != want {
+			t.Fatalf("Running time not persisted at %v: have %v, want %v", time.Duration(clock.Now()), have, want)
+		}
+		if b := balance(pool, clock.Now()); b > last {
+			t.Fatalf("Negative balance increased at %v: have %v, previously %v", time.Duration(clock.Now()), b, last)
+		} else {
+			last = b
+		}
+	}
+	// Restart without stopping the pool, as if it crashed. The balance may only
+	// be off by the decay of a single persistence period.
+	var restarted mclock.Simulated
+	pool = newClientPool(db, 1, &restarted, func(id enode.ID) {})
+	defer pool.stop()
+
+	b := balance(pool, restarted.Now())
+	if b < last {
+		t.Fatalf("Negative balance decayed across crash: have %v, before %v", b, last)
+	}
+	if limit := float64(last) * math.Exp(float64(persistCumulativeTimeRefresh)/float64(negBalanceExpTC)); float64(b) > limit*1.001 {
+		t.Fatalf("Negative balance jumped across crash: have %v, before %v, limit %v", b, last, uint64(limit))
+	}
+}
+
+func TestConnectedSnapshotClockSkew(t *testing.T) {
+	var (
+		clock mclock.Simulated
+		db    = rawdb.NewMemoryDatabase()
+	)
+	// Persist a snapshot dated in the future, as if the wall clock moved back
+	ndb := newNodeDB(db, &clock)
+	ndb.setActiveSnapshot(&activeSnapshot{
+		Time:    uint64(time.Now().Add(time.Hour).Unix()),
+		Clients: []activeSnapshotEntry{{ID: poolTestPeer(0).ID(), Capacity: 5}},
+	})
+	ndb.close()
+
+	pool := newClientPool(db, 1, &clock, func(id enode.ID) {})
+	defer pool.stop()
+	pool.setLimits(10, uint64(10))
+	pool.addBalance(poolTestPeer(0).ID(), int64(time.Hour), "")
+
+	p0 := &poolTestPeerWithCap{poolTestPeer: poolTestPeer(0)}
+	if !pool.connect(p0, 0) {
+		t.Fatalf("Failed to reconnect client")
+	}
+	if p0.cap != 5 {
+		t.Fatalf("Capacity not restored from skewed snapshot: have %d, want 5", p0.cap)
+	}
+}
+
+// Tests that the connected set snapshot is dated by the pool clock, so a pool
+// running on a simulated clock ages its snapshots accordingly.
+func TestConnectedSnapshotPoolClock(t *testing.T) {
+	var (
+		clock mclock.Simulated
+		db    = rawdb.NewMemoryDatabase()
+	)
+	pool := newClientPool(db, 1, &clock, func(id enode.ID) {})
+	pool.setLimits(10, uint64(10))
+
+	start := time.Now()
+	clock.Run(time.Hour)
+	pool.saveSnapshot()
+	pool.stop()
+
+	snap := pool.ndb.getActiveSnapshot()
+	if snap == nil {
+		t.Fatalf("Connected client snapshot not saved")
+	}
+	if age := time.Unix(int64(snap.Time), 0).Sub(start); age < time.Hour-time.Second || age > time.Hour+time.Minute {
+		t.Fatalf("Snapshot not dated by the pool clock: %v after start, want %v", age, time.Hour)
+	}
+}
+
+// Tests that the capacity updates sent to the clients carry the reason of the
+// change.
+func TestClientPoolCapacityReason(t *testing.T) {
+	var (
+		clock mclock.Simulated
+		db    = rawdb.NewMemoryDatabase()
+	)
+	pool := newClientPool(db, 1, &clock, func(id enode.ID) {})
+	defer pool.stop()
+	pool.setLimits(10, uint64(10))
+	pool.setDefaultFactors(priceFactors{1, 0, 1}, priceFactors{1, 0, 1})
+
+	p := &poolTestPeerWithCap{poolTestPeer: poolTestPeer(0)}
+	pool.addBalance(p.ID(), int64(time.Minute), "")
+	pool.connect(p, 5)
+	if p.cap != 5 || p.reason != capReasonInitial {
+		t.Fatalf("Initial capacity update mismatch: have %d (%v), want %d (%v)", p.cap, p.reason, 5, capReasonInitial)
+	}
+	err := pool.forClients([]enode.ID{p.ID()}, func(c *clientInfo, id enode.ID) error {
+		return pool.setCapacity(c, 3)
+	})
+	if err != nil {
+		t.Fatalf("Failed to set capacity: %v", err)
+	}
+	if p.cap != 3 || p.reason != capReasonOperator {
+		t.Fatalf("Operator capacity update mismatch: have %d (%v), want %d (%v)", p.cap, p.reason, 3, capReasonOperator)
+	}
+	clock.Run(time.Minute)             // All positive balance should be used up.
+	time.Sleep(300 * time.Millisecond) // Ensure the callback is called
+	if p.cap != 1 || p.reason != capReasonBalanceExhausted {
+		t.Fatalf("Downgrade capacity update mismatch: have %d (%v), want %d (%v)", p.cap, p.reason, 1, capReasonBalanceExhausted)
+	}
+}
+
+func TestClientPoolServiceQuality(t *testing.T) {
+	var (
+		clock mclock.Simulated
+		db    = rawdb.NewMemoryDatabase()
+	)
+	pool := newClientPool(db, 1, &clock, func(id enode.ID) {})
+	defer pool.stop()
+	pool.setLimits(10, uint64(5))
+	pool.setDefaultFactors(priceFactors{1, 0, 1}, priceFactors{1, 0, 1})
+	pool.setServiceQualityTarget(0.9)
+
+	setCapacity := func(id enode.ID, capacity uint64) error {
+		return pool.forClients([]enode.ID{id}, func(c *clientInfo, id enode.ID) error {
+			return pool.setCapacity(c, capacity)
+		})
+	}
+	report := func(class, window string) ServiceQuality {
+		for _, q := range pool.serviceQuality() {
+			if q.Class == class && q.Window == window {
+				return q
+			}
+		}
+		t.Fatalf("Missing %s service quality over %s", class, window)
+		return ServiceQuality{}
+	}
+	expect := func(class, window string, full, reduced float64, clientTime time.Duration) {
+		t.Helper()
+		q := report(class, window)
+		if math.Abs(q.Full-full) > 1e-9 || math.Abs(q.Reduced-reduced) > 1e-9 || q.Inactive != 0 || q.ClientTime != clientTime.Seconds() {
+			t.Fatalf("%s service quality over %s mismatch: have %+v, want full %f, reduced %f, client time %v", class, window, q, full, reduced, clientTime)
+		}
+	}
+	// Two priority clients and a free one fill the pool
+	pool.addBalance(poolTestPeer(0).ID(), int64(1000*time.Hour), "")
+	pool.addBalance(poolTestPeer(1).ID(), int64(2000*time.Hour), "")
+	pool.connect(poolTestPeer(0), 2)
+	pool.connect(poolTestPeer(1), 2)
+	pool.connect(poolTestPeer(2), 0)
+
+	// The first priority client asks for more capacity than what can be freed up
+	// for it, so it's running at a reduced capacity for 15 minutes
+	clock.Run(30 * time.Minute)
+	if err := setCapacity(poolTestPeer(0).ID(), 4); err != errNoPriority {
+		t.Fatalf("Capacity increase not refused: %v", err)
+	}
+	clock.Run(15 * time.Minute)
+	if err := setCapacity(poolTestPeer(0).ID(), 2); err != nil {
+		t.Fatalf("Failed to reset capacity: %v", err)
+	}
+	if !pool.quality.alerted {
+		t.Fatalf("Service quality alert not fired")
+	}
+	clock.Run(15 * time.Minute)
+
+	expect("priority", "1h", 105.0/120, 15.0/120, 120*time.Minute)
+	expect("priority", "24h", 105.0/120, 15.0/120, 120*time.Minute)
+	expect("priority", "5m", 1, 0, 10*time.Minute)
+	expect("free", "1h", 1, 0, time.Hour)
+
+	if m := pool.metricsSnapshot(); len(m.Quality) != qualityClasses*len(qualityWindows) {
+		t.Fatalf("Service quality missing from the metrics snapshot: %+v", m.Quality)
+	}
+	// Lowering the target below the measured quality should clear the alert
+	pool.setServiceQualityTarget(0.8)
+	if pool.quality.alerted {
+		t.Fatalf("Service quality alert not cleared")
+	}
+	// Disconnected clients should not be accounted any more, and the reduced
+	// service should fall out of the windows after a day. The day window covers
+	// 24h12m (the partial current bucket) including the last 12 minutes of the
+	// disconnected client.
+	pool.disconnect(poolTestPeer(1))
+	pool.disconnect(poolTestPeer(2))
+	clock.Run(24 * time.Hour)
+
+	expect("priority", "1h", 1, 0, time.Hour)
+	expect("priority", "24h", 1, 0, 24*time.Hour+24*time.Minute)
+	expect("free", "1h", 1, 0, 0)
+}
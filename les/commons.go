@@ -137,6 +137,13 @@ func (c *lesCommons) latestLocalCheckpoint() params.TrustedCheckpoint {
 // The returned checkpoint is only the checkpoint generated by the local indexers,
 // not the stable checkpoint registered in the registrar contract.
 func (c *lesCommons) localCheckpoint(index uint64) params.TrustedCheckpoint {
+	// Don't assemble checkpoints from sections not (yet) processed by both of the
+	// indexers, e.g. ones being reprocessed after a manual rollback.
+	sections, _, _ := c.chtIndexer.Sections()
+	sections2, _, _ := c.bloomTrieIndexer.Sections()
+	if index >= sections || index >= sections2 {
+		return params.TrustedCheckpoint{}
+	}
 	sectionHead := c.chtIndexer.SectionHead(index)
 	return params.TrustedCheckpoint{
 		SectionIndex: index,
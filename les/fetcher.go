@@ -247,8 +247,10 @@ func (f *lightFetcher) unregisterPeer(p *serverPeer) {
 }
 
 // announce processes a new announcement message received from a peer, adding new
-// nodes to the peer's block tree and removing old nodes if necessary
-func (f *lightFetcher) announce(p *serverPeer, head *announceData) {
+// nodes to the peer's block tree and removing old nodes if necessary. If the peer
+// flagged the announcement as a deep reorg, the tree is discarded and a resync is
+// triggered, which revalidates the headers from the common ancestor onwards.
+func (f *lightFetcher) announce(p *serverPeer, head *announceData, deepReorg bool) {
 	f.lock.Lock()
 	defer f.lock.Unlock()
 	p.Log().Debug("Received new announcement", "number", head.Number, "hash", head.Hash, "reorg", head.ReorgDepth)
@@ -266,6 +268,10 @@ func (f *lightFetcher) announce(p *serverPeer, head *announceData) {
 		return
 	}
 
+	if deepReorg {
+		p.Log().Warn("Deep chain reorg announced", "number", head.Number, "hash", head.Hash, "depth", head.ReorgDepth)
+		deepReorgReceivedMeter.Mark(1)
+	}
 	n := fp.lastAnnounced
 	for i := uint64(0); i < head.ReorgDepth; i++ {
 		if n == nil {
@@ -274,9 +280,10 @@ func (f *lightFetcher) announce(p *serverPeer, head *announceData) {
 		n = n.parent
 	}
 	// n is now the reorg common ancestor, add a new branch of nodes
-	if n != nil && (head.Number >= n.number+maxNodeCount || head.Number <= n.number) {
+	if n != nil && (deepReorg || head.Number >= n.number+maxNodeCount || head.Number <= n.number) {
 		// if announced head block height is lower or same as n or too far from it to add
-		// intermediate nodes then discard previous announcement info and trigger a resync
+		// intermediate nodes, or the reorg was flagged too deep to follow, then discard
+		// previous announcement info and trigger a resync
 		n = nil
 		fp.nodeCnt = 0
 		fp.nodeByHash = make(map[common.Hash]*fetcherTreeNode)
@@ -17,9 +17,11 @@
 package les
 
 import (
+	"context"
 	"encoding/binary"
 	"math/big"
 	"math/rand"
+	"reflect"
 	"testing"
 	"time"
 
@@ -640,3 +642,181 @@ func TestStopResumeLes3(t *testing.T) {
 		}
 	}
 }
+
+// Tests that the checkpoint API serves valid CHT proofs and enforces its limits.
+func TestCheckpointAPIChtProof(t *testing.T) {
+	config := light.TestServerIndexerConfig
+
+	waitIndexers := func(cIndexer, bIndexer, btIndexer *core.ChainIndexer) {
+		for {
+			cs, _, _ := cIndexer.Sections()
+			if cs >= 1 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	server, tearDown := newServerEnv(t, int(config.ChtSize+config.ChtConfirms), 3, waitIndexers, false, false, 0)
+	defer tearDown()
+
+	api := NewPublicCheckpointAPI(server.handler.server)
+	header := server.handler.blockchain.GetHeaderByNumber(config.ChtSize - 1)
+
+	ctx := context.Background()
+	result, err := api.GetChtProof(ctx, header.Number.Uint64())
+	if err != nil {
+		t.Fatalf("Failed to retrieve CHT proof: %v", err)
+	}
+	if want := light.GetChtRoot(server.db, 0, header.Hash()); result.Root != want {
+		t.Fatalf("CHT root mismatch: have %x, want %x", result.Root, want)
+	}
+	proof := light.NewNodeSet()
+	for _, node := range result.Proof {
+		proof.Put(crypto.Keccak256(node), node)
+	}
+	value, err := trie.VerifyProof(result.Root, result.Key, proof)
+	if err != nil {
+		t.Fatalf("Failed to verify CHT proof: %v", err)
+	}
+	var node light.ChtNode
+	if err := rlp.DecodeBytes(value, &node); err != nil {
+		t.Fatalf("Failed to decode CHT node: %v", err)
+	}
+	if node.Hash != header.Hash() {
+		t.Fatalf("Proven hash mismatch: have %x, want %x", node.Hash, header.Hash())
+	}
+	// Sections not yet indexed should be rejected
+	if _, err := api.GetChtProof(ctx, config.ChtSize*2); err != errHelperTrieMissing {
+		t.Fatalf("Unindexed section error mismatch: have %v, want %v", err, errHelperTrieMissing)
+	}
+	// Exhausting the rate limit of a caller should reject its further requests,
+	// but not the ones of other callers
+	var (
+		busy  = context.WithValue(ctx, "remote", "10.0.0.1:30303")
+		other = context.WithValue(ctx, "remote", "10.0.0.2:30303")
+	)
+	for err == nil {
+		_, err = api.GetChtProof(busy, header.Number.Uint64())
+	}
+	if err != errRateLimited {
+		t.Fatalf("Rate limit error mismatch: have %v, want %v", err, errRateLimited)
+	}
+	if _, err := api.GetChtProof(context.WithValue(ctx, "remote", "10.0.0.1:30304"), header.Number.Uint64()); err != errRateLimited {
+		t.Fatalf("Rate limit of a new connection from the same host mismatch: have %v, want %v", err, errRateLimited)
+	}
+	if _, err := api.GetChtProof(other, header.Number.Uint64()); err != nil {
+		t.Fatalf("Other caller starved by the busy one: %v", err)
+	}
+}
+
+func TestReprocessSection(t *testing.T) {
+	config := light.TestServerIndexerConfig
+
+	waitIndexers := func(cIndexer, bIndexer, btIndexer *core.ChainIndexer) {
+		for {
+			cs, _, _ := cIndexer.Sections()
+			bts, _, _ := btIndexer.Sections()
+			if cs >= 2 && bts >= 2 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	server, tearDown := newServerEnv(t, int(2*config.ChtSize+config.ChtConfirms), 3, waitIndexers, false, false, 0)
+	defer tearDown()
+
+	api := NewPrivateLightServerAPI(server.handler.server)
+	original := api.IndexerStatus()
+	for kind, status := range original {
+		if status.Sections != 2 || status.Root == (common.Hash{}) {
+			t.Fatalf("%s indexer status mismatch: %+v", kind, status)
+		}
+	}
+	checkpoint := server.handler.server.localCheckpoint(1)
+	if checkpoint.Empty() {
+		t.Fatalf("Local checkpoint missing")
+	}
+	if err := api.ReprocessSection("cht", 2); err == nil {
+		t.Fatalf("Rollback of unprocessed section succeeded")
+	}
+	if err := api.ReprocessSection("unknown", 0); err == nil {
+		t.Fatalf("Rollback of unknown indexer succeeded")
+	}
+	// Roll back both indexers and wait until they regenerate the same tries
+	if err := api.ReprocessSection("cht", 1); err != nil {
+		t.Fatalf("Failed to roll back CHT indexer: %v", err)
+	}
+	if err := api.ReprocessSection("bloomtrie", 0); err != nil {
+		t.Fatalf("Failed to roll back bloom trie indexer: %v", err)
+	}
+	if cp := server.handler.server.localCheckpoint(1); !cp.Empty() && cp != checkpoint {
+		t.Fatalf("Checkpoint served from a reprocessed section: %+v", cp)
+	}
+	// Reprocessing runs on the indexers' own goroutines, which may be slow to
+	// be scheduled on a loaded machine. Only give up after a generous deadline.
+	for deadline := time.Now().Add(time.Minute); ; {
+		status := api.IndexerStatus()
+		if status["cht"].Sections == 2 && status["bloomtrie"].Sections == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Indexers did not catch up: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := api.IndexerStatus(); !reflect.DeepEqual(status, original) {
+		t.Fatalf("Indexer status mismatch after reprocessing: have %+v, want %+v", status, original)
+	}
+	if cp := server.handler.server.localCheckpoint(1); cp != checkpoint {
+		t.Fatalf("Checkpoint mismatch after reprocessing: have %+v, want %+v", cp, checkpoint)
+	}
+}
+
+// Tests that reorgs deeper than the configured threshold are flagged in the
+// announcements, but only towards les/3 clients.
+func TestDeepReorgAnnounceLes2(t *testing.T) { testDeepReorgAnnounce(t, 2) }
+func TestDeepReorgAnnounceLes3(t *testing.T) { testDeepReorgAnnounce(t, 3) }
+
+func testDeepReorgAnnounce(t *testing.T, protocol int) {
+	server, tearDown := newServerEnv(t, 199, protocol, nil, false, true, 0)
+	defer tearDown()
+
+	server.handler.server.config.LightDeepReorg = 100
+
+	expect := func(head *types.Block, depth uint64, deep bool) {
+		t.Helper()
+
+		msg, err := server.peer.app.ReadMsg()
+		if err != nil {
+			t.Fatalf("Failed to read announcement: %v", err)
+		}
+		if msg.Code != AnnounceMsg {
+			t.Fatalf("Message code mismatch: have %d, want %d", msg.Code, AnnounceMsg)
+		}
+		var announce announceData
+		if err := msg.Decode(&announce); err != nil {
+			t.Fatalf("Failed to decode announcement: %v", err)
+		}
+		if announce.Hash != head.Hash() || announce.Number != head.NumberU64() {
+			t.Fatalf("Announced head mismatch: have #%d [%x], want #%d [%x]", announce.Number, announce.Hash, head.NumberU64(), head.Hash())
+		}
+		if announce.ReorgDepth != depth {
+			t.Fatalf("Reorg depth mismatch: have %d, want %d", announce.ReorgDepth, depth)
+		}
+		update, _ := announce.Update.decode()
+		if flagged := update.get("deepReorg", nil) == nil; flagged != deep {
+			t.Fatalf("Deep reorg flag mismatch: have %v, want %v", flagged, deep)
+		}
+	}
+	chain := server.handler.blockchain
+
+	// The first head is announced without any reorg
+	server.backend.Commit()
+	expect(chain.CurrentBlock(), 0, false)
+
+	// Reorgs within the threshold should never be flagged
+	expect(forkChain(t, chain, server.db, 190, 12), 10, false)
+
+	// Deeper reorgs should only be flagged for the clients understanding it
+	expect(forkChain(t, chain, server.db, 2, 203), 200, protocol >= lpv3)
+}
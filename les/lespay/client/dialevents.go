@@ -0,0 +1,92 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// Dial event types
+const (
+	DialEventSelected     = "selected"     // Node chosen by weighted random selection
+	DialEventQuery        = "query"        // Pre-negotiation query sent
+	DialEventQuerySkipped = "querySkipped" // Pre-negotiation skipped because UDP queries keep failing
+	DialEventOverBudget   = "overBudget"   // Pre-negotiation skipped because the query budget is exhausted
+	DialEventCanDial      = "canDial"      // Pre-negotiation confirmed that a connection is possible
+	DialEventRefused      = "refused"      // Pre-negotiation refused the connection
+	DialEventTimeout      = "timeout"      // Pre-negotiation query timed out
+	DialEventDialed       = "dialed"       // Node handed over for dialing
+)
+
+// DialEvent is a debug event describing a decision made while selecting dial
+// candidates.
+type DialEvent struct {
+	Type   string   `json:"type"`
+	Node   enode.ID `json:"node"`
+	Weight uint64   `json:"weight,omitempty"` // Selection weight, for selected events only
+}
+
+// DialEventFeed delivers dial events to its subscribers. Unlike event.Feed it
+// never blocks the sender: events are dropped and counted if a subscriber is not
+// ready to receive them. The zero value is ready to use.
+type DialEventFeed struct {
+	lock    sync.Mutex
+	subs    map[chan<- DialEvent]struct{}
+	dropped uint64
+}
+
+// Subscribe adds a channel to the feed. The channel should be buffered, events
+// not fitting into it are dropped.
+func (f *DialEventFeed) Subscribe(ch chan<- DialEvent) event.Subscription {
+	f.lock.Lock()
+	if f.subs == nil {
+		f.subs = make(map[chan<- DialEvent]struct{})
+	}
+	f.subs[ch] = struct{}{}
+	f.lock.Unlock()
+
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		<-quit
+		f.lock.Lock()
+		delete(f.subs, ch)
+		f.lock.Unlock()
+		return nil
+	})
+}
+
+// Send delivers an event to all subscribers that are ready to receive it.
+func (f *DialEventFeed) Send(ev DialEvent) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for ch := range f.subs {
+		select {
+		case ch <- ev:
+		default:
+			atomic.AddUint64(&f.dropped, 1)
+		}
+	}
+}
+
+// Dropped returns the number of events dropped because of slow subscribers.
+func (f *DialEventFeed) Dropped() uint64 {
+	return atomic.LoadUint64(&f.dropped)
+}
@@ -159,6 +159,15 @@ func (rt ResponseTimeStats) Value(weights ResponseTimeWeights, expFactor utils.E
 	return expFactor.Value(v, rt.exp) / weightScaleFactor
 }
 
+// Weight returns the total weight of the response times added to the distribution.
+func (rt ResponseTimeStats) Weight(expFactor utils.ExpirationFactor) float64 {
+	var sum uint64
+	for _, v := range rt.stats {
+		sum += v
+	}
+	return expFactor.Value(float64(sum), rt.exp) / weightScaleFactor
+}
+
 // AddStats adds the given ResponseTimeStats to the current one.
 func (rt *ResponseTimeStats) AddStats(s *ResponseTimeStats) {
 	rt.setExp(s.exp)
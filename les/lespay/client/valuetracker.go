@@ -33,7 +33,7 @@ import (
 
 const (
 	vtVersion  = 1 // database encoding format for ValueTracker
-	nvtVersion = 1 // database encoding format for NodeValueTracker
+	nvtVersion = 2 // database encoding format for NodeValueTracker
 )
 
 var (
@@ -46,6 +46,7 @@ type NodeValueTracker struct {
 	lock sync.Mutex
 
 	rtStats, lastRtStats ResponseTimeStats
+	latStats             []ResponseTimeStats // unweighted response times per request type
 	lastTransfer         mclock.AbsTime
 	basket               serverBasket
 	reqCosts             []uint64
@@ -61,6 +62,9 @@ func (nv *NodeValueTracker) init(now mclock.AbsTime, reqValues *[]float64) {
 	nv.lastTransfer = now
 	nv.reqValues = reqValues
 	nv.basket.init(reqTypeCount)
+	if len(nv.latStats) != reqTypeCount {
+		nv.latStats = make([]ResponseTimeStats, reqTypeCount)
+	}
 }
 
 // updateCosts updates the request cost table of the server. The request value factor
@@ -105,6 +109,31 @@ func (nv *NodeValueTracker) RtStats() ResponseTimeStats {
 	return nv.rtStats
 }
 
+// LatencyStats returns the distribution of the node's response times to the given
+// request type. Unlike RtStats, each response is counted with the same weight.
+func (nv *NodeValueTracker) LatencyStats(reqType uint32) ResponseTimeStats {
+	nv.lock.Lock()
+	defer nv.lock.Unlock()
+
+	if int(reqType) >= len(nv.latStats) {
+		return ResponseTimeStats{}
+	}
+	return nv.latStats[reqType]
+}
+
+// TotalLatencyStats returns the distribution of the node's response times to any
+// request type.
+func (nv *NodeValueTracker) TotalLatencyStats() ResponseTimeStats {
+	nv.lock.Lock()
+	defer nv.lock.Unlock()
+
+	var stats ResponseTimeStats
+	for i := range nv.latStats {
+		stats.AddStats(&nv.latStats[i])
+	}
+	return stats
+}
+
 // ValueTracker coordinates service value calculation for individual servers and updates
 // global statistics
 type ValueTracker struct {
@@ -142,6 +171,13 @@ type nodeValueTrackerEncV1 struct {
 	ServerBasket        requestBasket
 }
 
+type nodeValueTrackerEncV2 struct {
+	RtStats             ResponseTimeStats
+	ServerBasketMapping uint
+	ServerBasket        requestBasket
+	LatStats            []ResponseTimeStats
+}
+
 // RequestInfo is an initializer structure for the service vector.
 type RequestInfo struct {
 	// Name identifies the request type and is used for re-mapping the service vector if necessary
@@ -375,19 +411,31 @@ func (vt *ValueTracker) loadOrNewNode(id enode.ID) *NodeValueTracker {
 		log.Error("Failed to decode node value tracker", "id", id, "err", err)
 		return nv
 	}
-	if version != nvtVersion {
+	var nve nodeValueTrackerEncV2
+	switch version {
+	case 1:
+		var nve1 nodeValueTrackerEncV1
+		if err := rlp.Decode(r, &nve1); err != nil {
+			log.Error("Failed to decode node value tracker", "id", id, "err", err)
+			return nv
+		}
+		nve.RtStats, nve.ServerBasketMapping, nve.ServerBasket = nve1.RtStats, nve1.ServerBasketMapping, nve1.ServerBasket
+	case nvtVersion:
+		if err := rlp.Decode(r, &nve); err != nil {
+			log.Error("Failed to decode node value tracker", "id", id, "err", err)
+			return nv
+		}
+	default:
 		log.Error("Unknown NodeValueTracker version", "stored", version, "current", nvtVersion)
 		return nv
 	}
-	var nve nodeValueTrackerEncV1
-	if err := rlp.Decode(r, &nve); err != nil {
-		log.Error("Failed to decode node value tracker", "id", id, "err", err)
-		return nv
-	}
 	nv.rtStats = nve.RtStats
 	nv.lastRtStats = nve.RtStats
 	if int(nve.ServerBasketMapping) == vt.currentMapping {
 		nv.basket.basket = nve.ServerBasket
+		// Latency statistics are simply dropped if the request types were remapped,
+		// they are quickly rebuilt from the responses of the server.
+		nv.latStats = nve.LatStats
 	} else {
 		if nve.ServerBasketMapping >= uint(len(vt.mappings)) {
 			log.Error("Unknown request basket mapping", "stored", nve.ServerBasketMapping, "current", vt.currentMapping)
@@ -405,10 +453,11 @@ func (vt *ValueTracker) saveNode(id enode.ID, nv *NodeValueTracker) {
 	vt.rtStats.AddStats(&recentRtStats)
 	nv.lastRtStats = nv.rtStats
 
-	nve := nodeValueTrackerEncV1{
+	nve := nodeValueTrackerEncV2{
 		RtStats:             nv.rtStats,
 		ServerBasketMapping: uint(vt.currentMapping),
 		ServerBasket:        nv.basket.basket,
+		LatStats:            nv.latStats,
 	}
 	enc1, err := rlp.EncodeToBytes(uint(nvtVersion))
 	if err != nil {
@@ -469,7 +518,8 @@ type ServedRequest struct {
 }
 
 // Served adds a served request to the node's statistics. An actual request may be composed
-// of one or more request types (service vector indices).
+// of one or more request types (service vector indices). The response time is added to
+// the latency statistics of the first one.
 func (vt *ValueTracker) Served(nv *NodeValueTracker, reqs []ServedRequest, respTime time.Duration) {
 	vt.statsExpLock.RLock()
 	expFactor := vt.statsExpFactor
@@ -484,6 +534,9 @@ func (vt *ValueTracker) Served(nv *NodeValueTracker, reqs []ServedRequest, respT
 		value += (*nv.reqValues)[r.ReqType] * float64(r.Amount)
 	}
 	nv.rtStats.Add(respTime, value, vt.statsExpFactor)
+	if len(reqs) > 0 && int(reqs[0].ReqType) < len(nv.latStats) {
+		nv.latStats[reqs[0].ReqType].Add(respTime, 1, expFactor)
+	}
 }
 
 type RequestStatsItem struct {
@@ -133,3 +133,46 @@ func TestValueTracker(t *testing.T) {
 		}
 	}
 }
+
+func TestLatencyStats(t *testing.T) {
+	db := memorydb.New()
+	clock := &mclock.Simulated{}
+	requestList := make([]RequestInfo, testReqTypes)
+	for i := range requestList {
+		requestList[i] = RequestInfo{Name: "testreq" + strconv.Itoa(i), InitAmount: 1, InitValue: 1}
+	}
+	vt := NewValueTracker(db, clock, requestList, time.Minute, 1/float64(time.Hour), 1/float64(time.Hour*100), 1/float64(time.Hour*1000))
+	id := enode.ID{1}
+	nv := vt.Register(id)
+	vt.UpdateCosts(nv, make([]uint64, testReqTypes))
+
+	for i := 0; i < 100; i++ {
+		vt.Served(nv, []ServedRequest{{ReqType: 0, Amount: 1}, {ReqType: 1, Amount: 10}}, time.Millisecond*100)
+		vt.Served(nv, []ServedRequest{{ReqType: 2, Amount: 1}}, time.Second*2)
+	}
+	check := func(nv *NodeValueTracker) {
+		expFactor := vt.StatsExpFactor()
+		if w := nv.LatencyStats(0).Weight(expFactor); w < 99 || w > 101 {
+			t.Errorf("Latency stats weight mismatch: have %f, want %d", w, 100)
+		}
+		if w := nv.LatencyStats(1).Weight(expFactor); w != 0 {
+			t.Errorf("Latency accounted to secondary request type: weight %f", w)
+		}
+		if timeout := nv.LatencyStats(0).Timeout(0.05); timeout > time.Millisecond*150 {
+			t.Errorf("Fast request type timeout too high: %v", timeout)
+		}
+		if timeout := nv.LatencyStats(2).Timeout(0.05); timeout < time.Second*2 {
+			t.Errorf("Slow request type timeout too low: %v", timeout)
+		}
+		if w := nv.TotalLatencyStats().Weight(expFactor); w < 199 || w > 201 {
+			t.Errorf("Total latency stats weight mismatch: have %f, want %d", w, 200)
+		}
+	}
+	check(nv)
+
+	// Check that the statistics survive a restart
+	vt.Stop()
+	vt = NewValueTracker(db, clock, requestList, time.Minute, 1/float64(time.Hour), 1/float64(time.Hour*100), 1/float64(time.Hour*1000))
+	defer vt.Stop()
+	check(vt.Register(id))
+}
@@ -32,6 +32,8 @@ type WrsIterator struct {
 
 	ns       *nodestate.NodeStateMachine
 	wrs      *utils.WeightedRandomSelect
+	weight   func(interface{}) uint64
+	events   *DialEventFeed
 	nextNode *enode.Node
 	closed   bool
 }
@@ -50,8 +52,9 @@ func NewWrsIterator(ns *nodestate.NodeStateMachine, requireFlags, disableFlags n
 	}
 
 	w := &WrsIterator{
-		ns:  ns,
-		wrs: utils.NewWeightedRandomSelect(wfn),
+		ns:     ns,
+		wrs:    utils.NewWeightedRandomSelect(wfn),
+		weight: wfn,
 	}
 	w.cond = sync.NewCond(&w.lock)
 
@@ -83,6 +86,15 @@ func NewWrsIterator(ns *nodestate.NodeStateMachine, requireFlags, disableFlags n
 	return w
 }
 
+// SetEventFeed sets the feed receiving an event for every selection, along with
+// the weight of the selected node.
+func (w *WrsIterator) SetEventFeed(feed *DialEventFeed) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.events = feed
+}
+
 // Next selects the next node.
 func (w *WrsIterator) Next() bool {
 	w.nextNode = w.chooseNode()
@@ -105,6 +117,9 @@ func (w *WrsIterator) chooseNode() *enode.Node {
 		// zero.
 		if c := w.wrs.Choose(); c != nil {
 			id := c.(enode.ID)
+			if w.events != nil {
+				w.events.Send(DialEvent{Type: DialEventSelected, Node: id, Weight: w.weight(id)})
+			}
 			w.wrs.Remove(id)
 			return w.ns.GetNode(id)
 		}
@@ -101,3 +101,50 @@ func TestWrsIterator(t *testing.T) {
 	expset()
 	ns.Stop()
 }
+
+func TestWrsIteratorEvents(t *testing.T) {
+	ns := nodestate.NewNodeStateMachine(nil, nil, &mclock.Simulated{}, testSetup)
+	w := NewWrsIterator(ns, sfTest2, sfTest3.Or(sfTest4), sfiTestWeight)
+
+	var feed DialEventFeed
+	events := make(chan DialEvent, iterTestNodeCount)
+	sub := feed.Subscribe(events)
+	defer sub.Unsubscribe()
+	w.SetEventFeed(&feed)
+
+	ns.Start()
+	defer ns.Stop()
+
+	// Make the nodes selectable one by one, so the selection order is known
+	for i := 1; i <= iterTestNodeCount; i++ {
+		ns.SetState(testNode(i), sfTest1, nodestate.Flags{}, 0)
+		ns.SetField(testNode(i), sfiTestWeight, uint64(i*10))
+		ns.SetState(testNode(i), sfTest2, nodestate.Flags{}, 0)
+		if !w.Next() {
+			t.Fatalf("Iterator closed")
+		}
+		ns.SetState(w.Node(), sfTest4, nodestate.Flags{}, 0)
+
+		select {
+		case ev := <-events:
+			want := DialEvent{Type: DialEventSelected, Node: testNodeID(i), Weight: uint64(i * 10)}
+			if ev != want {
+				t.Errorf("Event mismatch: have %+v, want %+v", ev, want)
+			}
+		default:
+			t.Fatalf("No event for selecting node %d", i)
+		}
+	}
+	// Overflow the subscription buffer and check that the sender isn't blocked
+	for i := 0; i < iterTestNodeCount+2; i++ {
+		feed.Send(DialEvent{Type: DialEventDialed, Node: testNodeID(i)})
+	}
+	if dropped := feed.Dropped(); dropped != 2 {
+		t.Errorf("Dropped event count mismatch: have %d, want 2", dropped)
+	}
+	sub.Unsubscribe()
+	feed.Send(DialEvent{Type: DialEventDialed})
+	if dropped := feed.Dropped(); dropped != 2 {
+		t.Errorf("Events dropped after unsubscribing: have %d, want 2", dropped)
+	}
+}
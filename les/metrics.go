@@ -98,6 +98,19 @@ var (
 	sqServedGauge        = metrics.NewRegisteredGauge("les/server/servingQueue/served", nil)
 	sqQueuedGauge        = metrics.NewRegisteredGauge("les/server/servingQueue/queued", nil)
 
+	sqClassQueuedGauges = [servingClassCount]metrics.Gauge{
+		metrics.NewRegisteredGauge("les/server/servingQueue/free/queued", nil),
+		metrics.NewRegisteredGauge("les/server/servingQueue/priority/queued", nil),
+	}
+	sqClassServedMeters = [servingClassCount]metrics.Meter{
+		metrics.NewRegisteredMeter("les/server/servingQueue/free/served", nil),
+		metrics.NewRegisteredMeter("les/server/servingQueue/priority/served", nil),
+	}
+	sqClassWaitTimers = [servingClassCount]metrics.Timer{
+		metrics.NewRegisteredTimer("les/server/servingQueue/free/wait", nil),
+		metrics.NewRegisteredTimer("les/server/servingQueue/priority/wait", nil),
+	}
+
 	clientConnectedMeter    = metrics.NewRegisteredMeter("les/server/clientEvent/connected", nil)
 	clientRejectedMeter     = metrics.NewRegisteredMeter("les/server/clientEvent/rejected", nil)
 	clientKickedMeter       = metrics.NewRegisteredMeter("les/server/clientEvent/kicked", nil)
@@ -105,6 +118,27 @@ var (
 	clientFreezeMeter       = metrics.NewRegisteredMeter("les/server/clientEvent/freeze", nil)
 	clientErrorMeter        = metrics.NewRegisteredMeter("les/server/clientEvent/error", nil)
 
+	totalPosBalanceGauge = metrics.NewRegisteredGauge("les/server/balance/positive", nil)
+	budgetAlertMeter     = metrics.NewRegisteredMeter("les/server/balance/budgetAlert", nil)
+
+	serviceQualityGauges = [qualityClasses][len(qualityWindows)]metrics.GaugeFloat64{
+		{
+			metrics.NewRegisteredGaugeFloat64("les/server/quality/priority/5m", nil),
+			metrics.NewRegisteredGaugeFloat64("les/server/quality/priority/1h", nil),
+			metrics.NewRegisteredGaugeFloat64("les/server/quality/priority/24h", nil),
+		},
+		{
+			metrics.NewRegisteredGaugeFloat64("les/server/quality/free/5m", nil),
+			metrics.NewRegisteredGaugeFloat64("les/server/quality/free/1h", nil),
+			metrics.NewRegisteredGaugeFloat64("les/server/quality/free/24h", nil),
+		},
+	}
+	serviceQualityAlertGauge = metrics.NewRegisteredGauge("les/server/quality/sloViolated", nil)
+	serviceQualityAlertMeter = metrics.NewRegisteredMeter("les/server/quality/sloAlert", nil)
+
+	deepReorgAnnouncedMeter = metrics.NewRegisteredMeter("les/server/announce/deepReorg", nil)
+	deepReorgReceivedMeter  = metrics.NewRegisteredMeter("les/client/announce/deepReorg", nil)
+
 	requestRTT       = metrics.NewRegisteredTimer("les/client/req/rtt", nil)
 	requestSendDelay = metrics.NewRegisteredTimer("les/client/req/sendDelay", nil)
 
@@ -114,6 +148,10 @@ var (
 	sessionValueMeter     = metrics.NewRegisteredMeter("les/client/serverPool/sessionValue", nil)
 	totalValueGauge       = metrics.NewRegisteredGauge("les/client/serverPool/totalValue", nil)
 	suggestedTimeoutGauge = metrics.NewRegisteredGauge("les/client/serverPool/timeout", nil)
+
+	queryBudgetExhaustedMeter = metrics.NewRegisteredMeter("les/client/serverPool/queryBudget/exhausted", nil)
+	unverifiedConnectedMeter  = metrics.NewRegisteredMeter("les/client/serverPool/unverified/connected", nil)
+	unverifiedFailedMeter     = metrics.NewRegisteredMeter("les/client/serverPool/unverified/failed", nil)
 )
 
 // meteredMsgReadWriter is a wrapper around a p2p.MsgReadWriter, capable of
@@ -22,11 +22,13 @@ import (
 	"math/big"
 	"math/rand"
 	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/common/mclock"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -132,6 +134,8 @@ type peerCommons struct {
 	announceType uint64    // New block announcement type.
 	serving      uint32    // The status indicates the peer is served.
 	headInfo     blockInfo // Latest block information.
+	announceTime time.Time // Time of the last announcement sent or received.
+	capReason    string    // Reason of the last capacity update sent or received, if any.
 
 	// Background task queue for caching peer tasks and executing in order.
 	sendQueue *utils.ExecQueue
@@ -175,6 +179,74 @@ func (p *peerCommons) Info() *eth.PeerInfo {
 	}
 }
 
+// LightPeerHead is a chain head known by or announced to a LES peer.
+type LightPeerHead struct {
+	Number uint64       `json:"number"`
+	Hash   common.Hash  `json:"hash"`
+	Td     *hexutil.Big `json:"td"`
+}
+
+// LightPeerInfo describes the capabilities negotiated with a connected LES peer
+// and the state of the announcement exchange with it.
+type LightPeerInfo struct {
+	ID           string                    `json:"id"`
+	Name         string                    `json:"name"`
+	Version      int                       `json:"version"`
+	AnnounceType string                    `json:"announceType"`
+	FlowControl  flowcontrol.ServerParams  `json:"flowControl"`
+	Checkpoint   *params.TrustedCheckpoint `json:"checkpoint,omitempty"` // Checkpoint advertised by a server peer
+	Head         LightPeerHead             `json:"head"`                 // Latest head reported by the peer
+	Served       *LightPeerHead            `json:"served,omitempty"`     // Latest head announced to a client peer
+	LastAnnounce *time.Time                `json:"lastAnnounce,omitempty"`
+	QueueDepth   int                       `json:"queueDepth"`
+
+	CapacityReason string `json:"capacityReason,omitempty"` // Reason of the last capacity update
+}
+
+// announceTypeName returns the human readable name of an announcement type.
+func announceTypeName(announceType uint64) string {
+	switch announceType {
+	case announceTypeNone:
+		return "none"
+	case announceTypeSimple:
+		return "simple"
+	case announceTypeSigned:
+		return "signed"
+	default:
+		return fmt.Sprintf("unknown(%d)", announceType)
+	}
+}
+
+// newLightPeerHead converts a block info into its RPC representation.
+func newLightPeerHead(info blockInfo) LightPeerHead {
+	head := LightPeerHead{Number: info.Number, Hash: info.Hash}
+	if info.Td != nil {
+		head.Td = (*hexutil.Big)(new(big.Int).Set(info.Td))
+	}
+	return head
+}
+
+// lightInfo gathers the fields shared by client and server peers. The caller
+// must hold the peer lock.
+func (p *peerCommons) lightInfo() LightPeerInfo {
+	info := LightPeerInfo{
+		ID:           p.id,
+		Name:         p.Name(),
+		Version:      p.version,
+		AnnounceType: announceTypeName(p.announceType),
+		FlowControl:  p.fcParams,
+		Head:         newLightPeerHead(p.headInfo),
+		QueueDepth:   p.sendQueue.Len(),
+
+		CapacityReason: p.capReason,
+	}
+	if !p.announceTime.IsZero() {
+		announced := p.announceTime
+		info.LastAnnounce = &announced
+	}
+	return info
+}
+
 // Head retrieves a copy of the current head (most recent) hash of the peer.
 func (p *peerCommons) Head() (hash common.Hash) {
 	p.lock.RLock()
@@ -333,8 +405,9 @@ type serverPeer struct {
 	stateSince, stateRecent uint64 // The range of state server peer can serve.
 
 	// Advertised checkpoint fields
-	checkpointNumber uint64                   // The block height which the checkpoint is registered.
-	checkpoint       params.TrustedCheckpoint // The advertised checkpoint sent by server.
+	checkpointNumber     uint64                   // The block height which the checkpoint is registered.
+	checkpoint           params.TrustedCheckpoint // The advertised checkpoint sent by server.
+	unattestedCheckpoint params.TrustedCheckpoint // The local, not yet registered checkpoint sent by server.
 
 	fcServer         *flowcontrol.ServerNode // Client side mirror token bucket.
 	vtLock           sync.Mutex
@@ -366,6 +439,19 @@ func newServerPeer(version int, network uint64, trusted bool, p *p2p.Peer, rw p2
 	}
 }
 
+// lightInfo returns the capability matrix of the server peer.
+func (p *serverPeer) lightInfo() LightPeerInfo {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	info := p.peerCommons.lightInfo()
+	if !p.checkpoint.Empty() {
+		checkpoint := p.checkpoint
+		info.Checkpoint = &checkpoint
+	}
+	return info
+}
+
 // rejectUpdate returns true if a parameter update has to be rejected because
 // the size and/or rate of updates exceed the capacity limitation
 func (p *serverPeer) rejectUpdate(size uint64) bool {
@@ -552,6 +638,11 @@ func (p *serverPeer) updateFlowControl(update keyValueMap) {
 		// todo can light client set a minimal acceptable flow control params?
 		p.fcParams = params
 		p.fcServer.UpdateParams(params)
+
+		var reason uint64
+		if update.get("flowControl/reason", &reason) == nil {
+			p.capReason = capacityReason(reason).String()
+		}
 	}
 	var MRC RequestCostList
 	if update.get("flowControl/MRC", &MRC) == nil {
@@ -611,6 +702,7 @@ func (p *serverPeer) Handshake(td *big.Int, head common.Hash, headNum uint64, ge
 
 		recv.get("checkpoint/value", &p.checkpoint)
 		recv.get("checkpoint/registerHeight", &p.checkpointNumber)
+		recv.get("checkpoint/unattested", &p.unattestedCheckpoint)
 
 		if !p.onlyAnnounce {
 			for msgCode := range reqAvgTimeCost {
@@ -672,6 +764,41 @@ func (p *serverPeer) sentRequest(id uint64, reqType, amount uint32) {
 	p.vtLock.Unlock()
 }
 
+// msgLatencyStats returns the response time statistics of the server for the given
+// message type. False is returned if the server is not tracked by a value tracker.
+func (p *serverPeer) msgLatencyStats(code uint64) (lpc.ResponseTimeStats, bool) {
+	p.vtLock.Lock()
+	nvt := p.nodeValueTracker
+	p.vtLock.Unlock()
+
+	if nvt == nil {
+		return lpc.ResponseTimeStats{}, false
+	}
+	m, ok := requestMapping[uint32(code)]
+	if !ok {
+		return lpc.ResponseTimeStats{}, false
+	}
+	return nvt.LatencyStats(uint32(m.first)), true
+}
+
+// latencyStats returns the response time statistics of the server for the type of
+// the given request, or for all request types if it has not been sent yet. False is
+// returned if the server is not tracked by a value tracker.
+func (p *serverPeer) latencyStats(id uint64) (lpc.ResponseTimeStats, bool) {
+	p.vtLock.Lock()
+	nvt := p.nodeValueTracker
+	e, sent := p.sentReqs[id]
+	p.vtLock.Unlock()
+
+	if nvt == nil {
+		return lpc.ResponseTimeStats{}, false
+	}
+	if sent {
+		return p.msgLatencyStats(uint64(e.reqType))
+	}
+	return nvt.TotalLatencyStats(), true
+}
+
 // answeredRequest marks a request answered at the current moment by this server.
 func (p *serverPeer) answeredRequest(id uint64) {
 	p.vtLock.Lock()
@@ -717,6 +844,8 @@ type clientPeer struct {
 	responseCount uint64 // Counter to generate an unique id for request processing.
 	errCh         chan error
 	fcClient      *flowcontrol.ClientNode // Server side mirror token bucket.
+	announced     blockInfo               // Latest head announced to the client.
+	capacity      uint64                  // Current capacity of the client (atomic), used for request scheduling.
 }
 
 func newClientPeer(version int, network uint64, p *p2p.Peer, rw p2p.MsgReadWriter) *clientPeer {
@@ -734,6 +863,19 @@ func newClientPeer(version int, network uint64, p *p2p.Peer, rw p2p.MsgReadWrite
 	}
 }
 
+// lightInfo returns the capability matrix of the client peer.
+func (p *clientPeer) lightInfo() LightPeerInfo {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	info := p.peerCommons.lightInfo()
+	if p.announced.Hash != (common.Hash{}) {
+		served := newLightPeerHead(p.announced)
+		info.Served = &served
+	}
+	return info
+}
+
 // freeClientId returns a string identifier for the peer. Multiple peers with
 // the same identifier can not be connected in free mode simultaneously.
 func (p *clientPeer) freeClientId() string {
@@ -863,23 +1005,45 @@ func (p *clientPeer) replyTxStatus(reqID uint64, stats []light.TxStatus) *reply
 // sendAnnounce announces the availability of a number of blocks through
 // a hash notification.
 func (p *clientPeer) sendAnnounce(request announceData) error {
-	return p2p.Send(p.rw, AnnounceMsg, request)
+	sent := time.Now()
+	if err := p2p.Send(p.rw, AnnounceMsg, request); err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.announceTime = sent
+	if request.Hash != (common.Hash{}) {
+		p.announced = blockInfo{Hash: request.Hash, Number: request.Number, Td: request.Td}
+	}
+	p.lock.Unlock()
+	return nil
 }
 
 // updateCapacity updates the request serving capacity assigned to a given client
-// and also sends an announcement about the updated flow control parameters
-func (p *clientPeer) updateCapacity(cap uint64) {
+// and also sends an announcement about the updated flow control parameters. The
+// reason of the change is only sent to les/3 clients and above.
+func (p *clientPeer) updateCapacity(cap uint64, reason capacityReason) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
 	p.fcParams = flowcontrol.ServerParams{MinRecharge: cap, BufLimit: cap * bufLimitRatio}
 	p.fcClient.UpdateParams(p.fcParams)
+	atomic.StoreUint64(&p.capacity, cap)
+	p.capReason = reason.String()
+
 	var kvList keyValueList
 	kvList = kvList.add("flowControl/MRR", cap)
 	kvList = kvList.add("flowControl/BL", cap*bufLimitRatio)
+	if p.version >= lpv3 {
+		kvList = kvList.add("flowControl/reason", uint64(reason))
+	}
 	p.queueSend(func() { p.sendAnnounce(announceData{Update: kvList}) })
 }
 
+// currentCapacity returns the current capacity of the client.
+func (p *clientPeer) currentCapacity() uint64 {
+	return atomic.LoadUint64(&p.capacity)
+}
+
 // freezeClient temporarily puts the client in a frozen state which means all
 // unprocessed and subsequent requests are dropped. Unfreezing happens automatically
 // after a short time if the client's buffer value is at least in the slightly positive
@@ -945,6 +1109,7 @@ func (p *clientPeer) Handshake(td *big.Int, head common.Hash, headNum uint64, ge
 		*lists = (*lists).add("flowControl/MRC", costList)
 		p.fcCosts = costList.decode(ProtocolLengths[uint(p.version)])
 		p.fcParams = server.defParams
+		atomic.StoreUint64(&p.capacity, server.defParams.MinRecharge)
 
 		// Add advertised checkpoint and register block height which
 		// client can verify the checkpoint validity.
@@ -955,14 +1120,25 @@ func (p *clientPeer) Handshake(td *big.Int, head common.Hash, headNum uint64, ge
 				*lists = (*lists).add("checkpoint/registerHeight", height)
 			}
 		}
+		// Add the local checkpoint if it's ahead of the registered one. It's
+		// only accepted by the clients trusting this server.
+		if cp := server.unattestedCheckpoint(); cp != nil {
+			*lists = (*lists).add("checkpoint/unattested", cp)
+		}
 	}, func(recv keyValueMap) error {
 		p.server = recv.get("flowControl/MRR", nil) == nil
 		if p.server {
 			p.announceType = announceTypeNone // connected to another server, send no messages
 		} else {
 			if recv.get("announceType", &p.announceType) != nil {
-				// set default announceType on server side
+				// set default announceType on server side, unless the client
+				// negotiated another one in an earlier session
 				p.announceType = announceTypeSimple
+				if announceType, ok := server.announcePrefs.get(p.ID()); ok {
+					p.announceType = announceType
+				}
+			} else {
+				server.announcePrefs.set(p.ID(), p.announceType)
 			}
 			p.fcClient = flowcontrol.NewClientNode(server.fcManager, server.defParams)
 		}
@@ -1104,6 +1280,18 @@ func (ps *clientPeerSet) allPeers() []*clientPeer {
 	return list
 }
 
+// lightInfos returns the capability matrix of all client peers. The peer list
+// is snapshotted under the set lock, but the peers are inspected without it.
+func (ps *clientPeerSet) lightInfos() []LightPeerInfo {
+	peers := ps.allPeers()
+	infos := make([]LightPeerInfo, 0, len(peers))
+	for _, p := range peers {
+		infos = append(infos, p.lightInfo())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
 // close disconnects all peers. No new peers can be registered
 // after close has returned.
 func (ps *clientPeerSet) close() {
@@ -1255,6 +1443,18 @@ func (ps *serverPeerSet) allPeers() []*serverPeer {
 	return list
 }
 
+// lightInfos returns the capability matrix of all server peers. The peer list
+// is snapshotted under the set lock, but the peers are inspected without it.
+func (ps *serverPeerSet) lightInfos() []LightPeerInfo {
+	peers := ps.allPeers()
+	infos := make([]LightPeerInfo, 0, len(peers))
+	for _, p := range peers {
+		infos = append(infos, p.lightInfo())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
 // close disconnects all peers. No new peers can be registered
 // after close has returned.
 func (ps *serverPeerSet) close() {
@@ -146,3 +146,62 @@ func TestHandshake(t *testing.T) {
 		}
 	}
 }
+
+func TestLightPeerInfo(t *testing.T) {
+	server, client, tearDown := newClientServerEnv(t, 4, lpv3, nil, nil, 0, false, true)
+	defer tearDown()
+
+	sinfos := server.handler.server.peers.lightInfos()
+	cinfos := client.handler.backend.peers.lightInfos()
+	if len(sinfos) != 1 || len(cinfos) != 1 {
+		t.Fatalf("Peer count mismatch: server %d, client %d, want 1", len(sinfos), len(cinfos))
+	}
+	sinfo, cinfo := sinfos[0], cinfos[0]
+	for _, info := range []LightPeerInfo{sinfo, cinfo} {
+		if info.Version != lpv3 {
+			t.Errorf("Protocol version mismatch: have %d, want %d", info.Version, lpv3)
+		}
+		if info.AnnounceType != "simple" {
+			t.Errorf("Announce type mismatch: have %s, want simple", info.AnnounceType)
+		}
+		if info.FlowControl != server.handler.server.defParams {
+			t.Errorf("Flow control mismatch: have %+v, want %+v", info.FlowControl, server.handler.server.defParams)
+		}
+		if info.LastAnnounce != nil {
+			t.Errorf("Unexpected announcement at %v", info.LastAnnounce)
+		}
+		if info.Checkpoint != nil {
+			t.Errorf("Unexpected checkpoint %v", info.Checkpoint)
+		}
+	}
+	if head := server.handler.blockchain.CurrentHeader(); cinfo.Head.Hash != head.Hash() || cinfo.Head.Number != head.Number.Uint64() {
+		t.Errorf("Server head mismatch: have #%d [%x], want #%d [%x]", cinfo.Head.Number, cinfo.Head.Hash, head.Number, head.Hash())
+	}
+	if head := client.handler.backend.blockchain.Genesis(); sinfo.Head.Hash != head.Hash() {
+		t.Errorf("Client head mismatch: have %x, want %x", sinfo.Head.Hash, head.Hash())
+	}
+	// Update the capacity of the client, which is announced by the server
+	params := server.handler.server.defParams
+	server.peer.cpeer.updateCapacity(params.MinRecharge*2, capReasonOperator)
+
+	for i := 0; ; i++ {
+		cinfo = client.handler.backend.peers.lightInfos()[0]
+		if cinfo.LastAnnounce != nil && cinfo.FlowControl.MinRecharge == params.MinRecharge*2 {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("Capacity update not received: %+v", cinfo)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sinfo = server.handler.server.peers.lightInfos()[0]
+	if sinfo.CapacityReason != "operator" || cinfo.CapacityReason != "operator" {
+		t.Errorf("Capacity update reason mismatch: sent %q, received %q, want %q", sinfo.CapacityReason, cinfo.CapacityReason, "operator")
+	}
+	if sinfo.LastAnnounce == nil || sinfo.LastAnnounce.After(*cinfo.LastAnnounce) {
+		t.Errorf("Announcement time mismatch: sent %v, received %v", sinfo.LastAnnounce, cinfo.LastAnnounce)
+	}
+	if sinfo.Served != nil {
+		t.Errorf("Unexpected served head %+v", sinfo.Served)
+	}
+}
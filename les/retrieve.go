@@ -38,6 +38,7 @@ type retrieveManager struct {
 	dist               *requestDistributor
 	peers              *serverPeerSet
 	softRequestTimeout func() time.Duration
+	serverTimeout      func(*serverPeer, uint64) time.Duration // optional, server specific soft timeout
 
 	lock     sync.RWMutex
 	sentReqs map[uint64]*sentReq
@@ -91,16 +92,26 @@ const (
 	rpNotDelivered
 )
 
-// newRetrieveManager creates the retrieve manager
-func newRetrieveManager(peers *serverPeerSet, dist *requestDistributor, srto func() time.Duration) *retrieveManager {
+// newRetrieveManager creates the retrieve manager. The optional server timeout
+// function overrides the global soft timeout for requests sent to server peers.
+func newRetrieveManager(peers *serverPeerSet, dist *requestDistributor, srto func() time.Duration, serverTimeout func(*serverPeer, uint64) time.Duration) *retrieveManager {
 	return &retrieveManager{
 		peers:              peers,
 		dist:               dist,
 		sentReqs:           make(map[uint64]*sentReq),
 		softRequestTimeout: srto,
+		serverTimeout:      serverTimeout,
 	}
 }
 
+// requestTimeout returns the soft timeout of the given request sent to the given peer.
+func (rm *retrieveManager) requestTimeout(p distPeer, reqID uint64) time.Duration {
+	if sp, ok := p.(*serverPeer); ok && rm.serverTimeout != nil {
+		return rm.serverTimeout(sp, reqID)
+	}
+	return rm.softRequestTimeout()
+}
+
 // retrieve sends a request (to multiple peers if necessary) and waits for an answer
 // that is delivered through the deliver function and successfully validated by the
 // validator callback. It returns when a valid answer is delivered or the context is
@@ -351,7 +362,7 @@ func (r *sentReq) tryRequest() {
 		}
 		r.eventsCh <- reqPeerEvent{event, p}
 		return
-	case <-time.After(r.rm.softRequestTimeout()):
+	case <-time.After(r.rm.requestTimeout(p, r.id)):
 		r.eventsCh <- reqPeerEvent{rpSoftTimeout, p}
 	}
 
@@ -18,6 +18,8 @@ package les
 
 import (
 	"crypto/ecdsa"
+	"fmt"
+	"os"
 	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
@@ -51,6 +53,9 @@ type LesServer struct {
 	defParams    flowcontrol.ServerParams
 	servingQueue *servingQueue
 	clientPool   *clientPool
+	poolRecord   *os.File // Client pool event log, nil if not recording
+
+	announcePrefs *announcePrefs // Announcement types negotiated by the clients
 
 	minCapacity, maxCapacity, freeCapacity uint64
 	threadsIdle                            int // Request serving threads count when system is idle.
@@ -92,6 +97,7 @@ func NewLesServer(e *eth.Ethereum, config *eth.Config) (*LesServer, error) {
 	srv.handler = newServerHandler(srv, e.BlockChain(), e.ChainDb(), e.TxPool(), e.Synced)
 	srv.costTracker, srv.minCapacity = newCostTracker(e.ChainDb(), config)
 	srv.freeCapacity = srv.minCapacity
+	srv.servingQueue.setFreeCapacity(srv.freeCapacity)
 
 	// Set up checkpoint oracle.
 	oracle := config.CheckpointOracle
@@ -117,7 +123,26 @@ func NewLesServer(e *eth.Ethereum, config *eth.Config) (*LesServer, error) {
 	}
 	srv.fcManager.SetCapacityLimits(srv.freeCapacity, srv.maxCapacity, srv.freeCapacity*2)
 	srv.clientPool = newClientPool(srv.chainDb, srv.freeCapacity, mclock.System{}, func(id enode.ID) { go srv.peers.unregister(peerIdToString(id)) })
+	srv.clientPool.setWarmUp(defaultWarmUp)
+	srv.announcePrefs = newAnnouncePrefs(srv.chainDb)
+	if config.LightFreePerAddr > 0 {
+		srv.clientPool.setFreeIDMode(freeIDDual, config.LightFreePerAddr)
+	}
+	if config.LightPoolRecord != "" {
+		file, err := os.Create(config.LightPoolRecord)
+		if err != nil {
+			return nil, err
+		}
+		srv.poolRecord = file
+		srv.clientPool.setRecorder(srv.poolRecord)
+		log.Info("Recording client pool events", "file", config.LightPoolRecord)
+	}
 	srv.clientPool.setDefaultFactors(priceFactors{0, 1, 1}, priceFactors{0, 1, 1})
+	if config.LightPoolImport != "" {
+		if err := srv.clientPool.importStateFile(config.LightPoolImport); err != nil {
+			return nil, fmt.Errorf("failed to import client pool state: %v", err)
+		}
+	}
 
 	checkpoint := srv.latestLocalCheckpoint()
 	if !checkpoint.Empty() {
@@ -142,6 +167,12 @@ func (s *LesServer) APIs() []rpc.API {
 			Service:   NewPrivateLightServerAPI(s),
 			Public:    false,
 		},
+		{
+			Namespace: "lescheckpoint",
+			Version:   "1.0",
+			Service:   NewPublicCheckpointAPI(s),
+			Public:    true,
+		},
 		{
 			Namespace: "debug",
 			Version:   "1.0",
@@ -191,6 +222,13 @@ func (s *LesServer) Start(srvr *p2p.Server) {
 func (s *LesServer) Stop() {
 	close(s.closeCh)
 
+	// Persist the connected client set before the sessions are torn down.
+	s.clientPool.saveSnapshot()
+
+	// Stop announcing new heads before the peers go away. The send queues of
+	// the peers are only closed by their own sessions.
+	s.handler.stopBroadcast()
+
 	// Disconnect existing sessions.
 	// This also closes the gate for any new registrations on the peer set.
 	// sessions which are already established but not added to pm.peers yet
@@ -201,6 +239,9 @@ func (s *LesServer) Stop() {
 	s.costTracker.stop()
 	s.handler.stop()
 	s.clientPool.stop() // client pool should be closed after handler.
+	if s.poolRecord != nil {
+		s.poolRecord.Close()
+	}
 	s.servingQueue.stop()
 
 	// Note, bloom trie indexer is closed by parent bloombits indexer.
@@ -221,6 +262,25 @@ func (s *LesServer) SetContractBackend(backend bind.ContractBackend) {
 	s.oracle.Start(backend)
 }
 
+// unattestedCheckpoint returns the latest checkpoint generated by the local
+// indexers if advertising it is enabled and the oracle doesn't have a stable
+// checkpoint registered for the same section yet.
+func (s *LesServer) unattestedCheckpoint() *params.TrustedCheckpoint {
+	if !s.config.UltraLightUnattestedCheckpoint {
+		return nil
+	}
+	local := s.latestLocalCheckpoint()
+	if local.Empty() {
+		return nil
+	}
+	if s.oracle != nil && s.oracle.IsRunning() {
+		if stable, _ := s.oracle.StableCheckpoint(); stable != nil && stable.SectionIndex >= local.SectionIndex {
+			return nil
+		}
+	}
+	return &local
+}
+
 // capacityManagement starts an event handler loop that updates the recharge curve of
 // the client manager and adjusts the client pool's size according to the total
 // capacity updates coming from the client manager
@@ -67,9 +67,12 @@ type serverHandler struct {
 	txpool     *core.TxPool
 	server     *LesServer
 
-	closeCh chan struct{}  // Channel used to exit all background routines of handler.
-	wg      sync.WaitGroup // WaitGroup used to track all background routines of handler.
-	synced  func() bool    // Callback function used to determine whether local node is synced.
+	closeCh   chan struct{}  // Channel used to exit all background routines of handler.
+	closeOnce sync.Once      // Ensures closeCh is only closed once.
+	wg        sync.WaitGroup // WaitGroup used to track all background routines of handler.
+	synced    func() bool    // Callback function used to determine whether local node is synced.
+
+	broadcastDone chan struct{} // Channel closed when the header broadcast loop exits, nil if not started
 
 	// Testing fields
 	addTxsSync bool
@@ -89,13 +92,24 @@ func newServerHandler(server *LesServer, blockchain *core.BlockChain, chainDb et
 
 // start starts the server handler.
 func (h *serverHandler) start() {
+	h.broadcastDone = make(chan struct{})
 	h.wg.Add(1)
 	go h.broadcastHeaders()
 }
 
-// stop stops the server handler.
+// stopBroadcast terminates the header broadcast loop and waits until it exits.
+// It must be called before the peer set is closed so that no announcements are
+// being queued to peers while they are torn down.
+func (h *serverHandler) stopBroadcast() {
+	h.closeOnce.Do(func() { close(h.closeCh) })
+	if h.broadcastDone != nil {
+		<-h.broadcastDone
+	}
+}
+
+// stop stops the server handler, waiting for all the peer sessions to finish.
 func (h *serverHandler) stop() {
-	close(h.closeCh)
+	h.stopBroadcast()
 	h.wg.Wait()
 }
 
@@ -486,7 +500,7 @@ func (h *serverHandler) handleMsg(p *clientPeer, wg *sync.WaitGroup) error {
 						atomic.AddUint32(&p.invalidCount, 1)
 						continue
 					}
-					code, err := triedb.Node(common.BytesToHash(account.CodeHash))
+					code, err := triedb.NodeWithTag(trie.ReadTagLES, common.BytesToHash(account.CodeHash))
 					if err != nil {
 						p.Log().Warn("Failed to retrieve account code", "block", header.Number, "hash", header.Hash(), "account", common.BytesToHash(request.AccKey), "codehash", common.BytesToHash(account.CodeHash), "err", err)
 						continue
@@ -588,8 +602,10 @@ func (h *serverHandler) handleMsg(p *clientPeer, wg *sync.WaitGroup) error {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				nodes := light.NewNodeSet()
-
+				var (
+					nodes   = light.NewNodeSet()
+					statedb = state.WithReadTag(h.blockchain.StateCache(), trie.ReadTagLES)
+				)
 				for i, request := range req.Reqs {
 					if i != 0 && !task.waitOrStop() {
 						sendResponse(req.ReqID, 0, nil, task.servingTime)
@@ -624,8 +640,6 @@ func (h *serverHandler) handleMsg(p *clientPeer, wg *sync.WaitGroup) error {
 						continue
 					}
 					// Open the account or storage trie for the request
-					statedb := h.blockchain.StateCache()
-
 					switch len(request.AccKey) {
 					case 0:
 						// No account key specified, open an account trie
@@ -844,7 +858,7 @@ func (h *serverHandler) handleMsg(p *clientPeer, wg *sync.WaitGroup) error {
 
 // getAccount retrieves an account from the state based on root.
 func (h *serverHandler) getAccount(triedb *trie.Database, root, hash common.Hash) (state.Account, error) {
-	trie, err := trie.New(root, triedb)
+	trie, err := trie.NewTagged(trie.ReadTagLES, common.Hash{}, root, triedb)
 	if err != nil {
 		return state.Account{}, err
 	}
@@ -903,8 +917,13 @@ func (h *serverHandler) txStatus(hash common.Hash) light.TxStatus {
 // clients. According to the agreement between client and server, server should
 // only broadcast new announcement if the total difficulty is higher than the
 // last one. Besides server will add the signature if client requires.
+//
+// If the new head reorgs the chain deeper than the configured threshold, les/3
+// clients are additionally notified via a flag so that they resync from the
+// common ancestor instead of following the announcement.
 func (h *serverHandler) broadcastHeaders() {
 	defer h.wg.Done()
+	defer close(h.broadcastDone)
 
 	headCh := make(chan core.ChainHeadEvent, 10)
 	headSub := h.blockchain.SubscribeChainHeadEvent(headCh)
@@ -934,27 +953,45 @@ func (h *serverHandler) broadcastHeaders() {
 			lastHead, lastTd = header, td
 
 			log.Debug("Announcing block to peers", "number", number, "hash", hash, "td", td, "reorg", reorg)
+
+			// Announcements are prepared without and with the deep reorg flag, both
+			// in a simple and a signed variant, which are created on demand.
 			var (
-				signed         bool
-				signedAnnounce announceData
+				announces [2]announceData
+				signed    [2]*announceData
+				threshold = h.server.config.LightDeepReorg
+				deep      = threshold != 0 && reorg > threshold
 			)
-			announce := announceData{Hash: hash, Number: number, Td: td, ReorgDepth: reorg}
+			announces[0] = announceData{Hash: hash, Number: number, Td: td, ReorgDepth: reorg}
+			if deep {
+				log.Warn("Announcing deep chain reorg", "number", number, "hash", hash, "depth", reorg, "threshold", threshold)
+				deepReorgAnnouncedMeter.Mark(1)
+
+				announces[1] = announces[0]
+				announces[1].Update = announces[1].Update.add("deepReorg", nil)
+			}
 			for _, p := range peers {
 				p := p
+
+				variant := 0
+				if deep && p.version >= lpv3 {
+					variant = 1
+				}
+				announce := announces[variant]
 				switch p.announceType {
 				case announceTypeSimple:
-					if !p.queueSend(func() { p.sendAnnounce(announce) }) {
-						log.Debug("Drop announcement because queue is full", "number", number, "hash", hash)
-					}
 				case announceTypeSigned:
-					if !signed {
-						signedAnnounce = announce
-						signedAnnounce.sign(h.server.privateKey)
-						signed = true
-					}
-					if !p.queueSend(func() { p.sendAnnounce(signedAnnounce) }) {
-						log.Debug("Drop announcement because queue is full", "number", number, "hash", hash)
-					}
+					if signed[variant] == nil {
+						signed[variant] = new(announceData)
+						*signed[variant] = announce
+						signed[variant].sign(h.server.privateKey)
+					}
+					announce = *signed[variant]
+				default:
+					continue
+				}
+				if !p.queueSend(func() { p.sendAnnounce(announce) }) {
+					log.Debug("Drop announcement because queue is full", "number", number, "hash", hash)
 				}
 			}
 		case <-h.closeCh:
@@ -0,0 +1,118 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"crypto/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/light"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// Tests that the server can be stopped while new heads are being announced and
+// clients keep connecting and disconnecting. Meant to be run with -race.
+func TestServerStopWhileAnnouncing(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		db := rawdb.NewMemoryDatabase()
+		indexers := testIndexers(db, nil, light.TestServerIndexerConfig)
+		handler, backend := newTestServerHandler(0, indexers, db, newClientPeerSet(), &mclock.System{})
+		server := handler.server
+
+		var (
+			wg   sync.WaitGroup
+			quit = make(chan struct{})
+		)
+		// Keep generating new heads to announce
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-quit:
+					return
+				default:
+					backend.Commit()
+				}
+			}
+		}()
+		// Keep connecting and disconnecting clients
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func(lifetime time.Duration) {
+				defer wg.Done()
+				for {
+					select {
+					case <-quit:
+						return
+					default:
+						connectStressPeer(handler, lifetime)
+					}
+				}
+			}(time.Millisecond * time.Duration(1+j))
+		}
+		time.Sleep(time.Millisecond * 50)
+		server.Stop()
+
+		close(quit)
+		wg.Wait()
+		backend.Close()
+		indexers[1].Close()
+	}
+}
+
+// connectStressPeer connects a client to the server handler, receives the
+// announcements for the given time and then disconnects.
+func connectStressPeer(handler *serverHandler, lifetime time.Duration) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+
+	var id enode.ID
+	rand.Read(id[:])
+	cpeer := newClientPeer(lpv3, NetworkId, p2p.NewPeer(id, "client", nil), net)
+	speer := newServerPeer(lpv3, NetworkId, false, p2p.NewPeer(id, "server", nil), app)
+
+	done := make(chan struct{})
+	go func() {
+		handler.handle(cpeer)
+		cpeer.close()
+		close(done)
+	}()
+	var (
+		genesis = handler.blockchain.Genesis()
+		head    = handler.blockchain.CurrentHeader()
+		td      = handler.blockchain.GetTd(head.Hash(), head.Number.Uint64())
+	)
+	if err := speer.Handshake(td, head.Hash(), head.Number.Uint64(), genesis.Hash(), nil); err == nil {
+		timeout := time.AfterFunc(lifetime, func() { app.Close() })
+		defer timeout.Stop()
+		for {
+			msg, err := app.ReadMsg()
+			if err != nil {
+				break
+			}
+			msg.Discard()
+		}
+	}
+	app.Close()
+	<-done
+}
@@ -48,6 +48,11 @@ const (
 	minRedialWait       = 10                     // minimum redial wait time in seconds
 	preNegLimit         = 5                      // maximum number of simultaneous pre-negotiation queries
 	maxQueryFails       = 100                    // number of consecutive UDP query failures before we print a warning
+
+	adaptiveTimeoutSamples = 10              // minimum number of responses before a server specific timeout is suggested
+	adaptiveTimeoutRatio   = 0.05            // rate of responses expected to arrive after the server specific timeout
+	adaptiveTimeoutFactor  = 2               // safety multiplier applied to the server specific timeout
+	maxAdaptiveTimeout     = time.Second * 5 // maximum server specific timeout
 )
 
 // serverPool provides a node iterator for dial candidates. The output is a mix of newly discovered
@@ -66,6 +71,8 @@ type serverPool struct {
 	trustedURLs  []string
 	fillSet      *lpc.FillSet
 	queryFails   uint32
+	queryBudget  *queryBudget      // Rate limit of the pre-negotiation queries (nil if unlimited)
+	dialEvents   lpc.DialEventFeed // Debug events of the dial candidate selection
 
 	timeoutLock      sync.RWMutex
 	timeout          time.Duration
@@ -100,6 +107,7 @@ var (
 	sfConnected        = serverPoolSetup.NewFlag("connected")
 	sfRedialWait       = serverPoolSetup.NewFlag("redialWait")
 	sfAlwaysConnect    = serverPoolSetup.NewFlag("alwaysConnect")
+	sfDialUnverified   = serverPoolSetup.NewFlag("dialUnverified")
 	sfDisableSelection = nodestate.MergeFlags(sfQueried, sfCanDial, sfDialing, sfConnected, sfRedialWait)
 
 	sfiNodeHistory = serverPoolSetup.NewPersistentField("nodeHistory", reflect.TypeOf(nodeHistory{}),
@@ -145,6 +153,7 @@ func newServerPool(db ethdb.KeyValueStore, dbKey []byte, vt *lpc.ValueTracker, d
 	s.recalTimeout()
 	s.mixer = enode.NewFairMix(mixTimeout)
 	knownSelector := lpc.NewWrsIterator(s.ns, sfHasValue, sfDisableSelection, sfiNodeWeight)
+	knownSelector.SetEventFeed(&s.dialEvents)
 	alwaysConnect := lpc.NewQueueIterator(s.ns, sfAlwaysConnect, sfDisableSelection, true, nil)
 	s.mixSources = append(s.mixSources, knownSelector)
 	s.mixSources = append(s.mixSources, alwaysConnect)
@@ -157,6 +166,7 @@ func newServerPool(db ethdb.KeyValueStore, dbKey []byte, vt *lpc.ValueTracker, d
 		iter = s.addPreNegFilter(iter, query)
 	}
 	s.dialIterator = enode.Filter(iter, func(node *enode.Node) bool {
+		s.dialEvents.Send(lpc.DialEvent{Type: lpc.DialEventDialed, Node: node.ID()})
 		s.ns.SetState(node, sfDialing, sfCanDial, 0)
 		s.ns.SetState(node, sfWaitDialTimeout, nodestate.Flags{}, time.Second*10)
 		return true
@@ -170,6 +180,23 @@ func newServerPool(db ethdb.KeyValueStore, dbKey []byte, vt *lpc.ValueTracker, d
 		}
 	})
 
+	// Track the outcome of the dials not confirmed by a pre-negotiation query
+	s.ns.SubscribeState(nodestate.MergeFlags(sfDialUnverified, sfCanDial, sfDialing, sfConnected), func(n *enode.Node, oldState, newState nodestate.Flags) {
+		if !newState.HasAll(sfDialUnverified) {
+			return
+		}
+		switch {
+		case newState.HasAll(sfConnected):
+			unverifiedConnectedMeter.Mark(1)
+			s.ns.SetState(n, nodestate.Flags{}, sfDialUnverified, 0)
+		case newState.Equals(sfDialUnverified):
+			// either the dial timed out or the node was never dialed
+			if oldState.HasAll(sfDialing) {
+				unverifiedFailedMeter.Mark(1)
+			}
+			s.ns.SetState(n, nodestate.Flags{}, sfDialUnverified, 0)
+		}
+	})
 	s.ns.AddLogMetrics(sfHasValue, sfDisableSelection, "selectable", nil, nil, serverSelectableGauge)
 	s.ns.AddLogMetrics(sfDialing, nodestate.Flags{}, "dialed", serverDialedMeter, nil, nil)
 	s.ns.AddLogMetrics(sfConnected, nodestate.Flags{}, "connected", nil, nil, serverConnectedGauge)
@@ -193,18 +220,29 @@ func (s *serverPool) addPreNegFilter(input enode.Iterator, query queryFunc) enod
 			if rand.Intn(maxQueryFails*2) < int(fails) {
 				// skip pre-negotiation with increasing chance, max 50%
 				// this ensures that the client can operate even if UDP is not working at all
-				s.ns.SetState(n, sfCanDial, nodestate.Flags{}, time.Second*10)
-				// set canDial before resetting queried so that FillSet will not read more
-				// candidates unnecessarily
-				s.ns.SetState(n, nodestate.Flags{}, sfQueried, 0)
+				s.skipQuery(n, lpc.DialEventQuerySkipped)
 				return
 			}
+			if !s.queryBudget.take() {
+				// dial optimistically instead of stalling the dial pipeline until
+				// the budget is refilled
+				queryBudgetExhaustedMeter.Mark(1)
+				s.skipQuery(n, lpc.DialEventOverBudget)
+				return
+			}
+			s.dialEvents.Send(lpc.DialEvent{Type: lpc.DialEventQuery, Node: n.ID()})
 			go func() {
 				q := query(n)
-				if q == -1 {
+				switch q {
+				case -1:
 					atomic.AddUint32(&s.queryFails, 1)
-				} else {
+					s.dialEvents.Send(lpc.DialEvent{Type: lpc.DialEventTimeout, Node: n.ID()})
+				case 0:
 					atomic.StoreUint32(&s.queryFails, 0)
+					s.dialEvents.Send(lpc.DialEvent{Type: lpc.DialEventRefused, Node: n.ID()})
+				default:
+					atomic.StoreUint32(&s.queryFails, 0)
+					s.dialEvents.Send(lpc.DialEvent{Type: lpc.DialEventCanDial, Node: n.ID()})
 				}
 				if q == 1 {
 					s.ns.SetState(n, sfCanDial, nodestate.Flags{}, time.Second*10)
@@ -224,6 +262,70 @@ func (s *serverPool) addPreNegFilter(input enode.Iterator, query queryFunc) enod
 	})
 }
 
+// skipQuery passes a node to the dialer without a pre-negotiation query. The
+// node is marked as unverified until the outcome of the dial is known.
+func (s *serverPool) skipQuery(n *enode.Node, event string) {
+	s.dialEvents.Send(lpc.DialEvent{Type: event, Node: n.ID()})
+	s.ns.SetState(n, sfCanDial.Or(sfDialUnverified), nodestate.Flags{}, 0)
+	s.ns.AddTimeout(n, sfCanDial, time.Second*10)
+	// set canDial before resetting queried so that FillSet will not read more
+	// candidates unnecessarily
+	s.ns.SetState(n, nodestate.Flags{}, sfQueried, 0)
+}
+
+// setQueryBudget limits the number of pre-negotiation queries sent per minute.
+// When the budget is exhausted, candidates are dialed without being queried.
+// Zero means no limit. It should be called before start.
+func (s *serverPool) setQueryBudget(perMinute int) {
+	if perMinute == 0 {
+		s.queryBudget = nil
+		return
+	}
+	s.queryBudget = newQueryBudget(s.clock, perMinute)
+}
+
+// queryBudget is a token bucket limiting the rate of the pre-negotiation queries.
+// It holds at most one minute worth of tokens.
+type queryBudget struct {
+	lock   sync.Mutex
+	clock  mclock.Clock
+	limit  float64 // Maximum number of tokens (queries per minute)
+	tokens float64
+	last   mclock.AbsTime
+}
+
+// newQueryBudget creates a full token bucket.
+func newQueryBudget(clock mclock.Clock, perMinute int) *queryBudget {
+	return &queryBudget{
+		clock:  clock,
+		limit:  float64(perMinute),
+		tokens: float64(perMinute),
+		last:   clock.Now(),
+	}
+}
+
+// take refills the bucket and takes a token from it if possible. A nil budget
+// is unlimited.
+func (b *queryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.clock.Now()
+	b.tokens += b.limit * float64(now-b.last) / float64(time.Minute)
+	if b.tokens > b.limit {
+		b.tokens = b.limit
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
 // start starts the server pool. Note that NodeStateMachine should be started first.
 func (s *serverPool) start() {
 	s.ns.Start()
@@ -344,6 +446,56 @@ func (s *serverPool) getTimeoutAndWeight() (time.Duration, lpc.ResponseTimeWeigh
 	return s.timeout, s.timeWeights
 }
 
+// adaptiveTimeout suggests a timeout based on the given response time statistics
+// of a single server: the 95th percentile of its response times multiplied by a
+// safety factor, bounded by minTimeout and maxAdaptiveTimeout. False is returned if
+// the statistics don't contain enough responses yet.
+func adaptiveTimeout(stats lpc.ResponseTimeStats, expFactor utils.ExpirationFactor) (time.Duration, bool) {
+	if stats.Weight(expFactor) < adaptiveTimeoutSamples {
+		return 0, false
+	}
+	timeout := stats.Timeout(adaptiveTimeoutRatio) * adaptiveTimeoutFactor
+	if timeout < minTimeout {
+		timeout = minTimeout
+	}
+	if timeout > maxAdaptiveTimeout {
+		timeout = maxAdaptiveTimeout
+	}
+	return timeout, true
+}
+
+// serverTimeout returns the recommended soft timeout of a request sent to the given
+// server, based on the server's response times to the same type of requests. If the
+// type of the request is not known (yet), the response times to any request type are
+// used. The global timeout is returned if the server has not answered enough requests.
+func (s *serverPool) serverTimeout(p *serverPeer, reqID uint64) time.Duration {
+	if stats, ok := p.latencyStats(reqID); ok {
+		if timeout, ok := adaptiveTimeout(stats, s.vt.StatsExpFactor()); ok {
+			return timeout
+		}
+	}
+	return s.getTimeout()
+}
+
+// serverTimeouts returns the recommended soft timeouts of the given server for each
+// LES request type.
+func (s *serverPool) serverTimeouts(p *serverPeer) map[string]time.Duration {
+	var (
+		expFactor = s.vt.StatsExpFactor()
+		timeouts  = make(map[string]time.Duration)
+	)
+	for code, req := range requests {
+		timeout := s.getTimeout()
+		if stats, ok := p.msgLatencyStats(code); ok {
+			if t, ok := adaptiveTimeout(stats, expFactor); ok {
+				timeout = t
+			}
+		}
+		timeouts[req.name] = timeout
+	}
+	return timeouts
+}
+
 // addDialCost adds the given amount of dial cost to the node history and returns the current
 // amount of total dial cost
 func (s *serverPool) addDialCost(n *nodeHistory, amount int64) uint64 {
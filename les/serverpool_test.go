@@ -55,6 +55,8 @@ type serverPoolTest struct {
 	clock                *mclock.Simulated
 	quit                 chan struct{}
 	preNeg, preNegFail   bool
+	queryBudget          int
+	queries              int32
 	vt                   *lpc.ValueTracker
 	sp                   *serverPool
 	input                enode.Iterator
@@ -110,6 +112,7 @@ func (s *serverPoolTest) start() {
 	var testQuery queryFunc
 	if s.preNeg {
 		testQuery = func(node *enode.Node) int {
+			atomic.AddInt32(&s.queries, 1)
 			idx := testNodeIndex(node.ID())
 			n := &s.testNodes[idx]
 			canConnect := !n.connected && n.connectCycles != 0 && s.cycle >= n.nextConnCycle
@@ -150,6 +153,7 @@ func (s *serverPoolTest) start() {
 	s.vt = lpc.NewValueTracker(s.db, s.clock, requestList, time.Minute, 1/float64(time.Hour), 1/float64(time.Hour*100), 1/float64(time.Hour*1000))
 	s.sp = newServerPool(s.db, []byte("serverpool:"), s.vt, s.input, 0, testQuery, s.clock, s.trusted)
 	s.sp.validSchemes = enode.ValidSchemesForTesting
+	s.sp.setQueryBudget(s.queryBudget)
 	s.sp.unixTime = func() int64 { return int64(s.clock.Now()) / int64(time.Second) }
 	s.disconnect = make(map[int][]int)
 	s.sp.start()
@@ -350,3 +354,150 @@ func testServerPoolTrustedNoDiscovery(t *testing.T, preNeg bool) {
 	s.stop()
 	s.checkNodes(t, trusted)
 }
+
+// Tests that the query budget is refilled over time but never beyond its limit.
+func TestQueryBudget(t *testing.T) {
+	clock := &mclock.Simulated{}
+	budget := newQueryBudget(clock, 6)
+
+	take := func(want int) {
+		t.Helper()
+		for i := 0; i < want; i++ {
+			if !budget.take() {
+				t.Fatalf("query %d refused, want %d allowed", i, want)
+			}
+		}
+		if budget.take() {
+			t.Fatalf("query allowed over the budget of %d", want)
+		}
+	}
+	take(6)
+	clock.Run(time.Second * 10)
+	take(1)
+	clock.Run(time.Second * 5)
+	take(0)
+	clock.Run(time.Hour)
+	take(6)
+
+	var unlimited *queryBudget
+	if !unlimited.take() {
+		t.Fatalf("query refused without budget")
+	}
+}
+
+// Tests that the server pool keeps dialing optimistically if the query budget is
+// exhausted and sends queries again as soon as the budget is refilled.
+func TestServerPoolQueryBudget(t *testing.T) {
+	s := newServerPoolTest(true, false)
+	s.queryBudget = 10
+	nodes := s.setNodes(100, 200, 200, true, false)
+	s.setNodes(100, 20, 20, false, false)
+	start := s.clock.Now()
+	s.start()
+
+	events := make(chan lpc.DialEvent, 1000)
+	sub := s.sp.dialEvents.Subscribe(events)
+	defer sub.Unsubscribe()
+
+	var (
+		overBudget int32
+		done       = make(chan struct{})
+	)
+	go func() {
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == lpc.DialEventOverBudget {
+					atomic.AddInt32(&overBudget, 1)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	s.run()
+
+	// The pool should have fallen back to unqueried dials without stalling
+	minutes := int32(time.Duration(s.clock.Now()-start)/time.Minute) + 1
+	if queries := atomic.LoadInt32(&s.queries); queries > 10*(minutes+1) {
+		t.Errorf("too many queries sent: have %d, want at most %d", queries, 10*(minutes+1))
+	}
+	if atomic.LoadInt32(&overBudget) == 0 {
+		t.Errorf("no candidates dialed over the query budget")
+	}
+	// After a pause, the refilled budget should be spent on queries again
+	s.clock.Run(time.Minute * 2)
+	queries := atomic.LoadInt32(&s.queries)
+	for i := 0; i < 5; i++ {
+		s.beginWait()
+		s.sp.dialIterator.Next()
+		s.endWait()
+	}
+	if atomic.LoadInt32(&s.queries) == queries {
+		t.Errorf("no queries sent after the budget was refilled")
+	}
+	s.stop()
+	close(done)
+	s.checkNodes(t, nodes)
+}
+
+// Tests that the server specific request timeouts converge to the response times
+// of the individual servers, causing less premature failovers to distant servers
+// and a quicker one from nearby servers than a fixed timeout.
+func TestAdaptiveTimeout(t *testing.T) {
+	vt := lpc.NewValueTracker(memorydb.New(), &mclock.Simulated{}, requestList, time.Minute, 1/float64(time.Hour), 1/float64(time.Hour*100), 1/float64(time.Hour*1000))
+	defer vt.Stop()
+
+	const (
+		fixedTimeout = time.Second
+		warmup       = 50
+		requests     = 250
+	)
+	for i, latency := range []time.Duration{time.Millisecond * 100, time.Millisecond * 1500} {
+		p := &serverPeer{}
+		p.setValueTracker(vt, vt.Register(testNodeID(i)))
+
+		var timeout time.Duration
+		if _, ok := p.latencyStats(0); !ok {
+			t.Fatalf("Server %d: no latency statistics", i)
+		}
+		var adaptiveFails, fixedFails int
+		for id := uint64(0); id < requests; id++ {
+			p.sentRequest(id, GetBlockHeadersMsg, 1)
+
+			timeout = fixedTimeout
+			stats, _ := p.latencyStats(id)
+			if adaptive, ok := adaptiveTimeout(stats, vt.StatsExpFactor()); ok {
+				timeout = adaptive
+			}
+			// Simulate a response with some jitter arriving after the latency
+			respTime := time.Duration(float64(latency) * (0.8 + 0.4*rand.Float64()))
+			if id >= warmup {
+				if respTime > timeout {
+					adaptiveFails++
+				}
+				if respTime > fixedTimeout {
+					fixedFails++
+				}
+			}
+			p.vtLock.Lock()
+			e := p.sentReqs[id]
+			e.at -= mclock.AbsTime(respTime)
+			p.sentReqs[id] = e
+			p.vtLock.Unlock()
+			p.answeredRequest(id)
+		}
+		if adaptiveFails > (requests-warmup)/10 || adaptiveFails > fixedFails {
+			t.Errorf("Server %d: too many premature failovers: adaptive %d, fixed %d", i, adaptiveFails, fixedFails)
+		}
+		if timeout < minTimeout || timeout > maxAdaptiveTimeout || timeout < latency {
+			t.Errorf("Server %d: timeout %v out of range", i, timeout)
+		}
+		if latency < minTimeout && timeout >= fixedTimeout {
+			t.Errorf("Server %d: timeout %v not below the fixed timeout", i, timeout)
+		}
+		if latency > fixedTimeout && fixedFails == 0 {
+			t.Errorf("Server %d: no failovers with the fixed timeout", i)
+		}
+	}
+}
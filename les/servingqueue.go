@@ -20,13 +20,33 @@ import (
 	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common/mclock"
 	"github.com/ethereum/go-ethereum/common/prque"
 )
 
+// Serving classes of the tasks, determined by the capacity of the requesting
+// client. Tasks of higher classes are served first, but the lowest class is
+// guaranteed a minimum share of the served tasks so it's never starved.
+const (
+	servingClassFree     = iota // Clients with at most the free capacity
+	servingClassPriority        // Clients with a capacity above the free one
+	servingClassCount
+)
+
+const (
+	// minFreeShare is the share of the recently served tasks the free class is
+	// guaranteed if it has tasks waiting.
+	minFreeShare = 0.1
+
+	// servingShareDecay is the per task decay factor of the recently served
+	// task counters the shares are calculated from.
+	servingShareDecay = 1 - 1.0/64
+)
+
 // servingQueue allows running tasks in a limited number of threads and puts the
-// waiting tasks in a priority queue
+// waiting tasks in a priority queue per serving class
 type servingQueue struct {
 	recentTime, queuedTime, servingTimeDiff uint64
 	burstLimit, burstDropLimit              uint64
@@ -38,10 +58,12 @@ type servingQueue struct {
 	setThreadsCh            chan int
 
 	wg          sync.WaitGroup
-	threadCount int          // number of currently running threads
-	queue       *prque.Prque // priority queue for waiting or suspended tasks
-	best        *servingTask // the highest priority task (not included in the queue)
-	suspendBias int64        // priority bias against suspending an already running task
+	threadCount int                             // number of currently running threads
+	queues      [servingClassCount]*prque.Prque // priority queues for waiting or suspended tasks per class
+	served      [servingClassCount]float64      // recently served tasks per class, decaying
+	best        *servingTask                    // the next task to serve (not included in the queues)
+	suspendBias int64                           // priority bias against suspending an already running task
+	freeCap     uint64                          // capacity up to which clients are in the free class (atomic)
 }
 
 // servingTask represents a request serving task. Tasks can be implemented to
@@ -57,6 +79,8 @@ type servingTask struct {
 	servingTime, timeAdded, maxTime, expTime uint64
 	peer                                     *clientPeer
 	priority                                 int64
+	class                                    int
+	queuedAt                                 mclock.AbsTime
 	biasAdded                                bool
 	token                                    runToken
 	tokenCh                                  chan runToken
@@ -123,7 +147,6 @@ func (t *servingTask) waitOrStop() bool {
 // newServingQueue returns a new servingQueue
 func newServingQueue(suspendBias int64, utilTarget float64) *servingQueue {
 	sq := &servingQueue{
-		queue:          prque.New(nil),
 		suspendBias:    suspendBias,
 		queueAddCh:     make(chan *servingTask, 100),
 		queueBestCh:    make(chan *servingTask),
@@ -135,13 +158,31 @@ func newServingQueue(suspendBias int64, utilTarget float64) *servingQueue {
 		burstDecRate:   utilTarget,
 		lastUpdate:     mclock.Now(),
 	}
+	for class := range sq.queues {
+		sq.queues[class] = prque.New(nil)
+	}
 	sq.wg.Add(2)
 	go sq.queueLoop()
 	go sq.threadCountLoop()
 	return sq
 }
 
-// newTask creates a new task with the given priority
+// setFreeCapacity sets the capacity up to which clients are served in the free
+// class, clients with a higher capacity are served with priority.
+func (sq *servingQueue) setFreeCapacity(cap uint64) {
+	atomic.StoreUint64(&sq.freeCap, cap)
+}
+
+// classOf returns the serving class of a client with the given capacity.
+func (sq *servingQueue) classOf(capacity uint64) int {
+	if capacity > atomic.LoadUint64(&sq.freeCap) {
+		return servingClassPriority
+	}
+	return servingClassFree
+}
+
+// newTask creates a new task with the given priority, in the serving class of
+// the current capacity of the peer
 func (sq *servingQueue) newTask(peer *clientPeer, maxTime uint64, priority int64) *servingTask {
 	return &servingTask{
 		sq:       sq,
@@ -149,6 +190,7 @@ func (sq *servingQueue) newTask(peer *clientPeer, maxTime uint64, priority int64
 		maxTime:  maxTime,
 		expTime:  maxTime,
 		priority: priority,
+		class:    sq.classOf(peer.currentCapacity()),
 	}
 }
 
@@ -212,13 +254,20 @@ func (l peerList) Swap(i, j int) {
 // them until burstTime goes under burstDropLimit or all peers are frozen
 func (sq *servingQueue) freezePeers() {
 	peerMap := make(map[*clientPeer]*peerTasks)
-	var peerList peerList
+	var (
+		peerList peerList
+		queued   []*servingTask
+	)
 	if sq.best != nil {
-		sq.queue.Push(sq.best, sq.best.priority)
+		queued = append(queued, sq.best)
 	}
 	sq.best = nil
-	for sq.queue.Size() > 0 {
-		task := sq.queue.PopItem().(*servingTask)
+	for _, queue := range sq.queues {
+		for queue.Size() > 0 {
+			queued = append(queued, queue.PopItem().(*servingTask))
+		}
+	}
+	for _, task := range queued {
 		tasks := peerMap[task.peer]
 		if tasks == nil {
 			bufValue, bufLimit := task.peer.fcClient.BufferStatus()
@@ -250,12 +299,74 @@ func (sq *servingQueue) freezePeers() {
 			}
 		} else {
 			for _, task := range tasks.list {
-				sq.queue.Push(task, task.priority)
+				sq.queues[task.class].Push(task, task.priority)
 			}
 		}
 	}
-	if sq.queue.Size() > 0 {
-		sq.best = sq.queue.PopItem().(*servingTask)
+	sq.best = sq.popBest()
+	sq.updateClassGauges()
+}
+
+// nextClass returns the class the next task is served from: the highest class
+// with waiting tasks, unless the free class has waiting tasks and received less
+// than its guaranteed share of the recently served tasks.
+func (sq *servingQueue) nextClass() int {
+	if sq.queues[servingClassFree].Size() > 0 {
+		var total float64
+		for _, served := range sq.served {
+			total += served
+		}
+		if sq.served[servingClassFree] <= total*minFreeShare {
+			return servingClassFree
+		}
+	}
+	for class := servingClassCount - 1; class >= 0; class-- {
+		if sq.queues[class].Size() > 0 {
+			return class
+		}
+	}
+	return -1
+}
+
+// popBest removes and returns the next task to serve from the queues, or nil if
+// there are no waiting tasks.
+func (sq *servingQueue) popBest() *servingTask {
+	class := sq.nextClass()
+	if class < 0 {
+		return nil
+	}
+	return sq.queues[class].PopItem().(*servingTask)
+}
+
+// dispatched accounts for the best task being handed to a thread controller and
+// selects the next one. The details of the task are captured before handing it
+// over, as it's modified by the serving thread afterwards.
+func (sq *servingQueue) dispatched(expTime uint64, class int, queuedAt mclock.AbsTime) {
+	sq.updateRecentTime()
+	sq.queuedTime -= expTime
+	sq.recentTime += expTime
+	sqServedGauge.Update(int64(sq.recentTime))
+	sqQueuedGauge.Update(int64(sq.queuedTime))
+
+	for class := range sq.served {
+		sq.served[class] *= servingShareDecay
+	}
+	sq.served[class]++
+	sqClassServedMeters[class].Mark(1)
+	sqClassWaitTimers[class].Update(time.Duration(mclock.Now() - queuedAt))
+
+	sq.best = sq.popBest()
+	sq.updateClassGauges()
+}
+
+// updateClassGauges publishes the number of waiting tasks per class.
+func (sq *servingQueue) updateClassGauges() {
+	for class, queue := range sq.queues {
+		size := queue.Size()
+		if sq.best != nil && sq.best.class == class {
+			size++
+		}
+		sqClassQueuedGauges[class].Update(int64(size))
 	}
 }
 
@@ -275,16 +386,16 @@ func (sq *servingQueue) updateRecentTime() {
 	}
 }
 
-// addTask inserts a task into the priority queue
+// addTask inserts a task into the priority queue of its class
 func (sq *servingQueue) addTask(task *servingTask) {
-	if sq.best == nil {
-		sq.best = task
-	} else if task.priority > sq.best.priority {
-		sq.queue.Push(sq.best, sq.best.priority)
-		sq.best = task
-	} else {
-		sq.queue.Push(task, task.priority)
+	task.queuedAt = mclock.Now()
+	if sq.best != nil {
+		sq.queues[sq.best.class].Push(sq.best, sq.best.priority)
 	}
+	sq.queues[task.class].Push(task, task.priority)
+	sq.best = sq.popBest()
+	sq.updateClassGauges()
+
 	sq.updateRecentTime()
 	sq.queuedTime += task.expTime
 	sqServedGauge.Update(int64(sq.recentTime))
@@ -300,21 +411,12 @@ func (sq *servingQueue) addTask(task *servingTask) {
 func (sq *servingQueue) queueLoop() {
 	for {
 		if sq.best != nil {
-			expTime := sq.best.expTime
+			expTime, class, queuedAt := sq.best.expTime, sq.best.class, sq.best.queuedAt
 			select {
 			case task := <-sq.queueAddCh:
 				sq.addTask(task)
 			case sq.queueBestCh <- sq.best:
-				sq.updateRecentTime()
-				sq.queuedTime -= expTime
-				sq.recentTime += expTime
-				sqServedGauge.Update(int64(sq.recentTime))
-				sqQueuedGauge.Update(int64(sq.queuedTime))
-				if sq.queue.Size() == 0 {
-					sq.best = nil
-				} else {
-					sq.best, _ = sq.queue.PopItem().(*servingTask)
-				}
+				sq.dispatched(expTime, class, queuedAt)
 			case <-sq.quit:
 				sq.wg.Done()
 				return
@@ -0,0 +1,137 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package les
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/common/prque"
+)
+
+// newTestServingQueue creates a serving queue without its event loops, so that
+// the tests can drive the scheduling directly.
+func newTestServingQueue(freeCap uint64) *servingQueue {
+	sq := &servingQueue{
+		burstLimit: math.MaxUint64 / 2,
+		lastUpdate: mclock.Now(),
+		freeCap:    freeCap,
+	}
+	for class := range sq.queues {
+		sq.queues[class] = prque.New(nil)
+	}
+	return sq
+}
+
+// serveBest hands the best task of the queue over as the event loop would.
+func serveBest(sq *servingQueue) {
+	sq.dispatched(sq.best.expTime, sq.best.class, sq.best.queuedAt)
+}
+
+func TestServingQueueClassOrder(t *testing.T) {
+	sq := newTestServingQueue(100)
+	free, paid := &clientPeer{capacity: 100}, &clientPeer{capacity: 1000}
+
+	sq.addTask(sq.newTask(free, 1, 10))
+	sq.addTask(sq.newTask(paid, 1, 0))
+	sq.addTask(sq.newTask(paid, 1, 1))
+
+	// The first served task is from the free class as nothing was served yet,
+	// then the priority class takes over
+	var classes []int
+	for sq.best != nil {
+		classes = append(classes, sq.best.class)
+		serveBest(sq)
+	}
+	want := []int{servingClassFree, servingClassPriority, servingClassPriority}
+	if !reflect.DeepEqual(classes, want) {
+		t.Fatalf("serving order mismatch: have %v, want %v", classes, want)
+	}
+	// Once the free class got its share, a waiting priority task comes first
+	// even if the free one has a better flow control priority
+	sq = newTestServingQueue(100)
+	for i := 0; i < 10; i++ {
+		sq.addTask(sq.newTask(free, 1, 0))
+		serveBest(sq)
+	}
+	sq.addTask(sq.newTask(free, 1, 10))
+	sq.addTask(sq.newTask(paid, 1, 0))
+	if sq.best.class != servingClassPriority {
+		t.Fatalf("free task served ahead of a priority one")
+	}
+}
+
+// runServingLoad feeds the queue with a synthetic load, serving a single task
+// per step. Tasks of paid and free clients arrive with the given probabilities
+// per step. The average delay in steps and the served task count of both classes
+// are returned.
+func runServingLoad(t *testing.T, seed int64, paidRate, freeRate float64) (delays [servingClassCount]float64, served [servingClassCount]int) {
+	var (
+		rng   = rand.New(rand.NewSource(seed))
+		sq    = newTestServingQueue(100)
+		peers = [servingClassCount]*clientPeer{{capacity: 100}, {capacity: 1000}}
+		added = make(map[*servingTask]int)
+	)
+	for step := 0; step < 20000; step++ {
+		for class, rate := range [servingClassCount]float64{freeRate, paidRate} {
+			for r := rate; r > 0; r-- {
+				if rng.Float64() < r {
+					// Older tasks have a better flow control priority
+					task := sq.newTask(peers[class], 1, -int64(step))
+					added[task] = step
+					sq.addTask(task)
+				}
+			}
+		}
+		if task := sq.best; task != nil {
+			delays[task.class] += float64(step - added[task])
+			served[task.class]++
+			serveBest(sq)
+		}
+	}
+	for class := range delays {
+		if served[class] == 0 {
+			t.Fatalf("seed %d: no tasks served from class %d", seed, class)
+		}
+		delays[class] /= float64(served[class])
+	}
+	return delays, served
+}
+
+func TestServingQueueLatencySeparation(t *testing.T) {
+	for seed := int64(0); seed < 5; seed++ {
+		delays, _ := runServingLoad(t, seed, 0.5, 0.45)
+		if delays[servingClassPriority] >= delays[servingClassFree] {
+			t.Fatalf("seed %d: priority clients not served faster: priority delay %.2f, free delay %.2f", seed, delays[servingClassPriority], delays[servingClassFree])
+		}
+	}
+}
+
+func TestServingQueueStarvation(t *testing.T) {
+	for seed := int64(0); seed < 5; seed++ {
+		// Paid clients alone saturate the queue, the free ones still get their
+		// guaranteed share
+		_, served := runServingLoad(t, seed, 1.5, 0.5)
+		share := float64(served[servingClassFree]) / float64(served[servingClassFree]+served[servingClassPriority])
+		if share < minFreeShare*0.95 {
+			t.Fatalf("seed %d: free clients starved: share %.3f, want at least %.3f", seed, share, minFreeShare)
+		}
+	}
+}
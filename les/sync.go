@@ -109,11 +109,17 @@ func (h *clientHandler) synchronise(peer *serverPeer) {
 	//     => Use hardcoded checkpoint
 	// (4) New version server with valid and higher stable checkpoint
 	//     => Use provided checkpoint
+	// (5) Trusted server advertising a local checkpoint ahead of the stable one
+	//     => Use the unattested checkpoint without verifying it
 	var checkpoint = &peer.checkpoint
-	var hardcoded bool
-	if h.checkpoint != nil && h.checkpoint.SectionIndex >= peer.checkpoint.SectionIndex {
+	var hardcoded, unattested bool
+	if peer.trusted && !peer.unattestedCheckpoint.Empty() && (checkpoint.Empty() || peer.unattestedCheckpoint.SectionIndex > checkpoint.SectionIndex) {
+		checkpoint = &peer.unattestedCheckpoint
+		unattested = true
+	}
+	if h.checkpoint != nil && h.checkpoint.SectionIndex >= checkpoint.SectionIndex {
 		checkpoint = h.checkpoint // Use the hardcoded one.
-		hardcoded = true
+		hardcoded, unattested = true, false
 	}
 	// Determine whether we should run checkpoint syncing or normal light syncing.
 	//
@@ -134,6 +140,9 @@ func (h *clientHandler) synchronise(peer *serverPeer) {
 	case hardcoded:
 		mode = legacyCheckpointSync
 		log.Debug("Disable checkpoint syncing", "reason", "checkpoint is hardcoded")
+	case unattested:
+		// The checkpoint is trusted via the server, no need for the oracle.
+		log.Debug("Using unattested checkpoint of trusted server", "peer", peer.id, "section", checkpoint.SectionIndex)
 	case h.backend.oracle == nil || !h.backend.oracle.IsRunning():
 		if h.checkpoint == nil {
 			mode = lightSync // Downgrade to light sync unfortunately.
@@ -153,10 +162,12 @@ func (h *clientHandler) synchronise(peer *serverPeer) {
 	if mode == checkpointSync || mode == legacyCheckpointSync {
 		// Validate the advertised checkpoint
 		if mode == checkpointSync {
-			if err := h.validateCheckpoint(peer); err != nil {
-				log.Debug("Failed to validate checkpoint", "reason", err)
-				h.removePeer(peer.id)
-				return
+			if !unattested {
+				if err := h.validateCheckpoint(peer); err != nil {
+					log.Debug("Failed to validate checkpoint", "reason", err)
+					h.removePeer(peer.id)
+					return
+				}
 			}
 			h.backend.blockchain.AddTrustedCheckpoint(checkpoint)
 		}
@@ -183,4 +194,11 @@ func (h *clientHandler) synchronise(peer *serverPeer) {
 		return
 	}
 	log.Debug("Synchronise finished", "elapsed", common.PrettyDuration(time.Since(start)))
+
+	// Delete the headers retrievable via the trusted CHTs if requested
+	if h.backend.config.LightPruneHeaders {
+		if _, _, err := h.backend.blockchain.PruneHeaders(); err != nil {
+			log.Error("Failed to prune old headers", "err", err)
+		}
+	}
 }
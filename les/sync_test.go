@@ -17,15 +17,21 @@
 package les
 
 import (
+	"context"
 	"fmt"
 	"math/big"
+	"net"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/light"
+	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/params"
 )
 
@@ -218,3 +224,199 @@ func testMissOracleBackend(t *testing.T, hasCheckpoint bool) {
 		t.Error("checkpoint syncing timeout")
 	}
 }
+
+// Test that a light client prunes the headers covered by the trusted checkpoint
+// after syncing, and retrieves them transparently via CHT proofs afterwards.
+func TestHeaderPruningLes3(t *testing.T) {
+	config := light.TestServerIndexerConfig
+
+	waitIndexers := func(cIndexer, bIndexer, btIndexer *core.ChainIndexer) {
+		for {
+			cs, _, _ := cIndexer.Sections()
+			bts, _, _ := btIndexer.Sections()
+			if cs >= 1 && bts >= 1 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	server, client, tearDown := newClientServerEnv(t, int(config.ChtSize+config.ChtConfirms), 3, waitIndexers, nil, 0, false, false)
+	defer tearDown()
+
+	// Register the checkpoint of the first section without using it for syncing,
+	// so all headers are downloaded from genesis
+	s, _, head := server.chtIndexer.Sections()
+	client.handler.backend.blockchain.AddTrustedCheckpoint(&params.TrustedCheckpoint{
+		SectionIndex: 0,
+		SectionHead:  head,
+		CHTRoot:      light.GetChtRoot(server.db, s-1, head),
+		BloomRoot:    light.GetBloomTrieRoot(server.db, s-1, head),
+	})
+	client.handler.backend.config.LightPruneHeaders = true
+
+	done := make(chan struct{})
+	client.handler.syncDone = func() { close(done) }
+
+	peer1, peer2, err := newTestPeerPair("peer", 3, server.handler, client.handler)
+	if err != nil {
+		t.Fatalf("Failed to connect testing peers %v", err)
+	}
+	defer peer1.close()
+	defer peer2.close()
+
+	select {
+	case <-done:
+	case <-time.NewTimer(10 * time.Second).C:
+		t.Fatal("syncing timeout")
+	}
+	// Ensure everything below the section head, except the genesis, is pruned
+	db := client.db
+	for number := uint64(0); number <= config.ChtSize+config.ChtConfirms; number++ {
+		pruned := number > 0 && number < config.ChtSize-1
+		if have := rawdb.ReadCanonicalHash(db, number) == (common.Hash{}); have != pruned {
+			t.Fatalf("Header #%d pruned mismatch: have %v, want %v", number, have, pruned)
+		}
+	}
+	// Retrieve a pruned header and ensure it matches the server's
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	header, err := client.handler.backend.blockchain.GetHeaderByNumberOdr(ctx, 5)
+	if err != nil {
+		t.Fatalf("Failed to retrieve pruned header: %v", err)
+	}
+	if want := server.backend.Blockchain().GetHeaderByNumber(5).Hash(); header.Hash() != want {
+		t.Fatalf("Retrieved header mismatch: have %x, want %x", header.Hash(), want)
+	}
+}
+
+// Test that the unattested local checkpoint advertised by a server is only used
+// by the clients trusting the server.
+func TestUnattestedCheckpointTrustedLes3(t *testing.T)   { testUnattestedCheckpoint(t, 3, true) }
+func TestUnattestedCheckpointUntrustedLes3(t *testing.T) { testUnattestedCheckpoint(t, 3, false) }
+
+func testUnattestedCheckpoint(t *testing.T, protocol int, trusted bool) {
+	config := light.TestServerIndexerConfig
+
+	waitIndexers := func(cIndexer, bIndexer, btIndexer *core.ChainIndexer) {
+		for {
+			cs, _, _ := cIndexer.Sections()
+			bts, _, _ := btIndexer.Sections()
+			if cs >= 1 && bts >= 1 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal("generate key err:", err)
+	}
+	node := enode.NewV4(&key.PublicKey, net.ParseIP("127.0.0.1"), 35000, 35000)
+
+	var ulcServers []string
+	if trusted {
+		ulcServers = []string{node.String()}
+	}
+	// Generate 512+4 blocks (totally 1 CHT sections), the checkpoint of which
+	// is not registered in the oracle.
+	server, client, tearDown := newClientServerEnv(t, int(config.ChtSize+config.ChtConfirms), protocol, waitIndexers, ulcServers, 100, false, false)
+	defer tearDown()
+	server.handler.server.config.UltraLightUnattestedCheckpoint = true
+
+	if cp := server.handler.server.unattestedCheckpoint(); cp == nil || cp.SectionIndex != 0 {
+		t.Fatalf("Unattested checkpoint mismatch: have %v, want section 0", cp)
+	}
+	expected := config.ChtSize + config.ChtConfirms
+
+	done := make(chan error)
+	client.handler.syncDone = func() {
+		header := client.handler.backend.blockchain.CurrentHeader()
+		if header.Number.Uint64() == expected {
+			done <- nil
+		} else {
+			done <- fmt.Errorf("blockchain length mismatch, want %d, got %d", expected, header.Number)
+		}
+	}
+	// Create connected peer pair.
+	if trusted {
+		speer, cpeer, err := connect(server.handler, node.ID(), client.handler, protocol)
+		if err != nil {
+			t.Fatalf("Failed to connect testing peers %v", err)
+		}
+		defer speer.close()
+		defer cpeer.close()
+	} else {
+		peer1, peer2, err := newTestPeerPair("peer", protocol, server.handler, client.handler)
+		if err != nil {
+			t.Fatalf("Failed to connect testing peers %v", err)
+		}
+		defer peer1.close()
+		defer peer2.close()
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("sync failed", err)
+		}
+	case <-time.NewTimer(10 * time.Second).C:
+		t.Fatal("checkpoint syncing timeout")
+	}
+	// The trusting client should start from the checkpoint, others from genesis
+	hash := rawdb.ReadCanonicalHash(client.db, 1)
+	if trusted && hash != (common.Hash{}) {
+		t.Error("Trusting client synced headers below the unattested checkpoint")
+	}
+	if !trusted && hash == (common.Hash{}) {
+		t.Error("Untrusting client used the unattested checkpoint")
+	}
+}
+
+// Tests that the client resyncs from the common ancestor on a deep reorg flagged
+// by the server.
+func TestDeepReorgSyncingLes3(t *testing.T) {
+	server, client, tearDown := newClientServerEnv(t, 200, 3, nil, nil, 0, false, false)
+	defer tearDown()
+
+	server.handler.server.config.LightDeepReorg = 100
+
+	// Signal every finished sync, the test checks the head after each of them
+	synced := make(chan struct{}, 1)
+	client.handler.syncDone = func() {
+		select {
+		case synced <- struct{}{}:
+		default:
+		}
+	}
+	peer1, peer2, err := newTestPeerPair("peer", 3, server.handler, client.handler)
+	if err != nil {
+		t.Fatalf("Failed to connect testing peers %v", err)
+	}
+	defer peer1.close()
+	defer peer2.close()
+
+	waitHead := func(head *types.Block) {
+		t.Helper()
+
+		timeout := time.NewTimer(10 * time.Second)
+		defer timeout.Stop()
+
+		for client.handler.backend.blockchain.CurrentHeader().Hash() != head.Hash() {
+			select {
+			case <-synced:
+			case <-timeout.C:
+				current := client.handler.backend.blockchain.CurrentHeader()
+				t.Fatalf("Client head mismatch: have #%d [%x], want #%d [%x]", current.Number, current.Hash(), head.NumberU64(), head.Hash())
+			}
+		}
+	}
+	waitHead(server.handler.blockchain.CurrentBlock())
+
+	// Announce a new head first, so the server knows the head being reorged.
+	// The single block is fetched without a sync, the reorg announcement is
+	// queued behind it on the same connection.
+	server.backend.Commit()
+
+	// Reorg the server chain 200 blocks deep and wait for the client to resync
+	waitHead(forkChain(t, server.handler.blockchain, server.db, 1, 201))
+}
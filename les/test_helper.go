@@ -157,6 +157,24 @@ func prepare(n int, backend *backends.SimulatedBackend) {
 	}
 }
 
+// forkChain inserts n blocks into the chain on top of the given canonical block,
+// diverging from the blocks above it, and returns the last inserted block.
+func forkChain(t *testing.T, chain *core.BlockChain, db ethdb.Database, parent uint64, n int) *types.Block {
+	block := chain.GetBlockByNumber(parent)
+
+	// Make sure the state of the fork point is on disk for generating the fork
+	if err := chain.StateCache().TrieDB().Commit(block.Root(), false); err != nil {
+		t.Fatalf("Failed to commit fork point state: %v", err)
+	}
+	blocks, _ := core.GenerateChain(chain.Config(), block, chain.Engine(), db, n, func(i int, b *core.BlockGen) {
+		b.SetExtra([]byte("fork"))
+	})
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("Failed to insert fork: %v", err)
+	}
+	return blocks[len(blocks)-1]
+}
+
 // testIndexers creates a set of indexers with specified params for testing purpose.
 func testIndexers(db ethdb.Database, odr light.OdrBackend, config *light.IndexerConfig) []*core.ChainIndexer {
 	var indexers [3]*core.ChainIndexer
@@ -220,6 +238,10 @@ func newTestClientHandler(backend *backends.SimulatedBackend, odr *LesOdr, index
 	}
 	client.handler = newClientHandler(ulcServers, ulcFraction, nil, client)
 
+	// There is no server pool to derive the request timeouts from, use the
+	// retriever's one instead
+	client.handler.fetcher.softRequestTimeout = odr.retriever.softRequestTimeout
+
 	if client.oracle != nil {
 		client.oracle.Start(backend)
 	}
@@ -281,10 +303,15 @@ func newTestServerHandler(blocks int, indexers []*core.ChainIndexer, db ethdb.Da
 		},
 		fcManager: flowcontrol.NewClientManager(nil, clock),
 	}
+	if indexers != nil {
+		server.chtIndexer, server.bloomTrieIndexer = indexers[0], indexers[2]
+	}
 	server.costTracker, server.freeCapacity = newCostTracker(db, server.config)
+	server.servingQueue.setFreeCapacity(server.freeCapacity)
 	server.costTracker.testCostList = testCostList(0) // Disable flow control mechanism.
 	server.clientPool = newClientPool(db, 1, clock, nil)
 	server.clientPool.setLimits(10000, 10000) // Assign enough capacity for clientpool
+	server.announcePrefs = newAnnouncePrefs(db)
 	server.handler = newServerHandler(server, simulation.Blockchain(), db, txpool, func() bool { return true })
 	if server.oracle != nil {
 		server.oracle.Start(simulation)
@@ -508,7 +535,7 @@ func newClientServerEnv(t *testing.T, blocks int, protocol int, callback indexer
 		clock = &mclock.Simulated{}
 	}
 	dist := newRequestDistributor(speers, clock)
-	rm := newRetrieveManager(speers, dist, func() time.Duration { return time.Millisecond * 500 })
+	rm := newRetrieveManager(speers, dist, func() time.Duration { return time.Millisecond * 500 }, nil)
 	odr := NewLesOdr(cdb, light.TestClientIndexerConfig, rm)
 
 	sindexers := testIndexers(sdb, nil, light.TestServerIndexerConfig)
@@ -84,6 +84,14 @@ func (q *ExecQueue) Queue(f func()) bool {
 	return ok
 }
 
+// Len returns the number of queued functions, including the one being executed.
+func (q *ExecQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.funcs)
+}
+
 // Clear drops all queued functions.
 func (q *ExecQueue) Clear() {
 	q.mu.Lock()
@@ -20,6 +20,7 @@ package light
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"math/big"
 	"sync"
@@ -45,6 +46,34 @@ var (
 	blockCacheLimit = 256
 )
 
+var prunedHeadersKey = []byte("LightPrunedHeaders") // Number of the first header not yet examined by header pruning
+
+// prunedEntrySize is the size of the database keys and canonical hash deleted
+// along with the header and total difficulty of a pruned block: the header and
+// td keys (41 + 42 bytes), the canonical hash entry (10 + 32) and the number
+// lookup entry (33 + 8).
+const prunedEntrySize = 41 + 42 + 10 + common.HashLength + 33 + 8
+
+// readPrunedHeaders retrieves the number of the first header not yet examined
+// by header pruning.
+func readPrunedHeaders(db ethdb.KeyValueReader) uint64 {
+	data, _ := db.Get(prunedHeadersKey)
+	if len(data) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+// writePrunedHeaders stores the number of the first header not yet examined
+// by header pruning.
+func writePrunedHeaders(db ethdb.KeyValueWriter, number uint64) {
+	var enc [8]byte
+	binary.BigEndian.PutUint64(enc[:], number)
+	if err := db.Put(prunedHeadersKey, enc[:]); err != nil {
+		log.Crit("Failed to store header pruning progress", "err", err)
+	}
+}
+
 // LightChain represents a canonical chain that by default only handles block
 // headers, downloading block bodies and receipts on demand through an ODR
 // interface. It only does header validation during chain insertion.
@@ -59,6 +88,7 @@ type LightChain struct {
 	chainHeadFeed event.Feed
 	scope         event.SubscriptionScope
 	genesisBlock  *types.Block
+	checkpoint    *params.TrustedCheckpoint // Latest trusted checkpoint, the header pruning boundary
 
 	bodyCache    *lru.Cache // Cache for the most recent block bodies
 	bodyRLPCache *lru.Cache // Cache for the most recent block bodies in RLP encoded format
@@ -131,6 +161,11 @@ func (lc *LightChain) AddTrustedCheckpoint(cp *params.TrustedCheckpoint) {
 	if lc.odr.BloomIndexer() != nil {
 		lc.odr.BloomIndexer().AddCheckpoint(cp.SectionIndex, cp.SectionHead)
 	}
+	lc.chainmu.Lock()
+	if lc.checkpoint == nil || lc.checkpoint.SectionIndex < cp.SectionIndex {
+		lc.checkpoint = cp
+	}
+	lc.chainmu.Unlock()
 	log.Info("Added trusted checkpoint", "block", (cp.SectionIndex+1)*lc.indexerConfig.ChtSize-1, "hash", cp.SectionHead)
 }
 
@@ -519,6 +554,65 @@ func (lc *LightChain) SyncCheckpoint(ctx context.Context, checkpoint *params.Tru
 	return false
 }
 
+// PruneHeaders deletes the canonical headers of the sections covered by the
+// latest trusted checkpoint, keeping the section heads needed to locate the
+// CHTs. Pruned headers are retrieved on demand with CHT proofs. It returns the
+// number of deleted headers and the approximate database space freed.
+func (lc *LightChain) PruneHeaders() (int, common.StorageSize, error) {
+	lc.chainmu.Lock()
+	defer lc.chainmu.Unlock()
+
+	if lc.checkpoint == nil || lc.odr.ChtIndexer() == nil {
+		return 0, 0, nil
+	}
+	// Only prune below the checkpoint's section head and the local head
+	limit := (lc.checkpoint.SectionIndex+1)*lc.indexerConfig.ChtSize - 1
+	if head := lc.hc.CurrentHeader().Number.Uint64(); head < limit {
+		limit = head
+	}
+	var (
+		start   = time.Now()
+		batch   = lc.chainDb.NewBatch()
+		count   int
+		size    common.StorageSize
+		number  = readPrunedHeaders(lc.chainDb)
+		section = lc.indexerConfig.ChtSize
+	)
+	if number == 0 {
+		number = 1 // Never prune the genesis
+	}
+	for ; number < limit; number++ {
+		if (number+1)%section == 0 {
+			continue // Keep the section heads
+		}
+		hash := rawdb.ReadCanonicalHash(lc.chainDb, number)
+		if hash == (common.Hash{}) {
+			continue
+		}
+		size += common.StorageSize(len(rawdb.ReadHeaderRLP(lc.chainDb, hash, number)) + len(rawdb.ReadTdRLP(lc.chainDb, hash, number)) + prunedEntrySize)
+		count++
+
+		rawdb.DeleteCanonicalHash(batch, number)
+		rawdb.DeleteHeader(batch, hash, number)
+		rawdb.DeleteTd(batch, hash, number)
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			writePrunedHeaders(batch, number+1)
+			if err := batch.Write(); err != nil {
+				return count, size, err
+			}
+			batch.Reset()
+		}
+	}
+	writePrunedHeaders(batch, number)
+	if err := batch.Write(); err != nil {
+		return count, size, err
+	}
+	if count > 0 {
+		log.Info("Pruned old headers", "count", count, "size", size, "elapsed", common.PrettyDuration(time.Since(start)))
+	}
+	return count, size, nil
+}
+
 // LockChain locks the chain mutex for reading so that multiple canonical hashes can be
 // retrieved while it is guaranteed that they belong to the same version of the chain
 func (lc *LightChain) LockChain() {
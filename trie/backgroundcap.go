@@ -0,0 +1,188 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+const (
+	// backgroundCapInterval is the time between two checks of the dirty cache
+	// size by the background flusher.
+	backgroundCapInterval = 100 * time.Millisecond
+
+	// backgroundCapBatch is the amount of data the background flusher writes
+	// out in one go before letting the other mutators in.
+	backgroundCapBatch = 256 * 1024
+)
+
+// memcacheFlushWaitTimer measures the time Cap and Commit spend waiting for the
+// background flusher to finish its current batch.
+var memcacheFlushWaitTimer = metrics.NewRegisteredResettingTimer("trie/memcache/flush/wait", nil)
+
+// StartBackgroundCap starts a background flusher which periodically checks the
+// size of the dirty cache and, once it exceeds the high watermark, flushes the
+// oldest nodes to disk in small batches until it drops below the low watermark.
+// The flusher never runs concurrently with Cap, Commit or a trie commit with a
+// leaf callback. If a flusher is already running, it is left untouched.
+func (db *Database) StartBackgroundCap(low, high common.StorageSize) {
+	db.capLock.Lock()
+	defer db.capLock.Unlock()
+
+	if db.capQuit != nil {
+		return
+	}
+	db.capQuit = make(chan chan struct{})
+	go db.backgroundCap(low, high, db.capQuit)
+}
+
+// StopBackgroundCap terminates the background flusher and waits until it exits.
+func (db *Database) StopBackgroundCap() {
+	db.capLock.Lock()
+	defer db.capLock.Unlock()
+
+	if db.capQuit == nil {
+		return
+	}
+	done := make(chan struct{})
+	db.capQuit <- done
+	<-done
+	db.capQuit = nil
+}
+
+// backgroundCap is the main loop of the background flusher.
+func (db *Database) backgroundCap(low, high common.StorageSize, quit chan chan struct{}) {
+	ticker := time.NewTicker(backgroundCapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case done := <-quit:
+			close(done)
+			return
+
+		case <-ticker.C:
+			if size, _ := db.Size(); size <= high {
+				continue
+			}
+			for {
+				db.flushLock.Lock()
+				more, err := db.capBatch(low)
+				db.flushLock.Unlock()
+
+				if err != nil {
+					log.Error("Failed to flush dirty trie nodes in background", "err", err)
+				}
+				if err != nil || !more {
+					break
+				}
+				select {
+				case done := <-quit:
+					close(done)
+					return
+				default:
+				}
+			}
+		}
+	}
+}
+
+// lockFlush acquires the flush lock on behalf of a synchronous mutator, metering
+// the time spent waiting for the background flusher.
+func (db *Database) lockFlush() {
+	start := time.Now()
+	db.flushLock.Lock()
+	memcacheFlushWaitTimer.UpdateSince(start)
+}
+
+// capBatch flushes a single batch of the oldest dirty nodes to disk, bounded by
+// backgroundCapBatch and the low watermark. It returns whether the dirty cache
+// is still above the watermark. The nodes are gathered under the read lock and
+// only removed from the cache after the write, skipping those dereferenced in
+// the meantime, so concurrent readers and inserters are only blocked briefly.
+//
+// Note, this method assumes the flush lock is held.
+func (db *Database) capBatch(low common.StorageSize) (bool, error) {
+	db.lock.RLock()
+	var (
+		size   = db.dirtySize()
+		batch  = db.diskdb.NewBatch()
+		hashes []common.Hash
+	)
+	for hash := db.oldest; hash != (common.Hash{}) && size > low && batch.ValueSize() < backgroundCapBatch; {
+		node := db.dirties[hash]
+		if node == nil {
+			break // Corrupted flush-list, leave it to the next Cap to repair
+		}
+		if err := batch.Put(hash[:], node.rlp()); err != nil {
+			db.lock.RUnlock()
+			return false, err
+		}
+		hashes = append(hashes, hash)
+		size -= common.StorageSize(common.HashLength + int(node.size) + cachedNodeSize)
+		if node.children != nil {
+			size -= common.StorageSize(cachedNodeChildrenSize + len(node.children)*(common.HashLength+2))
+		}
+		hash = node.flushNext
+	}
+	db.lock.RUnlock()
+
+	if len(hashes) == 0 {
+		return false, nil
+	}
+	start := time.Now()
+	if err := batch.Write(); err != nil {
+		return false, err
+	}
+	db.mirrorBatch(batch)
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	nodes, storage := len(db.dirties), db.dirtiesSize
+	for _, hash := range hashes {
+		node, ok := db.dirties[hash]
+		if !ok {
+			continue // Dereferenced since, nothing to clean up
+		}
+		db.unlinkFlushList(hash, node)
+		delete(db.dirties, hash)
+		db.dropPendingRefs(node)
+		db.releaseQuota(node)
+
+		db.dirtiesSize -= common.StorageSize(common.HashLength + int(node.size))
+		if node.children != nil {
+			db.childrenSize -= common.StorageSize(cachedNodeChildrenSize + len(node.children)*(common.HashLength+2))
+		}
+	}
+	db.resetCommitEstimate()
+	db.refreshCacheGauges()
+
+	db.flushnodes += uint64(nodes - len(db.dirties))
+	db.flushsize += storage - db.dirtiesSize
+	db.flushtime += time.Since(start)
+
+	memcacheFlushTimeTimer.Update(time.Since(start))
+	memcacheFlushSizeMeter.Mark(int64(storage - db.dirtiesSize))
+	memcacheFlushNodesMeter.Mark(int64(nodes - len(db.dirties)))
+
+	return db.dirtySize() > low, nil
+}
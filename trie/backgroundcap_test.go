@@ -0,0 +1,129 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that the background flusher keeps the dirty cache within the watermarks
+// under continuous inserts, without losing any data.
+func TestDatabaseBackgroundCap(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabase(diskdb)
+
+	const low, high = 64 * 1024, 128 * 1024
+	db.StartBackgroundCap(low, high)
+	defer db.StopBackgroundCap()
+
+	var (
+		hashes  []common.Hash
+		maxSize common.StorageSize
+	)
+	for i := 0; i < 4000; i++ {
+		blob := make([]byte, 100)
+		binary.BigEndian.PutUint64(blob, uint64(i))
+		hash := crypto.Keccak256Hash(blob)
+		db.InsertBlob(hash, blob)
+		hashes = append(hashes, hash)
+
+		if size, _ := db.Size(); size > maxSize {
+			maxSize = size
+		}
+		if i%10 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// Wait for the flusher to catch up
+	for i := 0; ; i++ {
+		if size, _ := db.Size(); size <= high {
+			break
+		}
+		if i == 50 {
+			size, _ := db.Size()
+			t.Fatalf("dirty cache not flushed: %v > %v", size, common.StorageSize(high))
+		}
+		time.Sleep(backgroundCapInterval)
+	}
+	if maxSize > 4*high {
+		t.Errorf("dirty cache grew too large: %v", maxSize)
+	}
+	if diskdb.Len() == 0 {
+		t.Fatalf("nothing flushed to disk")
+	}
+	for _, hash := range hashes {
+		if _, err := db.Node(hash); err != nil {
+			t.Fatalf("node %x lost: %v", hash, err)
+		}
+	}
+	if err := db.checkFlushList(); err != nil {
+		t.Fatalf("flush-list corrupted: %v", err)
+	}
+	// Synchronous flushes should still work alongside the background one
+	if err := db.Cap(0); err != nil {
+		t.Fatalf("failed to cap: %v", err)
+	}
+	if nodes := len(db.Nodes()); nodes != 0 {
+		t.Errorf("nodes left after cap: %d", nodes)
+	}
+}
+
+// Tests that the background flusher doesn't evict the parents of a trie commit
+// before the leaf callback got to reference them.
+func TestDatabaseBackgroundCapLeafReferences(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+
+	storage := makeDirtyTrie(db, 10)
+
+	accounts, _ := New(common.Hash{}, db)
+	accounts.Update([]byte("account"), storage[:])
+
+	db.StartBackgroundCap(0, 0)
+	defer db.StopBackgroundCap()
+
+	var referenced bool
+	root, err := accounts.Commit(func(leaf []byte, parent common.Hash) error {
+		// Give the flusher a few rounds to evict the parent
+		time.Sleep(3 * backgroundCapInterval)
+
+		db.lock.RLock()
+		_, ok := db.dirties[parent]
+		db.lock.RUnlock()
+		if !ok {
+			t.Errorf("parent %x flushed before its leaf was referenced", parent)
+		}
+		db.Reference(common.BytesToHash(leaf), parent)
+		referenced = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to commit account trie: %v", err)
+	}
+	if !referenced {
+		t.Fatalf("leaf callback not invoked")
+	}
+	db.Reference(root, common.Hash{})
+	if refs := db.CacheStats().RetainedRootRefs; refs > 2 {
+		t.Errorf("storage root retained by the meta root: %d root references", refs)
+	}
+}
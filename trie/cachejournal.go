@@ -0,0 +1,250 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/fastcache"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+const (
+	// defaultSlowCacheSave is the default duration of a clean cache save above
+	// which a warning is emitted.
+	defaultSlowCacheSave = time.Minute
+
+	// cacheSaveFailureWarn is the number of consecutive failed clean cache saves
+	// above which a warning is emitted.
+	cacheSaveFailureWarn = 3
+
+	// cacheSaveWarnInterval is the minimum time between two warnings about the
+	// clean cache saves.
+	cacheSaveWarnInterval = 10 * time.Minute
+)
+
+// errCacheSaveInProgress is returned if the clean cache is requested to be saved
+// while a previous save is still running.
+var errCacheSaveInProgress = errors.New("clean cache saving already in progress")
+
+var (
+	memcacheJournalSaveTimer    = metrics.NewRegisteredTimer("trie/memcache/journal/save", nil)
+	memcacheJournalSizeGauge    = metrics.NewRegisteredGauge("trie/memcache/journal/size", nil)
+	memcacheJournalSuccessGauge = metrics.NewRegisteredGauge("trie/memcache/journal/success", nil)
+	memcacheJournalFailMeter    = metrics.NewRegisteredMeter("trie/memcache/journal/fail", nil)
+)
+
+// saveCacheFile writes the clean cache into the given directory, it is replaced
+// by the tests to inject failures.
+var saveCacheFile = (*fastcache.Cache).SaveToFileConcurrent
+
+// cacheSaveStats tracks the outcome of the clean cache saves.
+type cacheSaveStats struct {
+	saved    time.Time          // Time of the last successful save
+	elapsed  time.Duration      // Duration of the last successful save
+	size     common.StorageSize // Size of the journal on disk after the last successful save
+	failures int                // Number of saves failed since the last successful one
+	err      error              // Error of the last failed save
+
+	slow   time.Duration // Duration of a save above which a warning is emitted
+	warned time.Time     // Time of the last warning, to rate limit them
+
+	lock sync.Mutex
+}
+
+// warn emits a warning about the clean cache saves, unless one was emitted
+// recently.
+//
+// Note, this method assumes that the stats lock is held!
+func (s *cacheSaveStats) warn(msg string, ctx ...interface{}) {
+	if now := time.Now(); now.Sub(s.warned) >= cacheSaveWarnInterval {
+		s.warned = now
+		log.Warn(msg, ctx...)
+	}
+}
+
+// SetSlowCacheSave sets the duration of a clean cache save above which a warning
+// is emitted. A zero duration restores the default.
+func (db *Database) SetSlowCacheSave(threshold time.Duration) {
+	db.saveStats.lock.Lock()
+	defer db.saveStats.lock.Unlock()
+
+	db.saveStats.slow = threshold
+}
+
+// NewDatabaseWithJournal creates a new trie database with a clean cache, loading
+// the cache contents from the given journal directory if it was saved earlier.
+// If the journal is missing or unreadable, an empty cache is created.
+func NewDatabaseWithJournal(diskdb ethdb.KeyValueStore, cache int, journal string) *Database {
+	db := NewDatabaseWithCache(diskdb, 0)
+	if cache > 0 {
+		db.cleans = fastcache.LoadFromFileOrNew(journal, cache*1024*1024)
+		db.cleanLimit = cache * 1024 * 1024
+	}
+	return db
+}
+
+// SaveCache saves the clean cache into the given journal directory using all
+// available CPU cores. Only one save may run at a time, concurrent calls are
+// skipped and return an error.
+func (db *Database) SaveCache(dir string) error {
+	return db.saveCache(dir, runtime.GOMAXPROCS(0))
+}
+
+// saveCache saves the clean cache into the given journal directory. The cache is
+// first written next to the journal and then swapped in with renames, so a crash
+// at any point leaves either the old journal, the new one, or none at all, but
+// never a partially written one.
+func (db *Database) saveCache(dir string, threads int) error {
+	if db.cleans == nil {
+		return nil
+	}
+	if !atomic.CompareAndSwapUint32(&db.cacheSaving, 0, 1) {
+		log.Warn("Skipping clean cache saving, already in progress", "path", dir)
+		return errCacheSaveInProgress
+	}
+	defer atomic.StoreUint32(&db.cacheSaving, 0)
+
+	log.Info("Writing clean trie cache to disk", "path", dir, "threads", threads)
+	start := time.Now()
+
+	if err := db.writeCache(dir, threads); err != nil {
+		log.Error("Failed to persist clean trie cache", "error", err)
+		db.cacheSaveFailed(dir, err)
+		return err
+	}
+	elapsed := time.Since(start)
+	log.Info("Persisted the clean trie cache", "path", dir, "elapsed", common.PrettyDuration(elapsed))
+	db.cacheSaved(dir, elapsed)
+	return nil
+}
+
+// writeCache writes the clean cache next to the journal in the given directory
+// and swaps it in with renames.
+func (db *Database) writeCache(dir string, threads int) error {
+	tmp, old := dir+".tmp", dir+".old"
+	if err := saveCacheFile(db.cleans, tmp, threads); err != nil {
+		return err
+	}
+	if err := db.writeSharedCache(tmp); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(dir, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// cacheSaved records a successful clean cache save, warning if it was too slow.
+func (db *Database) cacheSaved(dir string, elapsed time.Duration) {
+	var size common.StorageSize
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += common.StorageSize(info.Size())
+		}
+		return nil
+	})
+	stats := &db.saveStats
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.saved, stats.elapsed, stats.size = time.Now(), elapsed, size
+	stats.failures, stats.err = 0, nil
+
+	memcacheJournalSaveTimer.Update(elapsed)
+	memcacheJournalSizeGauge.Update(int64(size))
+	memcacheJournalSuccessGauge.Update(stats.saved.Unix())
+
+	slow := stats.slow
+	if slow == 0 {
+		slow = defaultSlowCacheSave
+	}
+	if elapsed > slow {
+		stats.warn("Clean trie cache saving is slow", "path", dir, "elapsed", common.PrettyDuration(elapsed), "size", size)
+	}
+}
+
+// cacheSaveFailed records a failed clean cache save, warning if the saves keep
+// failing.
+func (db *Database) cacheSaveFailed(dir string, err error) {
+	stats := &db.saveStats
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.failures++
+	stats.err = err
+	memcacheJournalFailMeter.Mark(1)
+
+	if stats.failures >= cacheSaveFailureWarn {
+		ctx := []interface{}{"path", dir, "failures", stats.failures, "err", err}
+		if !stats.saved.IsZero() {
+			ctx = append(ctx, "lastsaved", common.PrettyAge(stats.saved))
+		}
+		stats.warn("Clean trie cache saving keeps failing", ctx...)
+	}
+}
+
+// logCacheSaveHealth emits a summary of the state of the clean cache saves.
+func (db *Database) logCacheSaveHealth(dir string) {
+	stats := &db.saveStats
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	ctx := []interface{}{"path", dir, "size", stats.size, "elapsed", common.PrettyDuration(stats.elapsed), "failures", stats.failures}
+	if !stats.saved.IsZero() {
+		ctx = append(ctx, "lastsaved", common.PrettyAge(stats.saved))
+	}
+	if stats.err != nil {
+		ctx = append(ctx, "err", stats.err)
+	}
+	log.Info("Clean trie cache journal status", ctx...)
+}
+
+// SaveCachePeriodically saves the clean cache into the given journal directory
+// with the specified interval until the stop channel is closed. It only uses a
+// single CPU core to avoid hurting block processing. Saves colliding with a
+// manual SaveCache are skipped.
+func (db *Database) SaveCachePeriodically(dir string, interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.saveCache(dir, 1); err != errCacheSaveInProgress {
+				db.logCacheSaveHealth(dir)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
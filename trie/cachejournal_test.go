@@ -0,0 +1,164 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/fastcache"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Tests that manual and periodic clean cache saves can run concurrently without
+// corrupting the journal, and that the saved cache is loaded back.
+func TestDatabaseConcurrentCacheSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "triecache")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	journal := filepath.Join(dir, "journal")
+
+	db := NewDatabaseWithCache(memorydb.New(), 1)
+	for i := byte(0); i < 100; i++ {
+		db.cleans.Set(crypto.Keccak256([]byte{i}), []byte{i})
+	}
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		db.SaveCachePeriodically(journal, time.Millisecond, stopCh)
+		close(done)
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := db.SaveCache(journal); err != nil && err != errCacheSaveInProgress {
+				t.Errorf("Failed to save cache: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stopCh)
+	<-done
+
+	// Make sure the last save is complete and nothing is left behind
+	if err := db.SaveCache(journal); err != nil {
+		t.Fatalf("Failed to save cache: %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Journal directory entry count mismatch: have %d, want 1", len(entries))
+	}
+	loaded := NewDatabaseWithJournal(memorydb.New(), 1, journal)
+	for i := byte(0); i < 100; i++ {
+		if blob := loaded.cleans.Get(nil, crypto.Keccak256([]byte{i})); !bytes.Equal(blob, []byte{i}) {
+			t.Fatalf("Cached item %d mismatch: have %x, want %x", i, blob, []byte{i})
+		}
+	}
+}
+
+// Tests that the outcome of the clean cache saves is tracked, and that slow or
+// repeatedly failing saves are warned about, but not too often.
+func TestDatabaseCacheSaveHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "triecache")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	journal := filepath.Join(dir, "journal")
+
+	// Capture the warnings and inject failures into the saves
+	var warnings []string
+	handler := log.Root().GetHandler()
+	defer log.Root().SetHandler(handler)
+	log.Root().SetHandler(log.FuncHandler(func(r *log.Record) error {
+		if r.Lvl == log.LvlWarn {
+			warnings = append(warnings, r.Msg)
+		}
+		return nil
+	}))
+	var fail error
+	defer func(save func(*fastcache.Cache, string, int) error) { saveCacheFile = save }(saveCacheFile)
+	saveCacheFile = func(cache *fastcache.Cache, path string, threads int) error {
+		if fail != nil {
+			return fail
+		}
+		time.Sleep(time.Millisecond)
+		return cache.SaveToFileConcurrent(path, threads)
+	}
+	db := NewDatabaseWithCache(memorydb.New(), 1)
+	for i := byte(0); i < 100; i++ {
+		db.cleans.Set(crypto.Keccak256([]byte{i}), []byte{i})
+	}
+	// A successful save should be reflected in the stats
+	if err := db.SaveCache(journal); err != nil {
+		t.Fatalf("Failed to save cache: %v", err)
+	}
+	stats := db.CacheStats()
+	if stats.JournalSaved.IsZero() || stats.JournalElapsed < time.Millisecond || stats.JournalSize == 0 || stats.JournalFailures != 0 {
+		t.Fatalf("Save stats mismatch: saved %v, elapsed %v, size %v, failures %d", stats.JournalSaved, stats.JournalElapsed, stats.JournalSize, stats.JournalFailures)
+	}
+	if len(warnings) != 0 {
+		t.Fatalf("Unexpected warnings: %v", warnings)
+	}
+	// Repeated failures should only be warned about once the threshold is reached
+	fail = errors.New("disk full")
+	for i := 1; i <= 2*cacheSaveFailureWarn; i++ {
+		if err := db.SaveCache(journal); err != fail {
+			t.Fatalf("Save error mismatch: have %v, want %v", err, fail)
+		}
+		if failures := db.CacheStats().JournalFailures; failures != i {
+			t.Fatalf("Failure count mismatch: have %d, want %d", failures, i)
+		}
+		want := 0
+		if i >= cacheSaveFailureWarn {
+			want = 1
+		}
+		if len(warnings) != want {
+			t.Fatalf("Warning count mismatch after %d failures: have %d, want %d", i, len(warnings), want)
+		}
+	}
+	// A slow save should reset the failures, its warning is rate limited
+	fail, warnings = nil, nil
+	db.SetSlowCacheSave(time.Nanosecond)
+	if err := db.SaveCache(journal); err != nil {
+		t.Fatalf("Failed to save cache: %v", err)
+	}
+	if failures := db.CacheStats().JournalFailures; failures != 0 {
+		t.Fatalf("Failures not reset: %d", failures)
+	}
+	if len(warnings) != 0 {
+		t.Fatalf("Warnings not rate limited: %v", warnings)
+	}
+	db.saveStats.warned = time.Time{}
+	if err := db.SaveCache(journal); err != nil {
+		t.Fatalf("Failed to save cache: %v", err)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("Slow save warning count mismatch: have %d, want 1", len(warnings))
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"time"
+
+	"github.com/VictoriaMetrics/fastcache"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var (
+	memcacheDirtyNodesGauge    = metrics.NewRegisteredGauge("trie/memcache/dirty/nodes", nil)
+	memcacheDirtySizeGauge     = metrics.NewRegisteredGauge("trie/memcache/dirty/size", nil)
+	memcacheChildrenSizeGauge  = metrics.NewRegisteredGauge("trie/memcache/children/size", nil)
+	memcachePreimageSizeGauge  = metrics.NewRegisteredGauge("trie/memcache/preimages/size", nil)
+	memcacheOldestAgeGauge     = metrics.NewRegisteredGauge("trie/memcache/dirty/oldest", nil)
+	memcacheCleanEntriesGauge  = metrics.NewRegisteredGauge("trie/memcache/clean/entries", nil)
+	memcacheCleanSizeGauge     = metrics.NewRegisteredGauge("trie/memcache/clean/size", nil)
+	memcacheCleanHitRatioGauge = metrics.NewRegisteredGaugeFloat64("trie/memcache/clean/hitratio", nil)
+)
+
+// CacheStats is a snapshot of the state of the trie node caches.
+type CacheStats struct {
+	CleanHits    uint64             // Number of clean cache lookups served
+	CleanMisses  uint64             // Number of clean cache lookups missed
+	CleanEntries uint64             // Number of nodes in the clean cache
+	CleanSize    common.StorageSize // Memory used by the clean cache
+
+	DirtyNodes   int                // Number of nodes in the dirty cache
+	DirtySize    common.StorageSize // Storage size of the dirty nodes (exc. metadata)
+	ChildrenSize common.StorageSize // Storage size of the external children tracking
+	PreimageSize common.StorageSize // Storage size of the cached preimages
+
+	RetainedRoots    int    // Number of distinct trie roots retained by the meta root
+	RetainedRootRefs uint64 // Number of references to the retained roots, duplicates included
+	OrphanRefs       uint64 // Number of references dropped because their parent wasn't cached
+
+	PreimageRecording bool   // Whether the preimages of the secure trie keys are recorded
+	PreimagesRecorded uint64 // Preimages recorded since the database was created
+
+	JournalSaved    time.Time          // Time of the last successful clean cache save
+	JournalElapsed  time.Duration      // Duration of the last successful clean cache save
+	JournalSize     common.StorageSize // Size of the clean cache journal after the last successful save
+	JournalFailures int                // Number of clean cache saves failed since the last successful one
+
+	FlushListLength int           // Number of nodes linked in the flush-list
+	OldestAge       time.Duration // Time since the oldest dirty node was inserted
+	NewestAge       time.Duration // Time since the newest dirty node was inserted
+
+	GCNodes    uint64             // Nodes garbage collected since the last commit
+	GCSize     common.StorageSize // Data garbage collected since the last commit
+	GCTime     time.Duration      // Time spent on garbage collection since the last commit
+	FlushNodes uint64             // Nodes flushed since the last commit
+	FlushSize  common.StorageSize // Data flushed since the last commit
+	FlushTime  time.Duration      // Time spent on flushing since the last commit
+}
+
+// CacheStats returns a snapshot of the statistics of the clean and dirty caches,
+// also refreshing the cache gauges.
+func (db *Database) CacheStats() CacheStats {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	stats := CacheStats{
+		DirtyNodes:   len(db.dirties) - 1,
+		DirtySize:    db.dirtiesSize,
+		ChildrenSize: db.childrenSize,
+		PreimageSize: db.preimagesSize,
+		GCNodes:      db.gcnodes,
+		GCSize:       db.gcsize,
+		GCTime:       db.gctime,
+		FlushNodes:   db.flushnodes,
+		FlushSize:    db.flushsize,
+		FlushTime:    db.flushtime,
+
+		RetainedRoots:     db.roots.len(),
+		RetainedRootRefs:  db.roots.refs,
+		OrphanRefs:        db.orphanRefs,
+		PreimageRecording: !db.preimagesOff,
+		PreimagesRecorded: db.preimagesRecorded,
+	}
+	db.saveStats.lock.Lock()
+	stats.JournalSaved, stats.JournalElapsed = db.saveStats.saved, db.saveStats.elapsed
+	stats.JournalSize, stats.JournalFailures = db.saveStats.size, db.saveStats.failures
+	db.saveStats.lock.Unlock()
+
+	if db.cleans != nil {
+		var cs fastcache.Stats
+		db.cleans.UpdateStats(&cs)
+
+		stats.CleanHits = cs.GetCalls - cs.Misses
+		stats.CleanMisses = cs.Misses
+		stats.CleanEntries = cs.EntriesCount
+		stats.CleanSize = common.StorageSize(cs.BytesSize)
+	}
+	// Walk the flush-list, bailing out if it's longer than the cache
+	for hash := db.oldest; hash != (common.Hash{}) && stats.FlushListLength < len(db.dirties); stats.FlushListLength++ {
+		node, ok := db.dirties[hash]
+		if !ok {
+			break
+		}
+		hash = node.flushNext
+	}
+	now := db.clock.Now()
+	if node, ok := db.dirties[db.oldest]; ok && db.oldest != (common.Hash{}) {
+		stats.OldestAge = time.Duration(now - node.inserted)
+	}
+	if node, ok := db.dirties[db.newest]; ok && db.newest != (common.Hash{}) {
+		stats.NewestAge = time.Duration(now - node.inserted)
+	}
+	updateDirtyGauges(&stats)
+	if db.cleans != nil {
+		memcacheCleanEntriesGauge.Update(int64(stats.CleanEntries))
+		memcacheCleanSizeGauge.Update(int64(stats.CleanSize))
+		if lookups := stats.CleanHits + stats.CleanMisses; lookups > 0 {
+			memcacheCleanHitRatioGauge.Update(float64(stats.CleanHits) / float64(lookups))
+		}
+	}
+	return stats
+}
+
+// OldestNodeAge returns the time elapsed since the insertion of the oldest node
+// of the dirty cache, or zero if the cache is empty.
+func (db *Database) OldestNodeAge() time.Duration {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if node, ok := db.dirties[db.oldest]; ok && db.oldest != (common.Hash{}) {
+		return time.Duration(db.clock.Now() - node.inserted)
+	}
+	return 0
+}
+
+// FlushListHistogram counts the dirty nodes by age. The buckets are the upper
+// bounds of the age ranges in increasing order: the i-th count is the number of
+// nodes younger than buckets[i] but not younger than buckets[i-1]. An additional
+// last count holds the nodes not younger than the last bucket.
+func (db *Database) FlushListHistogram(buckets []time.Duration) []int {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var (
+		counts = make([]int, len(buckets)+1)
+		now    = db.clock.Now()
+		seen   int
+	)
+	// Walk the flush-list, bailing out if it's longer than the cache
+	for hash := db.oldest; hash != (common.Hash{}) && seen < len(db.dirties); seen++ {
+		node, ok := db.dirties[hash]
+		if !ok {
+			break
+		}
+		age := time.Duration(now - node.inserted)
+		i := 0
+		for i < len(buckets) && age >= buckets[i] {
+			i++
+		}
+		counts[i]++
+		hash = node.flushNext
+	}
+	return counts
+}
+
+// refreshCacheGauges updates the dirty cache and read statistics gauges. It's
+// called after every bulk modification of the dirty cache.
+//
+// Note, this method assumes that the database's lock is held!
+func (db *Database) refreshCacheGauges() {
+	if !metrics.Enabled {
+		return
+	}
+	stats := CacheStats{
+		DirtyNodes:   len(db.dirties) - 1,
+		DirtySize:    db.dirtiesSize,
+		ChildrenSize: db.childrenSize,
+		PreimageSize: db.preimagesSize,
+
+		RetainedRoots:    db.roots.len(),
+		RetainedRootRefs: db.roots.refs,
+	}
+	if node, ok := db.dirties[db.oldest]; ok && db.oldest != (common.Hash{}) {
+		stats.OldestAge = time.Duration(db.clock.Now() - node.inserted)
+	}
+	updateDirtyGauges(&stats)
+	db.updateReadGauges()
+}
+
+// updateDirtyGauges publishes the dirty cache statistics in the metrics system.
+func updateDirtyGauges(stats *CacheStats) {
+	memcacheDirtyNodesGauge.Update(int64(stats.DirtyNodes))
+	memcacheDirtySizeGauge.Update(int64(stats.DirtySize))
+	memcacheChildrenSizeGauge.Update(int64(stats.ChildrenSize))
+	memcachePreimageSizeGauge.Update(int64(stats.PreimageSize))
+	memcacheOldestAgeGauge.Update(int64(stats.OldestAge))
+	memcacheRetainedRootsGauge.Update(int64(stats.RetainedRoots))
+	memcacheRetainedRefsGauge.Update(int64(stats.RetainedRootRefs))
+}
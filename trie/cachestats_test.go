@@ -0,0 +1,129 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that the cache statistics track a deterministic sequence of inserts,
+// dereferences, commits and reads.
+func TestDatabaseCacheStats(t *testing.T) {
+	db := NewDatabaseWithCache(memorydb.New(), 1)
+
+	root := makeDirtyTrie(db, 100)
+	other := makeDirtyTrie(db, 20)
+
+	inserted := db.CacheStats()
+	if inserted.DirtyNodes != len(db.dirties)-1 || inserted.DirtyNodes == 0 {
+		t.Fatalf("dirty node count mismatch: have %d, want %d", inserted.DirtyNodes, len(db.dirties)-1)
+	}
+	if inserted.FlushListLength != inserted.DirtyNodes {
+		t.Errorf("flush-list length mismatch: have %d, want %d", inserted.FlushListLength, inserted.DirtyNodes)
+	}
+	if inserted.DirtySize != db.dirtiesSize || inserted.ChildrenSize != db.childrenSize {
+		t.Errorf("size mismatch: have %v/%v, want %v/%v", inserted.DirtySize, inserted.ChildrenSize, db.dirtiesSize, db.childrenSize)
+	}
+	if inserted.OldestAge < inserted.NewestAge {
+		t.Errorf("oldest node younger than newest: %v < %v", inserted.OldestAge, inserted.NewestAge)
+	}
+	if inserted.CleanEntries != 0 || inserted.CleanHits != 0 || inserted.CleanMisses != 0 {
+		t.Errorf("clean cache not empty: %+v", inserted)
+	}
+	// Dereference a trie, the collected nodes should be reported
+	db.Dereference(other)
+	collected := db.CacheStats()
+	if collected.GCNodes == 0 || collected.GCNodes != uint64(inserted.DirtyNodes-collected.DirtyNodes) {
+		t.Errorf("gc node count mismatch: have %d, want %d", collected.GCNodes, inserted.DirtyNodes-collected.DirtyNodes)
+	}
+	// Commit the rest, moving everything into the clean cache
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit database: %v", err)
+	}
+	committed := db.CacheStats()
+	if committed.DirtyNodes != 0 || committed.FlushListLength != 0 || committed.DirtySize != 0 {
+		t.Errorf("dirty cache not empty after commit: %+v", committed)
+	}
+	if committed.GCNodes != 0 {
+		t.Errorf("gc counters not reset by commit: %d", committed.GCNodes)
+	}
+	if committed.CleanEntries != uint64(collected.DirtyNodes) {
+		t.Errorf("clean entry count mismatch: have %d, want %d", committed.CleanEntries, collected.DirtyNodes)
+	}
+	// Read a cached and a missing node
+	db.Node(root)
+	db.Node(common.HexToHash("0xdeadbeef"))
+	if read := db.CacheStats(); read.CleanHits != 1 || read.CleanMisses != 1 {
+		t.Errorf("clean read stats mismatch: have %d hits and %d misses, want 1 and 1", read.CleanHits, read.CleanMisses)
+	}
+}
+
+// Tests that the age of the dirty nodes is tracked from their insertion.
+func TestDatabaseFlushListAges(t *testing.T) {
+	var (
+		clock = &mclock.Simulated{}
+		db    = NewDatabase(memorydb.New())
+	)
+	db.clock = clock
+
+	if age := db.OldestNodeAge(); age != 0 {
+		t.Fatalf("empty cache age mismatch: have %v, want 0", age)
+	}
+	insert := func(n int) {
+		for i := 0; i < n; i++ {
+			blob := []byte(fmt.Sprintf("node %d at %v", i, clock.Now()))
+			db.InsertBlob(crypto.Keccak256Hash(blob), blob)
+		}
+	}
+	insert(1)
+	clock.Run(5 * time.Second)
+	insert(2)
+	clock.Run(3 * time.Second)
+	insert(3)
+	clock.Run(time.Second)
+
+	if age := db.OldestNodeAge(); age != 9*time.Second {
+		t.Errorf("oldest node age mismatch: have %v, want %v", age, 9*time.Second)
+	}
+	buckets := []time.Duration{2 * time.Second, 5 * time.Second}
+	if have, want := db.FlushListHistogram(buckets), []int{3, 2, 1}; !reflect.DeepEqual(have, want) {
+		t.Errorf("histogram mismatch: have %v, want %v", have, want)
+	}
+	// Bucket bounds are exclusive, nodes exactly at a bound fall above it
+	buckets = []time.Duration{time.Second, 4 * time.Second, 9 * time.Second}
+	if have, want := db.FlushListHistogram(buckets), []int{0, 3, 2, 1}; !reflect.DeepEqual(have, want) {
+		t.Errorf("histogram mismatch at bounds: have %v, want %v", have, want)
+	}
+	if have, want := db.FlushListHistogram(nil), []int{6}; !reflect.DeepEqual(have, want) {
+		t.Errorf("histogram mismatch without buckets: have %v, want %v", have, want)
+	}
+	// Flushing the oldest nodes should make the cache younger
+	if err := db.Cap(db.dirtySize() - 1); err != nil {
+		t.Fatalf("failed to cap database: %v", err)
+	}
+	if age := db.OldestNodeAge(); age != 4*time.Second {
+		t.Errorf("oldest node age after cap mismatch: have %v, want %v", age, 4*time.Second)
+	}
+}
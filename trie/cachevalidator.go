@@ -0,0 +1,166 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+const (
+	// cacheHitReservoirSize is the number of recently hit clean cache keys the
+	// validator samples from.
+	cacheHitReservoirSize = 1024
+
+	// cacheHitSampleRate is the inverse of the fraction of clean cache keys whose
+	// hits are tracked, selected by the first byte of the hash. Keeping most hits
+	// away from the reservoir lock keeps the validator off the hot read path;
+	// a cache belonging to a different database diverges on all keys anyway.
+	cacheHitSampleRate = 16
+
+	// cacheValidationSamples is the number of clean cache entries cross-checked
+	// against the disk in a validation round.
+	cacheValidationSamples = 64
+
+	// cacheValidationThreshold is the number of mismatching entries after which
+	// the clean cache is considered corrupted and is wiped entirely.
+	cacheValidationThreshold = 16
+)
+
+var (
+	cacheValidationCheckMeter    = metrics.NewRegisteredMeter("trie/memcache/clean/validate/check", nil)
+	cacheValidationMismatchMeter = metrics.NewRegisteredMeter("trie/memcache/clean/validate/mismatch", nil)
+	cacheValidationWipeMeter     = metrics.NewRegisteredMeter("trie/memcache/clean/validate/wipe", nil)
+)
+
+// hitReservoir is a ring buffer of the recently hit clean cache keys.
+type hitReservoir struct {
+	enabled uint32 // Whether hits are being tracked (atomic)
+
+	lock       sync.Mutex
+	keys       []common.Hash
+	next       int // Position of the next key to overwrite
+	mismatches int // Mismatches found since the last wipe
+}
+
+// trackCleanHit records a clean cache hit for the validator to sample, if cache
+// validation is running and the key is part of the sampled subset.
+func (db *Database) trackCleanHit(hash common.Hash) {
+	r := &db.cleanHits
+	if atomic.LoadUint32(&r.enabled) == 0 || hash[0]%cacheHitSampleRate != 0 {
+		return
+	}
+	r.lock.Lock()
+	if len(r.keys) < cacheHitReservoirSize {
+		r.keys = append(r.keys, hash)
+	} else {
+		r.keys[r.next] = hash
+		r.next = (r.next + 1) % cacheHitReservoirSize
+	}
+	r.lock.Unlock()
+}
+
+// ValidateCleanCachePeriodically cross-checks a random sample of the recently
+// hit clean cache entries against the disk with the specified interval until the
+// stop channel is closed. Mismatching entries are evicted, and if too many are
+// found, the whole clean cache is wiped. It is meant to catch clean caches loaded
+// from a journal belonging to a different database.
+func (db *Database) ValidateCleanCachePeriodically(interval time.Duration, stopCh <-chan struct{}) {
+	if db.cleans == nil {
+		return
+	}
+	atomic.StoreUint32(&db.cleanHits.enabled, 1)
+	defer atomic.StoreUint32(&db.cleanHits.enabled, 0)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			db.validateCleanCache(cacheValidationSamples, cacheValidationThreshold)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// validateCleanCache compares the given number of randomly chosen recently hit
+// clean cache entries with their counterparts on disk, evicting mismatching
+// ones. Once the mismatch count reaches the threshold, the whole clean cache is
+// wiped. The number of mismatches found in this round is returned.
+func (db *Database) validateCleanCache(samples int, threshold int) int {
+	r := &db.cleanHits
+
+	// Collect the distinct keys, frequently hit ones are present multiple times
+	r.lock.Lock()
+	var (
+		keys = make([]common.Hash, 0, len(r.keys))
+		seen = make(map[common.Hash]struct{}, len(r.keys))
+	)
+	for _, hash := range r.keys {
+		if _, ok := seen[hash]; !ok {
+			seen[hash] = struct{}{}
+			keys = append(keys, hash)
+		}
+	}
+	r.lock.Unlock()
+
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	if len(keys) > samples {
+		keys = keys[:samples]
+	}
+	var mismatches int
+	for _, hash := range keys {
+		cached := db.cleans.Get(nil, hash[:])
+		if cached == nil {
+			continue // Evicted since the hit
+		}
+		cacheValidationCheckMeter.Mark(1)
+		if disk, _ := db.diskdb.Get(hash[:]); bytes.Equal(cached, disk) {
+			continue
+		}
+		log.Warn("Clean cache entry mismatches disk", "hash", hash)
+		db.cleans.Del(hash[:])
+		cacheValidationMismatchMeter.Mark(1)
+		mismatches++
+	}
+	if mismatches == 0 {
+		return 0
+	}
+	r.lock.Lock()
+	r.mismatches += mismatches
+	wipe := r.mismatches >= threshold
+	if wipe {
+		r.keys, r.next, r.mismatches = r.keys[:0], 0, 0
+	}
+	r.lock.Unlock()
+
+	if wipe {
+		log.Error("Clean trie cache diverged from disk, wiping it", "mismatches", threshold)
+		db.cleans.Reset()
+		cacheValidationWipeMeter.Mark(1)
+	}
+	return mismatches
+}
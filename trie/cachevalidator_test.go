@@ -0,0 +1,132 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+func TestDatabaseCleanCacheValidation(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabaseWithCache(diskdb, 1)
+	atomic.StoreUint32(&db.cleanHits.enabled, 1)
+
+	// Store some nodes on disk and hit them in the clean cache, only the hits of
+	// sampled keys are tracked
+	var (
+		hashes = make([]common.Hash, 20)
+		blobs  = make([][]byte, 20)
+	)
+	for i, nonce := 0, 0; i < len(hashes); nonce++ {
+		blob := []byte{byte(i), byte(nonce)}
+		if hash := crypto.Keccak256Hash(blob); hash[0]%cacheHitSampleRate == 0 {
+			hashes[i], blobs[i] = hash, blob
+			diskdb.Put(hash[:], blob)
+			i++
+		}
+	}
+	unsampled := crypto.Keccak256Hash([]byte{0x00})
+	for unsampled[0]%cacheHitSampleRate == 0 {
+		unsampled = crypto.Keccak256Hash(unsampled[:])
+	}
+	diskdb.Put(unsampled[:], []byte{0x00})
+	db.Node(unsampled)
+	db.Node(unsampled)
+	if len(db.cleanHits.keys) != 0 {
+		t.Fatalf("Hit of unsampled key tracked")
+	}
+	hitAll := func() {
+		for _, hash := range hashes {
+			db.Node(hash) // Load into the clean cache, if not yet there
+			db.Node(hash)
+		}
+	}
+	hitAll()
+	if n := db.validateCleanCache(len(hashes), 10); n != 0 {
+		t.Fatalf("Mismatches reported for consistent cache: %d", n)
+	}
+	// Make a few cache entries diverge from disk, they should be evicted
+	for i := 0; i < 5; i++ {
+		db.cleans.Set(hashes[i][:], []byte{0xff})
+	}
+	if n := db.validateCleanCache(len(hashes), 10); n != 5 {
+		t.Fatalf("Mismatch count wrong: have %d, want 5", n)
+	}
+	for i, hash := range hashes {
+		if i < 5 && db.cleans.Has(hash[:]) {
+			t.Fatalf("Mismatching entry %d not evicted", i)
+		}
+		if i >= 5 && !db.cleans.Has(hash[:]) {
+			t.Fatalf("Consistent entry %d evicted", i)
+		}
+		if blob, _ := db.Node(hash); !bytes.Equal(blob, blobs[i]) {
+			t.Fatalf("Entry %d not recovered: have %x, want %x", i, blob, blobs[i])
+		}
+	}
+	// Cross the threshold, the whole cache should be wiped
+	hitAll()
+	for i := 0; i < 5; i++ {
+		db.cleans.Set(hashes[i][:], []byte{0xff})
+	}
+	if n := db.validateCleanCache(len(hashes), 10); n != 5 {
+		t.Fatalf("Mismatch count wrong: have %d, want 5", n)
+	}
+	for i, hash := range hashes {
+		if db.cleans.Has(hash[:]) {
+			t.Fatalf("Entry %d not wiped", i)
+		}
+	}
+	// The cache should work fine after the wipe
+	hitAll()
+	if n := db.validateCleanCache(len(hashes), 10); n != 0 {
+		t.Fatalf("Mismatches reported after wipe: %d", n)
+	}
+}
+
+// Benchmarks the clean cache hits with and without the validator tracking them.
+func BenchmarkDatabaseCleanHitValidation(b *testing.B) {
+	for _, validate := range []bool{false, true} {
+		b.Run(fmt.Sprintf("validate=%v", validate), func(b *testing.B) {
+			diskdb := memorydb.New()
+			db := NewDatabaseWithCache(diskdb, 16)
+			if validate {
+				atomic.StoreUint32(&db.cleanHits.enabled, 1)
+			}
+			hashes := make([]common.Hash, 1024)
+			for i := range hashes {
+				blob := []byte{byte(i), byte(i >> 8)}
+				hashes[i] = crypto.Keccak256Hash(blob)
+				diskdb.Put(hashes[i][:], blob)
+				db.Node(hashes[i])
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					db.Node(hashes[i%len(hashes)])
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// errNoCleanCache is returned if the clean cache is requested to be warmed up,
+// but the database has none.
+var errNoCleanCache = errors.New("no clean cache")
+
+// WarmCache loads the nodes of the given tries from disk into the clean cache,
+// breadth-first so the nodes closest to the roots are loaded first, until the
+// given amount of node data has been loaded. Only the nodes of the given tries
+// are loaded, not of the tries referenced from their leaves (e.g. storage tries
+// from the account trie). Nodes already in the clean cache are not counted, but
+// their children are still visited.
+//
+// The traversal is aborted if the context is cancelled. The amount of data loaded
+// is returned either way.
+func (db *Database) WarmCache(ctx context.Context, roots []common.Hash, limit common.StorageSize) (common.StorageSize, error) {
+	if db.cleans == nil {
+		return 0, errNoCleanCache
+	}
+	var (
+		start  = time.Now()
+		queue  = append([]common.Hash(nil), roots...)
+		seen   = make(map[common.Hash]struct{})
+		loaded common.StorageSize
+		nodes  int
+	)
+	for ; len(queue) > 0; queue = queue[1:] {
+		select {
+		case <-ctx.Done():
+			log.Info("Aborted clean cache warm-up", "nodes", nodes, "size", loaded, "err", ctx.Err())
+			return loaded, ctx.Err()
+		default:
+		}
+		hash := queue[0]
+		if _, ok := seen[hash]; ok || hash == emptyRoot || hash == (common.Hash{}) {
+			continue
+		}
+		seen[hash] = struct{}{}
+
+		enc := db.cleans.Get(nil, hash[:])
+		if enc == nil {
+			blob, err := db.diskdb.Get(hash[:])
+			if err != nil || len(blob) == 0 {
+				return loaded, &MissingNodeError{NodeHash: hash}
+			}
+			if err := db.verifyNode(hash, blob); err != nil {
+				return loaded, err
+			}
+			if loaded+common.StorageSize(len(blob)) > limit {
+				break
+			}
+			db.cleans.Set(hash[:], blob)
+			db.trackShared(hash)
+			memcacheCleanWriteMeter.Mark(int64(len(blob)))
+
+			enc, loaded, nodes = blob, loaded+common.StorageSize(len(blob)), nodes+1
+		}
+		n, err := decodeNodeSafe(hash[:], enc)
+		if err != nil {
+			return loaded, err
+		}
+		forGatherChildren(simplifyNode(n), func(child common.Hash) {
+			queue = append(queue, child)
+		})
+	}
+	log.Info("Warmed up clean cache", "nodes", nodes, "size", loaded, "elapsed", common.PrettyDuration(time.Since(start)))
+	return loaded, nil
+}
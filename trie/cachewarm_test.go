@@ -0,0 +1,94 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that the clean cache can be warmed up from the tries on disk, within the
+// requested limit, and that the warm-up can be aborted.
+func TestDatabaseWarmCache(t *testing.T) {
+	diskdb := memorydb.New()
+	trie, _ := New(common.Hash{}, NewDatabase(diskdb))
+	for i := 0; i < 1000; i++ {
+		key := crypto.Keccak256([]byte{byte(i), byte(i >> 8)})
+		trie.Update(key, key)
+	}
+	root, _ := trie.Commit(nil)
+	trie.db.Commit(root, false)
+
+	var (
+		hashes []common.Hash
+		total  common.StorageSize
+	)
+	it := diskdb.NewIterator(nil, nil)
+	for it.Next() {
+		if len(it.Key()) == common.HashLength {
+			hashes = append(hashes, common.BytesToHash(it.Key()))
+			total += common.StorageSize(len(it.Value()))
+		}
+	}
+	it.Release()
+
+	// Warming up the whole trie should serve all its nodes from the clean cache
+	db := NewDatabaseWithCache(diskdb, 16)
+	loaded, err := db.WarmCache(context.Background(), []common.Hash{root}, total)
+	if err != nil {
+		t.Fatalf("failed to warm up cache: %v", err)
+	}
+	if loaded != total {
+		t.Fatalf("loaded size mismatch: have %v, want %v", loaded, total)
+	}
+	before := db.CacheStats()
+	for _, hash := range hashes {
+		if _, err := db.Node(hash); err != nil {
+			t.Fatalf("failed to retrieve node %x: %v", hash, err)
+		}
+	}
+	after := db.CacheStats()
+	if hits := after.CleanHits - before.CleanHits; hits != uint64(len(hashes)) {
+		t.Errorf("clean hit mismatch: have %d, want %d", hits, len(hashes))
+	}
+	if misses := after.CleanMisses - before.CleanMisses; misses != 0 {
+		t.Errorf("clean misses after warm-up: %d", misses)
+	}
+	// A limited warm-up should load the root first and stay within the limit
+	db = NewDatabaseWithCache(diskdb, 16)
+	if loaded, err = db.WarmCache(context.Background(), []common.Hash{root}, total/10); err != nil {
+		t.Fatalf("failed to warm up cache: %v", err)
+	}
+	if loaded > total/10 || loaded == 0 {
+		t.Errorf("limited load size mismatch: have %v, limit %v", loaded, total/10)
+	}
+	if !db.cleans.Has(root[:]) {
+		t.Errorf("root not loaded")
+	}
+	// Cancelled warm-ups should abort
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	db = NewDatabaseWithCache(diskdb, 16)
+	if loaded, err = db.WarmCache(ctx, []common.Hash{root}, total); err != context.Canceled || loaded != 0 {
+		t.Errorf("cancelled warm-up mismatch: loaded %v, err %v", loaded, err)
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mmap "github.com/edsrzf/mmap-go"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// The shared clean cache file is a lookup friendly copy of the clean cache,
+// saved into the journal directory along with the clean cache journal:
+//
+//	magic (8 bytes) || generation (8 bytes) || count (8 bytes) || index offset (8 bytes)
+//	node blobs
+//	count * (hash (32 bytes) || blob offset (8 bytes) || blob length (4 bytes))
+//
+// The index is sorted by hash, so nodes can be looked up with a binary search
+// directly in the memory mapped file.
+const (
+	sharedCacheFile       = "shared.bin" // Name of the shared clean cache file in the journal directory
+	sharedCacheHeaderSize = 32           // Size of the shared clean cache file header
+	sharedCacheEntrySize  = 44           // Size of an index entry of the shared clean cache file
+)
+
+// sharedCacheMagic identifies the shared clean cache file format.
+var sharedCacheMagic = []byte("gethscc1")
+
+// errSharedCacheCorrupted is returned if the shared clean cache file doesn't
+// have the expected layout.
+var errSharedCacheCorrupted = errors.New("corrupted shared clean cache")
+
+var (
+	memcacheSharedHitMeter  = metrics.NewRegisteredMeter("trie/memcache/shared/hit", nil)
+	memcacheSharedMissMeter = metrics.NewRegisteredMeter("trie/memcache/shared/miss", nil)
+	memcacheSharedReadMeter = metrics.NewRegisteredMeter("trie/memcache/shared/read", nil)
+	memcacheSharedLoadMeter = metrics.NewRegisteredMeter("trie/memcache/shared/load", nil)
+)
+
+const (
+	// sharedKeyShards is the number of independently locked shards the tracked
+	// clean cache keys are split into, to keep concurrent cache writes from contending.
+	sharedKeyShards = 64
+
+	// sharedKeyAllowance is the clean cache allowance backing a tracked key. The
+	// nodes average below it, so the tracked keys may fall short of the whole
+	// cache, but their memory use stays a small fraction of the cache size.
+	sharedKeyAllowance = 512
+)
+
+// sharedKeys tracks the keys of the clean cache entries, so the otherwise not
+// enumerable cache can be copied into the shared clean cache file. The number of
+// tracked keys is capped according to the clean cache size, once a shard is full
+// a new key replaces a random one. The shared copy is thus a best effort subset
+// of the cache.
+type sharedKeys struct {
+	enabled uint32 // Whether the keys are being tracked (atomic)
+	once    sync.Once
+	shards  [sharedKeyShards]sharedKeyShard
+}
+
+// sharedKeyShard is a separately locked part of the tracked keys.
+type sharedKeyShard struct {
+	lock  sync.Mutex
+	keys  map[common.Hash]struct{}
+	limit int // Maximum number of keys tracked in the shard
+}
+
+// shard returns the shard a clean cache key is tracked in.
+func (s *sharedKeys) shard(hash common.Hash) *sharedKeyShard {
+	return &s.shards[hash[0]%sharedKeyShards]
+}
+
+// ShareCleanCache makes the clean cache journal saves also write a lookup friendly
+// copy of the clean cache, which read-only processes using the same database can
+// memory map with NewDatabaseWithSharedCache instead of maintaining a clean cache
+// of their own.
+//
+// The clean cache can't be enumerated, so the keys of the nodes are tracked as they
+// enter the clean cache from this call on (i.e. when read from disk, flushed or
+// warmed up), up to a limit derived from the clean cache size. Cache hits are not
+// tracked to keep the read path free of any locking. Entries loaded from the
+// journal on startup are thus only shared after they are evicted and read again.
+func (db *Database) ShareCleanCache() {
+	if db.cleans == nil {
+		return
+	}
+	s := &db.sharing
+	s.once.Do(func() {
+		limit := db.cleanLimit / sharedKeyAllowance / sharedKeyShards
+		if limit == 0 {
+			limit = 1
+		}
+		for i := range s.shards {
+			s.shards[i].keys = make(map[common.Hash]struct{})
+			s.shards[i].limit = limit
+		}
+		atomic.StoreUint32(&s.enabled, 1)
+	})
+}
+
+// trackShared records a node entering the clean cache to be copied into the shared
+// clean cache file, if sharing is enabled. It must not be called on cache hits.
+func (db *Database) trackShared(hash common.Hash) {
+	s := &db.sharing
+	if atomic.LoadUint32(&s.enabled) == 0 {
+		return
+	}
+	shard := s.shard(hash)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if _, ok := shard.keys[hash]; ok {
+		return
+	}
+	if len(shard.keys) >= shard.limit {
+		for old := range shard.keys {
+			delete(shard.keys, old) // Map iteration starts at a random key
+			break
+		}
+	}
+	shard.keys[hash] = struct{}{}
+}
+
+// writeSharedCache writes the shared clean cache file into the given directory,
+// if sharing is enabled. Tracked keys evicted from the clean cache meanwhile are
+// dropped.
+func (db *Database) writeSharedCache(dir string) error {
+	s := &db.sharing
+	if atomic.LoadUint32(&s.enabled) == 0 {
+		return nil
+	}
+	var keys []common.Hash
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.Lock()
+		for hash := range shard.keys {
+			keys = append(keys, hash)
+		}
+		shard.lock.Unlock()
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+
+	f, err := os.Create(filepath.Join(dir, sharedCacheFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Stream the node blobs after a placeholder header, indexing them on the way
+	var (
+		w       = bufio.NewWriter(f)
+		index   = make([]byte, 0, len(keys)*sharedCacheEntrySize)
+		evicted []common.Hash
+		offset  = uint64(sharedCacheHeaderSize)
+		entry   [sharedCacheEntrySize]byte
+	)
+	if _, err := w.Write(make([]byte, sharedCacheHeaderSize)); err != nil {
+		return err
+	}
+	for _, hash := range keys {
+		blob := db.cleans.Get(nil, hash[:])
+		if blob == nil {
+			evicted = append(evicted, hash)
+			continue
+		}
+		if _, err := w.Write(blob); err != nil {
+			return err
+		}
+		copy(entry[:], hash[:])
+		binary.BigEndian.PutUint64(entry[common.HashLength:], offset)
+		binary.BigEndian.PutUint32(entry[common.HashLength+8:], uint32(len(blob)))
+		index = append(index, entry[:]...)
+		offset += uint64(len(blob))
+	}
+	if _, err := w.Write(index); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	// Fill in the header, the save time doubles as the generation of the file
+	header := make([]byte, sharedCacheHeaderSize)
+	copy(header, sharedCacheMagic)
+	binary.BigEndian.PutUint64(header[8:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint64(header[16:], uint64(len(index)/sharedCacheEntrySize))
+	binary.BigEndian.PutUint64(header[24:], offset)
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	for _, hash := range evicted {
+		shard := s.shard(hash)
+		shard.lock.Lock()
+		delete(shard.keys, hash)
+		shard.lock.Unlock()
+	}
+	return nil
+}
+
+// sharedCleanCache is a read-only, memory mapped shared clean cache file.
+type sharedCleanCache struct {
+	path string // Path of the shared clean cache file
+
+	lock       sync.RWMutex
+	file       *os.File    // Currently mapped file, nil if none
+	info       os.FileInfo // Identity of the mapped file, to detect replacements
+	data       mmap.MMap   // Memory mapped contents of the file
+	index      []byte      // Index section of the mapped file
+	generation uint64      // Generation of the mapped file
+}
+
+// NewDatabaseWithSharedCache creates a new trie database without a clean cache of
+// its own. Clean node lookups are served from the shared clean cache file in the
+// given journal directory instead, saved by another process using the same disk
+// database with ShareCleanCache enabled. Nodes missing from the file are read from
+// disk. The file is memory mapped read-only, RefreshSharedCache maps the new one
+// after the other process saved its clean cache again.
+func NewDatabaseWithSharedCache(diskdb ethdb.KeyValueStore, journal string) *Database {
+	db := NewDatabase(diskdb)
+	db.shared = &sharedCleanCache{path: filepath.Join(journal, sharedCacheFile)}
+	if _, err := db.shared.refresh(); err != nil && !os.IsNotExist(err) {
+		log.Warn("Failed to load shared clean trie cache", "path", db.shared.path, "err", err)
+	}
+	return db
+}
+
+// RefreshSharedCache maps the shared clean cache file again if it was replaced
+// since it was last loaded. Lookups keep being served from the previous file
+// until the new one is mapped.
+func (db *Database) RefreshSharedCache() error {
+	if db.shared == nil {
+		return nil
+	}
+	_, err := db.shared.refresh()
+	return err
+}
+
+// RefreshSharedCachePeriodically checks for a new shared clean cache file with
+// the specified interval until the stop channel is closed. The file is unmapped
+// afterwards, further lookups go to disk.
+func (db *Database) RefreshSharedCachePeriodically(interval time.Duration, stopCh <-chan struct{}) {
+	if db.shared == nil {
+		return
+	}
+	defer db.shared.close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.RefreshSharedCache(); err != nil && !os.IsNotExist(err) {
+				log.Warn("Failed to refresh shared clean trie cache", "path", db.shared.path, "err", err)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// sharedNode retrieves a node blob from the shared clean cache, or returns nil
+// if it's not available.
+func (db *Database) sharedNode(hash common.Hash) []byte {
+	if db.shared == nil {
+		return nil
+	}
+	enc := db.shared.get(hash)
+	if enc == nil {
+		memcacheSharedMissMeter.Mark(1)
+		return nil
+	}
+	memcacheSharedHitMeter.Mark(1)
+	memcacheSharedReadMeter.Mark(int64(len(enc)))
+	return enc
+}
+
+// refresh maps the shared clean cache file if it's not the currently mapped one,
+// reporting whether a new file was loaded.
+func (c *sharedCleanCache) refresh() (bool, error) {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return false, err
+	}
+	c.lock.RLock()
+	same := c.info != nil && os.SameFile(c.info, info) && c.info.ModTime().Equal(info.ModTime())
+	c.lock.RUnlock()
+	if same {
+		return false, nil
+	}
+	// The file was replaced, map the new one. Since the writer swaps in a complete
+	// journal directory, the file is never modified once it has been opened.
+	f, err := os.Open(c.path)
+	if err != nil {
+		return false, err
+	}
+	if info, err = f.Stat(); err != nil {
+		f.Close()
+		return false, err
+	}
+	data, err := mmap.Map(f, mmap.RDONLY, 0)
+	if err != nil {
+		f.Close()
+		return false, err
+	}
+	generation, index, err := parseSharedCache(data)
+	if err != nil {
+		data.Unmap()
+		f.Close()
+		return false, fmt.Errorf("%s: %v", c.path, err)
+	}
+	c.lock.Lock()
+	oldFile, oldData := c.file, c.data
+	c.file, c.info, c.data, c.index, c.generation = f, info, data, index, generation
+	c.lock.Unlock()
+
+	if oldData != nil {
+		oldData.Unmap()
+		oldFile.Close()
+	}
+	memcacheSharedLoadMeter.Mark(1)
+	log.Info("Loaded shared clean trie cache", "path", c.path, "nodes", len(index)/sharedCacheEntrySize,
+		"size", common.StorageSize(len(data)), "generation", generation)
+	return true, nil
+}
+
+// parseSharedCache validates the layout of a shared clean cache file, returning
+// its generation and index section.
+func parseSharedCache(data []byte) (uint64, []byte, error) {
+	if len(data) < sharedCacheHeaderSize || !bytes.Equal(data[:8], sharedCacheMagic) {
+		return 0, nil, errSharedCacheCorrupted
+	}
+	var (
+		generation = binary.BigEndian.Uint64(data[8:])
+		count      = binary.BigEndian.Uint64(data[16:])
+		offset     = binary.BigEndian.Uint64(data[24:])
+	)
+	if offset < sharedCacheHeaderSize || offset > uint64(len(data)) || (uint64(len(data))-offset)/sharedCacheEntrySize != count || (uint64(len(data))-offset)%sharedCacheEntrySize != 0 {
+		return 0, nil, errSharedCacheCorrupted
+	}
+	return generation, data[offset:], nil
+}
+
+// get looks up a node blob in the mapped file, returning a copy of it or nil if
+// it's not present.
+func (c *sharedCleanCache) get(hash common.Hash) []byte {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	count := len(c.index) / sharedCacheEntrySize
+	i := sort.Search(count, func(i int) bool {
+		return bytes.Compare(c.index[i*sharedCacheEntrySize:i*sharedCacheEntrySize+common.HashLength], hash[:]) >= 0
+	})
+	if i == count {
+		return nil
+	}
+	entry := c.index[i*sharedCacheEntrySize : (i+1)*sharedCacheEntrySize]
+	if !bytes.Equal(entry[:common.HashLength], hash[:]) {
+		return nil
+	}
+	var (
+		offset = binary.BigEndian.Uint64(entry[common.HashLength:])
+		size   = uint64(binary.BigEndian.Uint32(entry[common.HashLength+8:]))
+	)
+	if offset+size > uint64(len(c.data)-len(c.index)) {
+		return nil // Corrupted entry, fall back to the disk
+	}
+	return common.CopyBytes(c.data[offset : offset+size])
+}
+
+// close unmaps the shared clean cache file.
+func (c *sharedCleanCache) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.data != nil {
+		c.data.Unmap()
+		c.file.Close()
+	}
+	c.file, c.info, c.data, c.index = nil, nil, nil, nil
+}
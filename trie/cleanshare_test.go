@@ -0,0 +1,204 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that a database serves clean nodes from the shared clean cache file of
+// another database, keeps serving them consistently while the file is replaced by
+// new journal saves, and falls back to disk for the nodes missing from it.
+func TestDatabaseSharedCleanCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "triecache")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	journal := filepath.Join(dir, "journal")
+
+	writer := NewDatabaseWithCache(memorydb.New(), 16)
+	writer.ShareCleanCache()
+
+	// commit creates a trie in the writer, moving its nodes into the clean cache
+	commit := func(seed byte) (common.Hash, map[string]string) {
+		tr, _ := New(common.Hash{}, writer)
+		entries := make(map[string]string)
+		for i := 0; i < 200; i++ {
+			key, val := fmt.Sprintf("key-%d-%d", seed, i), fmt.Sprintf("value-%d-%d", seed, i)
+			tr.Update([]byte(key), []byte(val))
+			entries[key] = val
+		}
+		root, err := tr.Commit(nil)
+		if err != nil {
+			t.Fatalf("Failed to commit trie: %v", err)
+		}
+		if err := writer.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit database: %v", err)
+		}
+		return root, entries
+	}
+	// check reads all the entries of a trie through the given database
+	check := func(db *Database, root common.Hash, entries map[string]string) error {
+		tr, err := New(root, db)
+		if err != nil {
+			return err
+		}
+		for key, val := range entries {
+			have, err := tr.TryGet([]byte(key))
+			if err != nil {
+				return err
+			}
+			if string(have) != val {
+				return fmt.Errorf("value mismatch for %s: have %s, want %s", key, have, val)
+			}
+		}
+		return nil
+	}
+	root, entries := commit(0)
+	if err := writer.SaveCache(journal); err != nil {
+		t.Fatalf("Failed to save cache: %v", err)
+	}
+	// The reader has nothing on disk, everything has to come from the shared file
+	reader := NewDatabaseWithSharedCache(memorydb.New(), journal)
+	if err := check(reader, root, entries); err != nil {
+		t.Fatalf("Failed to read shared trie: %v", err)
+	}
+	// Keep reading from the reader while the writer rotates the journal
+	var (
+		stop = make(chan struct{})
+		errc = make(chan error, 4)
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < cap(errc); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					errc <- nil
+					return
+				default:
+				}
+				if err := check(reader, root, entries); err != nil {
+					errc <- err
+					return
+				}
+			}
+		}()
+	}
+	var (
+		roots    = []common.Hash{root}
+		contents = []map[string]string{entries}
+	)
+	generation := reader.shared.generation
+	for seed := byte(1); seed <= 5; seed++ {
+		root, entries := commit(seed)
+		roots, contents = append(roots, root), append(contents, entries)
+
+		if err := writer.SaveCache(journal); err != nil {
+			t.Fatalf("Failed to save cache: %v", err)
+		}
+		if err := check(reader, root, entries); err == nil {
+			t.Fatalf("Trie %d readable before refresh", seed)
+		}
+		if err := reader.RefreshSharedCache(); err != nil {
+			t.Fatalf("Failed to refresh shared cache: %v", err)
+		}
+		if reader.shared.generation == generation {
+			t.Fatalf("Shared cache generation not updated")
+		}
+		generation = reader.shared.generation
+	}
+	close(stop)
+	wg.Wait()
+	for i := 0; i < cap(errc); i++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("Failed to read shared trie during rotation: %v", err)
+		}
+	}
+	for i, root := range roots {
+		if err := check(reader, root, contents[i]); err != nil {
+			t.Fatalf("Failed to read shared trie %d: %v", i, err)
+		}
+	}
+	// Refreshing without a new save is a noop
+	if loaded, err := reader.shared.refresh(); loaded || err != nil {
+		t.Fatalf("Unchanged shared cache reloaded: %v, %v", loaded, err)
+	}
+}
+
+// Tests that the clean cache keys tracked for sharing are capped according to
+// the clean cache size.
+func TestDatabaseSharedKeysLimit(t *testing.T) {
+	db := NewDatabaseWithCache(memorydb.New(), 1)
+	db.ShareCleanCache()
+
+	limit := 1024 * 1024 / sharedKeyAllowance
+	for i := 0; i < 4*limit; i++ {
+		db.trackShared(crypto.Keccak256Hash(big.NewInt(int64(i)).Bytes()))
+	}
+	var tracked int
+	for i := range db.sharing.shards {
+		shard := &db.sharing.shards[i]
+		if len(shard.keys) > shard.limit {
+			t.Fatalf("shard %d over its limit: have %d, want at most %d", i, len(shard.keys), shard.limit)
+		}
+		tracked += len(shard.keys)
+	}
+	if tracked > limit || tracked < limit/2 {
+		t.Fatalf("tracked key count mismatch: have %d, want up to %d", tracked, limit)
+	}
+}
+
+// Benchmarks the clean cache hits with and without the clean cache being shared.
+func BenchmarkDatabaseNodeCleanHit(b *testing.B) {
+	for _, share := range []bool{false, true} {
+		b.Run(fmt.Sprintf("share=%v", share), func(b *testing.B) {
+			diskdb := memorydb.New()
+			db := NewDatabaseWithCache(diskdb, 16)
+			if share {
+				db.ShareCleanCache()
+			}
+			hashes := make([]common.Hash, 1024)
+			for i := range hashes {
+				blob := []byte{byte(i), byte(i >> 8)}
+				hashes[i] = crypto.Keccak256Hash(blob)
+				diskdb.Put(hashes[i][:], blob)
+				db.Node(hashes[i])
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					db.Node(hashes[i%len(hashes)])
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"encoding/binary"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+const (
+	commitBloomSize        = 8 * 1024 * 1024 // Bits of a single bloom generation (1MB)
+	commitBloomFuncs       = 4               // Hash functions of the bloom filters
+	commitBloomItems       = 768 * 1024      // Nodes added to a generation before rotating, keeps false positives around 1%
+	commitBloomGenerations = 4               // Number of generations kept
+)
+
+var memcacheCommitSkipMeter = metrics.NewRegisteredMeter("trie/memcache/commit/skip", nil)
+
+// commitBloom is a rotating set of bloom filters over the trie nodes written by
+// the recent commits. Nodes evicted from the dirty cache can be resurrected by
+// later tries (e.g. a reorg back to a previously committed state), and this
+// filter allows committing them again without re-writing them to disk.
+//
+// A generation is retired once it holds commitBloomItems nodes, so the filters
+// cover the last few million committed nodes irrespective of how many commits
+// they were written by. The bits of the oldest generation are reused for the
+// new one.
+//
+// The filters can return false positives, so every hit needs to be confirmed on
+// disk before skipping a write.
+type commitBloom struct {
+	generations []*commitBloomFilter // Bloom filters of the past commits, the newest last
+}
+
+// commitBloomFilter is a single generation of the commit bloom. The node hashes
+// are uniformly random already, so the hash functions are simply its 64 bit words.
+type commitBloomFilter struct {
+	bits  []uint64 // Bit set of the filter
+	items int      // Number of nodes added to the filter
+}
+
+// newCommitBloom creates an empty rotating commit bloom.
+func newCommitBloom() *commitBloom {
+	b := new(commitBloom)
+	b.rotate()
+	return b
+}
+
+// rotate starts a new generation, recycling the oldest one if all are in use.
+func (b *commitBloom) rotate() {
+	if len(b.generations) < commitBloomGenerations {
+		b.generations = append(b.generations, &commitBloomFilter{bits: make([]uint64, commitBloomSize/64)})
+		return
+	}
+	oldest := b.generations[0]
+	for i := range oldest.bits {
+		oldest.bits[i] = 0
+	}
+	oldest.items = 0
+
+	copy(b.generations, b.generations[1:])
+	b.generations[len(b.generations)-1] = oldest
+}
+
+// add inserts a trie node hash into the current generation, rotating it first
+// if it got too crowded to be useful.
+func (b *commitBloom) add(hash common.Hash) {
+	current := b.generations[len(b.generations)-1]
+	if current.items >= commitBloomItems {
+		b.rotate()
+		current = b.generations[len(b.generations)-1]
+	}
+	for i := 0; i < commitBloomFuncs; i++ {
+		bit := binary.BigEndian.Uint64(hash[i*8:]) % commitBloomSize
+		current.bits[bit/64] |= 1 << (bit % 64)
+	}
+	current.items++
+}
+
+// contains reports whether the trie node was maybe written by one of the recent
+// commits.
+func (b *commitBloom) contains(hash common.Hash) bool {
+	for _, bloom := range b.generations {
+		if bloom.contains(hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether the trie node was maybe added to the generation.
+func (f *commitBloomFilter) contains(hash common.Hash) bool {
+	for i := 0; i < commitBloomFuncs; i++ {
+		bit := binary.BigEndian.Uint64(hash[i*8:]) % commitBloomSize
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// persisted reports whether a dirty trie node is known to be already written to
+// disk by a recent commit, in which case it does not need to be written again.
+// Bloom hits are confirmed on disk to avoid losing nodes on false positives.
+//
+// Note, this method assumes the flush lock is held.
+func (db *Database) persisted(hash common.Hash) bool {
+	if db.committed == nil || !db.committed.contains(hash) {
+		return false
+	}
+	ok, _ := db.diskdb.Has(hash[:])
+	return ok
+}
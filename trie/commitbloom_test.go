@@ -0,0 +1,109 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that nodes resurrected in the dirty cache after being committed are not
+// written to disk again, but the disk content stays complete.
+func TestDatabaseCommitBloom(t *testing.T) {
+	diskdb := &recordingDB{Database: memorydb.New()}
+	db := NewDatabase(diskdb)
+
+	written := func() (size int) {
+		for _, n := range diskdb.writes {
+			size += n
+		}
+		diskdb.writes = nil
+		return size
+	}
+	root := makeDirtyTrie(db, 1000)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	first := written()
+
+	// Recreating the same trie makes all its nodes dirty again
+	if makeDirtyTrie(db, 1000) != root {
+		t.Fatalf("recreated trie root mismatch")
+	}
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit recreated trie: %v", err)
+	}
+	if second := written(); second > first/100 {
+		t.Errorf("recreated trie rewritten: have %d bytes, first commit %d", second, first)
+	}
+	if nodes := db.Nodes(); len(nodes) != 0 {
+		t.Errorf("dirty nodes left after commit: %d", len(nodes))
+	}
+	checkPersistedTrie(t, diskdb.Database, root, 1000)
+}
+
+// Tests that bloom hits of nodes not on disk don't prevent writing them.
+func TestDatabaseCommitBloomFalsePositives(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabase(diskdb)
+
+	root := makeDirtyTrie(db, 1000)
+	db.committed = newCommitBloom()
+	for _, hash := range db.Nodes() {
+		db.committed.add(hash)
+	}
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	checkPersistedTrie(t, diskdb, root, 1000)
+}
+
+// Tests that the commit bloom only rotates once a generation is full, rather
+// than on every commit, and that the retired generations are recycled.
+func TestCommitBloomRotation(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+	for i := 0; i < 10; i++ {
+		if err := db.Commit(makeDirtyTrie(db, 100), false); err != nil {
+			t.Fatalf("failed to commit: %v", err)
+		}
+	}
+	if gens := len(db.committed.generations); gens != 1 {
+		t.Fatalf("generation count mismatch after small commits: have %d, want 1", gens)
+	}
+	bloom := newCommitBloom()
+	first := &bloom.generations[0].bits[0]
+
+	var hash common.Hash
+	for i := 0; i < commitBloomGenerations*commitBloomItems+1; i++ {
+		for j := 0; j < commitBloomFuncs; j++ {
+			binary.BigEndian.PutUint64(hash[j*8:], uint64(i*commitBloomFuncs+j+1)*0x9e3779b97f4a7c15)
+		}
+		bloom.add(hash)
+	}
+	if gens := len(bloom.generations); gens != commitBloomGenerations {
+		t.Fatalf("generation count mismatch: have %d, want %d", gens, commitBloomGenerations)
+	}
+	if current := bloom.generations[len(bloom.generations)-1]; &current.bits[0] != first || current.items != 1 {
+		t.Fatalf("oldest generation not recycled: reused %v, items %d", &current.bits[0] == first, current.items)
+	}
+	if !bloom.contains(hash) {
+		t.Fatalf("last added node missing")
+	}
+}
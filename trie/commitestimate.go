@@ -0,0 +1,121 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// commitEstimate is the result of the last EstimateCommit, reused by cheap
+// estimates while the dirty cache doesn't change much.
+type commitEstimate struct {
+	lock sync.Mutex
+
+	valid   bool
+	dirties common.StorageSize // Size of the dirty cache at the time of the estimate
+	nodes   int
+	bytes   common.StorageSize
+}
+
+// EstimateCommit returns the number of nodes and the storage size (in the same
+// units as the CommitReport) which committing the given root would flush out to
+// disk. The dirty graph is walked the same way a commit does, but nothing is
+// written and only the read lock is held, so it is safe to call concurrently
+// with readers.
+func (db *Database) EstimateCommit(root common.Hash) (nodes int, bytes common.StorageSize, err error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if root == (common.Hash{}) || root == emptyRoot {
+		return 0, 0, nil
+	}
+	if _, ok := db.dirties[root]; !ok {
+		// Not dirty, it's either already on disk or it doesn't exist at all
+		if ok, _ := db.diskdb.Has(root[:]); !ok {
+			return 0, 0, &MissingNodeError{NodeHash: root}
+		}
+		return 0, 0, nil
+	}
+	seen := make(map[common.Hash]struct{})
+	nodes, bytes = db.estimateCommit(root, seen)
+
+	size := db.dirtiesSize
+	db.estimate.lock.Lock()
+	db.estimate.valid, db.estimate.dirties = true, size
+	db.estimate.nodes, db.estimate.bytes = nodes, bytes
+	db.estimate.lock.Unlock()
+
+	return nodes, bytes, nil
+}
+
+// EstimateCommitCheap is a cheaper version of EstimateCommit, which returns the
+// result of the last estimate as long as the dirty cache didn't grow by more
+// than delta since, regardless of the root it was made for. Otherwise, or if
+// anything was flushed in between, a full estimate is made.
+func (db *Database) EstimateCommitCheap(root common.Hash, delta common.StorageSize) (nodes int, bytes common.StorageSize, err error) {
+	db.lock.RLock()
+	size := db.dirtiesSize
+	db.lock.RUnlock()
+
+	db.estimate.lock.Lock()
+	if db.estimate.valid && size >= db.estimate.dirties && size-db.estimate.dirties <= delta {
+		nodes, bytes = db.estimate.nodes, db.estimate.bytes
+		db.estimate.lock.Unlock()
+		return nodes, bytes, nil
+	}
+	db.estimate.lock.Unlock()
+
+	return db.EstimateCommit(root)
+}
+
+// resetCommitEstimate invalidates the cached commit estimate after the dirty
+// cache shrank.
+func (db *Database) resetCommitEstimate() {
+	db.estimate.lock.Lock()
+	db.estimate.valid = false
+	db.estimate.lock.Unlock()
+}
+
+// estimateCommit is the recursive part of EstimateCommit, visiting every dirty
+// node reachable from hash exactly once.
+//
+// Note, this function assumes the read lock is held.
+func (db *Database) estimateCommit(hash common.Hash, seen map[common.Hash]struct{}) (int, common.StorageSize) {
+	node, ok := db.dirties[hash]
+	if !ok {
+		return 0, 0
+	}
+	if _, ok := seen[hash]; ok {
+		return 0, 0
+	}
+	seen[hash] = struct{}{}
+
+	nodes, bytes := 1, common.StorageSize(common.HashLength+len(node.rlp()))
+	for child := range node.children {
+		n, b := db.estimateCommit(child, seen)
+		nodes, bytes = nodes+n, bytes+b
+	}
+	if _, ok := node.node.(rawNode); !ok {
+		forGatherChildren(node.node, func(child common.Hash) {
+			n, b := db.estimateCommit(child, seen)
+			nodes, bytes = nodes+n, bytes+b
+		})
+	}
+	return nodes, bytes
+}
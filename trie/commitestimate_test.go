@@ -0,0 +1,128 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"math/big"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that the commit estimate matches the data actually flushed by a commit
+// on randomized tries, including already partially persisted ones.
+func TestDatabaseEstimateCommit(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	randomBytes := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	db := NewDatabase(memorydb.New())
+
+	newStorage := func() common.Hash {
+		trie, _ := New(common.Hash{}, db)
+		for i := rnd.Intn(100); i >= 0; i-- {
+			trie.Update(randomBytes(32), randomBytes(1+rnd.Intn(32)))
+		}
+		root, _ := trie.Commit(nil)
+		return root
+	}
+	accounts, _ := New(common.Hash{}, db)
+	for round := 0; round < 4; round++ {
+		// Update some accounts, some of them sharing their storage tries
+		shared := newStorage()
+		for i := 0; i < 50+rnd.Intn(50); i++ {
+			storage := shared
+			if rnd.Intn(2) == 0 {
+				storage = newStorage()
+			}
+			accounts.Update(randomBytes(32), storage[:])
+		}
+		root, _ := accounts.Commit(func(leaf []byte, parent common.Hash) error {
+			db.Reference(common.BytesToHash(leaf), parent)
+			return nil
+		})
+		nodes, size, err := db.EstimateCommit(root)
+		if err != nil {
+			t.Fatalf("round %d: failed to estimate commit: %v", round, err)
+		}
+		var (
+			flushed     = make(map[common.Hash]struct{})
+			flushedSize common.StorageSize
+		)
+		callback := func(owner common.Hash, hash common.Hash, blob []byte) {
+			if _, ok := flushed[hash]; !ok {
+				flushed[hash] = struct{}{}
+				flushedSize += common.StorageSize(common.HashLength + len(blob))
+			}
+		}
+		if err := db.CommitWithOptions(root, CommitOptions{Callback: callback}); err != nil {
+			t.Fatalf("round %d: failed to commit: %v", round, err)
+		}
+		if nodes != len(flushed) || size != flushedSize {
+			t.Errorf("round %d: estimate mismatch: have %d/%v, want %d/%v", round, nodes, size, len(flushed), flushedSize)
+		}
+		// Persisted tries should not need flushing any more
+		if nodes, size, err := db.EstimateCommit(root); nodes != 0 || size != 0 || err != nil {
+			t.Errorf("round %d: persisted trie estimate mismatch: have %d/%v/%v, want 0/0/nil", round, nodes, size, err)
+		}
+		accounts, _ = New(root, db)
+	}
+	if _, _, err := db.EstimateCommit(common.HexToHash("0x01")); err == nil {
+		t.Errorf("missing root estimated")
+	}
+}
+
+// Tests that the cheap commit estimate is only reused while the dirty cache
+// grows by less than the allowed delta.
+func TestDatabaseEstimateCommitCheap(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+	trie, _ := New(common.Hash{}, db)
+
+	update := func(from, to int) common.Hash {
+		for i := from; i < to; i++ {
+			key := common.BigToHash(big.NewInt(int64(i)))
+			trie.Update(crypto.Keccak256(key[:]), key[:])
+		}
+		root, _ := trie.Commit(nil)
+		return root
+	}
+	root := update(0, 100)
+	nodes, _, _ := db.EstimateCommitCheap(root, 1024)
+
+	// A small growth should return the stale estimate
+	root = update(100, 101)
+	if have, _, _ := db.EstimateCommitCheap(root, 1024); have != nodes {
+		t.Errorf("cheap estimate not reused: have %d, want %d", have, nodes)
+	}
+	// A large growth should redo the estimate
+	root = update(101, 200)
+	have, _, _ := db.EstimateCommitCheap(root, 1024)
+	if want, _, _ := db.EstimateCommit(root); have != want || have == nodes {
+		t.Errorf("cheap estimate mismatch: have %d, want %d (stale %d)", have, want, nodes)
+	}
+	// Committing should invalidate the cached estimate
+	db.Commit(root, false)
+	if have, _, _ := db.EstimateCommitCheap(root, 1024); have != 0 {
+		t.Errorf("cheap estimate not invalidated: have %d, want 0", have)
+	}
+}
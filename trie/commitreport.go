@@ -0,0 +1,106 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// commitReportHeavyTries is the number of largest storage tries reported in a
+// CommitReport.
+const commitReportHeavyTries = 8
+
+// TrieCommitSize is the amount of data persisted from a single storage trie.
+type TrieCommitSize struct {
+	Root  common.Hash        // Root hash of the storage trie
+	Nodes int                // Number of nodes persisted from the trie
+	Size  common.StorageSize // Storage size of the persisted nodes
+}
+
+// CommitReport is a breakdown of the data persisted by a single Commit between
+// the top level (account) trie, the storage tries hanging off of it and the
+// contract code blobs.
+type CommitReport struct {
+	AccountNodes int                // Number of persisted account trie nodes
+	AccountSize  common.StorageSize // Storage size of the persisted account trie nodes
+	StorageNodes int                // Number of persisted storage trie nodes
+	StorageSize  common.StorageSize // Storage size of the persisted storage trie nodes
+	CodeNodes    int                // Number of persisted code blobs
+	CodeSize     common.StorageSize // Storage size of the persisted code blobs
+
+	HeavyTries []TrieCommitSize // Largest persisted storage tries, sorted by size
+}
+
+// commitTracker accumulates the CommitReport during a commit walk.
+type commitTracker struct {
+	report CommitReport
+	tries  map[common.Hash]*TrieCommitSize
+}
+
+func newCommitTracker() *commitTracker {
+	return &commitTracker{tries: make(map[common.Hash]*TrieCommitSize)}
+}
+
+// track accounts a single persisted blob to the trie identified by owner, where
+// the zero owner is the top level trie.
+func (t *commitTracker) track(owner common.Hash, code bool, size int) {
+	storage := common.StorageSize(common.HashLength + size)
+	switch {
+	case code:
+		t.report.CodeNodes++
+		t.report.CodeSize += storage
+
+	case owner == (common.Hash{}):
+		t.report.AccountNodes++
+		t.report.AccountSize += storage
+
+	default:
+		t.report.StorageNodes++
+		t.report.StorageSize += storage
+
+		stats := t.tries[owner]
+		if stats == nil {
+			stats = &TrieCommitSize{Root: owner}
+			t.tries[owner] = stats
+		}
+		stats.Nodes++
+		stats.Size += storage
+	}
+}
+
+// finalize assembles the final report, selecting the heaviest storage tries.
+func (t *commitTracker) finalize() CommitReport {
+	heavy := make([]TrieCommitSize, 0, len(t.tries))
+	for _, stats := range t.tries {
+		heavy = append(heavy, *stats)
+	}
+	sort.Slice(heavy, func(i, j int) bool {
+		if heavy[i].Size != heavy[j].Size {
+			return heavy[i].Size > heavy[j].Size
+		}
+		return bytes.Compare(heavy[i].Root[:], heavy[j].Root[:]) < 0
+	})
+	if len(heavy) > commitReportHeavyTries {
+		heavy = heavy[:commitReportHeavyTries]
+	}
+	report := t.report
+	report.HeavyTries = heavy
+	return report
+}
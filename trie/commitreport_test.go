@@ -0,0 +1,76 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that the commit report correctly splits the persisted data between the
+// account trie and the storage tries referenced from it.
+func TestDatabaseCommitReport(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+
+	// Create two storage tries of very different sizes
+	newStorage := func(n int) common.Hash {
+		trie, _ := New(common.Hash{}, db)
+		for i := 0; i < n; i++ {
+			key := common.BigToHash(big.NewInt(int64(i)))
+			trie.Update(crypto.Keccak256(key[:]), key[:])
+		}
+		root, _ := trie.Commit(nil)
+		return root
+	}
+	small, large := newStorage(10), newStorage(500)
+
+	// Create an account trie referencing both storage tries
+	accounts, _ := New(common.Hash{}, db)
+	accounts.Update([]byte("small"), small[:])
+	accounts.Update([]byte("large"), large[:])
+	root, _ := accounts.Commit(func(leaf []byte, parent common.Hash) error {
+		db.Reference(common.BytesToHash(leaf), parent)
+		return nil
+	})
+	nodes := len(db.Nodes())
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	report := db.LastCommitReport()
+	if report.AccountNodes == 0 || report.StorageNodes == 0 {
+		t.Fatalf("missing breakdown: %+v", report)
+	}
+	if have := report.AccountNodes + report.StorageNodes + report.CodeNodes; have != nodes {
+		t.Errorf("node count mismatch: have %d, want %d", have, nodes)
+	}
+	if len(report.HeavyTries) != 2 {
+		t.Fatalf("heavy trie count mismatch: have %d, want 2", len(report.HeavyTries))
+	}
+	if report.HeavyTries[0].Root != large || report.HeavyTries[1].Root != small {
+		t.Errorf("heavy trie order mismatch: have %x, %x", report.HeavyTries[0].Root, report.HeavyTries[1].Root)
+	}
+	if sum := report.HeavyTries[0].Size + report.HeavyTries[1].Size; sum != report.StorageSize {
+		t.Errorf("storage size mismatch: have %v, want %v", sum, report.StorageSize)
+	}
+	if report.HeavyTries[0].Size < 10*report.HeavyTries[1].Size {
+		t.Errorf("storage proportions off: large %v, small %v", report.HeavyTries[0].Size, report.HeavyTries[1].Size)
+	}
+}
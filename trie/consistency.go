@@ -0,0 +1,113 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ConsistencyError is returned by CheckConsistency, listing every discrepancy
+// found in the dirty node cache.
+type ConsistencyError struct {
+	Issues []string
+}
+
+// Error implements error, joining all the discrepancies.
+func (err *ConsistencyError) Error() string {
+	return fmt.Sprintf("%d trie cache inconsistencies: %s", len(err.Issues), strings.Join(err.Issues, "; "))
+}
+
+// CheckConsistency audits the reference graph of the dirty node cache. The
+// parent counts of all dirty nodes are recomputed from the internal children of
+// the cached nodes and the external children maps, the flush-list is verified
+// to link up exactly the dirty set and the tracked cache sizes are recomputed.
+// Every discrepancy is reported in the returned ConsistencyError.
+//
+// Note, a node flushed by Cap and reinjected later on legitimately has less
+// parents than referencing nodes, as the references from the nodes inserted
+// before its flush are not tracked any more.
+func (db *Database) CheckConsistency() error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var issues []string
+
+	meta, ok := db.dirties[common.Hash{}]
+	if !ok || meta.children == nil {
+		issues = append(issues, "meta root missing")
+	}
+	var (
+		parents      = make(map[common.Hash]uint32, len(db.dirties))
+		dirtiesSize  common.StorageSize
+		childrenSize common.StorageSize
+	)
+	for hash, node := range db.dirties {
+		if hash != (common.Hash{}) {
+			dirtiesSize += common.StorageSize(common.HashLength + int(node.size))
+			if node.children != nil {
+				childrenSize += cachedNodeChildrenSize
+			}
+		}
+		childrenSize += common.StorageSize(len(node.children) * (common.HashLength + 2))
+
+		for child, refs := range node.children {
+			if _, ok := db.dirties[child]; ok {
+				parents[child] += uint32(refs)
+			}
+		}
+		if _, ok := node.node.(rawNode); !ok && node.node != nil {
+			forGatherChildren(node.node, func(child common.Hash) {
+				if _, ok := db.dirties[child]; ok {
+					parents[child]++
+				}
+			})
+		}
+	}
+	for hash, node := range db.dirties {
+		if hash == (common.Hash{}) {
+			continue
+		}
+		if node.parents != parents[hash] {
+			issues = append(issues, fmt.Sprintf("node %x: parents %d, want %d", hash, node.parents, parents[hash]))
+		}
+	}
+	if err := db.checkFlushList(); err != nil {
+		issues = append(issues, err.Error())
+	}
+	if db.dirtiesSize != dirtiesSize {
+		issues = append(issues, fmt.Sprintf("dirty size %v, want %v", db.dirtiesSize, dirtiesSize))
+	}
+	if db.childrenSize != childrenSize {
+		issues = append(issues, fmt.Sprintf("children size %v, want %v", db.childrenSize, childrenSize))
+	}
+	if ok {
+		var refs uint64
+		for _, count := range meta.children {
+			refs += uint64(count)
+		}
+		if db.roots.refs != refs {
+			issues = append(issues, fmt.Sprintf("retained root refs %d, want %d", db.roots.refs, refs))
+		}
+	}
+	if len(issues) > 0 {
+		return &ConsistencyError{Issues: issues}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that the consistency checker accepts a healthy cache throughout its
+// lifecycle and reports every deliberately corrupted counter.
+func TestDatabaseCheckConsistency(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+	if err := db.CheckConsistency(); err != nil {
+		t.Fatalf("empty database inconsistent: %v", err)
+	}
+	root := makeDirtyTrie(db, 100)
+	other := makeDirtyTrie(db, 150)
+	if err := db.CheckConsistency(); err != nil {
+		t.Fatalf("dirty database inconsistent: %v", err)
+	}
+	db.Dereference(root)
+	if err := db.CheckConsistency(); err != nil {
+		t.Fatalf("dereferenced database inconsistent: %v", err)
+	}
+	// Corrupt a parent counter, the sizes and the flush-list all at once
+	var victim common.Hash
+	for hash := range db.dirties {
+		if hash != (common.Hash{}) && hash != other {
+			victim = hash
+			break
+		}
+	}
+	db.dirties[victim].parents += 2
+	db.dirtiesSize += 10
+	db.childrenSize -= 10
+	db.dirties[db.newest].flushNext = common.HexToHash("0xdeadbeef")
+
+	err := db.CheckConsistency()
+	if err == nil {
+		t.Fatalf("corrupted database passed the check")
+	}
+	cerr, ok := err.(*ConsistencyError)
+	if !ok {
+		t.Fatalf("unexpected error type %T", err)
+	}
+	if len(cerr.Issues) != 4 {
+		t.Fatalf("issue count mismatch: have %d, want 4: %v", len(cerr.Issues), err)
+	}
+	if want := fmt.Sprintf("node %x", victim); !strings.Contains(err.Error(), want) {
+		t.Errorf("corrupted node not reported: %v", err)
+	}
+	// Restore the counters and check that a flush keeps the cache consistent
+	db.dirties[victim].parents -= 2
+	db.dirtiesSize -= 10
+	db.childrenSize += 10
+	db.dirties[db.newest].flushNext = common.Hash{}
+
+	size, _ := db.Size()
+	if err := db.Cap(size / 2); err != nil {
+		t.Fatalf("failed to cap database: %v", err)
+	}
+	if err := db.CheckConsistency(); err != nil {
+		t.Fatalf("capped database inconsistent: %v", err)
+	}
+}
+
+// Tests that committing nodes with external children keeps the tracked sizes
+// consistent.
+func TestDatabaseCheckConsistencyAfterCommit(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+	root := makeDirtyTrie(db, 100)
+	storage := makeDirtyTrie(db, 10)
+	db.Reference(storage, root)
+	db.Dereference(storage)
+
+	other := makeDirtyTrie(db, 50)
+	db.Reference(storage, other)
+
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit database: %v", err)
+	}
+	if err := db.CheckConsistency(); err != nil {
+		t.Fatalf("committed database inconsistent: %v", err)
+	}
+}
@@ -21,11 +21,15 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/VictoriaMetrics/fastcache"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/metrics"
@@ -54,6 +58,15 @@ var (
 	memcacheCommitTimeTimer  = metrics.NewRegisteredResettingTimer("trie/memcache/commit/time", nil)
 	memcacheCommitNodesMeter = metrics.NewRegisteredMeter("trie/memcache/commit/nodes", nil)
 	memcacheCommitSizeMeter  = metrics.NewRegisteredMeter("trie/memcache/commit/size", nil)
+
+	memcachePendingDropMeter = metrics.NewRegisteredMeter("trie/memcache/pending/drop", nil)
+
+	memcacheCorruptMeter    = metrics.NewRegisteredMeter("trie/memcache/disk/corrupt", nil)
+	memcacheDecodeFailMeter = metrics.NewRegisteredMeter("trie/memcache/decode/fail", nil)
+
+	memcacheQuotaRejectMeter = metrics.NewRegisteredMeter("trie/memcache/quota/reject", nil)
+
+	memcacheOrphanRefMeter = metrics.NewRegisteredMeter("trie/memcache/reference/orphan", nil)
 )
 
 // secureKeyPrefix is the database key prefix used to store trie node preimages.
@@ -76,12 +89,18 @@ const secureKeyLength = secureKeyPrefixLength + 32
 type Database struct {
 	diskdb ethdb.KeyValueStore // Persistent storage for matured trie nodes
 
-	cleans  *fastcache.Cache            // GC friendly memory cache of clean node RLPs
-	dirties map[common.Hash]*cachedNode // Data and references relationships of dirty nodes
-	oldest  common.Hash                 // Oldest tracked node, flush-list head
-	newest  common.Hash                 // Newest tracked node, flush-list tail
+	cleans     *fastcache.Cache            // GC friendly memory cache of clean node RLPs
+	cleanLimit int                         // Memory allowance (bytes) of the clean cache
+	dirties    map[common.Hash]*cachedNode // Data and references relationships of dirty nodes
+	oldest     common.Hash                 // Oldest tracked node, flush-list head
+	newest     common.Hash                 // Newest tracked node, flush-list tail
+	pending    map[common.Hash]uint32      // Parent references to children not yet inserted
+	roots      rootRefs                    // Trie roots retained by the meta root
 
-	preimages map[common.Hash][]byte // Preimages of nodes from the secure trie
+	preimages         map[common.Hash][]byte // Preimages of nodes from the secure trie
+	preimageOrder     []common.Hash          // Insertion order of the cached preimages, if the cache is capped
+	preimagesOff      bool                   // Whether the secure tries stopped recording preimages
+	preimagesRecorded uint64                 // Number of preimages recorded since the database was created
 
 	gctime  time.Duration      // Time spent on garbage collection since last commit
 	gcnodes uint64             // Nodes garbage collected since last commit
@@ -91,9 +110,36 @@ type Database struct {
 	flushnodes uint64             // Nodes flushed since last commit
 	flushsize  common.StorageSize // Data storage flushed since last commit
 
+	orphanRefs uint64 // References to uncached parents dropped since the database was created
+
+	clock mclock.Clock // Source of the dirty node insertion times
+
 	dirtiesSize   common.StorageSize // Storage size of the dirty node cache (exc. metadata)
 	childrenSize  common.StorageSize // Storage size of the external children tracking
 	preimagesSize common.StorageSize // Storage size of the preimages cache
+	preimageLimit common.StorageSize // Size of the preimages cache triggering a flush in Cap
+	preimageCap   common.StorageSize // Size of the preimages cache triggering a spill to disk, 0 if unlimited
+	batchSize     int                // Size of the batches written by Cap and Commit, 0 for the default
+
+	readStats  [numReadTags]readCounters // Read statistics per caller tag
+	depthStats depthCounters             // Read statistics per node depth, if enabled
+	lastCommit CommitReport              // Breakdown of the last persisted trie
+
+	cacheSaving uint32            // Whether the clean cache is being saved (atomic)
+	saveStats   cacheSaveStats    // Outcome of the clean cache saves
+	verifyReads uint32            // Whether nodes loaded from disk are checked against their hash (atomic)
+	cleanHits   hitReservoir      // Recently hit clean cache keys, sampled by the validator
+	sharing     sharedKeys        // Clean cache keys copied into the shared clean cache file
+	shared      *sharedCleanCache // Clean cache shared by another process, nil if none
+	estimate    commitEstimate    // Last commit estimate, reused by cheap estimates
+
+	flushLock sync.Mutex         // Serializes Cap and Commit with the background flusher
+	capLock   sync.Mutex         // Protects the background flusher lifecycle
+	capQuit   chan chan struct{} // Quit channel of the background flusher, nil if not running
+	mirror    *commitMirror      // Replica of the flushed nodes, nil if not mirroring
+	committed *commitBloom       // Nodes written by the recent commits, nil before the first one
+
+	quotas map[InsertSource]*insertQuota // Dirty cache budgets of the insertion sources
 
 	lock sync.RWMutex
 }
@@ -141,14 +187,17 @@ func (n rawShortNode) fstring(ind string) string { panic("this should never end
 // cachedNode is all the information we know about a single cached node in the
 // memory database write layer.
 type cachedNode struct {
-	node node   // Cached collapsed trie node, or raw rlp data
-	size uint16 // Byte size of the useful cached data
+	node   node         // Cached collapsed trie node, or raw rlp data (never modified)
+	size   uint16       // Byte size of the useful cached data
+	source InsertSource // Source the node is charged to, zero if trusted
 
 	parents  uint32                 // Number of live nodes referencing this one
 	children map[common.Hash]uint16 // External children referenced by this node
 
 	flushPrev common.Hash // Previous node in the flush-list
 	flushNext common.Hash // Next node in the flush-list
+
+	inserted mclock.AbsTime // Time of insertion into the dirty cache
 }
 
 // cachedNodeSize is the raw size of a cachedNode data structure without any
@@ -184,7 +233,7 @@ func (n *cachedNode) obj(hash common.Hash) node {
 
 // forChilds invokes the callback for  all the tracked children of this node,
 // both the implicit ones  from inside the node as well as the explicit ones
-//from outside the node.
+// from outside the node.
 func (n *cachedNode) forChilds(onChild func(hash common.Hash)) {
 	for child := range n.children {
 		onChild(child)
@@ -289,16 +338,67 @@ func NewDatabaseWithCache(diskdb ethdb.KeyValueStore, cache int) *Database {
 	if cache > 0 {
 		cleans = fastcache.New(cache * 1024 * 1024)
 	}
+	roots := newRootRefs()
 	return &Database{
-		diskdb: diskdb,
-		cleans: cleans,
+		diskdb:     diskdb,
+		cleans:     cleans,
+		cleanLimit: cache * 1024 * 1024,
 		dirties: map[common.Hash]*cachedNode{{}: {
-			children: make(map[common.Hash]uint16),
+			children: roots.counts,
 		}},
-		preimages: make(map[common.Hash][]byte),
+		roots:         roots,
+		clock:         mclock.System{},
+		preimages:     make(map[common.Hash][]byte),
+		preimageLimit: defaultPreimageLimit,
+	}
+}
+
+// SetBatchSize sets the amount of data Cap and Commit accumulate in a database
+// batch before writing it out. Zero (or a negative size) restores the default
+// of ethdb.IdealBatchSize.
+func (db *Database) SetBatchSize(size int) {
+	db.lockFlush()
+	defer db.flushLock.Unlock()
+
+	db.batchSize = size
+}
+
+// SetVerifyReads enables or disables the verification of the trie nodes loaded
+// from disk. If enabled, every node read from disk is hashed and compared to the
+// requested hash, and ErrCorruptedNode is returned on a mismatch.
+func (db *Database) SetVerifyReads(verify bool) {
+	if verify {
+		atomic.StoreUint32(&db.verifyReads, 1)
+	} else {
+		atomic.StoreUint32(&db.verifyReads, 0)
 	}
 }
 
+// verifyNode checks a node blob loaded from disk against its hash, if read
+// verification is enabled.
+func (db *Database) verifyNode(hash common.Hash, enc []byte) error {
+	if atomic.LoadUint32(&db.verifyReads) == 0 {
+		return nil
+	}
+	if have := crypto.Keccak256Hash(enc); have != hash {
+		memcacheCorruptMeter.Mark(1)
+		log.Error("Corrupted trie node on disk", "hash", hash, "have", have)
+		return ErrCorruptedNode
+	}
+	return nil
+}
+
+// flushBatchSize returns the amount of data to accumulate in a batch before
+// writing it out.
+//
+// Note, this method assumes the flush lock is held.
+func (db *Database) flushBatchSize() int {
+	if db.batchSize <= 0 {
+		return ethdb.IdealBatchSize
+	}
+	return db.batchSize
+}
+
 // DiskDB retrieves the persistent storage backing the trie database.
 func (db *Database) DiskDB() ethdb.KeyValueReader {
 	return db.diskdb
@@ -331,12 +431,14 @@ func (db *Database) insert(hash common.Hash, size int, node node) {
 		node:      simplifyNode(node),
 		size:      uint16(size),
 		flushPrev: db.newest,
+		inserted:  db.clock.Now(),
 	}
 	entry.forChilds(func(child common.Hash) {
 		if c := db.dirties[child]; c != nil {
 			c.parents++
 		}
 	})
+	db.applyPendingRefs(hash, entry)
 	db.dirties[hash] = entry
 
 	// Update the flush-list endpoints
@@ -348,27 +450,64 @@ func (db *Database) insert(hash common.Hash, size int, node node) {
 	db.dirtiesSize += common.StorageSize(common.HashLength + entry.size)
 }
 
-// insertPreimage writes a new trie node pre-image to the memory database if it's
-// yet unknown. The method will make a copy of the slice.
+// insertPreimage records a new trie node pre-image in the memory database if
+// preimage recording is enabled and it's yet unknown. The method will make a
+// copy of the slice.
 //
 // Note, this method assumes that the database's lock is held!
 func (db *Database) insertPreimage(hash common.Hash, preimage []byte) {
-	if _, ok := db.preimages[hash]; ok {
+	if db.preimagesOff {
 		return
 	}
+	if db.cachePreimage(hash, preimage) {
+		db.preimagesRecorded++
+	}
+}
+
+// cachePreimage writes a new trie node pre-image to the memory database if it's
+// yet unknown, regardless of preimage recording. The method will make a copy of
+// the slice and reports whether the preimage was added.
+//
+// Note, this method assumes that the database's lock is held!
+func (db *Database) cachePreimage(hash common.Hash, preimage []byte) bool {
+	if _, ok := db.preimages[hash]; ok {
+		return false
+	}
 	db.preimages[hash] = common.CopyBytes(preimage)
 	db.preimagesSize += common.StorageSize(common.HashLength + len(preimage))
+
+	if db.preimageCap != 0 {
+		db.preimageOrder = append(db.preimageOrder, hash)
+		if db.preimagesSize > db.preimageCap {
+			db.spillPreimages()
+		}
+	}
+	return true
 }
 
 // node retrieves a cached trie node from memory, or returns nil if none can be
-// found in the memory cache.
-func (db *Database) node(hash common.Hash) node {
+// found in the memory cache. The read is accounted to the given caller tag, the
+// depth is the path length of the node in nibbles, used for the detailed read
+// metrics. An error is only returned if the node was
+// found in the clean cache or on disk but failed the read verification or could
+// not be decoded.
+func (db *Database) node(tag ReadTag, hash common.Hash, depth int) (node, error) {
 	// Retrieve the node from the clean cache if available
 	if db.cleans != nil {
 		if enc := db.cleans.Get(nil, hash[:]); enc != nil {
 			memcacheCleanHitMeter.Mark(1)
 			memcacheCleanReadMeter.Mark(int64(len(enc)))
-			return mustDecodeNode(hash[:], enc)
+			db.markClean(tag, len(enc))
+			db.markDepth(depth, false)
+			db.trackCleanHit(hash)
+
+			n, err := decodeNodeSafe(hash[:], enc)
+			if err != nil {
+				// Don't serve the broken entry again, the next read goes to disk
+				db.cleans.Del(hash[:])
+				return nil, db.decodeFailed(hash, err, "clean cache")
+			}
+			return n, nil
 		}
 	}
 	// Retrieve the node from the dirty cache if available
@@ -379,26 +518,67 @@ func (db *Database) node(hash common.Hash) node {
 	if dirty != nil {
 		memcacheDirtyHitMeter.Mark(1)
 		memcacheDirtyReadMeter.Mark(int64(dirty.size))
-		return dirty.obj(hash)
+		db.markDirty(tag, int(dirty.size))
+		return dirty.obj(hash), nil
 	}
 	memcacheDirtyMissMeter.Mark(1)
 
+	// Retrieve the node from the shared clean cache if available
+	if enc := db.sharedNode(hash); enc != nil {
+		if err := db.verifyNode(hash, enc); err != nil {
+			return nil, err
+		}
+		db.markClean(tag, len(enc))
+		db.markDepth(depth, false)
+
+		n, err := decodeNodeSafe(hash[:], enc)
+		if err != nil {
+			return nil, db.decodeFailed(hash, err, "shared cache")
+		}
+		return n, nil
+	}
+
 	// Content unavailable in memory, attempt to retrieve from disk
 	enc, err := db.diskdb.Get(hash[:])
 	if err != nil || enc == nil {
-		return nil
+		return nil, nil
+	}
+	if err := db.verifyNode(hash, enc); err != nil {
+		return nil, err
+	}
+	db.markDisk(tag, len(enc))
+	db.markDepth(depth, true)
+
+	n, err := decodeNodeSafe(hash[:], enc)
+	if err != nil {
+		return nil, db.decodeFailed(hash, err, "disk")
 	}
 	if db.cleans != nil {
 		db.cleans.Set(hash[:], enc)
+		db.trackShared(hash)
 		memcacheCleanMissMeter.Mark(1)
 		memcacheCleanWriteMeter.Mark(int64(len(enc)))
 	}
-	return mustDecodeNode(hash[:], enc)
+	return n, nil
+}
+
+// decodeFailed accounts a trie node that could not be decoded from the given
+// source, returning the error to fail the read with.
+func (db *Database) decodeFailed(hash common.Hash, err error, source string) error {
+	memcacheDecodeFailMeter.Mark(1)
+	log.Error("Failed to decode trie node", "hash", hash, "source", source, "err", err)
+	return &CorruptedNodeError{NodeHash: hash, Err: err}
 }
 
 // Node retrieves an encoded cached trie node from memory. If it cannot be found
 // cached, the method queries the persistent database for the content.
 func (db *Database) Node(hash common.Hash) ([]byte, error) {
+	return db.NodeWithTag(ReadTagDefault, hash)
+}
+
+// NodeWithTag retrieves an encoded cached trie node similarly to Node, but
+// accounts the read to the given caller tag in the read statistics.
+func (db *Database) NodeWithTag(tag ReadTag, hash common.Hash) ([]byte, error) {
 	// It doesn't make sense to retrieve the metaroot
 	if hash == (common.Hash{}) {
 		return nil, errors.New("not found")
@@ -408,6 +588,8 @@ func (db *Database) Node(hash common.Hash) ([]byte, error) {
 		if enc := db.cleans.Get(nil, hash[:]); enc != nil {
 			memcacheCleanHitMeter.Mark(1)
 			memcacheCleanReadMeter.Mark(int64(len(enc)))
+			db.markClean(tag, len(enc))
+			db.trackCleanHit(hash)
 			return enc, nil
 		}
 	}
@@ -419,15 +601,30 @@ func (db *Database) Node(hash common.Hash) ([]byte, error) {
 	if dirty != nil {
 		memcacheDirtyHitMeter.Mark(1)
 		memcacheDirtyReadMeter.Mark(int64(dirty.size))
+		db.markDirty(tag, int(dirty.size))
 		return dirty.rlp(), nil
 	}
 	memcacheDirtyMissMeter.Mark(1)
 
+	// Retrieve the node from the shared clean cache if available
+	if enc := db.sharedNode(hash); enc != nil {
+		if err := db.verifyNode(hash, enc); err != nil {
+			return nil, err
+		}
+		db.markClean(tag, len(enc))
+		return enc, nil
+	}
+
 	// Content unavailable in memory, attempt to retrieve from disk
 	enc, err := db.diskdb.Get(hash[:])
 	if err == nil && enc != nil {
+		if err := db.verifyNode(hash, enc); err != nil {
+			return nil, err
+		}
+		db.markDisk(tag, len(enc))
 		if db.cleans != nil {
 			db.cleans.Set(hash[:], enc)
+			db.trackShared(hash)
 			memcacheCleanMissMeter.Mark(1)
 			memcacheCleanWriteMeter.Mark(int64(len(enc)))
 		}
@@ -476,6 +673,11 @@ func (db *Database) Nodes() []common.Hash {
 }
 
 // Reference adds a new reference from a parent node to a child node.
+//
+// If the parent is not in the dirty cache any more (e.g. it was flushed by Cap
+// after the caller resolved it), the reference is dropped and counted in the
+// cache statistics. The child is then persisted with the next flush, the same
+// way as any other unreferenced node.
 func (db *Database) Reference(child common.Hash, parent common.Hash) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
@@ -490,11 +692,25 @@ func (db *Database) reference(child common.Hash, parent common.Hash) {
 	if !ok {
 		return
 	}
-	// If the reference already exists, only duplicate for roots
+	// If the parent is gone, there's nothing to track the reference under
+	if !db.parentCached(child, parent) {
+		return
+	}
+	// References from the meta root are counted, the same root may be retained
+	// multiple times
+	if parent == (common.Hash{}) {
+		node.parents++
+		if db.roots.add(child) {
+			db.childrenSize += rootRefSize
+			db.roots.check()
+		}
+		return
+	}
+	// If the reference already exists, skip it
 	if db.dirties[parent].children == nil {
 		db.dirties[parent].children = make(map[common.Hash]uint16)
 		db.childrenSize += cachedNodeChildrenSize
-	} else if _, ok = db.dirties[parent].children[child]; ok && parent != (common.Hash{}) {
+	} else if _, ok = db.dirties[parent].children[child]; ok {
 		return
 	}
 	node.parents++
@@ -504,18 +720,42 @@ func (db *Database) reference(child common.Hash, parent common.Hash) {
 	}
 }
 
+// parentCached reports whether the parent of a reference is in the dirty cache,
+// counting and dropping the reference if it's not (e.g. because the parent was
+// flushed meanwhile).
+func (db *Database) parentCached(child common.Hash, parent common.Hash) bool {
+	if _, ok := db.dirties[parent]; ok {
+		return true
+	}
+	db.orphanRefs++
+	memcacheOrphanRefMeter.Mark(1)
+	log.Warn("Dropped reference to child of uncached trie node", "child", child, "parent", parent)
+	return false
+}
+
 // Dereference removes an existing reference from a root node.
 func (db *Database) Dereference(root common.Hash) {
-	// Sanity check to ensure that the meta-root is not removed
-	if root == (common.Hash{}) {
-		log.Error("Attempted to dereference the trie cache meta root")
-		return
-	}
+	db.DereferenceBatch([]common.Hash{root})
+}
+
+// DereferenceBatch removes an existing reference from each of the given root
+// nodes. The outcome is the same as dereferencing the roots one by one, but the
+// lock is only acquired once and the garbage collection is reported in one go.
+func (db *Database) DereferenceBatch(roots []common.Hash) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
 	nodes, storage, start := len(db.dirties), db.dirtiesSize, time.Now()
-	db.dereference(root, common.Hash{})
+	for _, root := range roots {
+		// Sanity check to ensure that the meta-root is not removed
+		if root == (common.Hash{}) {
+			log.Error("Attempted to dereference the trie cache meta root")
+			continue
+		}
+		db.dereference(root, common.Hash{})
+	}
+	db.resetCommitEstimate()
+	db.refreshCacheGauges()
 
 	db.gcnodes += uint64(nodes - len(db.dirties))
 	db.gcsize += storage - db.dirtiesSize
@@ -525,16 +765,22 @@ func (db *Database) Dereference(root common.Hash) {
 	memcacheGCSizeMeter.Mark(int64(storage - db.dirtiesSize))
 	memcacheGCNodesMeter.Mark(int64(nodes - len(db.dirties)))
 
-	log.Debug("Dereferenced trie from memory database", "nodes", nodes-len(db.dirties), "size", storage-db.dirtiesSize, "time", time.Since(start),
+	log.Debug("Dereferenced trie from memory database", "roots", len(roots), "nodes", nodes-len(db.dirties), "size", storage-db.dirtiesSize, "time", time.Since(start),
 		"gcnodes", db.gcnodes, "gcsize", db.gcsize, "gctime", db.gctime, "livenodes", len(db.dirties), "livesize", db.dirtiesSize)
 }
 
 // dereference is the private locked version of Dereference.
 func (db *Database) dereference(child common.Hash, parent common.Hash) {
+	// If the parent is gone, the reference was dropped, nothing to release
+	if _, ok := db.dirties[parent]; !ok {
+		return
+	}
 	// Dereference the parent-child
-	node := db.dirties[parent]
-
-	if node.children != nil && node.children[child] > 0 {
+	if parent == (common.Hash{}) {
+		if db.roots.remove(child) {
+			db.childrenSize -= rootRefSize
+		}
+	} else if node := db.dirties[parent]; node.children != nil && node.children[child] > 0 {
 		node.children[child]--
 		if node.children[child] == 0 {
 			delete(node.children, child)
@@ -556,22 +802,14 @@ func (db *Database) dereference(child common.Hash, parent common.Hash) {
 	}
 	if node.parents == 0 {
 		// Remove the node from the flush-list
-		switch child {
-		case db.oldest:
-			db.oldest = node.flushNext
-			db.dirties[node.flushNext].flushPrev = common.Hash{}
-		case db.newest:
-			db.newest = node.flushPrev
-			db.dirties[node.flushPrev].flushNext = common.Hash{}
-		default:
-			db.dirties[node.flushPrev].flushNext = node.flushNext
-			db.dirties[node.flushNext].flushPrev = node.flushPrev
-		}
+		db.unlinkFlushList(child, node)
 		// Dereference all children and delete the node
+		db.dropPendingRefs(node)
 		node.forChilds(func(hash common.Hash) {
 			db.dereference(hash, child)
 		})
 		delete(db.dirties, child)
+		db.releaseQuota(node)
 		db.dirtiesSize -= common.StorageSize(common.HashLength + int(node.size))
 		if node.children != nil {
 			db.childrenSize -= cachedNodeChildrenSize
@@ -583,8 +821,11 @@ func (db *Database) dereference(child common.Hash, parent common.Hash) {
 // memory usage goes below the given threshold.
 //
 // Note, this method is a non-synchronized mutator. It is unsafe to call this
-// concurrently with other mutators.
+// concurrently with other mutators, apart from the background flusher.
 func (db *Database) Cap(limit common.StorageSize) error {
+	db.lockFlush()
+	defer db.flushLock.Unlock()
+
 	// Create a database batch to flush persistent data out. It is important that
 	// outside code doesn't see an inconsistent state (referenced data removed from
 	// memory cache during commit but not yet in persistent storage). This is ensured
@@ -595,46 +836,42 @@ func (db *Database) Cap(limit common.StorageSize) error {
 	// db.dirtiesSize only contains the useful data in the cache, but when reporting
 	// the total memory consumption, the maintenance metadata is also needed to be
 	// counted.
-	size := db.dirtiesSize + common.StorageSize((len(db.dirties)-1)*cachedNodeSize)
-	size += db.childrenSize - common.StorageSize(len(db.dirties[common.Hash{}].children)*(common.HashLength+2))
-
-	// We reuse an ephemeral buffer for the keys. The batch Put operation
-	// copies it internally, so we can reuse it.
-	var keyBuf [secureKeyLength]byte
-	copy(keyBuf[:], secureKeyPrefix)
+	total := db.dirtiesSize + common.StorageSize((len(db.dirties)-1)*cachedNodeSize)
+	total += db.childrenSize - db.roots.size()
 
 	// If the preimage cache got large enough, push to disk. If it's still small
 	// leave for later to deduplicate writes.
-	flushPreimages := db.preimagesSize > 4*1024*1024
+	flushPreimages := db.preimagesSize > db.preimageLimit
 	if flushPreimages {
-		for hash, preimage := range db.preimages {
-			copy(keyBuf[secureKeyPrefixLength:], hash[:])
-			if err := batch.Put(keyBuf[:], preimage); err != nil {
-				log.Error("Failed to commit preimage from trie database", "err", err)
-				return err
-			}
-			if batch.ValueSize() > ethdb.IdealBatchSize {
-				if err := batch.Write(); err != nil {
-					return err
-				}
-				batch.Reset()
-			}
+		if err := writePreimages(batch, db.preimages, db.flushBatchSize()); err != nil {
+			return err
 		}
 	}
 	// Keep committing nodes from the flush-list until we're below allowance
-	oldest := db.oldest
+	size, oldest := total, db.oldest
 	for size > limit && oldest != (common.Hash{}) {
-		// Fetch the oldest referenced node and push into the batch
+		// Fetch the oldest referenced node and push into the batch. If the flush-list
+		// references a node not cached any more, rebuild it and restart flushing from
+		// the new head. Nodes already added to the batch are simply written twice.
 		node := db.dirties[oldest]
+		if node == nil {
+			db.lock.Lock()
+			db.repairFlushList(fmt.Errorf("missing flush-list item %x", oldest))
+			db.lock.Unlock()
+
+			size, oldest = total, db.oldest
+			continue
+		}
 		if err := batch.Put(oldest[:], node.rlp()); err != nil {
 			return err
 		}
-		// If we exceeded the ideal batch size, commit and reset
-		if batch.ValueSize() >= ethdb.IdealBatchSize {
+		// If we exceeded the batch size, commit and reset
+		if batch.ValueSize() >= db.flushBatchSize() {
 			if err := batch.Write(); err != nil {
 				log.Error("Failed to write flush list to disk", "err", err)
 				return err
 			}
+			db.mirrorBatch(batch)
 			batch.Reset()
 		}
 		// Iterate to the next flush item, or abort if the size cap was achieved. Size
@@ -651,17 +888,22 @@ func (db *Database) Cap(limit common.StorageSize) error {
 		log.Error("Failed to write flush list to disk", "err", err)
 		return err
 	}
+	db.mirrorBatch(batch)
+
 	// Write successful, clear out the flushed data
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
 	if flushPreimages {
 		db.preimages = make(map[common.Hash][]byte)
+		db.preimageOrder = nil
 		db.preimagesSize = 0
 	}
 	for db.oldest != oldest {
 		node := db.dirties[db.oldest]
 		delete(db.dirties, db.oldest)
+		db.dropPendingRefs(node)
+		db.releaseQuota(node)
 		db.oldest = node.flushNext
 
 		db.dirtiesSize -= common.StorageSize(common.HashLength + int(node.size))
@@ -672,6 +914,8 @@ func (db *Database) Cap(limit common.StorageSize) error {
 	if db.oldest != (common.Hash{}) {
 		db.dirties[db.oldest].flushPrev = common.Hash{}
 	}
+	db.resetCommitEstimate()
+	db.refreshCacheGauges()
 	db.flushnodes += uint64(nodes - len(db.dirties))
 	db.flushsize += storage - db.dirtiesSize
 	db.flushtime += time.Since(start)
@@ -686,6 +930,26 @@ func (db *Database) Cap(limit common.StorageSize) error {
 	return nil
 }
 
+// CommitOptions are the optional parameters of a Commit.
+type CommitOptions struct {
+	Report        bool // Whether to log the commit statistics at info level
+	SkipPreimages bool // Whether to leave the accumulated preimages cached
+
+	// Callback is invoked for every node written to disk along with the owner
+	// of the node: the root of the storage trie it belongs to or zero for the
+	// account trie. Contract code is owned by its own hash.
+	Callback func(owner common.Hash, hash common.Hash, blob []byte)
+
+	// CallbackOwners limits the callback invocations to nodes belonging to the
+	// listed owners. If empty, the callback is invoked for all nodes.
+	CallbackOwners []common.Hash
+
+	// Owner is the owner of the committed root, zero for the account trie. The
+	// nodes of the committed trie are attributed to it in the callback and the
+	// commit report.
+	Owner common.Hash
+}
+
 // Commit iterates over all the children of a particular node, writes them out
 // to disk, forcefully tearing down all references in both directions. As a side
 // effect, all pre-images accumulated up to this point are also written.
@@ -693,6 +957,34 @@ func (db *Database) Cap(limit common.StorageSize) error {
 // Note, this method is a non-synchronized mutator. It is unsafe to call this
 // concurrently with other mutators.
 func (db *Database) Commit(node common.Hash, report bool) error {
+	return db.CommitWithOptions(node, CommitOptions{Report: report})
+}
+
+// CommitOwner writes out a single storage trie belonging to the given owner,
+// leaving the rest of the dirty cache and the accumulated preimages untouched.
+// Only the committed nodes are uncached, the references to them from other
+// dirty nodes are resolved from disk afterwards. The optional callback is
+// invoked with the database key of every node written.
+//
+// Note, this method is a non-synchronized mutator. It is unsafe to call this
+// concurrently with other mutators, apart from the background flusher.
+func (db *Database) CommitOwner(owner common.Hash, root common.Hash, report bool, callback func(key []byte)) error {
+	opts := CommitOptions{Report: report, SkipPreimages: true, Owner: owner}
+	if callback != nil {
+		opts.Callback = func(owner common.Hash, hash common.Hash, blob []byte) { callback(hash[:]) }
+	}
+	return db.CommitWithOptions(root, opts)
+}
+
+// CommitWithOptions is the configurable version of Commit.
+//
+// Note, this method is a non-synchronized mutator. It is unsafe to call this
+// concurrently with other mutators, apart from the background flusher and
+// InsertBlob or Reference calls adding new references to the dirty nodes.
+func (db *Database) CommitWithOptions(node common.Hash, opts CommitOptions) error {
+	db.lockFlush()
+	defer db.flushLock.Unlock()
+
 	// Create a database batch to flush persistent data out. It is important that
 	// outside code doesn't see an inconsistent state (referenced data removed from
 	// memory cache during commit but not yet in persistent storage). This is ensured
@@ -700,25 +992,14 @@ func (db *Database) Commit(node common.Hash, report bool) error {
 	start := time.Now()
 	batch := db.diskdb.NewBatch()
 
-	// We reuse an ephemeral buffer for the keys. The batch Put operation
-	// copies it internally, so we can reuse it.
-	var keyBuf [secureKeyLength]byte
-	copy(keyBuf[:], secureKeyPrefix)
-
 	// Move all of the accumulated preimages into a write batch
-	for hash, preimage := range db.preimages {
-		copy(keyBuf[secureKeyPrefixLength:], hash[:])
-		if err := batch.Put(keyBuf[:], preimage); err != nil {
-			log.Error("Failed to commit preimage from trie database", "err", err)
+	if !opts.SkipPreimages {
+		db.lock.RLock()
+		err := writePreimages(batch, db.preimages, db.flushBatchSize())
+		db.lock.RUnlock()
+		if err != nil {
 			return err
 		}
-		// If the batch is too large, flush to disk
-		if batch.ValueSize() > ethdb.IdealBatchSize {
-			if err := batch.Write(); err != nil {
-				return err
-			}
-			batch.Reset()
-		}
 	}
 	// Since we're going to replay trie node writes into the clean cache, flush out
 	// any batched pre-images before continuing.
@@ -728,10 +1009,29 @@ func (db *Database) Commit(node common.Hash, report bool) error {
 	batch.Reset()
 
 	// Move the trie itself into the batch, flushing if enough data is accumulated
+	db.lock.RLock()
 	nodes, storage := len(db.dirties), db.dirtiesSize
+	db.lock.RUnlock()
+
+	if db.committed == nil {
+		db.committed = newCommitBloom()
+	}
 
 	uncacher := &cleaner{db}
-	if err := db.commit(node, batch, uncacher); err != nil {
+	tracker := newCommitTracker()
+	callback := opts.Callback
+	if callback != nil && len(opts.CallbackOwners) > 0 {
+		owners := make(map[common.Hash]struct{}, len(opts.CallbackOwners))
+		for _, owner := range opts.CallbackOwners {
+			owners[owner] = struct{}{}
+		}
+		callback = func(owner common.Hash, hash common.Hash, blob []byte) {
+			if _, ok := owners[owner]; ok {
+				opts.Callback(owner, hash, blob)
+			}
+		}
+	}
+	if err := db.commit(node, opts.Owner, batch, uncacher, tracker, callback); err != nil {
 		log.Error("Failed to commit trie from trie database", "err", err)
 		return err
 	}
@@ -740,27 +1040,38 @@ func (db *Database) Commit(node common.Hash, report bool) error {
 		log.Error("Failed to write trie to disk", "err", err)
 		return err
 	}
+	db.mirrorBatch(batch)
+
 	// Uncache any leftovers in the last batch
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
 	batch.Replay(uncacher)
 	batch.Reset()
+	db.resetCommitEstimate()
+	db.refreshCacheGauges()
 
 	// Reset the storage counters and bumpd metrics
-	db.preimages = make(map[common.Hash][]byte)
-	db.preimagesSize = 0
+	if !opts.SkipPreimages {
+		db.preimages = make(map[common.Hash][]byte)
+		db.preimageOrder = nil
+		db.preimagesSize = 0
+	}
 
 	memcacheCommitTimeTimer.Update(time.Since(start))
 	memcacheCommitSizeMeter.Mark(int64(storage - db.dirtiesSize))
 	memcacheCommitNodesMeter.Mark(int64(nodes - len(db.dirties)))
 
+	db.lastCommit = tracker.finalize()
+
 	logger := log.Info
-	if !report {
+	if !opts.Report {
 		logger = log.Debug
 	}
 	logger("Persisted trie from memory database", "nodes", nodes-len(db.dirties)+int(db.flushnodes), "size", storage-db.dirtiesSize+db.flushsize, "time", time.Since(start)+db.flushtime,
-		"gcnodes", db.gcnodes, "gcsize", db.gcsize, "gctime", db.gctime, "livenodes", len(db.dirties), "livesize", db.dirtiesSize)
+		"gcnodes", db.gcnodes, "gcsize", db.gcsize, "gctime", db.gctime, "livenodes", len(db.dirties), "livesize", db.dirtiesSize,
+		"accountnodes", db.lastCommit.AccountNodes, "accountsize", db.lastCommit.AccountSize, "storagenodes", db.lastCommit.StorageNodes,
+		"storagesize", db.lastCommit.StorageSize, "codenodes", db.lastCommit.CodeNodes, "codesize", db.lastCommit.CodeSize)
 
 	// Reset the garbage collection statistics
 	db.gcnodes, db.gcsize, db.gctime = 0, 0, 0
@@ -769,36 +1080,177 @@ func (db *Database) Commit(node common.Hash, report bool) error {
 	return nil
 }
 
-// commit is the private locked version of Commit.
-func (db *Database) commit(hash common.Hash, batch ethdb.Batch, uncacher *cleaner) error {
-	// If the node does not exist, it's a previously committed node
-	node, ok := db.dirties[hash]
-	if !ok {
-		return nil
+// commitChunkSize is the number of nodes handed to an encoder at once during a
+// commit.
+const commitChunkSize = 256
+
+// commitEncoders is the number of goroutines RLP encoding the nodes during a
+// commit.
+var commitEncoders = runtime.NumCPU()
+
+// commitEntry is a dirty node queued for writing during a commit.
+type commitEntry struct {
+	hash  common.Hash
+	owner common.Hash
+	node  *cachedNode
+	blob  []byte // RLP encoding of the node, filled in by an encoder
+}
+
+// commitChunk is a run of consecutive nodes in commit order, encoded together by
+// a single encoder.
+type commitChunk struct {
+	entries []commitEntry
+	done    chan struct{} // Closed when all the entries are encoded
+}
+
+// commit is the private locked version of Commit. The trie is walked in post-order
+// and the nodes are RLP encoded concurrently by a pool of encoders, but they are
+// written into the batch in walk order, children ahead of their parents, so the
+// batches replayed into the cleaner are the same as with a sequential commit.
+// Nodes already written by a recent commit are only dropped from memory. The
+// owner is the root of the trie the node belongs to, zero for the top level
+// (account) trie. The optional callback is invoked for every node committed.
+func (db *Database) commit(hash common.Hash, owner common.Hash, batch ethdb.Batch, uncacher *cleaner, tracker *commitTracker, callback func(common.Hash, common.Hash, []byte)) error {
+	var (
+		encode = make(chan *commitChunk, commitEncoders)
+		queue  = make(chan *commitChunk, 2*commitEncoders)
+		abort  = make(chan struct{})
+	)
+	defer close(abort)
+
+	// Walk the trie, feeding the chunks to the encoders and to the writer in order
+	go func() {
+		defer close(queue)
+		defer close(encode)
+
+		var (
+			seen  = make(map[common.Hash]struct{})
+			chunk = &commitChunk{done: make(chan struct{})}
+		)
+		emit := func() bool {
+			select {
+			case encode <- chunk:
+			case <-abort:
+				return false
+			}
+			select {
+			case queue <- chunk:
+			case <-abort:
+				return false
+			}
+			chunk = &commitChunk{entries: make([]commitEntry, 0, commitChunkSize), done: make(chan struct{})}
+			return true
+		}
+		push := func(entry commitEntry) bool {
+			if chunk.entries = append(chunk.entries, entry); len(chunk.entries) < commitChunkSize {
+				return true
+			}
+			return emit()
+		}
+		if db.commitWalk(hash, owner, seen, push) && len(chunk.entries) > 0 {
+			emit()
+		}
+	}()
+	for i := 0; i < commitEncoders; i++ {
+		go func() {
+			for chunk := range encode {
+				for j := range chunk.entries {
+					chunk.entries[j].blob = chunk.entries[j].node.rlp()
+				}
+				close(chunk.done)
+			}
+		}()
 	}
-	var err error
-	node.forChilds(func(child common.Hash) {
-		if err == nil {
-			err = db.commit(child, batch, uncacher)
+	// Write the encoded nodes in walk order, flushing if enough data is accumulated
+	for chunk := range queue {
+		<-chunk.done
+		for _, entry := range chunk.entries {
+			if db.persisted(entry.hash) {
+				// Written by a recent commit, only drop it from memory
+				db.lock.Lock()
+				uncacher.Put(entry.hash[:], entry.blob)
+				db.lock.Unlock()
+				memcacheCommitSkipMeter.Mark(1)
+			} else {
+				if err := batch.Put(entry.hash[:], entry.blob); err != nil {
+					return err
+				}
+				db.committed.add(entry.hash)
+			}
+			_, code := entry.node.node.(rawNode)
+			tracker.track(entry.owner, code, len(entry.blob))
+			if callback != nil {
+				callback(entry.owner, entry.hash, entry.blob)
+			}
+			// If we've reached the batch size, commit and start over
+			if batch.ValueSize() >= db.flushBatchSize() {
+				if err := batch.Write(); err != nil {
+					return err
+				}
+				db.mirrorBatch(batch)
+
+				db.lock.Lock()
+				batch.Replay(uncacher)
+				batch.Reset()
+				db.lock.Unlock()
+			}
 		}
-	})
-	if err != nil {
-		return err
 	}
-	if err := batch.Put(hash[:], node.rlp()); err != nil {
-		return err
+	return nil
+}
+
+// commitWalk visits the dirty nodes of the trie rooted at hash in post-order and
+// pushes every node not seen before into the commit queue. Nodes written out by
+// the commit in the meantime are not dirty any more and are skipped. It returns
+// false if the commit was aborted.
+func (db *Database) commitWalk(hash common.Hash, owner common.Hash, seen map[common.Hash]struct{}, push func(commitEntry) bool) bool {
+	// If the node does not exist, it's a previously committed node. The external
+	// children are modified by concurrent (de)references, so they are copied out
+	// under the lock; the collapsed node itself is never modified after insertion.
+	db.lock.RLock()
+	node, ok := db.dirties[hash]
+	var children []common.Hash
+	if ok && len(node.children) > 0 {
+		children = make([]common.Hash, 0, len(node.children))
+		for child := range node.children {
+			children = append(children, child)
+		}
 	}
-	// If we've reached an optimal batch size, commit and start over
-	if batch.ValueSize() >= ethdb.IdealBatchSize {
-		if err := batch.Write(); err != nil {
-			return err
+	db.lock.RUnlock()
+	if !ok {
+		return true
+	}
+	if _, ok := seen[hash]; ok {
+		return true
+	}
+	seen[hash] = struct{}{}
+
+	for _, child := range children {
+		// External children are the roots of other tries (or contract code)
+		if !db.commitWalk(child, child, seen, push) {
+			return false
 		}
-		db.lock.Lock()
-		batch.Replay(uncacher)
-		batch.Reset()
-		db.lock.Unlock()
 	}
-	return nil
+	ok = true
+	if _, raw := node.node.(rawNode); !raw {
+		forGatherChildren(node.node, func(child common.Hash) {
+			if ok {
+				ok = db.commitWalk(child, owner, seen, push)
+			}
+		})
+	}
+	return ok && push(commitEntry{hash: hash, owner: owner, node: node})
+}
+
+// LastCommitReport returns the breakdown of the data persisted by the last
+// successful Commit.
+func (db *Database) LastCommitReport() CommitReport {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	report := db.lastCommit
+	report.HeavyTries = append([]TrieCommitSize(nil), report.HeavyTries...)
+	return report
 }
 
 // cleaner is a database batch replayer that takes a batch of write operations
@@ -813,41 +1265,58 @@ type cleaner struct {
 // the two-phase commit is to ensure ensure data availability while moving from
 // memory to disk.
 func (c *cleaner) Put(key []byte, rlp []byte) error {
+	// Only trie nodes are tracked, skip anything else (e.g. preimages)
+	if len(key) != common.HashLength {
+		return nil
+	}
 	hash := common.BytesToHash(key)
 
 	// If the node does not exist, we're done on this path
-	node, ok := c.db.dirties[hash]
-	if !ok {
+	if !c.uncache(hash) {
 		return nil
 	}
-	// Node still exists, remove it from the flush-list
-	switch hash {
-	case c.db.oldest:
-		c.db.oldest = node.flushNext
-		c.db.dirties[node.flushNext].flushPrev = common.Hash{}
-	case c.db.newest:
-		c.db.newest = node.flushPrev
-		c.db.dirties[node.flushPrev].flushNext = common.Hash{}
-	default:
-		c.db.dirties[node.flushPrev].flushNext = node.flushNext
-		c.db.dirties[node.flushNext].flushPrev = node.flushPrev
-	}
-	// Remove the node from the dirty cache
-	delete(c.db.dirties, hash)
-	c.db.dirtiesSize -= common.StorageSize(common.HashLength + int(node.size))
-	if node.children != nil {
-		c.db.dirtiesSize -= common.StorageSize(cachedNodeChildrenSize + len(node.children)*(common.HashLength+2))
-	}
 	// Move the flushed node into the clean cache to prevent insta-reloads
 	if c.db.cleans != nil {
 		c.db.cleans.Set(hash[:], rlp)
+		c.db.trackShared(hash)
 		memcacheCleanWriteMeter.Mark(int64(len(rlp)))
 	}
 	return nil
 }
 
+// Delete reacts to database deletions. Commit batches don't normally contain
+// any, but if a trie node is deleted from disk, it is evicted from the clean
+// cache so it is not served from memory any more. The dirty cache is left alone:
+// nodes are keyed by content, so a dirty node with the same hash is still live
+// and will be written again when flushed. Other keys are ignored.
 func (c *cleaner) Delete(key []byte) error {
-	panic("not implemented")
+	if len(key) != common.HashLength {
+		return nil
+	}
+	if c.db.cleans != nil {
+		c.db.cleans.Del(key)
+	}
+	return nil
+}
+
+// uncache removes a node from the dirty cache and the flush-list, returning
+// whether the node was found.
+func (c *cleaner) uncache(hash common.Hash) bool {
+	node, ok := c.db.dirties[hash]
+	if !ok {
+		return false
+	}
+	// Node still exists, remove it from the flush-list
+	c.db.unlinkFlushList(hash, node)
+	// Remove the node from the dirty cache
+	delete(c.db.dirties, hash)
+	c.db.dropPendingRefs(node)
+	c.db.releaseQuota(node)
+	c.db.dirtiesSize -= common.StorageSize(common.HashLength + int(node.size))
+	if node.children != nil {
+		c.db.childrenSize -= common.StorageSize(cachedNodeChildrenSize + len(node.children)*(common.HashLength+2))
+	}
+	return true
 }
 
 // Size returns the current storage size of the memory cache in front of the
@@ -856,10 +1325,16 @@ func (db *Database) Size() (common.StorageSize, common.StorageSize) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
+	return db.dirtySize(), db.preimagesSize
+}
+
+// dirtySize returns the total memory consumption of the dirty cache.
+//
+// Note, this method assumes the lock is held.
+func (db *Database) dirtySize() common.StorageSize {
 	// db.dirtiesSize only contains the useful data in the cache, but when reporting
 	// the total memory consumption, the maintenance metadata is also needed to be
-	// counted.
+	// counted, along with the references pending on children not yet inserted.
 	var metadataSize = common.StorageSize((len(db.dirties) - 1) * cachedNodeSize)
-	var metarootRefs = common.StorageSize(len(db.dirties[common.Hash{}].children) * (common.HashLength + 2))
-	return db.dirtiesSize + db.childrenSize + metadataSize - metarootRefs, db.preimagesSize
+	return db.dirtiesSize + db.childrenSize + metadataSize + db.pendingSize() - db.roots.size()
 }
@@ -17,9 +17,18 @@
 package trie
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"reflect"
+	"runtime"
+	"sync"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 )
 
@@ -31,3 +40,672 @@ func TestDatabaseMetarootFetch(t *testing.T) {
 		t.Fatalf("metaroot retrieval succeeded")
 	}
 }
+
+// Tests that batches containing both writes and deletions can be replayed into
+// the cleaner: deleted nodes are evicted from the clean cache but stay dirty.
+func TestCleanerReplayDeletions(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabaseWithCache(diskdb, 1)
+
+	var hashes []common.Hash
+	for i := 0; i < 4; i++ {
+		hash := common.BigToHash(big.NewInt(int64(i + 1)))
+		db.InsertBlob(hash, []byte{byte(i)})
+		hashes = append(hashes, hash)
+	}
+	db.cleans.Set(hashes[3][:], []byte{3})
+
+	batch := diskdb.NewBatch()
+	batch.Put(hashes[0][:], []byte{0})
+	batch.Delete(hashes[3][:])
+	batch.Put(secureKey(hashes[1]), []byte{0xff})
+	batch.Delete(secureKey(hashes[2]))
+	batch.Delete([]byte("non-trie-key"))
+
+	db.lock.Lock()
+	if err := batch.Replay(&cleaner{db}); err != nil {
+		t.Fatalf("failed to replay batch: %v", err)
+	}
+	db.lock.Unlock()
+
+	// Only the written node must be gone from the dirty cache, the rest intact
+	if nodes := db.Nodes(); len(nodes) != 3 {
+		t.Fatalf("dirty node count mismatch: have %d, want %d", len(nodes), 3)
+	}
+	if db.oldest != hashes[1] || db.newest != hashes[3] {
+		t.Fatalf("flush-list endpoints mismatch: have %x-%x, want %x-%x", db.oldest, db.newest, hashes[1], hashes[3])
+	}
+	if next := db.dirties[hashes[2]].flushNext; next != hashes[3] {
+		t.Fatalf("flush-list link mismatch: have %x, want %x", next, hashes[3])
+	}
+	if db.dirtiesSize != 3*(common.HashLength+1) {
+		t.Fatalf("dirty size mismatch: have %v, want %v", db.dirtiesSize, 3*(common.HashLength+1))
+	}
+	// The written node must be moved into the clean cache, the deleted evicted
+	if !db.cleans.Has(hashes[0][:]) {
+		t.Errorf("written node missing from clean cache")
+	}
+	if db.cleans.Has(hashes[3][:]) {
+		t.Errorf("deleted node present in clean cache")
+	}
+	if blob, err := db.Node(hashes[3]); err != nil || !bytes.Equal(blob, []byte{3}) {
+		t.Errorf("deleted dirty node mismatch: have %x, %v, want %x", blob, err, []byte{3})
+	}
+}
+
+// makeDirtyTrie creates a trie with the given number of entries in the dirty
+// cache of the database, referenced from the meta root.
+func makeDirtyTrie(db *Database, n int) common.Hash {
+	trie, _ := New(common.Hash{}, db)
+	for i := 0; i < n; i++ {
+		key := common.BigToHash(big.NewInt(int64(i)))
+		trie.Update(crypto.Keccak256(key[:]), key[:])
+	}
+	root, _ := trie.Commit(nil)
+	db.Reference(root, common.Hash{})
+	return root
+}
+
+// checkPersistedTrie ensures that all entries of a trie created by makeDirtyTrie
+// are retrievable from disk.
+func checkPersistedTrie(t *testing.T, diskdb *memorydb.Database, root common.Hash, n int) {
+	t.Helper()
+
+	trie, err := New(root, NewDatabase(diskdb))
+	if err != nil {
+		t.Fatalf("failed to open persisted trie: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		key := common.BigToHash(big.NewInt(int64(i)))
+		if val, err := trie.TryGet(crypto.Keccak256(key[:])); err != nil || !bytes.Equal(val, key[:]) {
+			t.Fatalf("entry %d mismatch: have %x, want %x (err %v)", i, val, key, err)
+		}
+	}
+}
+
+// Tests that references added to the nodes of a trie while it's being committed
+// don't race with the commit walking their external children.
+func TestDatabaseCommitConcurrentReference(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabase(diskdb)
+
+	accounts, _ := New(common.Hash{}, db)
+	for i := 0; i < 50; i++ {
+		storage, _ := New(common.Hash{}, db)
+		for j := 0; j < 20; j++ {
+			key := crypto.Keccak256([]byte{byte(i), byte(j)})
+			storage.Update(key, key)
+		}
+		root, _ := storage.Commit(nil)
+		accounts.Update(crypto.Keccak256([]byte{byte(i)}), root[:])
+	}
+	root, _ := accounts.Commit(func(leaf []byte, parent common.Hash) error {
+		db.Reference(common.BytesToHash(leaf), parent)
+		return nil
+	})
+	db.Reference(root, common.Hash{})
+
+	// Keep referencing new blobs from the account root during the commit
+	var (
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			blob := make([]byte, 40)
+			binary.BigEndian.PutUint64(blob, uint64(i))
+			hash := crypto.Keccak256Hash(blob)
+			db.InsertBlob(hash, blob)
+			db.Reference(hash, root)
+		}
+	}()
+	err := db.Commit(root, false)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	if _, err := New(root, NewDatabase(diskdb)); err != nil {
+		t.Fatalf("committed trie missing: %v", err)
+	}
+}
+
+// Tests that the commit callback is only invoked for the requested owners and
+// that filtering doesn't change the data written to disk.
+func TestDatabaseCommitCallbackOwners(t *testing.T) {
+	// populate creates an account trie referencing two storage tries
+	populate := func(db *Database) (common.Hash, common.Hash, common.Hash) {
+		storage := func(n int) common.Hash {
+			trie, _ := New(common.Hash{}, db)
+			for i := 0; i < n; i++ {
+				key := common.BigToHash(big.NewInt(int64(i)))
+				trie.Update(crypto.Keccak256(key[:]), key[:])
+			}
+			root, _ := trie.Commit(nil)
+			return root
+		}
+		first, second := storage(10), storage(20)
+
+		accounts, _ := New(common.Hash{}, db)
+		accounts.Update([]byte("first"), first[:])
+		accounts.Update([]byte("second"), second[:])
+		root, _ := accounts.Commit(func(leaf []byte, parent common.Hash) error {
+			db.Reference(common.BytesToHash(leaf), parent)
+			return nil
+		})
+		return root, first, second
+	}
+	commit := func(owners []common.Hash) (*memorydb.Database, map[common.Hash]int, common.Hash, common.Hash) {
+		diskdb := memorydb.New()
+		db := NewDatabase(diskdb)
+		root, first, second := populate(db)
+
+		seen := make(map[common.Hash]int)
+		opts := CommitOptions{
+			Callback: func(owner common.Hash, hash common.Hash, blob []byte) {
+				if crypto.Keccak256Hash(blob) != hash {
+					t.Errorf("callback blob mismatch for %x", hash)
+				}
+				seen[owner]++
+			},
+			CallbackOwners: owners,
+		}
+		if err := db.CommitWithOptions(root, opts); err != nil {
+			t.Fatalf("failed to commit: %v", err)
+		}
+		return diskdb, seen, first, second
+	}
+	alldisk, all, first, second := commit(nil)
+	if len(all) != 3 || all[common.Hash{}] == 0 || all[first] == 0 || all[second] == 0 {
+		t.Fatalf("unfiltered callback owners mismatch: %v", all)
+	}
+	accdisk, acc, _, _ := commit([]common.Hash{{}})
+	if len(acc) != 1 || acc[common.Hash{}] != all[common.Hash{}] {
+		t.Fatalf("account filtered callback mismatch: have %v, want %d account nodes", acc, all[common.Hash{}])
+	}
+	_, sto, _, _ := commit([]common.Hash{second})
+	if len(sto) != 1 || sto[second] != all[second] {
+		t.Fatalf("storage filtered callback mismatch: have %v, want %d nodes of %x", sto, all[second], second)
+	}
+	// The filtering must not affect the persisted data
+	if alldisk.Len() != accdisk.Len() {
+		t.Fatalf("persisted item count mismatch: have %d, want %d", accdisk.Len(), alldisk.Len())
+	}
+	it := alldisk.NewIterator(nil, nil)
+	defer it.Release()
+	for it.Next() {
+		if blob, err := accdisk.Get(it.Key()); err != nil || !bytes.Equal(blob, it.Value()) {
+			t.Fatalf("persisted item %x mismatch", it.Key())
+		}
+	}
+}
+
+// Tests that committing a single storage trie only persists and uncaches the
+// nodes of that trie, leaving the account trie and other storage tries dirty.
+func TestDatabaseCommitOwner(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabase(diskdb)
+
+	makeStorage := func(prefix byte, n int) (common.Hash, []common.Hash) {
+		trie, _ := New(common.Hash{}, db)
+		for i := 0; i < n; i++ {
+			key := common.BigToHash(big.NewInt(int64(i)))
+			trie.Update(crypto.Keccak256(key[:]), append([]byte{prefix}, key[:]...))
+		}
+		root, _ := trie.Commit(nil)
+
+		var hashes []common.Hash
+		for it := trie.NodeIterator(nil); it.Next(true); {
+			if it.Hash() != (common.Hash{}) {
+				hashes = append(hashes, it.Hash())
+			}
+		}
+		return root, hashes
+	}
+	rootA, nodesA := makeStorage('a', 50)
+	rootB, nodesB := makeStorage('b', 50)
+
+	account := makeDirtyTrie(db, 20)
+	db.Reference(rootA, account)
+	db.Reference(rootB, account)
+
+	var (
+		ownerA  = common.HexToHash("0xaa")
+		written = make(map[common.Hash]bool)
+	)
+	if err := db.CommitOwner(ownerA, rootA, false, func(key []byte) { written[common.BytesToHash(key)] = true }); err != nil {
+		t.Fatalf("failed to commit owner: %v", err)
+	}
+	if len(written) != len(nodesA) {
+		t.Errorf("callback count mismatch: have %d, want %d", len(written), len(nodesA))
+	}
+	for _, hash := range nodesA {
+		if _, ok := db.dirties[hash]; ok {
+			t.Errorf("committed node %x still dirty", hash)
+		}
+		if ok, _ := diskdb.Has(hash[:]); !ok {
+			t.Errorf("committed node %x missing from disk", hash)
+		}
+	}
+	for _, hash := range nodesB {
+		if _, ok := db.dirties[hash]; !ok {
+			t.Errorf("node %x of other owner not dirty", hash)
+		}
+	}
+	if _, ok := db.dirties[account]; !ok {
+		t.Errorf("account trie root not dirty")
+	}
+	if report := db.LastCommitReport(); report.AccountNodes != 0 || report.StorageNodes != len(nodesA) {
+		t.Errorf("commit report mismatch: have %d account and %d storage nodes, want 0 and %d", report.AccountNodes, report.StorageNodes, len(nodesA))
+	}
+	if err := db.CheckConsistency(); err != nil {
+		t.Fatalf("database inconsistent after owner commit: %v", err)
+	}
+	// The rest of the state should still be committable
+	if err := db.Commit(account, false); err != nil {
+		t.Fatalf("failed to commit account trie: %v", err)
+	}
+	if len(db.dirties) != 1 {
+		t.Fatalf("dirty nodes left after full commit: %d", len(db.dirties)-1)
+	}
+}
+
+// Tests that committing with concurrent encoders writes the nodes in the same
+// order as a sequential commit, also across intermediate batch flushes.
+func TestDatabaseCommitParallelOrder(t *testing.T) {
+	defer func(encoders int) { commitEncoders = encoders }(commitEncoders)
+
+	commitOrder := func(encoders int) []common.Hash {
+		commitEncoders = encoders
+
+		diskdb := memorydb.New()
+		db := NewDatabase(diskdb)
+		root := makeDirtyTrie(db, 20000)
+
+		var order []common.Hash
+		opts := CommitOptions{Callback: func(owner common.Hash, hash common.Hash, blob []byte) {
+			order = append(order, hash)
+		}}
+		if err := db.CommitWithOptions(root, opts); err != nil {
+			t.Fatalf("failed to commit with %d encoders: %v", encoders, err)
+		}
+		if len(db.dirties) != 1 {
+			t.Fatalf("dirty nodes left after commit with %d encoders: %d", encoders, len(db.dirties)-1)
+		}
+		checkPersistedTrie(t, diskdb, root, 20000)
+		return order
+	}
+	want := commitOrder(1)
+	for _, encoders := range []int{2, 8} {
+		if have := commitOrder(encoders); !reflect.DeepEqual(have, want) {
+			t.Errorf("commit order mismatch with %d encoders: have %d nodes, want %d", encoders, len(have), len(want))
+		}
+	}
+}
+
+func BenchmarkCommitSequential(b *testing.B) { benchmarkCommit(b, 1) }
+func BenchmarkCommitParallel(b *testing.B)   { benchmarkCommit(b, runtime.NumCPU()) }
+
+// benchmarkCommit measures committing a synthetic trie of about a million nodes
+// with the given number of encoders.
+func benchmarkCommit(b *testing.B, encoders int) {
+	defer func(encoders int) { commitEncoders = encoders }(commitEncoders)
+	commitEncoders = encoders
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db := NewDatabase(memorydb.New())
+		root := makeDirtyTrie(db, 500000)
+		b.StartTimer()
+
+		if err := db.Commit(root, false); err != nil {
+			b.Fatalf("failed to commit: %v", err)
+		}
+	}
+}
+
+// recordingDB is a memory database whose batches record their value size at
+// every write.
+type recordingDB struct {
+	*memorydb.Database
+	writes []int
+}
+
+func (db *recordingDB) NewBatch() ethdb.Batch {
+	return &recordingBatch{Batch: db.Database.NewBatch(), db: db}
+}
+
+// recordingBatch is a database batch recording its value size at every write.
+type recordingBatch struct {
+	ethdb.Batch
+	db *recordingDB
+}
+
+func (b *recordingBatch) Write() error {
+	if size := b.ValueSize(); size > 0 {
+		b.db.writes = append(b.db.writes, size)
+	}
+	return b.Batch.Write()
+}
+
+// Tests that Cap and Commit write their batches out at the configured size.
+func TestDatabaseBatchSize(t *testing.T) {
+	const batchSize = 4096
+
+	for _, flush := range []string{"cap", "commit"} {
+		diskdb := &recordingDB{Database: memorydb.New()}
+		db := NewDatabase(diskdb)
+		db.SetBatchSize(batchSize)
+
+		root := makeDirtyTrie(db, 1000)
+		if flush == "cap" {
+			if err := db.Cap(0); err != nil {
+				t.Fatalf("failed to cap database: %v", err)
+			}
+		} else {
+			if err := db.Commit(root, false); err != nil {
+				t.Fatalf("failed to commit database: %v", err)
+			}
+		}
+		if len(diskdb.writes) < 10 {
+			t.Fatalf("%s: too few batch writes: %d", flush, len(diskdb.writes))
+		}
+		// All but the last batch must be written right above the configured size
+		for i, written := range diskdb.writes[:len(diskdb.writes)-1] {
+			if written < batchSize || written >= batchSize+1024 {
+				t.Errorf("%s: batch %d size mismatch: have %d, want [%d, %d)", flush, i, written, batchSize, batchSize+1024)
+			}
+		}
+		if last := diskdb.writes[len(diskdb.writes)-1]; last >= batchSize+1024 {
+			t.Errorf("%s: last batch too large: %d", flush, last)
+		}
+	}
+	// Resetting the batch size should restore the default
+	diskdb := &recordingDB{Database: memorydb.New()}
+	db := NewDatabase(diskdb)
+	db.SetBatchSize(batchSize)
+	db.SetBatchSize(0)
+
+	if err := db.Commit(makeDirtyTrie(db, 1000), false); err != nil {
+		t.Fatalf("failed to commit database: %v", err)
+	}
+	for i, written := range diskdb.writes[:len(diskdb.writes)-1] {
+		if written < ethdb.IdealBatchSize {
+			t.Errorf("batch %d size mismatch with default size: have %d, want >= %d", i, written, ethdb.IdealBatchSize)
+		}
+	}
+}
+
+// Tests that corrupted nodes on disk are detected if read verification is
+// enabled, and that they are never moved into the clean cache.
+func TestDatabaseVerifyReads(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabase(diskdb)
+	root := makeDirtyTrie(db, 100)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit trie: %v", err)
+	}
+	// Corrupt the last hashed node of the trie
+	var leaf common.Hash
+	for it := mustNewTrie(t, root, NewDatabase(diskdb)).NodeIterator(nil); it.Next(true); {
+		if it.Hash() != (common.Hash{}) {
+			leaf = it.Hash()
+		}
+	}
+	rootEnc, _ := diskdb.Get(root[:])
+	diskdb.Put(leaf[:], []byte{0xc0})
+
+	// Without verification, the garbage is handed back
+	db = NewDatabaseWithCache(diskdb, 1)
+	if blob, err := db.Node(leaf); err != nil || !bytes.Equal(blob, []byte{0xc0}) {
+		t.Fatalf("unverified read mismatch: have %x (err %v), want c0", blob, err)
+	}
+	// With verification, the corruption is reported and not cached
+	db = NewDatabaseWithCache(diskdb, 1)
+	db.SetVerifyReads(true)
+
+	if blob, err := db.Node(root); err != nil || !bytes.Equal(blob, rootEnc) {
+		t.Fatalf("verified read of healthy node failed: have %x (err %v)", blob, err)
+	}
+	if _, err := db.Node(leaf); err != ErrCorruptedNode {
+		t.Fatalf("corrupted node error mismatch: have %v, want %v", err, ErrCorruptedNode)
+	}
+	if db.cleans.Has(leaf[:]) {
+		t.Fatalf("corrupted node moved into clean cache")
+	}
+	// Resolving the corrupted node through a trie should fail the same way
+	failed := false
+	for i := 0; i < 100; i++ {
+		key := common.BigToHash(big.NewInt(int64(i)))
+		if _, err := mustNewTrie(t, root, db).TryGet(crypto.Keccak256(key[:])); err != nil {
+			if err != ErrCorruptedNode {
+				t.Fatalf("trie read error mismatch: have %v, want %v", err, ErrCorruptedNode)
+			}
+			failed = true
+		}
+	}
+	if !failed {
+		t.Fatalf("no trie read hit the corrupted node")
+	}
+	if db.cleans.Has(leaf[:]) {
+		t.Fatalf("corrupted node moved into clean cache by trie read")
+	}
+}
+
+// Tests that undecodable nodes on disk or in the clean cache fail the single
+// read with a corruption error instead of crashing, and that they are evicted
+// from or kept out of the clean cache.
+func TestDatabaseCorruptedNodeDecode(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabase(diskdb)
+	root := makeDirtyTrie(db, 100)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit trie: %v", err)
+	}
+	var leaf common.Hash
+	for it := mustNewTrie(t, root, NewDatabase(diskdb)).NodeIterator(nil); it.Next(true); {
+		if it.Hash() != (common.Hash{}) {
+			leaf = it.Hash()
+		}
+	}
+	healthy, _ := diskdb.Get(leaf[:])
+
+	// Garbage in the clean cache should be evicted, the next read hits the disk
+	db = NewDatabaseWithCache(diskdb, 1)
+	db.cleans.Set(leaf[:], []byte{0xc0})
+
+	_, err := db.node(ReadTagDefault, leaf, 0)
+	if cerr, ok := err.(*CorruptedNodeError); !ok || cerr.NodeHash != leaf || !errors.Is(err, ErrCorruptedNode) {
+		t.Fatalf("clean cache corruption error mismatch: have %v", err)
+	}
+	if db.cleans.Has(leaf[:]) {
+		t.Fatalf("undecodable node not evicted from clean cache")
+	}
+	if n, err := db.node(ReadTagDefault, leaf, 0); n == nil || err != nil {
+		t.Fatalf("healthy node not reloaded from disk: have %v (err %v)", n, err)
+	}
+	// Garbage on disk should fail every read without entering the clean cache,
+	// regardless of read verification
+	for _, verify := range []bool{false, true} {
+		for _, garbage := range [][]byte{{0xc0}, healthy[:len(healthy)/2], append([]byte{0xf9, 0xff, 0xff}, healthy...)} {
+			diskdb.Put(leaf[:], garbage)
+
+			db = NewDatabaseWithCache(diskdb, 1)
+			db.SetVerifyReads(verify)
+			if _, err := db.node(ReadTagDefault, leaf, 0); !errors.Is(err, ErrCorruptedNode) {
+				t.Fatalf("verify %v, garbage %x: corruption error mismatch: have %v", verify, garbage, err)
+			}
+			if db.cleans.Has(leaf[:]) {
+				t.Fatalf("verify %v, garbage %x: undecodable node moved into clean cache", verify, garbage)
+			}
+			failed := false
+			for i := 0; i < 100; i++ {
+				key := common.BigToHash(big.NewInt(int64(i)))
+				if _, err := mustNewTrie(t, root, db).TryGet(crypto.Keccak256(key[:])); err != nil {
+					if !errors.Is(err, ErrCorruptedNode) {
+						t.Fatalf("verify %v, garbage %x: trie read error mismatch: have %v", verify, garbage, err)
+					}
+					failed = true
+				}
+			}
+			if !failed {
+				t.Fatalf("verify %v, garbage %x: no trie read hit the corrupted node", verify, garbage)
+			}
+		}
+	}
+}
+
+// mustNewTrie opens a trie at the given root, failing the test on error.
+func mustNewTrie(t *testing.T, root common.Hash, db *Database) *Trie {
+	t.Helper()
+
+	trie, err := New(root, db)
+	if err != nil {
+		t.Fatalf("failed to open trie %x: %v", root, err)
+	}
+	return trie
+}
+
+// Tests that dereferencing a batch of roots leaves the same dirty cache behind
+// as dereferencing them one by one.
+func TestDatabaseDereferenceBatch(t *testing.T) {
+	var (
+		sequential = NewDatabase(memorydb.New())
+		batched    = NewDatabase(memorydb.New())
+		roots      []common.Hash
+	)
+	// Create overlapping tries, referencing some of them twice
+	for i := 1; i <= 20; i++ {
+		root := makeDirtyTrie(sequential, i*5)
+		if makeDirtyTrie(batched, i*5) != root {
+			t.Fatalf("trie %d root mismatch", i)
+		}
+		roots = append(roots, root)
+		if i%4 == 0 {
+			sequential.Reference(root, common.Hash{})
+			batched.Reference(root, common.Hash{})
+		}
+	}
+	drop := []common.Hash{roots[3], common.Hash{}, roots[0], roots[7], roots[3], roots[12], roots[19]}
+	for _, root := range drop {
+		sequential.Dereference(root)
+	}
+	batched.DereferenceBatch(drop)
+
+	if len(batched.dirties) != len(sequential.dirties) {
+		t.Fatalf("dirty node count mismatch: have %d, want %d", len(batched.dirties), len(sequential.dirties))
+	}
+	for hash, want := range sequential.dirties {
+		have, ok := batched.dirties[hash]
+		if !ok {
+			t.Fatalf("dirty node %x missing", hash)
+		}
+		if have.parents != want.parents || !reflect.DeepEqual(have.children, want.children) {
+			t.Errorf("dirty node %x references mismatch", hash)
+		}
+	}
+	if batched.dirtiesSize != sequential.dirtiesSize || batched.childrenSize != sequential.childrenSize {
+		t.Errorf("size mismatch: have %v/%v, want %v/%v", batched.dirtiesSize, batched.childrenSize, sequential.dirtiesSize, sequential.childrenSize)
+	}
+	if batched.gcnodes != sequential.gcnodes || batched.gcsize != sequential.gcsize {
+		t.Errorf("gc stats mismatch: have %d/%v, want %d/%v", batched.gcnodes, batched.gcsize, sequential.gcnodes, sequential.gcsize)
+	}
+	if err := batched.CheckConsistency(); err != nil {
+		t.Errorf("inconsistent cache after batch dereference: %v", err)
+	}
+}
+
+func BenchmarkDereferenceSequential(b *testing.B) { benchmarkDereference(b, false) }
+func BenchmarkDereferenceBatch(b *testing.B)      { benchmarkDereference(b, true) }
+
+// benchmarkDereference measures dereferencing several hundred small tries one
+// by one or in a single batch.
+func benchmarkDereference(b *testing.B, batch bool) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db := NewDatabase(memorydb.New())
+		roots := make([]common.Hash, 500)
+		for j := range roots {
+			trie, _ := New(common.Hash{}, db)
+			for k := 0; k < 10; k++ {
+				key := crypto.Keccak256([]byte{byte(j), byte(j >> 8), byte(k)})
+				trie.Update(key, key)
+			}
+			roots[j], _ = trie.Commit(nil)
+			db.Reference(roots[j], common.Hash{})
+		}
+		b.StartTimer()
+
+		if batch {
+			db.DereferenceBatch(roots)
+		} else {
+			for _, root := range roots {
+				db.Dereference(root)
+			}
+		}
+	}
+}
+
+// dirtyTrieNodes collects the dirty nodes of a trie with their storage sizes.
+func dirtyTrieNodes(t *testing.T, db *Database, root common.Hash) map[common.Hash]common.StorageSize {
+	nodes := make(map[common.Hash]common.StorageSize)
+	for it := mustNewTrie(t, root, db).NodeIterator(nil); it.Next(true); {
+		if node, ok := db.dirties[it.Hash()]; ok && it.Hash() != (common.Hash{}) {
+			nodes[it.Hash()] = common.StorageSize(common.HashLength + int(node.size))
+		}
+	}
+	return nodes
+}
+
+// Tests that referencing a child of a parent already flushed out of the dirty
+// cache drops and counts the reference instead of crashing or leaking it, and
+// that dereferencing it through the same parent is a noop.
+func TestDatabaseReferenceFlushedParent(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+
+	parentBlob := bytes.Repeat([]byte{0x01}, 68)
+	parent := crypto.Keccak256Hash(parentBlob)
+	db.InsertBlob(parent, parentBlob)
+	db.Reference(parent, common.Hash{})
+	if err := db.Cap(0); err != nil {
+		t.Fatalf("failed to flush parent: %v", err)
+	}
+	if _, ok := db.dirties[parent]; ok {
+		t.Fatalf("parent not flushed")
+	}
+	childBlob := bytes.Repeat([]byte{0x02}, 68)
+	child := crypto.Keccak256Hash(childBlob)
+	db.InsertBlob(child, childBlob)
+	db.Reference(child, parent)
+
+	if _, ok := db.dirties[common.Hash{}].children[child]; ok {
+		t.Fatalf("reference anchored to the meta root")
+	}
+	if parents := db.dirties[child].parents; parents != 0 {
+		t.Fatalf("child parent count mismatch: have %d, want %d", parents, 0)
+	}
+	if orphans := db.CacheStats().OrphanRefs; orphans != 1 {
+		t.Fatalf("orphan reference count mismatch: have %d, want %d", orphans, 1)
+	}
+	db.lock.Lock()
+	db.dereference(child, parent)
+	db.lock.Unlock()
+
+	if _, ok := db.dirties[child]; !ok {
+		t.Fatalf("child garbage collected through dropped reference")
+	}
+	// The unreferenced child should be flushed as any other node
+	if err := db.Cap(0); err != nil {
+		t.Fatalf("failed to flush child: %v", err)
+	}
+	if len(db.dirties) != 1 || db.dirtiesSize != 0 {
+		t.Fatalf("dirty cache not empty: nodes %d, size %v", len(db.dirties), db.dirtiesSize)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// maxTrackedDepth is the deepest path length (in nibbles) tracked individually
+// by the depth statistics. Deeper reads are accounted to the last bucket.
+const maxTrackedDepth = 2 * common.HashLength
+
+var (
+	depthCleanHistogram = metrics.NewRegisteredHistogram("trie/reads/depth/clean", nil, metrics.NewExpDecaySample(1028, 0.015))
+	depthDiskHistogram  = metrics.NewRegisteredHistogram("trie/reads/depth/disk", nil, metrics.NewExpDecaySample(1028, 0.015))
+)
+
+// DepthStats contains the number of trie node reads served by the clean cache
+// and by the persistent database, indexed by the path length of the node.
+type DepthStats struct {
+	CleanHits [maxTrackedDepth + 1]uint64
+	DiskReads [maxTrackedDepth + 1]uint64
+}
+
+// depthCounters is the live, atomically updated version of DepthStats.
+type depthCounters struct {
+	enabled   uint32
+	cleanHits [maxTrackedDepth + 1]uint64
+	diskReads [maxTrackedDepth + 1]uint64
+}
+
+// SetDetailedMetrics enables or disables gathering the per-depth distribution
+// of trie node reads. It is off by default as it adds cost to every lookup.
+func (db *Database) SetDetailedMetrics(enabled bool) {
+	if enabled {
+		atomic.StoreUint32(&db.depthStats.enabled, 1)
+	} else {
+		atomic.StoreUint32(&db.depthStats.enabled, 0)
+	}
+}
+
+// markDepth accounts a clean cache hit or disk read of a node at the given path
+// length, if detailed metrics are enabled.
+func (db *Database) markDepth(depth int, disk bool) {
+	if depth < 0 || atomic.LoadUint32(&db.depthStats.enabled) == 0 {
+		return
+	}
+	if depth > maxTrackedDepth {
+		depth = maxTrackedDepth
+	}
+	if disk {
+		atomic.AddUint64(&db.depthStats.diskReads[depth], 1)
+		depthDiskHistogram.Update(int64(depth))
+	} else {
+		atomic.AddUint64(&db.depthStats.cleanHits[depth], 1)
+		depthCleanHistogram.Update(int64(depth))
+	}
+}
+
+// DepthStats returns the per-depth distribution of the node reads gathered
+// while detailed metrics were enabled.
+func (db *Database) DepthStats() DepthStats {
+	var stats DepthStats
+	for i := range stats.CleanHits {
+		stats.CleanHits[i] = atomic.LoadUint64(&db.depthStats.cleanHits[i])
+		stats.DiskReads[i] = atomic.LoadUint64(&db.depthStats.diskReads[i])
+	}
+	return stats
+}
+
+// EstimateCacheSize estimates the clean cache size needed to hold every node of
+// the persisted trie with the given root up to the given path length (in nibbles).
+// The nodes are read directly from disk, leaving the caches and the read stats
+// untouched.
+//
+// The estimate descends along the given number of random paths. A node whose
+// path is d nibbles long is reached by a random path with the probability of
+// 16^-d, so weighting the size of each node met by 16^d gives an unbiased
+// estimate of the total size.
+func (db *Database) EstimateCacheSize(root common.Hash, depth int, samples int) (common.StorageSize, error) {
+	if samples <= 0 {
+		return 0, errors.New("no samples requested")
+	}
+	if root == emptyRoot || root == (common.Hash{}) {
+		return 0, nil
+	}
+	var (
+		total float64
+		key   = make([]byte, common.HashLength)
+	)
+	for i := 0; i < samples; i++ {
+		rand.Read(key)
+		path := keybytesToHex(key)
+
+		var (
+			n   node = hashNode(root[:])
+			pos int
+		)
+	descend:
+		for pos <= depth {
+			switch nn := n.(type) {
+			case hashNode:
+				hash := common.BytesToHash(nn)
+				blob, err := db.diskdb.Get(hash[:])
+				if err != nil {
+					return 0, err
+				}
+				total += float64(len(blob)+common.HashLength) * math.Pow(16, float64(pos))
+				if n, err = decodeNodeSafe(hash[:], blob); err != nil {
+					return 0, db.decodeFailed(hash, err, "disk")
+				}
+			case *shortNode:
+				if len(path)-pos < len(nn.Key) || !bytes.Equal(nn.Key, path[pos:pos+len(nn.Key)]) {
+					break descend
+				}
+				pos += len(nn.Key)
+				n = nn.Val
+			case *fullNode:
+				n = nn.Children[path[pos]]
+				pos++
+			default:
+				break descend
+			}
+		}
+	}
+	return common.StorageSize(total / float64(samples)), nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that node reads are accounted to the depth of the node if detailed metrics
+// are enabled, and that the cache size estimate covers the requested depth.
+func TestDatabaseDepthStats(t *testing.T) {
+	diskdb := memorydb.New()
+	triedb := NewDatabase(diskdb)
+	root := makeDirtyTrie(triedb, 256)
+	if err := triedb.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit trie: %v", err)
+	}
+	read := func(db *Database) {
+		trie, err := New(root, db)
+		if err != nil {
+			t.Fatalf("failed to open trie: %v", err)
+		}
+		for i := 0; i < 256; i++ {
+			key := common.BigToHash(big.NewInt(int64(i)))
+			trie.Get(crypto.Keccak256(key[:]))
+		}
+	}
+	// Reads should not be tracked by default
+	db := NewDatabaseWithCache(diskdb, 16)
+	read(db)
+	if stats := db.DepthStats(); stats != (DepthStats{}) {
+		t.Fatalf("depth stats gathered while disabled: %v", stats)
+	}
+	// Fresh reads should be served from disk, repeated ones from the clean cache
+	db = NewDatabaseWithCache(diskdb, 16)
+	db.SetDetailedMetrics(true)
+	read(db)
+
+	disk := db.DepthStats()
+	if disk.DiskReads[0] != 1 {
+		t.Errorf("root disk reads mismatch: have %d, want 1", disk.DiskReads[0])
+	}
+	var total uint64
+	for depth := range disk.DiskReads {
+		total += disk.DiskReads[depth]
+		if disk.CleanHits[depth] != 0 {
+			t.Errorf("depth %d: unexpected clean hits: %d", depth, disk.CleanHits[depth])
+		}
+	}
+	if stats := db.ReadStats(ReadTagDefault); stats.DiskReads != total {
+		t.Errorf("disk read count mismatch: have %d, want %d", total, stats.DiskReads)
+	}
+	read(db)
+	clean := db.DepthStats()
+	if clean.DiskReads != disk.DiskReads || clean.CleanHits != disk.DiskReads {
+		t.Errorf("clean hits mismatch: have %v, want %v", clean.CleanHits, disk.DiskReads)
+	}
+	// The estimate of the root level should be exact, deeper ones larger
+	blob, _ := diskdb.Get(root[:])
+	if size, err := db.EstimateCacheSize(root, 0, 16); err != nil || size != common.StorageSize(len(blob)+common.HashLength) {
+		t.Errorf("root size estimate mismatch: have %v (%v), want %d", size, err, len(blob)+common.HashLength)
+	}
+	if size, err := db.EstimateCacheSize(root, 2, 256); err != nil || size <= common.StorageSize(len(blob)+common.HashLength) {
+		t.Errorf("deep size estimate too small: have %v (%v)", size, err)
+	}
+	if after := db.DepthStats(); after != clean {
+		t.Errorf("size estimation affected the read stats")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// errDirtyIteratorFlushed is returned by a DirtyIterator if the nodes it was
+// positioned at were flushed out of the dirty cache during the iteration.
+var errDirtyIteratorFlushed = errors.New("dirty nodes flushed during iteration")
+
+// DirtyIterator walks the nodes held in the dirty cache of a trie database in
+// flush-list order, from the oldest to the newest, without committing anything.
+// The database lock is only held while stepping, so long iterations do not block
+// concurrent readers. Nodes inserted during the iteration are visited if they
+// are appended after the iterator's position.
+type DirtyIterator struct {
+	db      *Database
+	started bool
+	next    common.Hash // Successor of the current node when it was visited
+
+	hash     common.Hash
+	blob     []byte
+	parents  uint32
+	children map[common.Hash]uint16
+	size     common.StorageSize
+	err      error
+}
+
+// DirtyIterator creates an iterator over the dirty trie nodes. The meta root
+// holding the external references is not a real node and is never returned.
+func (db *Database) DirtyIterator() *DirtyIterator {
+	return &DirtyIterator{db: db}
+}
+
+// Next moves the iterator to the next dirty node, returning whether there is
+// one. If the iteration cannot be continued because the node the iterator was
+// at and its successor were both flushed in the meantime, false is returned and
+// Error reports the failure.
+func (it *DirtyIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.db.lock.RLock()
+	defer it.db.lock.RUnlock()
+
+	next := it.db.oldest
+	if it.started {
+		if node, ok := it.db.dirties[it.hash]; ok {
+			next = node.flushNext
+		} else {
+			next = it.next
+		}
+	}
+	it.started = true
+	if next == (common.Hash{}) {
+		return false
+	}
+	node, ok := it.db.dirties[next]
+	if !ok {
+		it.err = errDirtyIteratorFlushed
+		return false
+	}
+	it.hash, it.next = next, node.flushNext
+	it.blob = node.rlp()
+	it.parents = node.parents
+	it.children = make(map[common.Hash]uint16, len(node.children))
+	for child, refs := range node.children {
+		it.children[child] = refs
+	}
+	it.size = common.StorageSize(common.HashLength + int(node.size))
+	return true
+}
+
+// Hash returns the hash of the current node.
+func (it *DirtyIterator) Hash() common.Hash { return it.hash }
+
+// Blob returns the RLP encoding of the current node, or the raw data if it was
+// inserted as a blob (e.g. contract code).
+func (it *DirtyIterator) Blob() []byte { return it.blob }
+
+// Parents returns the number of live nodes referencing the current node.
+func (it *DirtyIterator) Parents() uint32 { return it.parents }
+
+// Children returns the external references of the current node (e.g. storage
+// trie roots referenced from an account trie leaf) along with their reference
+// counts. The returned map is a copy.
+func (it *DirtyIterator) Children() map[common.Hash]uint16 { return it.children }
+
+// Size returns the storage size of the current node as accounted in the dirty
+// cache size.
+func (it *DirtyIterator) Size() common.StorageSize { return it.size }
+
+// Error returns the error that aborted the iteration, if any.
+func (it *DirtyIterator) Error() error { return it.err }
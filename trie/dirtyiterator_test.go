@@ -0,0 +1,94 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that the dirty iterator walks the dirty cache in flush-list order and
+// covers all of it, skipping the meta root.
+func TestDatabaseDirtyIterator(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+
+	storage, _ := New(common.Hash{}, db)
+	for i := 0; i < 100; i++ {
+		key := common.BigToHash(big.NewInt(int64(i)))
+		storage.Update(crypto.Keccak256(key[:]), key[:])
+	}
+	sroot, _ := storage.Commit(nil)
+
+	code := []byte("contract code")
+	db.InsertBlob(crypto.Keccak256Hash(code), code)
+
+	accounts, _ := New(common.Hash{}, db)
+	accounts.Update([]byte("account"), sroot[:])
+	root, _ := accounts.Commit(func(leaf []byte, parent common.Hash) error {
+		db.Reference(common.BytesToHash(leaf), parent)
+		return nil
+	})
+	db.Reference(root, common.Hash{})
+
+	var (
+		it    = db.DirtyIterator()
+		hash  = db.oldest
+		size  common.StorageSize
+		count int
+	)
+	for it.Next() {
+		if it.Hash() != hash {
+			t.Fatalf("node %d: hash mismatch: have %x, want %x", count, it.Hash(), hash)
+		}
+		if have := crypto.Keccak256Hash(it.Blob()); have != hash {
+			t.Errorf("node %d: blob hash mismatch: have %x, want %x", count, have, hash)
+		}
+		if it.Parents() != db.dirties[hash].parents {
+			t.Errorf("node %d: parent count mismatch: have %d, want %d", count, it.Parents(), db.dirties[hash].parents)
+		}
+		if refs := it.Children()[sroot]; (refs != 0) != (len(db.dirties[hash].children) != 0) {
+			t.Errorf("node %d: external reference mismatch: have %d", count, refs)
+		}
+		size += it.Size()
+		count++
+		hash = db.dirties[hash].flushNext
+	}
+	if it.Error() != nil {
+		t.Fatalf("iteration failed: %v", it.Error())
+	}
+	if count != len(db.dirties)-1 {
+		t.Errorf("node count mismatch: have %d, want %d", count, len(db.dirties)-1)
+	}
+	if size != db.dirtiesSize {
+		t.Errorf("size mismatch: have %v, want %v", size, db.dirtiesSize)
+	}
+	// Flushing the nodes ahead of the iterator should abort the iteration
+	it = db.DirtyIterator()
+	it.Next()
+	it.Next()
+	db.Cap(0)
+	if it.Next() {
+		t.Fatalf("iteration continued over flushed nodes")
+	}
+	if it.Error() != errDirtyIteratorFlushed {
+		t.Errorf("error mismatch: have %v, want %v", it.Error(), errDirtyIteratorFlushed)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// dirtyJournalVersion is the version of the dirty cache journal format. Journals
+// with a different version are discarded.
+const dirtyJournalVersion uint64 = 1
+
+// errDirtiesNotEmpty is returned if a dirty cache journal is attempted to be
+// loaded into a database which already tracks dirty nodes.
+var errDirtiesNotEmpty = errors.New("dirty cache not empty")
+
+// journalChild is an external reference of a journaled dirty node.
+type journalChild struct {
+	Hash common.Hash
+	Refs uint64
+}
+
+// journalNode is a single journaled dirty node.
+type journalNode struct {
+	Hash     common.Hash
+	Blob     []byte
+	Size     uint64
+	Raw      bool // Whether the node was inserted as a raw blob (e.g. code)
+	Children []journalChild
+}
+
+// dirtyJournal is the content of a dirty cache journal. The nodes are stored in
+// flush-list order.
+type dirtyJournal struct {
+	Version uint64
+	Roots   []journalChild // External references held by the meta root
+	Nodes   []journalNode
+}
+
+// Journal writes the dirty trie nodes along with their external references and
+// flush-list order into the given file, so that the recent, not yet committed
+// tries survive a restart. The file is first written next to the destination
+// and then moved in place, so a crash never leaves a partial journal behind.
+func (db *Database) Journal(path string) error {
+	start := time.Now()
+
+	db.lock.RLock()
+	journal := dirtyJournal{Version: dirtyJournalVersion}
+	for child, refs := range db.dirties[common.Hash{}].children {
+		journal.Roots = append(journal.Roots, journalChild{Hash: child, Refs: uint64(refs)})
+	}
+	for hash := db.oldest; hash != (common.Hash{}); {
+		node := db.dirties[hash]
+		_, raw := node.node.(rawNode)
+		entry := journalNode{Hash: hash, Blob: node.rlp(), Size: uint64(node.size), Raw: raw}
+		for child, refs := range node.children {
+			entry.Children = append(entry.Children, journalChild{Hash: child, Refs: uint64(refs)})
+		}
+		journal.Nodes = append(journal.Nodes, entry)
+		hash = node.flushNext
+	}
+	db.lock.RUnlock()
+
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(file)
+	if err := rlp.Encode(buf, &journal); err != nil {
+		file.Close()
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	log.Info("Journalled dirty trie cache", "path", path, "nodes", len(journal.Nodes), "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// LoadJournal restores the dirty trie nodes from a journal written by Journal,
+// relinking the flush-list and all the reference counts. The journal is deleted
+// after a successful load so that a crash later on can't resurrect stale nodes.
+//
+// The restored references of the meta root are returned along with their counts.
+// They are owned by the caller, who needs to either track them for garbage
+// collection the same way as before the restart, or dereference them.
+//
+// The journal is verified in full before anything is inserted: if it's missing,
+// corrupted or of a different version, the database is left untouched and the
+// error is returned. Such errors are not fatal, the caller should only log them.
+func (db *Database) LoadJournal(path string) (map[common.Hash]int, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var journal dirtyJournal
+	if err := rlp.DecodeBytes(blob, &journal); err != nil {
+		return nil, err
+	}
+	if journal.Version != dirtyJournalVersion {
+		return nil, fmt.Errorf("journal version mismatch: have %d, want %d", journal.Version, dirtyJournalVersion)
+	}
+	for _, root := range journal.Roots {
+		if root.Refs > 65535 {
+			return nil, fmt.Errorf("journal root %x reference count %d out of range", root.Hash, root.Refs)
+		}
+	}
+	nodes := make([]node, len(journal.Nodes))
+	for i, entry := range journal.Nodes {
+		if crypto.Keccak256Hash(entry.Blob) != entry.Hash {
+			return nil, fmt.Errorf("journal node %d (%x) corrupted", i, entry.Hash)
+		}
+		if entry.Size > 65535 {
+			return nil, fmt.Errorf("journal node %d (%x) size %d out of range", i, entry.Hash, entry.Size)
+		}
+		if entry.Raw {
+			nodes[i] = rawNode(entry.Blob)
+			continue
+		}
+		n, err := decodeNodeSafe(entry.Hash[:], entry.Blob)
+		if err != nil {
+			return nil, fmt.Errorf("journal node %d (%x) undecodable: %v", i, entry.Hash, err)
+		}
+		nodes[i] = compactNode(n)
+		if enc, err := rlp.EncodeToBytes(simplifyNode(nodes[i])); err != nil || !bytes.Equal(enc, entry.Blob) {
+			return nil, fmt.Errorf("journal node %d (%x) reencoding mismatch", i, entry.Hash)
+		}
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if len(db.dirties) > 1 {
+		return nil, errDirtiesNotEmpty
+	}
+	for i, entry := range journal.Nodes {
+		db.insert(entry.Hash, int(entry.Size), nodes[i])
+	}
+	// Restore the external references once all the nodes are present
+	for _, entry := range journal.Nodes {
+		for _, child := range entry.Children {
+			db.reference(child.Hash, entry.Hash)
+		}
+	}
+	for _, root := range journal.Roots {
+		for i := uint64(0); i < root.Refs; i++ {
+			db.reference(root.Hash, common.Hash{})
+		}
+	}
+	roots := make(map[common.Hash]int, db.roots.len())
+	for root, refs := range db.roots.counts {
+		roots[root] = int(refs)
+	}
+	if err := os.Remove(path); err != nil {
+		log.Warn("Failed to remove dirty trie cache journal", "path", path, "err", err)
+	}
+	log.Info("Loaded dirty trie cache journal", "path", path, "nodes", len(journal.Nodes), "roots", len(roots), "size", db.dirtiesSize)
+	return roots, nil
+}
+
+// compactNode converts the keys of a decoded node (and all of its embedded
+// children) back into the compact encoding used by the collapsed nodes held in
+// the dirty cache.
+func compactNode(n node) node {
+	switch n := n.(type) {
+	case *shortNode:
+		return &shortNode{Key: hexToCompact(n.Key), Val: compactNode(n.Val)}
+
+	case *fullNode:
+		full := &fullNode{}
+		for i, child := range n.Children {
+			if child != nil {
+				full.Children[i] = compactNode(child)
+			}
+		}
+		return full
+
+	default:
+		return n
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Tests that the dirty cache can be journalled and restored into a new database,
+// retaining all the nodes, reference counts and the flush-list order.
+func TestDatabaseDirtyJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirty-journal-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	diskdb := memorydb.New()
+	db := NewDatabase(diskdb)
+
+	storage, _ := New(common.Hash{}, db)
+	for i := 0; i < 100; i++ {
+		key := common.BigToHash(big.NewInt(int64(i)))
+		storage.Update(crypto.Keccak256(key[:]), key[:])
+	}
+	sroot, _ := storage.Commit(nil)
+
+	code := []byte("contract code")
+	db.InsertBlob(crypto.Keccak256Hash(code), code)
+
+	accounts, _ := New(common.Hash{}, db)
+	accounts.Update([]byte("account"), sroot[:])
+	root, _ := accounts.Commit(func(leaf []byte, parent common.Hash) error {
+		db.Reference(common.BytesToHash(leaf), parent)
+		return nil
+	})
+	db.Reference(root, common.Hash{})
+	db.Reference(root, common.Hash{})
+
+	if err := db.Journal(path); err != nil {
+		t.Fatalf("failed to journal dirty cache: %v", err)
+	}
+	restored := NewDatabase(diskdb)
+	roots, err := restored.LoadJournal(path)
+	if err != nil {
+		t.Fatalf("failed to load journal: %v", err)
+	}
+	if len(roots) != 1 || roots[root] != 2 {
+		t.Errorf("restored roots mismatch: have %v, want %x: 2", roots, root)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("journal not removed after loading: %v", err)
+	}
+	if err := restored.checkFlushList(); err != nil {
+		t.Fatalf("restored flush-list broken: %v", err)
+	}
+	haveDirty, havePreimage := restored.Size()
+	wantDirty, wantPreimage := db.Size()
+	if haveDirty != wantDirty || havePreimage != wantPreimage || restored.childrenSize != db.childrenSize {
+		t.Errorf("size mismatch: have %v/%v/%v, want %v/%v/%v", haveDirty, havePreimage, restored.childrenSize, wantDirty, wantPreimage, db.childrenSize)
+	}
+	have, want := restored.DirtyIterator(), db.DirtyIterator()
+	for want.Next() {
+		if !have.Next() {
+			t.Fatalf("restored cache too short, missing %x", want.Hash())
+		}
+		if have.Hash() != want.Hash() || !bytes.Equal(have.Blob(), want.Blob()) || have.Parents() != want.Parents() || len(have.Children()) != len(want.Children()) {
+			t.Fatalf("restored node mismatch: have %x/%d, want %x/%d", have.Hash(), have.Parents(), want.Hash(), want.Parents())
+		}
+		if blob, err := restored.Node(want.Hash()); err != nil || !bytes.Equal(blob, want.Blob()) {
+			t.Errorf("restored node %x lookup mismatch: %v", want.Hash(), err)
+		}
+	}
+	if have.Next() {
+		t.Fatalf("restored cache too long, extra %x", have.Hash())
+	}
+	if restored.dirties[common.Hash{}].children[root] != 2 {
+		t.Errorf("root reference count mismatch: have %d, want 2", restored.dirties[common.Hash{}].children[root])
+	}
+	// Dereferencing the restored tries should free everything
+	restored.Dereference(root)
+	restored.Dereference(root)
+	if nodes := len(restored.Nodes()); nodes != 1 { // The code blob is not referenced
+		t.Errorf("restored nodes not garbage collected: %d left", nodes)
+	}
+}
+
+// Tests that corrupted or incompatible dirty cache journals are rejected without
+// touching the database.
+func TestDatabaseDirtyJournalCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirty-journal-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	db := NewDatabase(memorydb.New())
+	trie, _ := New(common.Hash{}, db)
+	for i := 0; i < 10; i++ {
+		key := common.BigToHash(big.NewInt(int64(i)))
+		trie.Update(crypto.Keccak256(key[:]), key[:])
+	}
+	trie.Commit(nil)
+	if err := db.Journal(path); err != nil {
+		t.Fatalf("failed to journal dirty cache: %v", err)
+	}
+	valid, _ := ioutil.ReadFile(path)
+
+	var journal dirtyJournal
+	rlp.DecodeBytes(valid, &journal)
+	journal.Version++
+	version, _ := rlp.EncodeToBytes(&journal)
+	journal.Version--
+	journal.Nodes[0].Blob = append([]byte{}, journal.Nodes[0].Blob...)
+	journal.Nodes[0].Blob[len(journal.Nodes[0].Blob)-1]++
+	corrupt, _ := rlp.EncodeToBytes(&journal)
+
+	for i, blob := range [][]byte{valid[:len(valid)/2], version, corrupt} {
+		ioutil.WriteFile(path, blob, 0644)
+
+		restored := NewDatabase(memorydb.New())
+		if _, err := restored.LoadJournal(path); err == nil {
+			t.Errorf("journal %d: invalid journal loaded", i)
+		}
+		if nodes := len(restored.Nodes()); nodes != 0 {
+			t.Errorf("journal %d: nodes loaded from invalid journal: %d", i, nodes)
+		}
+	}
+	// Loading into a populated database should be refused
+	ioutil.WriteFile(path, valid, 0644)
+	if _, err := db.LoadJournal(path); err != errDirtiesNotEmpty {
+		t.Errorf("error mismatch: have %v, want %v", err, errDirtiesNotEmpty)
+	}
+}
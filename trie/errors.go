@@ -17,19 +17,82 @@
 package trie
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/ethereum/go-ethereum/common"
 )
 
+// ErrCorruptedNode is returned when a trie node loaded from disk doesn't match
+// its hash, if read verification is enabled on the trie database.
+var ErrCorruptedNode = errors.New("corrupted trie node")
+
+// CorruptedNodeError is returned when a trie node loaded from disk or from the
+// clean cache cannot be decoded. It matches ErrCorruptedNode with errors.Is.
+type CorruptedNodeError struct {
+	NodeHash common.Hash // hash of the corrupted node
+	Err      error       // decoding error of the node
+}
+
+func (err *CorruptedNodeError) Error() string {
+	return fmt.Sprintf("corrupted trie node %x: %v", err.NodeHash, err.Err)
+}
+
+// Is reports whether the target is ErrCorruptedNode.
+func (err *CorruptedNodeError) Is(target error) bool {
+	return target == ErrCorruptedNode
+}
+
+// Unwrap returns the decoding error of the node.
+func (err *CorruptedNodeError) Unwrap() error {
+	return err.Err
+}
+
+// ErrQuotaExceeded is returned when a source tagged insert doesn't fit into the
+// dirty cache budget of its source.
+var ErrQuotaExceeded = errors.New("trie insert quota exceeded")
+
+// QuotaExceededError is returned when a source tagged insert doesn't fit into the
+// dirty cache budget of its source. It matches ErrQuotaExceeded with errors.Is.
+type QuotaExceededError struct {
+	Source InsertSource       // source the insert was tagged with
+	Used   common.StorageSize // dirty data held by the source
+	Limit  common.StorageSize // dirty data budget of the source
+	Size   common.StorageSize // size of the rejected insert
+}
+
+func (err *QuotaExceededError) Error() string {
+	return fmt.Sprintf("trie insert quota exceeded: source %d, used %v, limit %v, insert %v", err.Source, err.Used, err.Limit, err.Size)
+}
+
+// Is reports whether the target is ErrQuotaExceeded.
+func (err *QuotaExceededError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
 // MissingNodeError is returned by the trie functions (TryGet, TryUpdate, TryDelete)
 // in the case where a trie node is not present in the local database. It contains
 // information necessary for retrieving the missing node.
 type MissingNodeError struct {
+	Owner    common.Hash // owner of the trie (account hash of a storage trie), zero for the account trie
 	NodeHash common.Hash // hash of the missing node
 	Path     []byte      // hex-encoded path to the missing node
 }
 
 func (err *MissingNodeError) Error() string {
-	return fmt.Sprintf("missing trie node %x (path %x)", err.NodeHash, err.Path)
+	if err.Owner == (common.Hash{}) {
+		return fmt.Sprintf("missing trie node %x (path %x)", err.NodeHash, err.Path)
+	}
+	return fmt.Sprintf("missing trie node %x (owner %x) (path %x)", err.NodeHash, err.Owner, err.Path)
+}
+
+// FormatNodeError renders a trie error for logging. Missing node errors are
+// rendered with all their fields, so that the failing lookup can be located
+// regardless of which trie it happened in. Other errors are rendered as is.
+func FormatNodeError(err error) string {
+	missing, ok := err.(*MissingNodeError)
+	if !ok {
+		return err.Error()
+	}
+	return fmt.Sprintf("missing trie node: owner=%x hash=%x path=%x", missing.Owner, missing.NodeHash, missing.Path)
 }
@@ -0,0 +1,141 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// unlinkFlushList removes a cached node from the flush-list. If any neighbour
+// referenced by the node is missing from the dirty cache, the list is rebuilt
+// first instead of crashing on the nil entry.
+//
+// The caller must hold the database lock.
+func (db *Database) unlinkFlushList(hash common.Hash, node *cachedNode) {
+	var intact bool
+	switch hash {
+	case db.oldest:
+		_, intact = db.dirties[node.flushNext]
+	case db.newest:
+		_, intact = db.dirties[node.flushPrev]
+	default:
+		_, prev := db.dirties[node.flushPrev]
+		_, next := db.dirties[node.flushNext]
+		intact = prev && next
+	}
+	if !intact {
+		db.repairFlushList(fmt.Errorf("dangling neighbour of %x", hash))
+	}
+	switch hash {
+	case db.oldest:
+		db.oldest = node.flushNext
+		db.dirties[node.flushNext].flushPrev = common.Hash{}
+	case db.newest:
+		db.newest = node.flushPrev
+		db.dirties[node.flushPrev].flushNext = common.Hash{}
+	default:
+		db.dirties[node.flushPrev].flushNext = node.flushNext
+		db.dirties[node.flushNext].flushPrev = node.flushPrev
+	}
+}
+
+// checkFlushList verifies that the flush-list links up all the dirty nodes (apart
+// from the meta root) exactly once, with consistent back references.
+//
+// The caller must hold the database lock.
+func (db *Database) checkFlushList() error {
+	var (
+		prev  common.Hash
+		count int
+	)
+	for hash := db.oldest; hash != (common.Hash{}); {
+		node, ok := db.dirties[hash]
+		if !ok {
+			return fmt.Errorf("flush-list item %d (%x) missing", count, hash)
+		}
+		if node.flushPrev != prev {
+			return fmt.Errorf("flush-list item %d (%x) links back to %x, want %x", count, hash, node.flushPrev, prev)
+		}
+		if count++; count >= len(db.dirties) {
+			return fmt.Errorf("flush-list longer than the dirty cache (%d items)", len(db.dirties)-1)
+		}
+		prev, hash = hash, node.flushNext
+	}
+	if count > 0 && prev != db.newest { // newest is not reset when the list empties
+		return fmt.Errorf("flush-list ends at %x, want %x", prev, db.newest)
+	}
+	if count != len(db.dirties)-1 {
+		return fmt.Errorf("flush-list links %d items, want %d", count, len(db.dirties)-1)
+	}
+	return nil
+}
+
+// repairFlushList rebuilds the flush-list from the dirty cache. The original
+// insertion order is lost, so the nodes are relinked in a deterministic order
+// derived from the node hashes, with children always preceding their parents
+// to retain the guarantee that no node is flushed before its descendants.
+//
+// The caller must hold the database lock.
+func (db *Database) repairFlushList(reason error) {
+	hashes := make([]common.Hash, 0, len(db.dirties))
+	for hash := range db.dirties {
+		if hash != (common.Hash{}) {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	var (
+		order   = make([]common.Hash, 0, len(hashes))
+		visited = make(map[common.Hash]struct{}, len(hashes))
+		visit   func(hash common.Hash)
+	)
+	visit = func(hash common.Hash) {
+		node, ok := db.dirties[hash]
+		if !ok || hash == (common.Hash{}) {
+			return
+		}
+		if _, ok := visited[hash]; ok {
+			return
+		}
+		visited[hash] = struct{}{}
+		node.forChilds(visit)
+		order = append(order, hash)
+	}
+	for _, hash := range hashes {
+		visit(hash)
+	}
+	// Relink the nodes in the gathered order
+	db.oldest, db.newest = common.Hash{}, common.Hash{}
+	for _, hash := range order {
+		node := db.dirties[hash]
+		node.flushPrev, node.flushNext = db.newest, common.Hash{}
+		if db.oldest == (common.Hash{}) {
+			db.oldest = hash
+		} else {
+			db.dirties[db.newest].flushNext = hash
+		}
+		db.newest = hash
+	}
+	log.Warn("Repaired corrupted trie flush-list", "nodes", len(order), "reason", reason)
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that a corrupted flush-list is rebuilt with all dirty nodes, ordered so
+// that children precede their parents.
+func TestFlushListRepair(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+	root := makeDirtyTrie(db, 100)
+
+	db.dirties[db.oldest].flushNext = common.HexToHash("0xdeadbeef")
+	if err := db.checkFlushList(); err == nil {
+		t.Fatalf("corrupted flush-list passed the check")
+	}
+	db.repairFlushList(errors.New("test"))
+	if err := db.checkFlushList(); err != nil {
+		t.Fatalf("repaired flush-list inconsistent: %v", err)
+	}
+	if db.newest != root {
+		t.Fatalf("flush-list tail mismatch: have %x, want root %x", db.newest, root)
+	}
+}
+
+// Tests that Cap recovers from a flush-list referencing a missing node and keeps
+// flushing correctly.
+func TestFlushListRepairOnCap(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabase(diskdb)
+	root := makeDirtyTrie(db, 100)
+
+	db.dirties[db.oldest].flushNext = common.HexToHash("0xdeadbeef")
+
+	// Flush a part of the nodes first, then the rest
+	size, _ := db.Size()
+	if err := db.Cap(size / 2); err != nil {
+		t.Fatalf("failed to cap database: %v", err)
+	}
+	if err := db.checkFlushList(); err != nil {
+		t.Fatalf("flush-list inconsistent after cap: %v", err)
+	}
+	if len(db.dirties) == 1 {
+		t.Fatalf("partial cap flushed everything")
+	}
+	if err := db.Cap(0); err != nil {
+		t.Fatalf("failed to cap database: %v", err)
+	}
+	if len(db.dirties) != 1 {
+		t.Fatalf("dirty nodes left after full cap: %d", len(db.dirties)-1)
+	}
+	checkPersistedTrie(t, diskdb, root, 100)
+}
+
+// Tests that Commit recovers from a flush-list with a dangling neighbour instead
+// of crashing while uncaching the persisted nodes.
+func TestFlushListRepairOnCommit(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabase(diskdb)
+	root := makeDirtyTrie(db, 100)
+
+	middle := db.dirties[db.dirties[db.oldest].flushNext].flushNext
+	db.dirties[middle].flushPrev = common.HexToHash("0xdeadbeef")
+
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit database: %v", err)
+	}
+	if len(db.dirties) != 1 {
+		t.Fatalf("dirty nodes left after commit: %d", len(db.dirties)-1)
+	}
+	if err := db.checkFlushList(); err != nil {
+		t.Fatalf("flush-list inconsistent after commit: %v", err)
+	}
+	checkPersistedTrie(t, diskdb, root, 100)
+}
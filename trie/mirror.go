@@ -0,0 +1,164 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// commitMirrorQueue is the number of trie node writes buffered for the commit
+// mirror. Writes beyond it are dropped instead of stalling the flushes.
+const commitMirrorQueue = 16384
+
+var (
+	memcacheMirrorWriteMeter = metrics.NewRegisteredMeter("trie/memcache/mirror/write", nil)
+	memcacheMirrorDropMeter  = metrics.NewRegisteredMeter("trie/memcache/mirror/drop", nil)
+	memcacheMirrorFailMeter  = metrics.NewRegisteredMeter("trie/memcache/mirror/fail", nil)
+)
+
+// mirrorWrite is a single trie node queued for the commit mirror, or a flush
+// marker if done is set.
+type mirrorWrite struct {
+	key  []byte
+	blob []byte
+	done chan struct{}
+}
+
+// commitMirror asynchronously replicates the trie nodes written to disk into a
+// secondary store. It implements ethdb.KeyValueWriter to be able to replay the
+// written batches into it.
+type commitMirror struct {
+	writer ethdb.KeyValueWriter
+	queue  chan mirrorWrite
+
+	dropped uint64 // Number of writes dropped due to a full queue (atomic)
+	failed  uint64 // Number of writes rejected by the mirror (atomic)
+}
+
+// newCommitMirror creates a commit mirror and starts its writer goroutine.
+func newCommitMirror(writer ethdb.KeyValueWriter) *commitMirror {
+	m := &commitMirror{
+		writer: writer,
+		queue:  make(chan mirrorWrite, commitMirrorQueue),
+	}
+	go m.loop()
+	return m
+}
+
+// loop writes the queued trie nodes into the mirror until the queue is closed.
+func (m *commitMirror) loop() {
+	for write := range m.queue {
+		if write.done != nil {
+			close(write.done)
+			continue
+		}
+		if err := m.writer.Put(write.key, write.blob); err != nil {
+			log.Warn("Failed to mirror trie node", "hash", common.BytesToHash(write.key), "err", err)
+			atomic.AddUint64(&m.failed, 1)
+			memcacheMirrorFailMeter.Mark(1)
+			continue
+		}
+		memcacheMirrorWriteMeter.Mark(1)
+	}
+}
+
+// Put queues a trie node for mirroring, dropping it if the queue is full. Other
+// keys (e.g. preimages) are ignored.
+func (m *commitMirror) Put(key []byte, blob []byte) error {
+	if len(key) != common.HashLength {
+		return nil
+	}
+	// The replayed slices may be reused by the batch after a reset, copy them
+	select {
+	case m.queue <- mirrorWrite{key: common.CopyBytes(key), blob: common.CopyBytes(blob)}:
+	default:
+		atomic.AddUint64(&m.dropped, 1)
+		memcacheMirrorDropMeter.Mark(1)
+	}
+	return nil
+}
+
+// Delete is only here to satisfy ethdb.KeyValueWriter, flushes never delete.
+func (m *commitMirror) Delete(key []byte) error {
+	return nil
+}
+
+// flush blocks until all the writes queued so far have been processed.
+func (m *commitMirror) flush() {
+	done := make(chan struct{})
+	m.queue <- mirrorWrite{done: done}
+	<-done
+}
+
+// SetCommitMirror sets a secondary store into which every trie node written to
+// disk by Commit and Cap is replicated, with the exact same key and content. The
+// mirror is fed asynchronously through a bounded queue so a slow mirror cannot
+// stall the flushes: if the queue is full, writes are dropped and counted. Errors
+// returned by the mirror are logged and counted, but never fail a flush. Any
+// previous mirror is drained before being replaced, a nil writer disables
+// mirroring.
+func (db *Database) SetCommitMirror(writer ethdb.KeyValueWriter) {
+	db.lockFlush()
+	defer db.flushLock.Unlock()
+
+	if db.mirror != nil {
+		db.mirror.flush()
+		close(db.mirror.queue)
+		db.mirror = nil
+	}
+	if writer != nil {
+		db.mirror = newCommitMirror(writer)
+	}
+}
+
+// FlushCommitMirror blocks until all the trie nodes queued for the commit mirror
+// have been written into it. It is meant to be called on shutdown.
+func (db *Database) FlushCommitMirror() {
+	db.lockFlush()
+	defer db.flushLock.Unlock()
+
+	if db.mirror != nil {
+		db.mirror.flush()
+	}
+}
+
+// CommitMirrorStats returns the number of trie node writes dropped because the
+// commit mirror fell behind and the number of writes the mirror rejected.
+func (db *Database) CommitMirrorStats() (dropped uint64, failed uint64) {
+	db.lockFlush()
+	defer db.flushLock.Unlock()
+
+	if db.mirror == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&db.mirror.dropped), atomic.LoadUint64(&db.mirror.failed)
+}
+
+// mirrorBatch queues the trie nodes of a batch just written to disk for the
+// commit mirror, if any.
+//
+// Note, this method assumes the flush lock is held.
+func (db *Database) mirrorBatch(batch ethdb.Batch) {
+	if db.mirror != nil {
+		batch.Replay(db.mirror)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// blockingMirror is a commit mirror blocking all writes until released.
+type blockingMirror struct {
+	release chan struct{}
+	writes  int
+}
+
+func (m *blockingMirror) Put(key []byte, value []byte) error {
+	<-m.release
+	m.writes++
+	return nil
+}
+
+func (m *blockingMirror) Delete(key []byte) error { return nil }
+
+// failingMirror is a commit mirror rejecting all writes.
+type failingMirror struct{}
+
+func (failingMirror) Put(key []byte, value []byte) error { return errors.New("mirror down") }
+func (failingMirror) Delete(key []byte) error            { return nil }
+
+// Tests that the trie nodes written by Cap and Commit are replicated into the
+// commit mirror, and that nothing else is.
+func TestDatabaseCommitMirror(t *testing.T) {
+	var (
+		diskdb = memorydb.New()
+		mirror = memorydb.New()
+		db     = NewDatabase(diskdb)
+	)
+	db.SetCommitMirror(mirror)
+
+	db.insertPreimage(common.Hash{0x01}, []byte{0x02})
+	root := makeDirtyTrie(db, 1000)
+	if err := db.Cap(db.dirtiesSize / 2); err != nil {
+		t.Fatalf("failed to cap database: %v", err)
+	}
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit database: %v", err)
+	}
+	db.FlushCommitMirror()
+
+	nodes := 0
+	it := diskdb.NewIterator(nil, nil)
+	for it.Next() {
+		if len(it.Key()) != common.HashLength {
+			continue
+		}
+		nodes++
+		if blob, err := mirror.Get(it.Key()); err != nil || !bytes.Equal(blob, it.Value()) {
+			t.Errorf("node %x mismatch: have %x, want %x (err %v)", it.Key(), blob, it.Value(), err)
+		}
+	}
+	it.Release()
+	if mirror.Len() != nodes {
+		t.Errorf("mirrored entry count mismatch: have %d, want %d", mirror.Len(), nodes)
+	}
+	if dropped, failed := db.CommitMirrorStats(); dropped != 0 || failed != 0 {
+		t.Errorf("unexpected mirror errors: %d dropped, %d failed", dropped, failed)
+	}
+	// Replace the mirror with a failing one and ensure commits still succeed
+	db.SetCommitMirror(failingMirror{})
+	root = makeDirtyTrie(db, 10)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit with failing mirror: %v", err)
+	}
+	db.FlushCommitMirror()
+	if _, failed := db.CommitMirrorStats(); failed == 0 {
+		t.Errorf("mirror failures not counted")
+	}
+}
+
+// Tests that a blocked commit mirror does not stall the commit, but the writes
+// overflowing its queue are dropped and counted.
+func TestDatabaseCommitMirrorBlocked(t *testing.T) {
+	var (
+		diskdb = memorydb.New()
+		mirror = &blockingMirror{release: make(chan struct{})}
+		db     = NewDatabase(diskdb)
+	)
+	db.SetCommitMirror(mirror)
+
+	root := makeDirtyTrie(db, 20000)
+	nodes := len(db.dirties) - 1
+	if nodes <= commitMirrorQueue {
+		t.Fatalf("trie too small to overflow the mirror queue: %d nodes", nodes)
+	}
+	done := make(chan error)
+	go func() { done <- db.Commit(root, false) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to commit database: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("commit stalled by blocked mirror")
+	}
+	checkPersistedTrie(t, diskdb, root, 20000)
+
+	close(mirror.release)
+	db.FlushCommitMirror()
+
+	dropped, failed := db.CommitMirrorStats()
+	if dropped == 0 || failed != 0 {
+		t.Errorf("mirror stats mismatch: %d dropped, %d failed", dropped, failed)
+	}
+	if mirror.writes+int(dropped) != nodes {
+		t.Errorf("mirrored node count mismatch: %d written + %d dropped, want %d", mirror.writes, dropped, nodes)
+	}
+}
@@ -105,6 +105,9 @@ func (n valueNode) fstring(ind string) string {
 	return fmt.Sprintf("%x ", []byte(n))
 }
 
+// mustDecodeNode parses the RLP encoding of a trie node, panicking on failure.
+// It is only meant for encodings produced by the database itself, data read
+// from disk or from the clean cache needs to go through decodeNodeSafe.
 func mustDecodeNode(hash, buf []byte) node {
 	n, err := decodeNode(hash, buf)
 	if err != nil {
@@ -113,6 +116,18 @@ func mustDecodeNode(hash, buf []byte) node {
 	return n
 }
 
+// decodeNodeSafe parses the RLP encoding of a trie node loaded from an untrusted
+// source. Unlike decodeNode, it also converts any panic of the decoder into an
+// error, so that corrupt data can only ever fail the single read.
+func decodeNodeSafe(hash, buf []byte) (n node, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			n, err = nil, fmt.Errorf("decoder panic: %v", r)
+		}
+	}()
+	return decodeNode(hash, buf)
+}
+
 // decodeNode parses the RLP encoding of a trie node.
 func decodeNode(hash, buf []byte) (node, error) {
 	if len(buf) == 0 {
@@ -20,6 +20,8 @@ import (
 	"bytes"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 	"github.com/ethereum/go-ethereum/rlp"
 )
 
@@ -92,3 +94,41 @@ func TestDecodeFullNode(t *testing.T) {
 		t.Fatalf("decode full node err: %v", err)
 	}
 }
+
+// Tests that truncated and bit-flipped encodings of real trie nodes never make
+// the decoder panic, and that truncated encodings are always rejected.
+func TestDecodeNodeSafeCorrupted(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabase(diskdb)
+	if err := db.Commit(makeDirtyTrie(db, 100), false); err != nil {
+		t.Fatalf("failed to commit trie: %v", err)
+	}
+	decode := func(hash, buf []byte) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("decoder panicked on %x: %v", buf, r)
+			}
+		}()
+		_, err = decodeNodeSafe(hash, buf)
+		return err
+	}
+	it := diskdb.NewIterator(nil, nil)
+	defer it.Release()
+
+	for it.Next() {
+		hash, blob := it.Key(), common.CopyBytes(it.Value())
+		if len(hash) != common.HashLength {
+			continue
+		}
+		for i := 0; i < len(blob); i++ {
+			if err := decode(hash, blob[:i]); err == nil {
+				t.Errorf("node %x truncated to %d bytes accepted", hash, i)
+			}
+		}
+		for i := 0; i < len(blob)*8; i++ {
+			blob[i/8] ^= 1 << uint(i%8)
+			decode(hash, blob)
+			blob[i/8] ^= 1 << uint(i%8)
+		}
+	}
+}
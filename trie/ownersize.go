@@ -0,0 +1,109 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// OwnerSize is the amount of dirty data belonging to a single trie.
+type OwnerSize struct {
+	Owner common.Hash        `json:"owner"` // Root hash of the storage trie, zero for the account trie
+	Nodes int                `json:"nodes"` // Number of dirty nodes of the trie
+	Size  common.StorageSize `json:"size"`  // Storage size of the dirty nodes
+}
+
+// SizeByOwner breaks the dirty cache down by the tries the nodes belong to and
+// returns the topN largest ones sorted by size, or all of them if topN is not
+// positive. Storage tries are identified by their root hash, the nodes of the
+// account tries (and the contract code referenced from them) are accounted to
+// the zero owner.
+//
+// Nodes are keyed by hash only, so the owners are assigned by walking the tries
+// referenced from the meta root: nodes shared between tries are accounted to
+// the first owner they are reached from, and nodes not referenced by any root
+// are not accounted at all. The read lock is held during the whole walk.
+func (db *Database) SizeByOwner(topN int) []OwnerSize {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	type ownedNode struct {
+		hash, owner common.Hash
+	}
+	var (
+		owners = make(map[common.Hash]*OwnerSize)
+		seen   = make(map[common.Hash]struct{})
+		stack  []ownedNode
+	)
+	for root := range db.dirties[common.Hash{}].children {
+		stack = append(stack, ownedNode{hash: root})
+	}
+	for len(stack) > 0 {
+		next := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		node, ok := db.dirties[next.hash]
+		if !ok {
+			continue
+		}
+		if _, ok := seen[next.hash]; ok {
+			continue
+		}
+		seen[next.hash] = struct{}{}
+
+		stats := owners[next.owner]
+		if stats == nil {
+			stats = &OwnerSize{Owner: next.owner}
+			owners[next.owner] = stats
+		}
+		stats.Nodes++
+		stats.Size += common.StorageSize(common.HashLength + int(node.size))
+
+		for child := range node.children {
+			// External children are the roots of storage tries or contract code
+			owner := child
+			if child, ok := db.dirties[child]; ok {
+				if _, code := child.node.(rawNode); code {
+					owner = next.owner
+				}
+			}
+			stack = append(stack, ownedNode{hash: child, owner: owner})
+		}
+		if _, raw := node.node.(rawNode); !raw {
+			forGatherChildren(node.node, func(child common.Hash) {
+				stack = append(stack, ownedNode{hash: child, owner: next.owner})
+			})
+		}
+	}
+	sizes := make([]OwnerSize, 0, len(owners))
+	for _, stats := range owners {
+		sizes = append(sizes, *stats)
+	}
+	sort.Slice(sizes, func(i, j int) bool {
+		if sizes[i].Size != sizes[j].Size {
+			return sizes[i].Size > sizes[j].Size
+		}
+		return bytes.Compare(sizes[i].Owner[:], sizes[j].Owner[:]) < 0
+	})
+	if topN > 0 && len(sizes) > topN {
+		sizes = sizes[:topN]
+	}
+	return sizes
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"math/big"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that the dirty cache is broken down exactly by the owning tries.
+func TestDatabaseSizeByOwner(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+
+	// Create storage tries of different sizes, with distinct values to keep them
+	// from sharing any nodes
+	newStorage := func(id byte, n int) common.Hash {
+		trie, _ := New(common.Hash{}, db)
+		for i := 0; i < n; i++ {
+			key := common.BigToHash(big.NewInt(int64(i)))
+			trie.Update(crypto.Keccak256(key[:]), append(key[:], id))
+		}
+		root, _ := trie.Commit(nil)
+		return root
+	}
+	storage := []common.Hash{newStorage(1, 10), newStorage(2, 100), newStorage(3, 500)}
+
+	accounts, _ := New(common.Hash{}, db)
+	for i := range storage {
+		accounts.Update([]byte{byte(i)}, storage[i][:])
+	}
+	root, _ := accounts.Commit(func(leaf []byte, parent common.Hash) error {
+		db.Reference(common.BytesToHash(leaf), parent)
+		return nil
+	})
+	db.Reference(root, common.Hash{})
+
+	size := func(nodes map[common.Hash]common.StorageSize) (total common.StorageSize) {
+		for _, size := range nodes {
+			total += size
+		}
+		return total
+	}
+	nodes := dirtyTrieNodes(t, db, root)
+	want := []OwnerSize{{Owner: common.Hash{}, Nodes: len(nodes), Size: size(nodes)}}
+	for _, owner := range storage {
+		nodes := dirtyTrieNodes(t, db, owner)
+		want = append(want, OwnerSize{Owner: owner, Nodes: len(nodes), Size: size(nodes)})
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].Size > want[j].Size })
+
+	if have := db.SizeByOwner(0); !reflect.DeepEqual(have, want) {
+		t.Fatalf("owner breakdown mismatch:\nhave %+v\nwant %+v", have, want)
+	}
+	if have := db.SizeByOwner(2); !reflect.DeepEqual(have, want[:2]) {
+		t.Errorf("top owners mismatch:\nhave %+v\nwant %+v", have, want[:2])
+	}
+	if want[0].Owner != storage[2] {
+		t.Errorf("largest owner mismatch: have %x, want %x", want[0].Owner, storage[2])
+	}
+	// Flushing nodes out should be reflected in the breakdown
+	if err := db.Cap(db.dirtySize() / 2); err != nil {
+		t.Fatalf("failed to cap: %v", err)
+	}
+	var total common.StorageSize
+	for _, owner := range db.SizeByOwner(0) {
+		total += owner.Size
+	}
+	if total != db.dirtiesSize {
+		t.Errorf("total size after cap mismatch: have %v, want %v", total, db.dirtiesSize)
+	}
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	if have := db.SizeByOwner(0); len(have) != 0 {
+		t.Errorf("owners left after commit: %+v", have)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import "github.com/ethereum/go-ethereum/common"
+
+const (
+	// maxPendingRefs is the maximum number of children tracked with parent
+	// references waiting for the child to be inserted. References beyond it are
+	// dropped.
+	maxPendingRefs = 256 * 1024
+
+	// pendingRefSize is the memory overhead of a single tracked child.
+	pendingRefSize = common.HashLength + 4 // uint32 counter
+)
+
+// InsertSynced inserts a trie node retrieved by the state syncer into the memory
+// database. Contrary to the nodes of a committed trie, these may arrive before
+// their children, so references to children neither cached nor persisted yet are
+// recorded and applied once the child is inserted. Ordinary commits don't go
+// through this path as their children are always inserted first.
+func (db *Database) InsertSynced(hash common.Hash, blob []byte) error {
+	n, err := decodeNode(hash[:], blob)
+	if err != nil {
+		return &CorruptedNodeError{NodeHash: hash, Err: err}
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if _, ok := db.dirties[hash]; ok {
+		return nil
+	}
+	db.insert(hash, len(blob), n)
+	db.dirties[hash].forChilds(func(child common.Hash) {
+		if _, ok := db.dirties[child]; !ok {
+			db.addPendingRef(child)
+		}
+	})
+	return nil
+}
+
+// addPendingRef records a reference from a synced parent to a child that is
+// neither in the dirty cache, nor persisted. Such a child is inserted out of
+// order later on, at which point the reference is applied.
+//
+// The caller must hold the database lock.
+func (db *Database) addPendingRef(child common.Hash) {
+	if db.onDisk(child) {
+		return
+	}
+	if db.pending == nil {
+		db.pending = make(map[common.Hash]uint32)
+	}
+	if _, ok := db.pending[child]; !ok && len(db.pending) >= maxPendingRefs {
+		memcachePendingDropMeter.Mark(1)
+		return
+	}
+	db.pending[child]++
+}
+
+// onDisk reports whether a node is in the persistent database, checking the clean
+// cache first to avoid hitting the disk for recently read or written nodes.
+func (db *Database) onDisk(hash common.Hash) bool {
+	if db.cleans != nil && db.cleans.Has(hash[:]) {
+		return true
+	}
+	ok, _ := db.diskdb.Has(hash[:])
+	return ok
+}
+
+// pendingSize returns the memory overhead of the tracked pending references.
+//
+// The caller must hold the database lock.
+func (db *Database) pendingSize() common.StorageSize {
+	return common.StorageSize(len(db.pending) * pendingRefSize)
+}
+
+// applyPendingRefs adds the references accumulated before the node was inserted
+// to its parent count.
+//
+// The caller must hold the database lock.
+func (db *Database) applyPendingRefs(hash common.Hash, node *cachedNode) {
+	if refs, ok := db.pending[hash]; ok {
+		node.parents += refs
+		delete(db.pending, hash)
+	}
+}
+
+// dropPendingRef removes a single pending reference to a child, used when the
+// referencing parent is flushed or dereferenced before the child got inserted.
+//
+// The caller must hold the database lock.
+func (db *Database) dropPendingRef(child common.Hash) {
+	if refs, ok := db.pending[child]; ok {
+		if refs <= 1 {
+			delete(db.pending, child)
+		} else {
+			db.pending[child] = refs - 1
+		}
+	}
+}
+
+// dropPendingRefs removes the pending references of a parent node leaving the
+// dirty cache.
+//
+// The caller must hold the database lock.
+func (db *Database) dropPendingRefs(node *cachedNode) {
+	if len(db.pending) == 0 {
+		return
+	}
+	if _, ok := node.node.(rawNode); ok {
+		return
+	}
+	// External children are only ever referenced if present, skip them
+	forGatherChildren(node.node, func(child common.Hash) {
+		if _, ok := db.dirties[child]; !ok {
+			db.dropPendingRef(child)
+		}
+	})
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that references from a synced parent inserted before its children are
+// applied once the children arrive, matching the bookkeeping of the children
+// first order.
+func TestDatabasePendingReferences(t *testing.T) {
+	// Persist a small trie and gather its nodes, parents first
+	diskdb := memorydb.New()
+	src := NewDatabase(diskdb)
+	root := makeDirtyTrie(src, 50)
+	if err := src.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit trie: %v", err)
+	}
+	var hashes []common.Hash
+	for it := mustNewTrie(t, root, src).NodeIterator(nil); it.Next(true); {
+		if it.Hash() != (common.Hash{}) {
+			hashes = append(hashes, it.Hash())
+		}
+	}
+	sync := func(hashes []common.Hash) *Database {
+		db := NewDatabase(memorydb.New())
+		for _, hash := range hashes {
+			blob, _ := diskdb.Get(hash[:])
+			if err := db.InsertSynced(hash, blob); err != nil {
+				t.Fatalf("failed to insert node %x: %v", hash, err)
+			}
+		}
+		return db
+	}
+	reversed := make([]common.Hash, len(hashes))
+	for i, hash := range hashes {
+		reversed[len(hashes)-1-i] = hash
+	}
+	ordered, unordered := sync(reversed), sync(hashes)
+
+	for _, hash := range hashes {
+		if have, want := unordered.dirties[hash].parents, ordered.dirties[hash].parents; have != want {
+			t.Errorf("node %x: parent count mismatch: have %d, want %d", hash, have, want)
+		}
+	}
+	if len(ordered.pending) != 0 || len(unordered.pending) != 0 {
+		t.Errorf("pending references not applied: ordered %d, unordered %d", len(ordered.pending), len(unordered.pending))
+	}
+	// Dereferencing the root should garbage collect the whole trie
+	unordered.Reference(root, common.Hash{})
+	unordered.Dereference(root)
+	if len(unordered.dirties) != 1 {
+		t.Errorf("trie not garbage collected with its root: %d nodes left", len(unordered.dirties)-1)
+	}
+	// Pending references should be dropped if the parent leaves the cache first
+	for _, flush := range []string{"dereference", "commit"} {
+		db := sync(hashes[:1])
+		if len(db.pending) == 0 {
+			t.Fatalf("%s: no pending references tracked for the root", flush)
+		}
+		db.Reference(root, common.Hash{})
+		switch flush {
+		case "dereference":
+			db.Dereference(root)
+		case "commit":
+			if err := db.Commit(root, false); err != nil {
+				t.Fatalf("%s: failed to commit root: %v", flush, err)
+			}
+		}
+		if len(db.pending) != 0 {
+			t.Errorf("%s: pending references retained: %v", flush, db.pending)
+		}
+	}
+	// Ordinary inserts should not track anything
+	db := NewDatabase(memorydb.New())
+	blob, _ := diskdb.Get(root[:])
+	db.insert(root, len(blob), mustDecodeNode(root[:], blob))
+	if len(db.pending) != 0 {
+		t.Errorf("pending references tracked for ordinary insert: %v", db.pending)
+	}
+}
+
+// Tests that ordinary commits on top of a persisted trie, referencing unchanged
+// subtries already on disk, don't leave pending references behind.
+func TestDatabasePendingReferencesImport(t *testing.T) {
+	diskdb := memorydb.New()
+	for _, cache := range []int{0, 16} {
+		db := NewDatabaseWithCache(diskdb, cache)
+		tr, _ := New(common.Hash{}, db)
+		for i := 0; i < 1000; i++ {
+			key := crypto.Keccak256([]byte(fmt.Sprintf("key-%d", i)))
+			tr.Update(key, key)
+		}
+		root, _ := tr.Commit(nil)
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("cache %d: failed to commit base trie: %v", cache, err)
+		}
+		// Import a series of "blocks" each changing a few keys only
+		for block := 0; block < 50; block++ {
+			tr, _ = New(root, db)
+			for i := 0; i < 5; i++ {
+				key := crypto.Keccak256([]byte(fmt.Sprintf("key-%d", (block*7+i*131)%1000)))
+				tr.Update(key, []byte(fmt.Sprintf("value-%d-%d", block, i)))
+			}
+			root, _ = tr.Commit(nil)
+			db.Reference(root, common.Hash{})
+		}
+		if len(db.pending) != 0 {
+			t.Errorf("cache %d: pending references tracked for persisted children: %d", cache, len(db.pending))
+		}
+		if size, _ := db.Size(); size == 0 {
+			t.Errorf("cache %d: empty dirty cache after import", cache)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// defaultPreimageLimit is the default size of the preimage cache above which
+// Cap writes the preimages to disk.
+const defaultPreimageLimit = 4 * 1024 * 1024
+
+var memcachePreimageSpillMeter = metrics.NewRegisteredMeter("trie/memcache/preimages/spill", nil)
+
+// preimageEntry is the RLP format of a single exported preimage.
+type preimageEntry struct {
+	Hash     common.Hash
+	Preimage []byte
+}
+
+// Preimages returns a copy of the preimages accumulated in memory and not yet
+// written to disk.
+func (db *Database) Preimages() map[common.Hash][]byte {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	preimages := make(map[common.Hash][]byte, len(db.preimages))
+	for hash, preimage := range db.preimages {
+		preimages[hash] = preimage
+	}
+	return preimages
+}
+
+// IteratePreimages invokes the callback for every known preimage, first for the
+// ones accumulated in memory, then for the ones stored on disk. Every preimage
+// is visited once, even if it is present in both places. The iteration stops if
+// the callback returns false. The preimage slices must not be modified.
+func (db *Database) IteratePreimages(fn func(hash common.Hash, preimage []byte) bool) error {
+	cached := db.Preimages()
+	for hash, preimage := range cached {
+		if !fn(hash, preimage) {
+			return nil
+		}
+	}
+	it := db.diskdb.NewIterator(secureKeyPrefix, nil)
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+		if len(key) != secureKeyLength {
+			continue
+		}
+		hash := common.BytesToHash(key[secureKeyPrefixLength:])
+		if _, ok := cached[hash]; ok {
+			continue
+		}
+		if !fn(hash, common.CopyBytes(it.Value())) {
+			return nil
+		}
+	}
+	return it.Error()
+}
+
+// ExportPreimages writes all known preimages into the given writer as a stream
+// of RLP encoded (hash, preimage) pairs.
+func (db *Database) ExportPreimages(w io.Writer) error {
+	var err error
+	iterErr := db.IteratePreimages(func(hash common.Hash, preimage []byte) bool {
+		err = rlp.Encode(w, &preimageEntry{Hash: hash, Preimage: preimage})
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return iterErr
+}
+
+// ImportPreimages reads a stream of preimages written by ExportPreimages and
+// adds them to the in-memory preimage set, to be persisted by the next commit,
+// even if preimage recording is disabled. Every preimage is checked against its
+// hash. The number of imported preimages is returned.
+func (db *Database) ImportPreimages(r io.Reader) (int, error) {
+	var (
+		stream = rlp.NewStream(r, 0)
+		count  int
+	)
+	for {
+		var entry preimageEntry
+		if err := stream.Decode(&entry); err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, fmt.Errorf("preimage %d: %v", count, err)
+		}
+		if hash := crypto.Keccak256Hash(entry.Preimage); hash != entry.Hash {
+			return count, fmt.Errorf("preimage %d: hash mismatch: have %x, want %x", count, hash, entry.Hash)
+		}
+		db.lock.Lock()
+		db.cachePreimage(entry.Hash, entry.Preimage)
+		db.lock.Unlock()
+		count++
+	}
+}
+
+// SetPreimageLimit sets the size of the preimage cache above which Cap writes
+// the preimages to disk. Smaller caches are kept to deduplicate writes. A zero
+// limit flushes the preimages on every Cap.
+func (db *Database) SetPreimageLimit(limit common.StorageSize) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.preimageLimit = limit
+}
+
+// SetPreimageRecording enables or disables the recording of the preimages of the
+// secure trie keys at runtime. Disabling it flushes the preimages accumulated so
+// far to disk and releases the memory used for them, they stay retrievable from
+// disk. Preimages imported via ImportPreimages are cached regardless.
+func (db *Database) SetPreimageRecording(enabled bool) error {
+	db.lock.Lock()
+	db.preimagesOff = !enabled
+	db.lock.Unlock()
+
+	if enabled {
+		return nil
+	}
+	if err := db.FlushPreimages(); err != nil {
+		return err
+	}
+	// Recreate the map, deleting the entries doesn't shrink it
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if len(db.preimages) == 0 {
+		db.preimages = make(map[common.Hash][]byte)
+		db.preimageOrder = nil
+	}
+	return nil
+}
+
+// PreimageRecording returns whether the preimages of the secure trie keys are
+// recorded.
+func (db *Database) PreimageRecording() bool {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return !db.preimagesOff
+}
+
+// FlushPreimages writes all the cached preimages to disk, independently of the
+// trie nodes. Preimages added while the write is in progress stay cached.
+func (db *Database) FlushPreimages() error {
+	db.lockFlush()
+	defer db.flushLock.Unlock()
+
+	batch := db.diskdb.NewBatch()
+
+	db.lock.RLock()
+	flushed := make([]common.Hash, 0, len(db.preimages))
+	for hash := range db.preimages {
+		flushed = append(flushed, hash)
+	}
+	err := writePreimages(batch, db.preimages, db.flushBatchSize())
+	db.lock.RUnlock()
+
+	if err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		log.Error("Failed to write preimages to disk", "err", err)
+		return err
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	for _, hash := range flushed {
+		db.preimagesSize -= common.StorageSize(common.HashLength + len(db.preimages[hash]))
+		delete(db.preimages, hash)
+	}
+	if len(db.preimages) == 0 {
+		db.preimageOrder = db.preimageOrder[:0]
+	}
+	return nil
+}
+
+// SetPreimageCacheSize caps the memory used by the cached preimages. Whenever the
+// cache grows above the cap, the oldest preimages are written to disk right away,
+// down to half the cap, instead of waiting for the next Cap or Commit. A zero size
+// removes the cap.
+func (db *Database) SetPreimageCacheSize(size common.StorageSize) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.preimageCap = size
+	if size == 0 {
+		db.preimageOrder = nil
+		return
+	}
+	// The insertion order isn't tracked without a cap, consider the preimages
+	// cached so far equally old
+	if len(db.preimageOrder) == 0 {
+		for hash := range db.preimages {
+			db.preimageOrder = append(db.preimageOrder, hash)
+		}
+	}
+	if db.preimagesSize > db.preimageCap {
+		db.spillPreimages()
+	}
+}
+
+// spillPreimages writes the oldest cached preimages to disk and drops them from
+// the cache, until it shrinks to half its cap. If the write fails, the preimages
+// are kept cached.
+//
+// Note, this method assumes that the database's lock is held!
+func (db *Database) spillPreimages() {
+	var (
+		spill = make(map[common.Hash][]byte)
+		size  = db.preimagesSize
+		n     int
+	)
+	// Preimages flushed in the meantime leave stale hashes behind, skip them
+	for ; n < len(db.preimageOrder) && size > db.preimageCap/2; n++ {
+		hash := db.preimageOrder[n]
+		if preimage, ok := db.preimages[hash]; ok {
+			if _, dup := spill[hash]; !dup {
+				spill[hash] = preimage
+				size -= common.StorageSize(common.HashLength + len(preimage))
+			}
+		}
+	}
+	batch := db.diskdb.NewBatch()
+	if err := writePreimages(batch, spill, db.flushBatchSize()); err != nil {
+		log.Error("Failed to spill preimages to disk", "err", err)
+		return
+	}
+	if err := batch.Write(); err != nil {
+		log.Error("Failed to spill preimages to disk", "err", err)
+		return
+	}
+	for hash := range spill {
+		delete(db.preimages, hash)
+	}
+	db.preimageOrder = db.preimageOrder[n:]
+	db.preimagesSize = size
+
+	memcachePreimageSpillMeter.Mark(int64(len(spill)))
+}
+
+// writePreimages adds the preimages to the batch, writing the batch out whenever
+// it grows above the given size.
+func writePreimages(batch ethdb.Batch, preimages map[common.Hash][]byte, size int) error {
+	// We reuse an ephemeral buffer for the keys. The batch Put operation
+	// copies it internally, so we can reuse it.
+	var keyBuf [secureKeyLength]byte
+	copy(keyBuf[:], secureKeyPrefix)
+
+	for hash, preimage := range preimages {
+		copy(keyBuf[secureKeyPrefixLength:], hash[:])
+		if err := batch.Put(keyBuf[:], preimage); err != nil {
+			log.Error("Failed to commit preimage from trie database", "err", err)
+			return err
+		}
+		// If the batch is too large, flush to disk
+		if batch.ValueSize() > size {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that preimages are left cached if requested.
+func TestDatabaseCommitSkipPreimages(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabase(diskdb)
+	root := makeDirtyTrie(db, 10)
+
+	hash := crypto.Keccak256Hash([]byte("preimage"))
+	db.lock.Lock()
+	db.insertPreimage(hash, []byte("preimage"))
+	db.lock.Unlock()
+
+	if err := db.CommitWithOptions(root, CommitOptions{SkipPreimages: true}); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	if ok, _ := diskdb.Has(secureKey(hash)); ok {
+		t.Fatalf("preimage persisted")
+	}
+	if blob, _ := db.preimage(hash); !bytes.Equal(blob, []byte("preimage")) {
+		t.Fatalf("preimage not retained: %x", blob)
+	}
+	checkPersistedTrie(t, diskdb, root, 10)
+}
+
+// Tests that the preimages are iterated from both memory and disk without
+// duplicates, and that they survive an export-import round trip.
+func TestDatabasePreimageExport(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+
+	want := make(map[common.Hash][]byte)
+	insert := func(from, to int) {
+		db.lock.Lock()
+		defer db.lock.Unlock()
+
+		for i := from; i < to; i++ {
+			preimage := common.BigToHash(big.NewInt(int64(i))).Bytes()
+			hash := crypto.Keccak256Hash(preimage)
+			db.insertPreimage(hash, preimage)
+			want[hash] = preimage
+		}
+	}
+	// Persist some preimages, then cache more, overlapping the persisted ones
+	insert(0, 100)
+	if err := db.Commit(makeDirtyTrie(db, 1), false); err != nil {
+		t.Fatalf("failed to commit preimages: %v", err)
+	}
+	insert(90, 150)
+	if n := len(db.Preimages()); n != 60 {
+		t.Fatalf("cached preimage count mismatch: have %d, want 60", n)
+	}
+	have := make(map[common.Hash][]byte)
+	err := db.IteratePreimages(func(hash common.Hash, preimage []byte) bool {
+		if _, ok := have[hash]; ok {
+			t.Errorf("preimage %x visited twice", hash)
+		}
+		have[hash] = preimage
+		return true
+	})
+	if err != nil {
+		t.Fatalf("failed to iterate preimages: %v", err)
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("iterated preimages mismatch: have %d, want %d", len(have), len(want))
+	}
+	// Export the preimages and import them into an empty database
+	var buf bytes.Buffer
+	if err := db.ExportPreimages(&buf); err != nil {
+		t.Fatalf("failed to export preimages: %v", err)
+	}
+	exported := buf.Bytes()
+
+	imported := NewDatabase(memorydb.New())
+	if n, err := imported.ImportPreimages(bytes.NewReader(exported)); err != nil || n != len(want) {
+		t.Fatalf("failed to import preimages: have %d, want %d (err %v)", n, len(want), err)
+	}
+	if !reflect.DeepEqual(imported.Preimages(), want) {
+		t.Fatalf("imported preimages mismatch")
+	}
+	// Corrupt a preimage and ensure the import is rejected
+	exported[len(exported)-1] ^= 0xff
+	if _, err := NewDatabase(memorydb.New()).ImportPreimages(bytes.NewReader(exported)); err == nil {
+		t.Fatalf("corrupted preimage imported")
+	}
+}
+
+// Tests that the preimages are flushed by Cap exactly when the configured limit
+// is exceeded, and by FlushPreimages unconditionally.
+func TestDatabasePreimageLimit(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabase(diskdb)
+
+	insert := func(from, to int) {
+		db.lock.Lock()
+		defer db.lock.Unlock()
+
+		for i := from; i < to; i++ {
+			preimage := common.BigToHash(big.NewInt(int64(i))).Bytes()
+			db.insertPreimage(crypto.Keccak256Hash(preimage), preimage)
+		}
+	}
+	persisted := func() int {
+		var count int
+		it := diskdb.NewIterator(secureKeyPrefix, nil)
+		defer it.Release()
+		for it.Next() {
+			count++
+		}
+		return count
+	}
+	// 10 preimages take 640 bytes, below the limit they stay cached
+	db.SetPreimageLimit(1000)
+	insert(0, 10)
+	if err := db.Cap(0); err != nil {
+		t.Fatalf("failed to cap database: %v", err)
+	}
+	if n := persisted(); n != 0 {
+		t.Fatalf("preimages flushed below the limit: %d", n)
+	}
+	// Exceed the limit, all preimages should be flushed
+	insert(10, 20)
+	if err := db.Cap(0); err != nil {
+		t.Fatalf("failed to cap database: %v", err)
+	}
+	if n := persisted(); n != 20 {
+		t.Fatalf("persisted preimage count mismatch: have %d, want 20", n)
+	}
+	if _, size := db.Size(); size != 0 {
+		t.Fatalf("preimage cache not emptied: %v", size)
+	}
+	// A zero limit flushes on every cap
+	db.SetPreimageLimit(0)
+	insert(20, 21)
+	if err := db.Cap(0); err != nil {
+		t.Fatalf("failed to cap database: %v", err)
+	}
+	if n := persisted(); n != 21 {
+		t.Fatalf("persisted preimage count mismatch: have %d, want 21", n)
+	}
+	// Explicit flushes ignore the limit
+	db.SetPreimageLimit(1000)
+	insert(21, 25)
+	if err := db.FlushPreimages(); err != nil {
+		t.Fatalf("failed to flush preimages: %v", err)
+	}
+	if n := persisted(); n != 25 {
+		t.Fatalf("persisted preimage count mismatch: have %d, want 25", n)
+	}
+	if _, size := db.Size(); size != 0 {
+		t.Fatalf("preimage cache not emptied: %v", size)
+	}
+	if err := db.FlushPreimages(); err != nil {
+		t.Fatalf("failed to flush empty preimage cache: %v", err)
+	}
+}
+
+// Tests that preimage recording can be toggled while secure tries are committed
+// concurrently, without losing any of the recorded preimages.
+func TestDatabasePreimageRecording(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+
+	commit := func(key []byte) {
+		trie, _ := NewSecure(common.Hash{}, db)
+		trie.Update(key, key)
+		if _, err := trie.Commit(nil); err != nil {
+			t.Errorf("failed to commit trie: %v", err)
+		}
+	}
+	var (
+		wg      sync.WaitGroup
+		quit    = make(chan struct{})
+		commits uint64
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(writer uint32) {
+			defer wg.Done()
+
+			for n := uint32(0); ; n++ {
+				select {
+				case <-quit:
+					return
+				default:
+				}
+				key := make([]byte, 8)
+				binary.BigEndian.PutUint32(key, writer)
+				binary.BigEndian.PutUint32(key[4:], n)
+				commit(key)
+
+				atomic.AddUint64(&commits, 1)
+				runtime.Gosched()
+			}
+		}(uint32(i))
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.SetPreimageRecording(i%2 == 1); err != nil {
+			t.Fatalf("failed to toggle preimage recording: %v", err)
+		}
+		// Let the writers make some progress in both states
+		for start := atomic.LoadUint64(&commits); atomic.LoadUint64(&commits) < start+10; {
+			runtime.Gosched()
+		}
+	}
+	close(quit)
+	wg.Wait()
+
+	// Every recorded preimage should be known, either from memory or from disk
+	stats := db.CacheStats()
+	if !stats.PreimageRecording {
+		t.Fatalf("preimage recording disabled")
+	}
+	var known uint64
+	db.IteratePreimages(func(hash common.Hash, preimage []byte) bool {
+		if crypto.Keccak256Hash(preimage) != hash {
+			t.Errorf("preimage %x mismatch: %x", hash, preimage)
+		}
+		known++
+		return true
+	})
+	if known != stats.PreimagesRecorded {
+		t.Fatalf("known preimages mismatch: have %d, want %d", known, stats.PreimagesRecorded)
+	}
+	if known == 0 {
+		t.Fatalf("no preimages recorded")
+	}
+	// Disabling the recording should flush the preimages, keeping them readable
+	if err := db.SetPreimageRecording(false); err != nil {
+		t.Fatalf("failed to disable preimage recording: %v", err)
+	}
+	if stats := db.CacheStats(); stats.PreimageRecording || stats.PreimageSize != 0 {
+		t.Fatalf("preimage cache not released: recording %v, size %v", stats.PreimageRecording, stats.PreimageSize)
+	}
+	db.IteratePreimages(func(hash common.Hash, preimage []byte) bool {
+		if enc, err := db.preimage(hash); err != nil || !bytes.Equal(enc, preimage) {
+			t.Errorf("preimage %x unreadable: %x, %v", hash, enc, err)
+		}
+		return true
+	})
+	// New preimages should only be recorded once recording is enabled again
+	commit([]byte("disabled"))
+	if _, err := db.preimage(crypto.Keccak256Hash([]byte("disabled"))); err == nil {
+		t.Errorf("preimage recorded while disabled")
+	}
+	if err := db.SetPreimageRecording(true); err != nil {
+		t.Fatalf("failed to enable preimage recording: %v", err)
+	}
+	commit([]byte("enabled"))
+	if enc, err := db.preimage(crypto.Keccak256Hash([]byte("enabled"))); err != nil || string(enc) != "enabled" {
+		t.Errorf("preimage not recorded: %q, %v", enc, err)
+	}
+	if stats := db.CacheStats(); stats.PreimagesRecorded != known+1 {
+		t.Errorf("recorded preimages mismatch: have %d, want %d", stats.PreimagesRecorded, known+1)
+	}
+}
+
+// Tests that the preimage cache stays within its cap, spilling the oldest
+// preimages to disk, while all of them stay retrievable.
+func TestDatabasePreimageCacheSize(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabase(diskdb)
+	db.SetPreimageCacheSize(1024)
+
+	var keys [][]byte
+	for i := 0; i < 20; i++ {
+		trie, _ := NewSecure(common.Hash{}, db)
+		for j := 0; j < 10; j++ {
+			key := []byte(fmt.Sprintf("key-%03d-%03d", i, j))
+			trie.Update(key, key)
+			keys = append(keys, key)
+		}
+		if _, err := trie.Commit(nil); err != nil {
+			t.Fatalf("failed to commit trie %d: %v", i, err)
+		}
+		if size := db.CacheStats().PreimageSize; size > 1024 {
+			t.Fatalf("preimage cache above cap after trie %d: %v", i, size)
+		}
+	}
+	// The oldest preimages should be on disk, and all of them retrievable
+	if blob, _ := diskdb.Get(secureKey(crypto.Keccak256Hash(keys[0]))); !bytes.Equal(blob, keys[0]) {
+		t.Errorf("oldest preimage not spilled: %q", blob)
+	}
+	for _, key := range keys {
+		if enc, err := db.preimage(crypto.Keccak256Hash(key)); err != nil || !bytes.Equal(enc, key) {
+			t.Errorf("preimage of %q mismatch: %q, %v", key, enc, err)
+		}
+	}
+	// Removing the cap should let the cache grow again
+	db.SetPreimageCacheSize(0)
+
+	trie, _ := NewSecure(common.Hash{}, db)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("uncapped-%03d", i))
+		trie.Update(key, key)
+	}
+	trie.Commit(nil)
+	if size := db.CacheStats().PreimageSize; size <= 1024 {
+		t.Errorf("preimage cache still capped: %v", size)
+	}
+}
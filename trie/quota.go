@@ -0,0 +1,147 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// InsertSource identifies the origin of the nodes inserted into the dirty cache,
+// e.g. a sync peer. The zero source is trusted and not subject to any quota.
+//
+// Note, the state sync scheduler (Sync) deliberately doesn't charge its results
+// to the delivering peers. It only accepts nodes it requested by hash, so a peer
+// can't push data of its own choosing; and the parents it keeps in memory until
+// their subtries complete are dictated by the trie shape, not by the peer. A per
+// peer budget there would only throttle honest peers serving the upper levels.
+// The quotas are meant for inserts of unrequested data via InsertBlobFrom.
+type InsertSource uint16
+
+// insertQuota is the dirty cache budget of a single insertion source.
+type insertQuota struct {
+	limit common.StorageSize // Maximum dirty data of the source, 0 if unlimited
+	used  common.StorageSize // Dirty data currently held by the source
+}
+
+// SetInsertQuota sets the amount of dirty data the given source may hold in the
+// memory database. Inserts over the budget are rejected with a QuotaExceededError
+// until some of the nodes of the source are flushed or garbage collected. A zero
+// limit removes the budget. The quota of the trusted zero source can't be set.
+//
+// Lowering the limit below the current usage doesn't evict anything, it only
+// rejects further inserts.
+func (db *Database) SetInsertQuota(source InsertSource, limit common.StorageSize) {
+	if source == 0 {
+		return
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	quota := db.quotas[source]
+	if quota == nil {
+		if limit == 0 {
+			return
+		}
+		if db.quotas == nil {
+			db.quotas = make(map[InsertSource]*insertQuota)
+		}
+		quota = new(insertQuota)
+		db.quotas[source] = quota
+	}
+	quota.limit = limit
+	db.dropQuota(source, quota)
+}
+
+// InsertQuota returns the amount of dirty data held by the given source and its
+// budget, zero if unlimited.
+func (db *Database) InsertQuota(source InsertSource) (used common.StorageSize, limit common.StorageSize) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if quota := db.quotas[source]; quota != nil {
+		return quota.used, quota.limit
+	}
+	return 0, 0
+}
+
+// InsertBlobFrom is the source tagged version of InsertBlob, charging the blob to
+// the budget of the given source. If the blob would exceed the budget, nothing is
+// inserted and a QuotaExceededError is returned. Blobs already in the dirty cache
+// are not charged again. The zero source bypasses the quotas.
+func (db *Database) InsertBlobFrom(source InsertSource, hash common.Hash, blob []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if _, ok := db.dirties[hash]; ok {
+		return nil
+	}
+	if err := db.chargeQuota(source, common.StorageSize(common.HashLength+len(blob))); err != nil {
+		return err
+	}
+	db.insert(hash, len(blob), rawNode(blob))
+	db.dirties[hash].source = source
+	return nil
+}
+
+// chargeQuota accounts the given amount of dirty data to a source, or returns an
+// error if it doesn't fit into its budget.
+//
+// Note, this method assumes that the database's lock is held!
+func (db *Database) chargeQuota(source InsertSource, size common.StorageSize) error {
+	if source == 0 {
+		return nil
+	}
+	quota := db.quotas[source]
+	if quota == nil {
+		if db.quotas == nil {
+			db.quotas = make(map[InsertSource]*insertQuota)
+		}
+		quota = new(insertQuota)
+		db.quotas[source] = quota
+	}
+	if quota.limit != 0 && quota.used+size > quota.limit {
+		memcacheQuotaRejectMeter.Mark(1)
+		return &QuotaExceededError{Source: source, Used: quota.used, Limit: quota.limit, Size: size}
+	}
+	quota.used += size
+	return nil
+}
+
+// releaseQuota returns the dirty data of a node leaving the dirty cache to the
+// budget of its source.
+//
+// Note, this method assumes that the database's lock is held!
+func (db *Database) releaseQuota(node *cachedNode) {
+	if node.source == 0 {
+		return
+	}
+	quota := db.quotas[node.source]
+	if quota == nil {
+		return
+	}
+	quota.used -= common.StorageSize(common.HashLength + int(node.size))
+	db.dropQuota(node.source, quota)
+}
+
+// dropQuota forgets a source which has neither a budget nor any dirty data.
+//
+// Note, this method assumes that the database's lock is held!
+func (db *Database) dropQuota(source InsertSource, quota *insertQuota) {
+	if quota.limit == 0 && quota.used == 0 {
+		delete(db.quotas, source)
+	}
+}
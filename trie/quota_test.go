@@ -0,0 +1,106 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that source tagged inserts are limited by the budget of their source,
+// that the budget is released as the nodes leave the dirty cache and that
+// untagged inserts are not limited.
+func TestDatabaseInsertQuota(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+
+	blob := func(i byte) (common.Hash, []byte) {
+		blob := bytes.Repeat([]byte{i}, 68) // 100 bytes charged with the hash
+		return crypto.Keccak256Hash(blob), blob
+	}
+	insert := func(source InsertSource, i byte) (common.Hash, error) {
+		hash, blob := blob(i)
+		if err := db.InsertBlobFrom(source, hash, blob); err != nil {
+			return hash, err
+		}
+		db.Reference(hash, common.Hash{})
+		return hash, nil
+	}
+	db.SetInsertQuota(1, 250)
+
+	first, err := insert(1, 1)
+	if err != nil {
+		t.Fatalf("failed to insert first blob: %v", err)
+	}
+	second, err := insert(1, 2)
+	if err != nil {
+		t.Fatalf("failed to insert second blob: %v", err)
+	}
+	third, err := insert(1, 3)
+	if qerr, ok := err.(*QuotaExceededError); !ok || qerr.Source != 1 || !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("quota exhaustion error mismatch: have %v", err)
+	}
+	if _, ok := db.dirties[third]; ok {
+		t.Fatalf("rejected blob inserted")
+	}
+	if used, limit := db.InsertQuota(1); used != 200 || limit != 250 {
+		t.Fatalf("quota mismatch: have %v/%v, want %v/%v", used, limit, 200, 250)
+	}
+	// Known blobs are not charged again, other sources have their own budget
+	if _, err := insert(1, 1); err != nil {
+		t.Fatalf("failed to reinsert known blob: %v", err)
+	}
+	if _, err := insert(2, 3); err != nil {
+		t.Fatalf("failed to insert blob from another source: %v", err)
+	}
+	if used, _ := db.InsertQuota(1); used != 200 {
+		t.Fatalf("quota usage mismatch: have %v, want %v", used, 200)
+	}
+	// Untagged inserts bypass the quotas
+	for i := byte(10); i < 20; i++ {
+		if _, err := insert(0, i); err != nil {
+			t.Fatalf("failed to insert untagged blob: %v", err)
+		}
+	}
+	if used, limit := db.InsertQuota(0); used != 0 || limit != 0 {
+		t.Fatalf("untagged inserts accounted: have %v/%v", used, limit)
+	}
+	// Committing and dereferencing release the budget
+	if err := db.Commit(first, false); err != nil {
+		t.Fatalf("failed to commit blob: %v", err)
+	}
+	if used, _ := db.InsertQuota(1); used != 100 {
+		t.Fatalf("quota usage mismatch after commit: have %v, want %v", used, 100)
+	}
+	if _, err := insert(1, 4); err != nil {
+		t.Fatalf("failed to insert blob after commit: %v", err)
+	}
+	db.Dereference(second)
+	if used, _ := db.InsertQuota(1); used != 100 {
+		t.Fatalf("quota usage mismatch after dereference: have %v, want %v", used, 100)
+	}
+	// Removing the budget of an idle source forgets it
+	db.Dereference(third)
+	db.SetInsertQuota(2, 0)
+	if _, ok := db.quotas[2]; ok {
+		t.Fatalf("idle source without budget not dropped")
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// ReadTag identifies the subsystem on whose behalf a trie node is retrieved, so
+// that the read load of the database can be attributed between block processing,
+// RPC calls and light client serving.
+type ReadTag uint8
+
+const (
+	ReadTagDefault ReadTag = iota // Untagged reads
+	ReadTagState                  // Reads issued through the state database wrapper
+	ReadTagRPC                    // Reads issued on behalf of RPC handlers
+	ReadTagLES                    // Reads issued while serving light clients
+
+	numReadTags // Number of known tags, must be the last one
+)
+
+// readTagNames are the human readable names of the read tags, also used as the
+// metric name suffixes.
+var readTagNames = [numReadTags]string{"default", "state", "rpc", "les"}
+
+// String implements fmt.Stringer.
+func (tag ReadTag) String() string {
+	if tag < numReadTags {
+		return readTagNames[tag]
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(tag))
+}
+
+// ReadStats contains the cumulative read statistics of a single read tag.
+type ReadStats struct {
+	CleanHits uint64 // Number of reads served from the clean cache
+	DirtyHits uint64 // Number of reads served from the dirty cache
+	DiskReads uint64 // Number of reads served from the persistent database
+	Bytes     uint64 // Total number of bytes read
+}
+
+// Kinds of node reads, indexing the counters of a read tag.
+const (
+	readClean = iota // Reads served from the clean cache
+	readDirty        // Reads served from the dirty cache
+	readDisk         // Reads served from the persistent database
+
+	numReadKinds // Number of read kinds, must be the last one
+)
+
+const (
+	// readCountShift is the bit offset of the number of reads in a packed read
+	// counter, the bits below it hold the number of bytes read.
+	readCountShift = 40
+	readBytesMask  = 1<<readCountShift - 1
+
+	// readFoldCount and readFoldBytes are the values of the two halves of a
+	// packed read counter above which it's folded into the totals. They leave
+	// plenty of headroom for the reads racing with the fold.
+	readFoldCount = 1 << (63 - readCountShift)
+	readFoldBytes = 1 << (readCountShift - 1)
+)
+
+// readCounter accumulates the reads of a single kind and tag. The number of reads
+// and the bytes read are packed into a single word, so accounting a read takes a
+// single atomic add. The word is folded into the totals long before either half
+// could overflow.
+type readCounter struct {
+	packed uint64 // Recent reads (high bits) and bytes read (low bits)
+	reads  uint64 // Folded number of reads
+	bytes  uint64 // Folded number of bytes read
+}
+
+// add accounts a read of the given size.
+func (c *readCounter) add(size int) {
+	v := atomic.AddUint64(&c.packed, 1<<readCountShift|uint64(size))
+	if v>>readCountShift >= readFoldCount || v&readBytesMask >= readFoldBytes {
+		v = atomic.SwapUint64(&c.packed, 0)
+		atomic.AddUint64(&c.reads, v>>readCountShift)
+		atomic.AddUint64(&c.bytes, v&readBytesMask)
+	}
+}
+
+// load returns the number of reads and bytes read. A read racing with a fold
+// may be briefly missing from the result.
+func (c *readCounter) load() (reads uint64, bytes uint64) {
+	v := atomic.LoadUint64(&c.packed)
+	return atomic.LoadUint64(&c.reads) + v>>readCountShift, atomic.LoadUint64(&c.bytes) + v&readBytesMask
+}
+
+// readCounters are the live counters of a single read tag.
+type readCounters [numReadKinds]readCounter
+
+// readGauges are the metrics counterparts of the read counters of a single tag.
+// They are refreshed together with the other cache gauges instead of on every
+// read, to keep the read path to a single atomic add.
+type readGauges struct {
+	clean, dirty, disk, bytes metrics.Gauge
+}
+
+var readTagGauges [numReadTags]readGauges
+
+func init() {
+	for tag, name := range readTagNames {
+		readTagGauges[tag] = readGauges{
+			clean: metrics.NewRegisteredGauge("trie/reads/"+name+"/clean", nil),
+			dirty: metrics.NewRegisteredGauge("trie/reads/"+name+"/dirty", nil),
+			disk:  metrics.NewRegisteredGauge("trie/reads/"+name+"/disk", nil),
+			bytes: metrics.NewRegisteredGauge("trie/reads/"+name+"/bytes", nil),
+		}
+	}
+}
+
+// sanitize maps unknown tags into the default bucket.
+func (tag ReadTag) sanitize() ReadTag {
+	if tag >= numReadTags {
+		return ReadTagDefault
+	}
+	return tag
+}
+
+// markClean accounts a clean cache hit of the given size to the tag.
+func (db *Database) markClean(tag ReadTag, size int) {
+	db.readStats[tag.sanitize()][readClean].add(size)
+}
+
+// markDirty accounts a dirty cache hit of the given size to the tag.
+func (db *Database) markDirty(tag ReadTag, size int) {
+	db.readStats[tag.sanitize()][readDirty].add(size)
+}
+
+// markDisk accounts a disk read of the given size to the tag.
+func (db *Database) markDisk(tag ReadTag, size int) {
+	db.readStats[tag.sanitize()][readDisk].add(size)
+}
+
+// updateReadGauges publishes the read statistics of all tags in the metrics
+// system.
+func (db *Database) updateReadGauges() {
+	for tag := ReadTag(0); tag < numReadTags; tag++ {
+		stats := db.ReadStats(tag)
+		readTagGauges[tag].clean.Update(int64(stats.CleanHits))
+		readTagGauges[tag].dirty.Update(int64(stats.DirtyHits))
+		readTagGauges[tag].disk.Update(int64(stats.DiskReads))
+		readTagGauges[tag].bytes.Update(int64(stats.Bytes))
+	}
+}
+
+// ReadStats returns the cumulative read statistics gathered for the given tag.
+// Unknown tags are reported as part of the default bucket.
+func (db *Database) ReadStats(tag ReadTag) ReadStats {
+	var (
+		counters = &db.readStats[tag.sanitize()]
+		stats    ReadStats
+		bytes    uint64
+	)
+	stats.CleanHits, bytes = counters[readClean].load()
+	stats.Bytes += bytes
+	stats.DirtyHits, bytes = counters[readDirty].load()
+	stats.Bytes += bytes
+	stats.DiskReads, bytes = counters[readDisk].load()
+	stats.Bytes += bytes
+	return stats
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that node reads are accounted to the correct caller tag and cache layer.
+func TestDatabaseReadStats(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabaseWithCache(diskdb, 1)
+
+	// Insert a dirty blob and persist another one directly to disk
+	dirty, clean := common.HexToHash("0x01"), common.HexToHash("0x02")
+	db.InsertBlob(dirty, []byte{0x01, 0x02})
+	diskdb.Put(clean[:], []byte{0x03, 0x04, 0x05})
+
+	db.NodeWithTag(ReadTagLES, dirty) // dirty hit
+	db.NodeWithTag(ReadTagLES, clean) // disk read, populates the clean cache
+	db.NodeWithTag(ReadTagLES, clean) // clean hit
+	db.Node(clean)                    // untagged clean hit
+	db.NodeWithTag(numReadTags+1, clean)
+
+	if have, want := db.ReadStats(ReadTagLES), (ReadStats{CleanHits: 1, DirtyHits: 1, DiskReads: 1, Bytes: 8}); have != want {
+		t.Errorf("les stats mismatch: have %+v, want %+v", have, want)
+	}
+	if have, want := db.ReadStats(ReadTagDefault), (ReadStats{CleanHits: 2, Bytes: 6}); have != want {
+		t.Errorf("default stats mismatch: have %+v, want %+v", have, want)
+	}
+	if have := db.ReadStats(ReadTagState); have != (ReadStats{}) {
+		t.Errorf("state stats mismatch: have %+v, want none", have)
+	}
+}
+
+// Tests that the node reads of tagged tries are accounted to their tag, also when
+// resolved lazily after construction.
+func TestDatabaseTaggedTrieReads(t *testing.T) {
+	diskdb := memorydb.New()
+	triedb := NewDatabase(diskdb)
+	tr, _ := New(common.Hash{}, triedb)
+	for i := 0; i < 100; i++ {
+		key := crypto.Keccak256([]byte{byte(i)})
+		tr.Update(key, key)
+	}
+	root, _ := tr.Commit(nil)
+	triedb.Commit(root, false)
+
+	db := NewDatabase(diskdb)
+	rpc, err := NewSecureTagged(ReadTagRPC, common.Hash{}, root, db)
+	if err != nil {
+		t.Fatalf("failed to open tagged trie: %v", err)
+	}
+	rpc.trie.Get(crypto.Keccak256([]byte{0x00}))
+	rpc.Copy().trie.Get(crypto.Keccak256([]byte{0x01}))
+
+	stats := db.ReadStats(ReadTagRPC)
+	if stats.DiskReads < 3 || stats.Bytes == 0 {
+		t.Errorf("rpc reads not accounted: %+v", stats)
+	}
+	if have := db.ReadStats(ReadTagDefault); have != (ReadStats{}) {
+		t.Errorf("tagged reads accounted to the default tag: %+v", have)
+	}
+}
+
+// Tests that the packed read counters are folded into the totals before either
+// half overflows.
+func TestReadCounterFold(t *testing.T) {
+	var c readCounter
+
+	// Push the byte half over the fold limit
+	c.add(readFoldBytes - 1)
+	c.add(10)
+	if c.packed != 0 {
+		t.Fatalf("counter not folded on byte limit: packed %x", c.packed)
+	}
+	if reads, bytes := c.load(); reads != 2 || bytes != readFoldBytes+9 {
+		t.Fatalf("counter mismatch after byte fold: have %d/%d, want %d/%d", reads, bytes, 2, readFoldBytes+9)
+	}
+	// Push the count half over the fold limit
+	c.packed = (readFoldCount - 1) << readCountShift
+	c.add(1)
+	if c.packed != 0 {
+		t.Fatalf("counter not folded on count limit: packed %x", c.packed)
+	}
+	if reads, bytes := c.load(); reads != readFoldCount+2 || bytes != readFoldBytes+10 {
+		t.Fatalf("counter mismatch after count fold: have %d/%d, want %d/%d", reads, bytes, readFoldCount+2, readFoldBytes+10)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var memcacheRollbackTimeTimer = metrics.NewRegisteredTimer("trie/memcache/rollback/time", nil)
+
+// Rollback drops every dirty node not reachable from the given roots, such as
+// the nodes inserted by a block import that failed halfway. Unlike Dereference,
+// it also reclaims nodes that were never referenced by anything. References of
+// the meta root to dropped roots are removed, while the reference counts, the
+// flush-list and the size counters are rebuilt from the surviving nodes, keeping
+// their flush order. Unknown and already persisted roots are ignored.
+//
+// The write lock is held for the whole rollback, which is linear in the size of
+// the dirty cache. The number and size of the dropped nodes are returned.
+func (db *Database) Rollback(keep []common.Hash) (int, common.StorageSize) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	start := time.Now()
+
+	// Mark all the nodes reachable from the roots to keep
+	var (
+		live  = make(map[common.Hash]struct{})
+		stack []common.Hash
+	)
+	for _, root := range keep {
+		if root != (common.Hash{}) {
+			stack = append(stack, root)
+		}
+	}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		node, ok := db.dirties[hash]
+		if !ok {
+			continue
+		}
+		if _, ok := live[hash]; ok {
+			continue
+		}
+		live[hash] = struct{}{}
+		node.forChilds(func(child common.Hash) {
+			stack = append(stack, child)
+		})
+	}
+	// Gather the flush order of the survivors before dropping anything
+	var order []common.Hash
+	if err := db.checkFlushList(); err != nil {
+		db.repairFlushList(err)
+	}
+	for hash := db.oldest; hash != (common.Hash{}); hash = db.dirties[hash].flushNext {
+		if _, ok := live[hash]; ok {
+			order = append(order, hash)
+		}
+	}
+	// Drop the unreachable nodes and the references to them
+	meta := db.dirties[common.Hash{}]
+	for root := range meta.children {
+		if _, ok := db.dirties[root]; ok {
+			if _, ok := live[root]; !ok {
+				db.roots.drop(root)
+			}
+		}
+	}
+	var (
+		nodes   int
+		storage common.StorageSize
+		dropped []*cachedNode
+	)
+	for hash, node := range db.dirties {
+		if _, ok := live[hash]; ok || hash == (common.Hash{}) {
+			continue
+		}
+		delete(db.dirties, hash)
+		dropped = append(dropped, node)
+
+		nodes++
+		storage += common.StorageSize(common.HashLength + int(node.size))
+	}
+	for _, node := range dropped {
+		db.dropPendingRefs(node)
+		db.releaseQuota(node)
+	}
+	// Rebuild the reference counts and the size counters of the survivors
+	db.dirtiesSize, db.childrenSize = 0, db.roots.size()
+	for hash := range live {
+		node := db.dirties[hash]
+		node.parents = 0
+
+		db.dirtiesSize += common.StorageSize(common.HashLength + int(node.size))
+		if node.children != nil {
+			db.childrenSize += common.StorageSize(cachedNodeChildrenSize + len(node.children)*(common.HashLength+2))
+		}
+	}
+	for hash, node := range db.dirties {
+		for child, refs := range node.children {
+			// External children may have been flushed in the meantime
+			if child, ok := db.dirties[child]; ok {
+				child.parents += uint32(refs)
+			}
+		}
+		if hash != (common.Hash{}) {
+			if _, raw := node.node.(rawNode); !raw {
+				forGatherChildren(node.node, func(child common.Hash) {
+					if child, ok := db.dirties[child]; ok {
+						child.parents++
+					}
+				})
+			}
+		}
+	}
+	// Relink the survivors in their original flush order
+	db.oldest, db.newest = common.Hash{}, common.Hash{}
+	for _, hash := range order {
+		node := db.dirties[hash]
+		node.flushPrev, node.flushNext = db.newest, common.Hash{}
+		if db.oldest == (common.Hash{}) {
+			db.oldest = hash
+		} else {
+			db.dirties[db.newest].flushNext = hash
+		}
+		db.newest = hash
+	}
+	if len(order) != len(live) {
+		db.repairFlushList(errors.New("survivors missing from the flush-list"))
+	}
+	db.resetCommitEstimate()
+	db.refreshCacheGauges()
+
+	elapsed := time.Since(start)
+	db.gcnodes += uint64(nodes)
+	db.gcsize += storage
+	db.gctime += elapsed
+
+	memcacheGCSizeMeter.Mark(int64(storage))
+	memcacheGCNodesMeter.Mark(int64(nodes))
+	memcacheRollbackTimeTimer.Update(elapsed)
+
+	log.Info("Rolled back trie memory database", "roots", len(keep), "nodes", nodes, "size", storage, "time", elapsed,
+		"livenodes", len(db.dirties), "livesize", db.dirtiesSize)
+	return nodes, storage
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that rolling back a failed import reclaims exactly the orphaned nodes,
+// restoring the dirty cache to its state before the import.
+func TestDatabaseRollback(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabase(diskdb)
+
+	// Create a few overlapping roots, flushing some of their nodes
+	update := func(parent common.Hash, from, n int, value string) common.Hash {
+		trie := mustNewTrie(t, parent, db)
+		for i := from; i < from+n; i++ {
+			key := common.BigToHash(big.NewInt(int64(i)))
+			trie.Update(crypto.Keccak256(key[:]), []byte(value))
+		}
+		root, _ := trie.Commit(nil)
+		return root
+	}
+	roots := []common.Hash{makeDirtyTrie(db, 200)}
+	for i := 1; i < 3; i++ {
+		roots = append(roots, update(roots[i-1], i*10, 10, fmt.Sprintf("block-%d", i)))
+		db.Reference(roots[i], common.Hash{})
+	}
+	if err := db.Cap(db.dirtySize() * 3 / 4); err != nil {
+		t.Fatalf("failed to cap: %v", err)
+	}
+	// snapshot captures the reference counts of the dirty nodes and the totals
+	type snapshot struct {
+		parents map[common.Hash]uint32
+		size    common.StorageSize
+		oldest  common.Hash
+		newest  common.Hash
+	}
+	snap := func() snapshot {
+		parents := make(map[common.Hash]uint32, len(db.dirties))
+		for hash, node := range db.dirties {
+			parents[hash] = node.parents
+		}
+		return snapshot{parents, db.dirtiesSize, db.oldest, db.newest}
+	}
+	before := snap()
+
+	// Simulate an import failing after committing a trie which never got
+	// referenced from the meta root
+	parent := roots[len(roots)-1]
+	update(parent, 50, 20, "failed")
+
+	orphans := len(db.dirties) - len(before.parents)
+	if orphans == 0 {
+		t.Fatalf("failed import left no orphaned nodes")
+	}
+	nodes, _ := db.Rollback(roots)
+	if nodes != orphans {
+		t.Errorf("dropped node count mismatch: have %d, want %d", nodes, orphans)
+	}
+	if after := snap(); !reflect.DeepEqual(after, before) {
+		t.Errorf("dirty cache not restored: have %d nodes, size %v, want %d nodes, size %v", len(after.parents), after.size, len(before.parents), before.size)
+	}
+	if err := db.CheckConsistency(); err != nil {
+		t.Errorf("inconsistent database after rollback: %v", err)
+	}
+	// Rolling back to a subset of the roots should drop the other ones too
+	var dropped []common.Hash
+	for _, root := range roots[:len(roots)-1] {
+		if _, ok := db.dirties[root]; ok {
+			dropped = append(dropped, root)
+		}
+	}
+	if len(dropped) == 0 {
+		t.Fatalf("no dirty roots to drop")
+	}
+	db.Rollback([]common.Hash{parent, common.HexToHash("0xdeadbeef")})
+	if err := db.CheckConsistency(); err != nil {
+		t.Errorf("inconsistent database after partial rollback: %v", err)
+	}
+	meta := db.dirties[common.Hash{}]
+	if _, ok := meta.children[parent]; !ok {
+		t.Errorf("kept root %x not referenced", parent)
+	}
+	for _, root := range dropped {
+		if _, ok := meta.children[root]; ok {
+			t.Errorf("dropped root %x still referenced", root)
+		}
+		if _, ok := db.dirties[root]; ok {
+			t.Errorf("dropped root %x still dirty", root)
+		}
+	}
+	if err := db.Commit(parent, false); err != nil {
+		t.Fatalf("failed to commit after rollback: %v", err)
+	}
+	if _, err := New(parent, NewDatabase(diskdb)); err != nil {
+		t.Errorf("state not persisted after rollback: %v", err)
+	}
+	if nodes := db.Nodes(); len(nodes) != 0 {
+		t.Errorf("dirty nodes left after commit: %d", len(nodes))
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+const (
+	// defaultRetainedRootsWarn is the default number of distinct roots retained
+	// by the meta root above which a warning is emitted.
+	defaultRetainedRootsWarn = 100000
+
+	// retainedRootsWarnInterval is the minimum time between two warnings about
+	// the number of retained roots.
+	retainedRootsWarnInterval = 10 * time.Minute
+
+	// rootRefSize is the tracking overhead of a single retained root.
+	rootRefSize = common.HashLength + 2 // uint16 counter
+)
+
+var (
+	memcacheRetainedRootsGauge = metrics.NewRegisteredGauge("trie/memcache/roots/retained", nil)
+	memcacheRetainedRefsGauge  = metrics.NewRegisteredGauge("trie/memcache/roots/refs", nil)
+)
+
+// rootRefs is the counted set of trie roots referenced by the meta root, i.e.
+// the tries the garbage collection of the chain retains in the dirty cache. The
+// counts are shared with the external children of the meta root node, so the
+// generic node traversals see them as usual, but all mutations go through the
+// set to keep its counters exact.
+type rootRefs struct {
+	counts map[common.Hash]uint16 // Number of references per retained root
+	refs   uint64                 // Number of references, duplicates included
+
+	warnAt int       // Number of retained roots above which a warning is emitted, 0 for the default
+	warned time.Time // Time of the last warning, to rate limit them
+}
+
+// newRootRefs creates an empty retained root set.
+func newRootRefs() rootRefs {
+	return rootRefs{counts: make(map[common.Hash]uint16)}
+}
+
+// add adds a reference to the given root, returning whether it was not retained
+// before.
+func (r *rootRefs) add(root common.Hash) bool {
+	r.counts[root]++
+	r.refs++
+	return r.counts[root] == 1
+}
+
+// remove removes a reference from the given root, returning whether it was the
+// last one. Roots not retained are ignored.
+func (r *rootRefs) remove(root common.Hash) bool {
+	count, ok := r.counts[root]
+	if !ok {
+		return false
+	}
+	r.refs--
+	if count > 1 {
+		r.counts[root] = count - 1
+		return false
+	}
+	delete(r.counts, root)
+	return true
+}
+
+// drop removes all references from the given root.
+func (r *rootRefs) drop(root common.Hash) {
+	if count, ok := r.counts[root]; ok {
+		r.refs -= uint64(count)
+		delete(r.counts, root)
+	}
+}
+
+// len returns the number of distinct retained roots.
+func (r *rootRefs) len() int {
+	return len(r.counts)
+}
+
+// size returns the tracking overhead of the retained roots.
+func (r *rootRefs) size() common.StorageSize {
+	return common.StorageSize(len(r.counts) * rootRefSize)
+}
+
+// check emits a warning if the number of retained roots exceeds the threshold,
+// unless one was emitted recently.
+func (r *rootRefs) check() {
+	threshold := r.warnAt
+	if threshold == 0 {
+		threshold = defaultRetainedRootsWarn
+	}
+	if len(r.counts) <= threshold {
+		return
+	}
+	if now := time.Now(); now.Sub(r.warned) >= retainedRootsWarnInterval {
+		r.warned = now
+		log.Warn("Too many trie roots retained in memory, check the garbage collection retention", "roots", len(r.counts), "refs", r.refs, "threshold", threshold)
+	}
+}
+
+// SetRetainedRootsWarning sets the number of distinct trie roots retained in the
+// dirty cache above which a warning is emitted. A zero threshold restores the
+// default.
+func (db *Database) SetRetainedRootsWarning(threshold int) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.roots.warnAt = threshold
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that a large number of retained roots is tracked exactly by the meta root
+// reference set through duplicate references, dereferences and rollbacks.
+func TestDatabaseRetainedRootsScale(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+
+	const count = 50000
+	roots := make([]common.Hash, count)
+	for i := range roots {
+		blob := make([]byte, 40)
+		binary.BigEndian.PutUint64(blob, uint64(i))
+		roots[i] = crypto.Keccak256Hash(blob)
+		db.InsertBlob(roots[i], blob)
+		db.Reference(roots[i], common.Hash{})
+		if i%2 == 0 {
+			db.Reference(roots[i], common.Hash{}) // Same state in multiple blocks
+		}
+	}
+	check := func(roots int, refs uint64) {
+		t.Helper()
+		stats := db.CacheStats()
+		if stats.RetainedRoots != roots || stats.RetainedRootRefs != refs {
+			t.Fatalf("retained roots mismatch: have %d/%d, want %d/%d", stats.RetainedRoots, stats.RetainedRootRefs, roots, refs)
+		}
+		if stats.ChildrenSize != common.StorageSize(roots*rootRefSize) {
+			t.Fatalf("children size mismatch: have %v, want %v", stats.ChildrenSize, common.StorageSize(roots*rootRefSize))
+		}
+		if err := db.CheckConsistency(); err != nil {
+			t.Fatalf("inconsistent database: %v", err)
+		}
+		// The meta root references are not counted in the memory usage
+		if size, _ := db.Size(); size != db.dirtiesSize+common.StorageSize((len(db.dirties)-1)*cachedNodeSize) {
+			t.Fatalf("size mismatch: have %v, want %v", size, db.dirtiesSize+common.StorageSize((len(db.dirties)-1)*cachedNodeSize))
+		}
+	}
+	check(count, count+count/2)
+
+	// Dereference every root once, only the duplicated ones are retained
+	db.DereferenceBatch(roots)
+	check(count/2, count/2)
+	if len(db.dirties) != count/2+1 {
+		t.Fatalf("dirty node count mismatch: have %d, want %d", len(db.dirties)-1, count/2)
+	}
+	// Dereferencing roots not retained any more is a noop
+	db.DereferenceBatch(roots[1:2])
+	check(count/2, count/2)
+
+	db.DereferenceBatch(roots)
+	check(0, 0)
+	if len(db.dirties) != 1 || db.dirtiesSize != 0 {
+		t.Fatalf("dirty cache not empty: nodes %d, size %v", len(db.dirties)-1, db.dirtiesSize)
+	}
+}
+
+// Tests that a warning is only considered once the number of retained roots
+// exceeds the configured threshold.
+func TestDatabaseRetainedRootsWarning(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+	db.SetRetainedRootsWarning(10)
+
+	for i := 0; i < 11; i++ {
+		blob := bytes.Repeat([]byte{byte(i)}, 40)
+		root := crypto.Keccak256Hash(blob)
+		db.InsertBlob(root, blob)
+		db.Reference(root, common.Hash{})
+		db.Reference(root, common.Hash{})
+
+		if warned := !db.roots.warned.IsZero(); warned != (i == 10) {
+			t.Fatalf("root %d: warned %v, want %v", i, warned, i == 10)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import "github.com/ethereum/go-ethereum/common"
+
+// SharingReport is the breakdown of the dirty nodes reachable from two roots,
+// including the tries referenced from them (e.g. storage tries).
+type SharingReport struct {
+	SharedNodes int                `json:"sharedNodes"` // Dirty nodes reachable from both roots
+	SharedSize  common.StorageSize `json:"sharedSize"`  // Storage size of the shared nodes
+	OnlyANodes  int                `json:"onlyANodes"`  // Dirty nodes only reachable from the first root
+	OnlyASize   common.StorageSize `json:"onlyASize"`   // Storage size of the nodes unique to the first root
+	OnlyBNodes  int                `json:"onlyBNodes"`  // Dirty nodes only reachable from the second root
+	OnlyBSize   common.StorageSize `json:"onlyBSize"`   // Storage size of the nodes unique to the second root
+}
+
+// SharingReport measures how much of the dirty cache two roots share. The nodes
+// reachable from the first root are marked in a first traversal, and the second
+// traversal splits the nodes reachable from the second root into shared and
+// unique ones. Nodes already flushed to disk are not part of the dirty cache and
+// are not counted, neither are the nodes below them.
+//
+// The read lock is only held while a single node is visited, so mutations of the
+// cache in the meantime can skew the report.
+func (db *Database) SharingReport(rootA, rootB common.Hash) SharingReport {
+	var (
+		report SharingReport
+		marked = make(map[common.Hash]common.StorageSize)
+	)
+	db.walkDirty(rootA, func(hash common.Hash, size common.StorageSize) bool {
+		if _, ok := marked[hash]; ok {
+			return false
+		}
+		marked[hash] = size
+		report.OnlyANodes++
+		report.OnlyASize += size
+		return true
+	})
+	visited := make(map[common.Hash]struct{})
+	db.walkDirty(rootB, func(hash common.Hash, size common.StorageSize) bool {
+		if _, ok := visited[hash]; ok {
+			return false
+		}
+		visited[hash] = struct{}{}
+
+		if _, ok := marked[hash]; ok {
+			report.SharedNodes++
+			report.SharedSize += size
+			report.OnlyANodes--
+			report.OnlyASize -= size
+		} else {
+			report.OnlyBNodes++
+			report.OnlyBSize += size
+		}
+		return true
+	})
+	return report
+}
+
+// walkDirty visits the dirty nodes reachable from the given node, including the
+// ones referenced as external children, taking the read lock for every single
+// node. The descendants of a node are only visited if the callback returns true.
+func (db *Database) walkDirty(hash common.Hash, visit func(hash common.Hash, size common.StorageSize) bool) {
+	// The meta root is not a trie, refuse walking all the live nodes
+	if hash == (common.Hash{}) {
+		return
+	}
+	db.lock.RLock()
+	node, ok := db.dirties[hash]
+	var children []common.Hash
+	if ok {
+		for child := range node.children {
+			children = append(children, child)
+		}
+		if _, raw := node.node.(rawNode); !raw {
+			forGatherChildren(node.node, func(child common.Hash) {
+				children = append(children, child)
+			})
+		}
+	}
+	db.lock.RUnlock()
+
+	if !ok || !visit(hash, common.StorageSize(common.HashLength+int(node.size))) {
+		return
+	}
+	for _, child := range children {
+		db.walkDirty(child, visit)
+	}
+}
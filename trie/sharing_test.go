@@ -0,0 +1,85 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that the sharing report splits the dirty nodes of two roots exactly.
+func TestDatabaseSharingReport(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+
+	// Create two roots differing in a single key, the first also referencing a
+	// separate trie as an external child
+	rootA := makeDirtyTrie(db, 100)
+	trie := mustNewTrie(t, rootA, db)
+	key := common.BigToHash(big.NewInt(42))
+	trie.Update(crypto.Keccak256(key[:]), []byte("modified"))
+	rootB, _ := trie.Commit(nil)
+
+	child := makeDirtyTrie(db, 10)
+	db.Reference(child, rootA)
+
+	nodesA, nodesB := dirtyTrieNodes(t, db, rootA), dirtyTrieNodes(t, db, rootB)
+	for hash, size := range dirtyTrieNodes(t, db, child) {
+		nodesA[hash] = size
+	}
+	var want SharingReport
+	for hash, size := range nodesA {
+		if _, ok := nodesB[hash]; ok {
+			want.SharedNodes++
+			want.SharedSize += size
+		} else {
+			want.OnlyANodes++
+			want.OnlyASize += size
+		}
+	}
+	for hash, size := range nodesB {
+		if _, ok := nodesA[hash]; !ok {
+			want.OnlyBNodes++
+			want.OnlyBSize += size
+		}
+	}
+	if want.SharedNodes == 0 || want.OnlyANodes <= len(dirtyTrieNodes(t, db, child)) || want.OnlyBNodes == 0 {
+		t.Fatalf("test tries don't overlap partially: %+v", want)
+	}
+	if have := db.SharingReport(rootA, rootB); have != want {
+		t.Errorf("sharing report mismatch:\nhave %+v\nwant %+v", have, want)
+	}
+	// Swapping the roots should swap the unique counts
+	swapped := SharingReport{
+		SharedNodes: want.SharedNodes, SharedSize: want.SharedSize,
+		OnlyANodes: want.OnlyBNodes, OnlyASize: want.OnlyBSize,
+		OnlyBNodes: want.OnlyANodes, OnlyBSize: want.OnlyASize,
+	}
+	if have := db.SharingReport(rootB, rootA); have != swapped {
+		t.Errorf("swapped sharing report mismatch:\nhave %+v\nwant %+v", have, swapped)
+	}
+	// Comparing a root with itself or with an unknown root is trivial
+	if have := db.SharingReport(rootB, rootB); have.SharedNodes != len(nodesB) || have.OnlyANodes != 0 || have.OnlyBNodes != 0 {
+		t.Errorf("self sharing report mismatch: %+v", have)
+	}
+	if have := db.SharingReport(rootA, common.HexToHash("0xdeadbeef")); have.OnlyANodes != len(nodesA) || have.SharedNodes != 0 || have.OnlyBNodes != 0 {
+		t.Errorf("unknown root sharing report mismatch: %+v", have)
+	}
+}
@@ -46,8 +46,10 @@ type LeafCallback func(leaf []byte, parent common.Hash) error
 //
 // Trie is not safe for concurrent use.
 type Trie struct {
-	db   *Database
-	root node
+	db    *Database
+	root  node
+	owner common.Hash // Account hash owning the trie if it's a storage trie, reported in errors
+	tag   ReadTag     // Caller tag the node reads of the trie are accounted to
 	// Keep track of the number leafs which have been inserted since the last
 	// hashing operation. This number will not directly map to the number of
 	// actually unhashed nodes
@@ -66,11 +68,25 @@ func (t *Trie) newFlag() nodeFlag {
 // New will panic if db is nil and returns a MissingNodeError if root does
 // not exist in the database. Accessing the trie loads nodes from db on demand.
 func New(root common.Hash, db *Database) (*Trie, error) {
+	return NewWithOwner(common.Hash{}, root, db)
+}
+
+// NewWithOwner creates a trie similarly to New, but marks it as the storage trie
+// of the given account, so that missing node errors can be traced back to it.
+func NewWithOwner(owner common.Hash, root common.Hash, db *Database) (*Trie, error) {
+	return NewTagged(ReadTagDefault, owner, root, db)
+}
+
+// NewTagged creates a trie similarly to NewWithOwner, but accounts all the node
+// reads of the trie to the given caller tag in the read statistics of db.
+func NewTagged(tag ReadTag, owner common.Hash, root common.Hash, db *Database) (*Trie, error) {
 	if db == nil {
 		panic("trie.New called without a database")
 	}
 	trie := &Trie{
-		db: db,
+		db:    db,
+		owner: owner,
+		tag:   tag,
 	}
 	if root != (common.Hash{}) && root != emptyRoot {
 		rootnode, err := trie.resolveHash(root[:], nil)
@@ -93,7 +109,7 @@ func (t *Trie) NodeIterator(start []byte) NodeIterator {
 func (t *Trie) Get(key []byte) []byte {
 	res, err := t.TryGet(key)
 	if err != nil {
-		log.Error(fmt.Sprintf("Unhandled trie error: %v", err))
+		log.Error("Unhandled trie error", "err", FormatNodeError(err))
 	}
 	return res
 }
@@ -154,7 +170,7 @@ func (t *Trie) tryGet(origNode node, key []byte, pos int) (value []byte, newnode
 // stored in the trie.
 func (t *Trie) Update(key, value []byte) {
 	if err := t.TryUpdate(key, value); err != nil {
-		log.Error(fmt.Sprintf("Unhandled trie error: %v", err))
+		log.Error("Unhandled trie error", "err", FormatNodeError(err))
 	}
 }
 
@@ -257,7 +273,7 @@ func (t *Trie) insert(n node, prefix, key []byte, value node) (bool, node, error
 // Delete removes any existing value for key from the trie.
 func (t *Trie) Delete(key []byte) {
 	if err := t.TryDelete(key); err != nil {
-		log.Error(fmt.Sprintf("Unhandled trie error: %v", err))
+		log.Error("Unhandled trie error", "err", FormatNodeError(err))
 	}
 }
 
@@ -402,10 +418,14 @@ func (t *Trie) resolve(n node, prefix []byte) (node, error) {
 
 func (t *Trie) resolveHash(n hashNode, prefix []byte) (node, error) {
 	hash := common.BytesToHash(n)
-	if node := t.db.node(hash); node != nil {
+	node, err := t.db.node(t.tag, hash, len(prefix))
+	if err != nil {
+		return nil, err
+	}
+	if node != nil {
 		return node, nil
 	}
-	return nil, &MissingNodeError{NodeHash: hash, Path: prefix}
+	return nil, &MissingNodeError{Owner: t.owner, NodeHash: hash, Path: prefix}
 }
 
 // Hash returns the root hash of the trie. It does not write to the
@@ -418,6 +438,10 @@ func (t *Trie) Hash() common.Hash {
 
 // Commit writes all nodes to the trie's memory database, tracking the internal
 // and external (for account tries) references.
+//
+// If a leaf callback is given, the database is not flushed during the commit, so
+// the callback may reference the parent it's invoked with, but it must not call
+// Cap or Commit on the database itself.
 func (t *Trie) Commit(onleaf LeafCallback) (root common.Hash, err error) {
 	if t.db == nil {
 		panic("commit called on trie with nil database")
@@ -436,6 +460,11 @@ func (t *Trie) Commit(onleaf LeafCallback) (root common.Hash, err error) {
 	}
 	var wg sync.WaitGroup
 	if onleaf != nil {
+		// The leaf callback references nodes from their freshly inserted parents,
+		// keep the background flusher from evicting those in between.
+		t.db.lockFlush()
+		defer t.db.flushLock.Unlock()
+
 		h.onleaf = onleaf
 		h.leafCh = make(chan *leaf, leafChanSize)
 		wg.Add(1)